@@ -0,0 +1,266 @@
+// Package grpc implements a proxy.CertSource that retrieves the client
+// certificates from a certificate authority implementing the CertIssuer gRPC
+// service defined in the issuerpb package.
+//
+// The key pair is generated locally and only a certificate signing request
+// is sent to the issuer, so the private key never leaves the process.
+package grpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/planetscale/sql-proxy/certsource/grpc/issuerpb"
+	"github.com/planetscale/sql-proxy/proxy"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	defaultTimeout = 10 * time.Second
+	defaultRetries = 3
+
+	// retryBackoff is the time to wait before the first retry of an
+	// unavailable issuer. It doubles with each retry.
+	retryBackoff = 100 * time.Millisecond
+)
+
+// KeyType is the type of the private keys generated for the client
+// certificates.
+type KeyType string
+
+const (
+	// KeyECDSAP256 generates ECDSA keys on the P-256 curve.
+	KeyECDSAP256 KeyType = "ecdsa-p256"
+
+	// KeyRSA2048 generates 2048 bit RSA keys.
+	KeyRSA2048 KeyType = "rsa-2048"
+)
+
+// Options are the options for creating a new CertSource.
+type Options struct {
+	// Addr is the address of the issuer, i.e: "ca.internal:443".
+	Addr string
+
+	// TLSConfig authenticates the connection to the issuer, with the
+	// client's bootstrap identity as its certificate. It must be set.
+	TLSConfig *tls.Config
+
+	// KeyType is the type of the generated private keys. By default it's
+	// KeyECDSAP256.
+	KeyType KeyType
+
+	// Timeout is the deadline of a single IssueCert call. By default it's
+	// 10 seconds.
+	Timeout time.Duration
+
+	// Retries is the number of times an IssueCert call is retried if the
+	// issuer is unavailable. By default it's 3, a negative value disables
+	// retries.
+	Retries int
+
+	// DialOptions are appended to the options used to connect to the
+	// issuer.
+	DialOptions []grpc.DialOption
+}
+
+// CertSource retrieves client certificates from a CertIssuer service. The
+// connection to the issuer is shared by all calls. It's safe for concurrent
+// use.
+type CertSource struct {
+	conn    *grpc.ClientConn
+	client  issuerpb.CertIssuerClient
+	keyType KeyType
+	timeout time.Duration
+	retries int
+}
+
+var _ proxy.CertSource = (*CertSource)(nil)
+
+// New returns a CertSource for the issuer at the given address. The
+// connection is established lazily, on the first call to Cert.
+func New(opts Options) (*CertSource, error) {
+	if opts.Addr == "" {
+		return nil, errors.New("Addr must be set")
+	}
+	if opts.TLSConfig == nil {
+		return nil, errors.New("TLSConfig must be set")
+	}
+
+	s := &CertSource{
+		keyType: opts.KeyType,
+		timeout: opts.Timeout,
+		retries: opts.Retries,
+	}
+	switch s.keyType {
+	case "":
+		s.keyType = KeyECDSAP256
+	case KeyECDSAP256, KeyRSA2048:
+	default:
+		return nil, fmt.Errorf("unknown KeyType %q", opts.KeyType)
+	}
+	if s.timeout <= 0 {
+		s.timeout = defaultTimeout
+	}
+	if s.retries == 0 {
+		s.retries = defaultRetries
+	} else if s.retries < 0 {
+		s.retries = 0
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(credentials.NewTLS(opts.TLSConfig)),
+	}, opts.DialOptions...)
+	conn, err := grpc.Dial(opts.Addr, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to issuer: %w", err)
+	}
+
+	s.conn = conn
+	s.client = issuerpb.NewCertIssuerClient(conn)
+	return s, nil
+}
+
+// Close closes the connection to the issuer.
+func (s *CertSource) Close() error {
+	return s.conn.Close()
+}
+
+// Cert generates a new key pair and has the issuer sign a certificate for it.
+func (s *CertSource) Cert(ctx context.Context, org, db, branch string) (*proxy.Cert, error) {
+	key, err := s.generateKey()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate private key: %w", err)
+	}
+
+	csr, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: org + "/" + db + "/" + branch},
+	}, key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create certificate signing request: %w", err)
+	}
+
+	resp, err := s.issue(ctx, &issuerpb.IssueCertRequest{
+		Organization: org,
+		Database:     db,
+		Branch:       branch,
+		Csr:          csr,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return certFromResponse(resp, key)
+}
+
+// issue calls IssueCert, retrying while the issuer is unavailable.
+func (s *CertSource) issue(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+	backoff := retryBackoff
+	for attempt := 0; ; attempt++ {
+		callCtx, cancel := context.WithTimeout(ctx, s.timeout)
+		resp, err := s.client.IssueCert(callCtx, req)
+		cancel()
+		if err == nil {
+			return resp, nil
+		}
+
+		if status.Code(err) != codes.Unavailable || attempt >= s.retries {
+			return nil, classify(err)
+		}
+
+		select {
+		case <-time.After(backoff):
+			backoff *= 2
+		case <-ctx.Done():
+			return nil, classify(err)
+		}
+	}
+}
+
+// classify wraps the error of an IssueCert call in a proxy.CertSourceError
+// matching its status code.
+func classify(err error) error {
+	err = fmt.Errorf("couldn't issue certificate: %w", err)
+
+	st, _ := status.FromError(errors.Unwrap(err))
+	switch st.Code() {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return &proxy.CertSourceError{Kind: proxy.CertErrorUnauthorized, Err: err}
+	case codes.NotFound:
+		return &proxy.CertSourceError{Kind: proxy.CertErrorNotFound, Err: err}
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return &proxy.CertSourceError{Kind: proxy.CertErrorUnavailable, Err: err}
+	case codes.ResourceExhausted:
+		certErr := &proxy.CertSourceError{Kind: proxy.CertErrorRateLimited, Err: err}
+		for _, detail := range st.Details() {
+			if info, ok := detail.(*errdetails.RetryInfo); ok {
+				certErr.RetryAfter = info.GetRetryDelay().AsDuration()
+			}
+		}
+		return certErr
+	}
+	return err
+}
+
+func (s *CertSource) generateKey() (crypto.Signer, error) {
+	if s.keyType == KeyRSA2048 {
+		return rsa.GenerateKey(rand.Reader, 2048)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// certFromResponse builds the proxy.Cert from the issuer's response for the
+// given private key.
+func certFromResponse(resp *issuerpb.IssueCertResponse, key crypto.Signer) (*proxy.Cert, error) {
+	if len(resp.CertChain) == 0 {
+		return nil, errors.New("issuer returned no certificate")
+	}
+
+	leaf, err := x509.ParseCertificate(resp.CertChain[0])
+	if err != nil {
+		return nil, fmt.Errorf("issuer returned an invalid certificate: %w", err)
+	}
+
+	type publicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+	if pub, ok := key.Public().(publicKey); !ok || !pub.Equal(leaf.PublicKey) {
+		return nil, errors.New("issuer returned a certificate for another key")
+	}
+
+	caCerts := make([]*x509.Certificate, 0, len(resp.CaCerts))
+	for _, der := range resp.CaCerts {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, fmt.Errorf("issuer returned an invalid CA certificate: %w", err)
+		}
+		caCerts = append(caCerts, cert)
+	}
+
+	return &proxy.Cert{
+		ClientCert: tls.Certificate{
+			Certificate: resp.CertChain,
+			PrivateKey:  key,
+			Leaf:        leaf,
+		},
+		CACerts:    caCerts,
+		AccessHost: resp.AccessHost,
+		Ports: proxy.RemotePorts{
+			Proxy: int(resp.ProxyPort),
+		},
+		Expiry: leaf.NotAfter,
+	}, nil
+}
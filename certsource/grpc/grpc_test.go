@@ -0,0 +1,340 @@
+package grpc
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/planetscale/sql-proxy/certsource/grpc/issuerpb"
+	"github.com/planetscale/sql-proxy/proxy"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// testCA issues the certificates of the tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+
+	mu     sync.Mutex
+	serial int64
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key, serial: 1}
+}
+
+// sign issues a certificate for the given public key.
+func (ca *testCA) sign(t *testing.T, commonName string, pub interface{}, usage x509.ExtKeyUsage, dnsNames ...string) []byte {
+	ca.mu.Lock()
+	ca.serial++
+	serial := ca.serial
+	ca.mu.Unlock()
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, pub, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return der
+}
+
+// keyPair issues a certificate with a new key.
+func (ca *testCA) keyPair(t *testing.T, commonName string, usage x509.ExtKeyUsage, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{
+		Certificate: [][]byte{ca.sign(t, commonName, key.Public(), usage, dnsNames...)},
+		PrivateKey:  key,
+	}
+}
+
+// fakeIssuer implements the CertIssuer service.
+type fakeIssuer struct {
+	issuerpb.UnimplementedCertIssuerServer
+
+	issue func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error)
+
+	mu    sync.Mutex
+	calls int
+}
+
+func (f *fakeIssuer) IssueCert(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+	f.mu.Lock()
+	f.calls++
+	f.mu.Unlock()
+	return f.issue(ctx, req)
+}
+
+func (f *fakeIssuer) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls
+}
+
+// signingIssuer returns an issue func that signs the CSRs with the CA.
+func signingIssuer(t *testing.T, ca *testCA) func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+	return func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+		csr, err := x509.ParseCertificateRequest(req.Csr)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+		if err := csr.CheckSignature(); err != nil {
+			return nil, status.Error(codes.InvalidArgument, err.Error())
+		}
+
+		return &issuerpb.IssueCertResponse{
+			CertChain:  [][]byte{ca.sign(t, csr.Subject.CommonName, csr.PublicKey, x509.ExtKeyUsageClientAuth)},
+			CaCerts:    [][]byte{ca.cert.Raw},
+			ExpiresAt:  timestamppb.New(time.Now().Add(time.Hour)),
+			AccessHost: req.Branch + "." + req.Database + ".example.com",
+			ProxyPort:  3307,
+		}, nil
+	}
+}
+
+// startIssuer serves the issuer in-process over mTLS and returns a
+// CertSource connected to it.
+func startIssuer(t *testing.T, issuer *fakeIssuer, opts Options) *CertSource {
+	t.Helper()
+	ca := newTestCA(t)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+
+	srv := grpc.NewServer(grpc.Creds(credentials.NewTLS(&tls.Config{
+		Certificates: []tls.Certificate{ca.keyPair(t, "issuer", x509.ExtKeyUsageServerAuth, "issuer.test")},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})))
+	issuerpb.RegisterCertIssuerServer(srv, issuer)
+
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l) // nolint: errcheck
+	t.Cleanup(srv.Stop)
+
+	opts.Addr = "issuer.test"
+	opts.TLSConfig = &tls.Config{
+		Certificates: []tls.Certificate{ca.keyPair(t, "bootstrap", x509.ExtKeyUsageClientAuth)},
+		RootCAs:      pool,
+	}
+	opts.DialOptions = append(opts.DialOptions, grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+		return l.DialContext(ctx)
+	}))
+
+	s, err := New(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestCertSource_Cert(t *testing.T) {
+	for _, keyType := range []KeyType{KeyECDSAP256, KeyRSA2048} {
+		t.Run(string(keyType), func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+
+			var bootstrap string
+			issuer := &fakeIssuer{}
+			issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+				p, _ := peer.FromContext(ctx)
+				tlsInfo := p.AuthInfo.(credentials.TLSInfo)
+				bootstrap = tlsInfo.State.PeerCertificates[0].Subject.CommonName
+				return signingIssuer(t, ca)(ctx, req)
+			}
+			s := startIssuer(t, issuer, Options{KeyType: keyType})
+
+			cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.IsNil)
+			c.Assert(bootstrap, qt.Equals, "bootstrap")
+
+			c.Assert(cert.ClientCert.Leaf.Subject.CommonName, qt.Equals, "myorg/mydb/main")
+			c.Assert(cert.CACerts, qt.HasLen, 1)
+			c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+			c.Assert(cert.AccessHost, qt.Equals, "main.mydb.example.com")
+			c.Assert(cert.Ports.Proxy, qt.Equals, 3307)
+
+			// the private key was generated locally, for the signed certificate
+			key, ok := cert.ClientCert.PrivateKey.(interface{ Public() crypto.PublicKey })
+			c.Assert(ok, qt.IsTrue)
+			c.Assert(cert.ClientCert.Leaf.PublicKey, qt.DeepEquals, key.Public())
+
+			// the connection is reused
+			_, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.IsNil)
+			c.Assert(issuer.callCount(), qt.Equals, 2)
+		})
+	}
+}
+
+func TestCertSource_RetryUnavailable(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	issuer := &fakeIssuer{}
+	issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+		if issuer.callCount() < 3 {
+			return nil, status.Error(codes.Unavailable, "try again")
+		}
+		return signingIssuer(t, ca)(ctx, req)
+	}
+	s := startIssuer(t, issuer, Options{Retries: 2})
+
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(issuer.callCount(), qt.Equals, 3)
+}
+
+func TestCertSource_RetriesExhausted(t *testing.T) {
+	c := qt.New(t)
+
+	issuer := &fakeIssuer{}
+	issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+		return nil, status.Error(codes.Unavailable, "down for maintenance")
+	}
+	s := startIssuer(t, issuer, Options{Retries: 1})
+
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.ErrorMatches, "couldn't issue certificate: .*down for maintenance")
+	c.Assert(status.Code(errors.Unwrap(err)), qt.Equals, codes.Unavailable)
+	c.Assert(issuer.callCount(), qt.Equals, 2)
+}
+
+func TestCertSource_ErrorKinds(t *testing.T) {
+	rateLimited, err := status.New(codes.ResourceExhausted, "slow down").WithDetails(&errdetails.RetryInfo{
+		RetryDelay: durationpb.New(3 * time.Second),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		err            error
+		wantKind       proxy.CertErrorKind
+		wantRetryAfter time.Duration
+	}{
+		{err: status.Error(codes.Unauthenticated, "bad token"), wantKind: proxy.CertErrorUnauthorized},
+		{err: status.Error(codes.PermissionDenied, "not allowed"), wantKind: proxy.CertErrorUnauthorized},
+		{err: status.Error(codes.NotFound, "no such database"), wantKind: proxy.CertErrorNotFound},
+		{err: status.Error(codes.Unavailable, "down"), wantKind: proxy.CertErrorUnavailable},
+		{err: rateLimited.Err(), wantKind: proxy.CertErrorRateLimited, wantRetryAfter: 3 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(status.Code(tt.err).String(), func(t *testing.T) {
+			c := qt.New(t)
+
+			issuer := &fakeIssuer{}
+			issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+				return nil, tt.err
+			}
+			s := startIssuer(t, issuer, Options{Retries: -1})
+
+			_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			var certErr *proxy.CertSourceError
+			c.Assert(errors.As(err, &certErr), qt.IsTrue)
+			c.Assert(certErr.Kind, qt.Equals, tt.wantKind)
+			c.Assert(certErr.RetryAfter, qt.Equals, tt.wantRetryAfter)
+			c.Assert(errors.Is(err, proxy.ErrUnauthorized), qt.Equals, tt.wantKind == proxy.CertErrorUnauthorized)
+			c.Assert(issuer.callCount(), qt.Equals, 1)
+		})
+	}
+}
+
+func TestCertSource_Timeout(t *testing.T) {
+	c := qt.New(t)
+
+	issuer := &fakeIssuer{}
+	issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	s := startIssuer(t, issuer, Options{Timeout: 50 * time.Millisecond, Retries: -1})
+
+	start := time.Now()
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(status.Code(errors.Unwrap(err)), qt.Equals, codes.DeadlineExceeded)
+	c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue)
+}
+
+func TestCertSource_WrongKey(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	issuer := &fakeIssuer{}
+	issuer.issue = func(ctx context.Context, req *issuerpb.IssueCertRequest) (*issuerpb.IssueCertResponse, error) {
+		other := ca.keyPair(t, "other", x509.ExtKeyUsageClientAuth)
+		return &issuerpb.IssueCertResponse{CertChain: other.Certificate}, nil
+	}
+	s := startIssuer(t, issuer, Options{})
+
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.ErrorMatches, "issuer returned a certificate for another key")
+}
+
+func TestNew(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := New(Options{TLSConfig: &tls.Config{}})
+	c.Assert(err, qt.ErrorMatches, "Addr must be set")
+
+	_, err = New(Options{Addr: "ca.internal:443"})
+	c.Assert(err, qt.ErrorMatches, "TLSConfig must be set")
+
+	_, err = New(Options{Addr: "ca.internal:443", TLSConfig: &tls.Config{}, KeyType: "dsa"})
+	c.Assert(err, qt.ErrorMatches, `unknown KeyType "dsa"`)
+}
@@ -0,0 +1,6 @@
+// Package issuerpb contains the generated code of the CertIssuer gRPC
+// service, implemented by certificate authorities to issue client
+// certificates for the proxy.
+package issuerpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative issuer.proto
@@ -0,0 +1,352 @@
+// Package spiffe implements a proxy.CertSource serving the X.509-SVID of the
+// workload, retrieved from the SPIFFE Workload API, i.e: of a SPIRE agent.
+// The proxy then authenticates with the identity of its workload rather than
+// with certificates of a bespoke API.
+//
+// The SVID and the bundle of its trust domain are streamed by the Workload
+// API, the rotated ones replace the previous ones as soon as they're
+// received. The SVIDs hold no address, the remote address of the instances
+// must be set with proxy.Options.RemoteAddr or an AddrResolver, and the
+// SPIFFE ID of the remote servers can be verified with
+// proxy.Options.ServerSPIFFEID.
+//
+// It's a separate package so the users of the proxy package don't depend on
+// it.
+package spiffe
+
+import (
+	"context"
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/planetscale/sql-proxy/proxy"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+)
+
+// EndpointSocketEnv is the environment variable holding the address of the
+// Workload API by default.
+const EndpointSocketEnv = "SPIFFE_ENDPOINT_SOCKET"
+
+const (
+	// retryBackoff is the time to wait before fetching the SVIDs again once
+	// the stream of the Workload API failed. It doubles with each failure,
+	// up to maxRetryBackoff.
+	retryBackoff    = 100 * time.Millisecond
+	maxRetryBackoff = 30 * time.Second
+)
+
+// Options are the options for creating a new CertSource.
+type Options struct {
+	// Addr is the address of the Workload API, i.e:
+	// "unix:///run/spire/sockets/agent.sock" or "tcp://127.0.0.1:8081". By
+	// default it's the one of the SPIFFE_ENDPOINT_SOCKET environment
+	// variable.
+	Addr string
+
+	// SPIFFEID selects the SVID of the workloads entitled to several. By
+	// default the first one is used, the default SVID of the workload.
+	SPIFFEID string
+
+	// Logger logs the rotations of the SVID and the failures of the
+	// Workload API. By default it's zap.L().
+	Logger *zap.Logger
+
+	// DialOptions are appended to the options used to connect to the
+	// Workload API.
+	DialOptions []grpc.DialOption
+}
+
+// CertSource serves the X.509-SVID of the workload for every instance. It's
+// safe for concurrent use.
+type CertSource struct {
+	conn     *grpc.ClientConn
+	spiffeID string
+	log      *zap.Logger
+
+	// cancel stops the stream of the SVIDs, done is closed once it stopped.
+	cancel context.CancelFunc
+	done   chan struct{}
+
+	mu sync.Mutex // protects the fields below
+	// cert holds the SVID received last, nil until the first one is.
+	cert *proxy.Cert
+	// err is the error of the last failure of the stream, if any.
+	err error
+	// reloaded is closed once cert is replaced.
+	reloaded chan struct{}
+}
+
+var _ proxy.ReloadingCertSource = (*CertSource)(nil)
+
+// New returns a CertSource serving the SVID of the workload. It returns once
+// the Workload API sent the first SVID, or fails once ctx is done before.
+func New(ctx context.Context, opts Options) (*CertSource, error) {
+	addr := opts.Addr
+	if addr == "" {
+		addr = os.Getenv(EndpointSocketEnv)
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("Addr must be set, or the %s environment variable", EndpointSocketEnv)
+	}
+	target, err := dialTarget(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Addr: %w", err)
+	}
+
+	dialOpts := append([]grpc.DialOption{
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	}, opts.DialOptions...)
+	conn, err := grpc.Dial(target, dialOpts...)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to the Workload API: %w", err)
+	}
+
+	watchCtx, cancel := context.WithCancel(context.Background())
+	s := &CertSource{
+		conn:     conn,
+		spiffeID: opts.SPIFFEID,
+		log:      opts.Logger,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		reloaded: make(chan struct{}),
+	}
+	if s.log == nil {
+		s.log = zap.L()
+	}
+
+	first := s.Reloaded()
+	go s.watch(watchCtx)
+
+	select {
+	case <-first:
+		return s, nil
+	case <-ctx.Done():
+		s.mu.Lock()
+		err := s.err
+		s.mu.Unlock()
+		s.Close()
+		if err == nil {
+			err = ctx.Err()
+		}
+		return nil, fmt.Errorf("couldn't fetch the X.509-SVID: %w", err)
+	}
+}
+
+// Close stops watching the SVIDs and closes the connection to the Workload
+// API.
+func (s *CertSource) Close() error {
+	s.cancel()
+	<-s.done
+	return s.conn.Close()
+}
+
+// Cert returns the SVID received last, whatever the instance.
+func (s *CertSource) Cert(ctx context.Context, org, db, branch string) (*proxy.Cert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.cert == nil {
+		return nil, &proxy.CertSourceError{
+			Kind: proxy.CertErrorUnavailable,
+			Err:  errors.New("no X.509-SVID received from the Workload API"),
+		}
+	}
+	cert := *s.cert
+	return &cert, nil
+}
+
+// Reloaded returns a channel that is closed the next time a rotated SVID is
+// received.
+func (s *CertSource) Reloaded() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloaded
+}
+
+// watch streams the SVIDs until ctx is done, fetching them again once the
+// stream failed.
+func (s *CertSource) watch(ctx context.Context) {
+	defer close(s.done)
+
+	backoff := retryBackoff
+	for {
+		received, err := s.stream(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if received {
+			backoff = retryBackoff
+		}
+
+		s.mu.Lock()
+		s.err = err
+		s.mu.Unlock()
+		s.log.Warn("X.509-SVID stream of the Workload API failed, retrying",
+			zap.Duration("backoff", backoff),
+			zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > maxRetryBackoff {
+			backoff = maxRetryBackoff
+		}
+	}
+}
+
+// stream receives the SVIDs of a FetchX509SVID stream, until it fails. It
+// reports whether an SVID was received.
+func (s *CertSource) stream(ctx context.Context) (received bool, _ error) {
+	ctx, cancel := context.WithCancel(metadata.AppendToOutgoingContext(ctx, "workload.spiffe.io", "true"))
+	defer cancel()
+
+	stream, err := s.conn.NewStream(ctx, &grpc.StreamDesc{
+		StreamName:    "FetchX509SVID",
+		ServerStreams: true,
+	}, fetchX509SVIDMethod, grpc.ForceCodec(codec{}))
+	if err != nil {
+		return false, err
+	}
+	if err := stream.SendMsg(&x509SVIDRequest{}); err != nil {
+		return false, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return false, err
+	}
+
+	for {
+		var resp x509SVIDResponse
+		if err := stream.RecvMsg(&resp); err != nil {
+			return received, err
+		}
+
+		cert, err := s.certFromResponse(&resp)
+		if err != nil {
+			s.log.Error("Workload API sent an invalid X.509-SVID, keeping the previous one", zap.Error(err))
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			continue
+		}
+		received = true
+
+		leaf := cert.ClientCert.Leaf
+		s.log.Info("received X.509-SVID from the Workload API",
+			zap.String("spiffe_id", leaf.URIs[0].String()),
+			zap.String("serial", leaf.SerialNumber.String()),
+			zap.Time("not_after", leaf.NotAfter))
+
+		s.mu.Lock()
+		s.cert = cert
+		s.err = nil
+		close(s.reloaded)
+		s.reloaded = make(chan struct{})
+		s.mu.Unlock()
+	}
+}
+
+// certFromResponse builds the proxy.Cert of the SVID of the given response.
+func (s *CertSource) certFromResponse(resp *x509SVIDResponse) (*proxy.Cert, error) {
+	if len(resp.svids) == 0 {
+		return nil, errors.New("no X.509-SVID")
+	}
+	svid := &resp.svids[0]
+	if s.spiffeID != "" {
+		svid = nil
+		for i := range resp.svids {
+			if resp.svids[i].spiffeID == s.spiffeID {
+				svid = &resp.svids[i]
+				break
+			}
+		}
+		if svid == nil {
+			return nil, fmt.Errorf("no X.509-SVID for %q", s.spiffeID)
+		}
+	}
+
+	certs, err := x509.ParseCertificates(svid.certs)
+	if err != nil {
+		return nil, fmt.Errorf("invalid certificates of %q: %w", svid.spiffeID, err)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates for %q", svid.spiffeID)
+	}
+	leaf := certs[0]
+	if len(leaf.URIs) != 1 || leaf.URIs[0].String() != svid.spiffeID {
+		return nil, fmt.Errorf("certificate of %q doesn't hold its SPIFFE ID as its single URI SAN", svid.spiffeID)
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(svid.key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid private key of %q: %w", svid.spiffeID, err)
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key of %q: %T", svid.spiffeID, key)
+	}
+	type publicKey interface {
+		Equal(crypto.PublicKey) bool
+	}
+	if pub, ok := signer.Public().(publicKey); !ok || !pub.Equal(leaf.PublicKey) {
+		return nil, fmt.Errorf("private key of %q doesn't match its certificate", svid.spiffeID)
+	}
+
+	bundle, err := x509.ParseCertificates(svid.bundle)
+	if err != nil {
+		return nil, fmt.Errorf("invalid bundle of %q: %w", svid.spiffeID, err)
+	}
+	if len(bundle) == 0 {
+		return nil, fmt.Errorf("no bundle for %q", svid.spiffeID)
+	}
+
+	chain := make([][]byte, 0, len(certs))
+	for _, cert := range certs {
+		chain = append(chain, cert.Raw)
+	}
+	return &proxy.Cert{
+		ClientCert: tls.Certificate{
+			Certificate: chain,
+			PrivateKey:  signer,
+			Leaf:        leaf,
+		},
+		CACerts: bundle,
+		Expiry:  leaf.NotAfter,
+	}, nil
+}
+
+// dialTarget returns the gRPC target of the given Workload API address, a
+// "unix" URL with an absolute path, or a "tcp" one with an IP address and a
+// port, as the SPIFFE specification has it.
+func dialTarget(addr string) (string, error) {
+	u, err := url.Parse(addr)
+	if err != nil {
+		return "", err
+	}
+
+	switch u.Scheme {
+	case "unix":
+		if u.Opaque != "" || u.Path == "" || u.Host != "" {
+			return "", fmt.Errorf("%q must be a unix URL with an absolute path, i.e: unix:///run/spire/sockets/agent.sock", addr)
+		}
+		return "unix://" + u.Path, nil
+	case "tcp":
+		if net.ParseIP(u.Hostname()) == nil || u.Port() == "" || u.Path != "" {
+			return "", fmt.Errorf("%q must be a tcp URL with an IP address and a port, i.e: tcp://127.0.0.1:8081", addr)
+		}
+		return "passthrough:///" + u.Host, nil
+	}
+	return "", fmt.Errorf("%q must be a unix or tcp URL", addr)
+}
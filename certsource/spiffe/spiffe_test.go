@@ -0,0 +1,484 @@
+package spiffe
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/planetscale/sql-proxy/proxy"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// marshal encodes the response like the Workload API does.
+func (r *x509SVIDResponse) marshal() ([]byte, error) {
+	var b []byte
+	for _, svid := range r.svids {
+		var m []byte
+		m = protowire.AppendTag(m, 1, protowire.BytesType)
+		m = protowire.AppendString(m, svid.spiffeID)
+		m = protowire.AppendTag(m, 2, protowire.BytesType)
+		m = protowire.AppendBytes(m, svid.certs)
+		m = protowire.AppendTag(m, 3, protowire.BytesType)
+		m = protowire.AppendBytes(m, svid.key)
+		m = protowire.AppendTag(m, 4, protowire.BytesType)
+		m = protowire.AppendBytes(m, svid.bundle)
+		// the hint is skipped
+		m = protowire.AppendTag(m, 5, protowire.BytesType)
+		m = protowire.AppendString(m, "internal")
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, m)
+	}
+	// the CRLs are skipped
+	b = protowire.AppendTag(b, 2, protowire.BytesType)
+	b = protowire.AppendBytes(b, []byte("crl"))
+	return b, nil
+}
+
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// svid issues an X.509-SVID for the given SPIFFE ID, valid for the given
+// duration.
+func (ca *testCA) svid(t *testing.T, id string, validity time.Duration) x509SVID {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := url.Parse(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         []*url.URL{u},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(validity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return x509SVID{
+		spiffeID: id,
+		certs:    der,
+		key:      pkcs8,
+		bundle:   ca.cert.Raw,
+	}
+}
+
+// tlsCertificate returns the certificate of the given SVID.
+func (s x509SVID) tlsCertificate(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := x509.ParsePKCS8PrivateKey(s.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{s.certs}, PrivateKey: key}
+}
+
+// fakeWorkloadAPI is a Workload API streaming the responses sent to
+// responses to every client. A stream ends with the error sent to errs.
+type fakeWorkloadAPI struct {
+	responses chan *x509SVIDResponse
+	errs      chan error
+
+	mu      sync.Mutex
+	streams int
+}
+
+func (f *fakeWorkloadAPI) fetchX509SVID(_ interface{}, stream grpc.ServerStream) error {
+	f.mu.Lock()
+	f.streams++
+	f.mu.Unlock()
+
+	md, _ := metadata.FromIncomingContext(stream.Context())
+	if v := md.Get("workload.spiffe.io"); len(v) != 1 || v[0] != "true" {
+		return status.Error(codes.InvalidArgument, "security header missing from request")
+	}
+	if err := stream.RecvMsg(&x509SVIDRequest{}); err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case resp := <-f.responses:
+			if err := stream.SendMsg(resp); err != nil {
+				return err
+			}
+		case err := <-f.errs:
+			return err
+		case <-stream.Context().Done():
+			return stream.Context().Err()
+		}
+	}
+}
+
+func (f *fakeWorkloadAPI) streamCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.streams
+}
+
+// startWorkloadAPI serves the fake Workload API in-process and returns the
+// options of a CertSource connecting to it.
+func startWorkloadAPI(t *testing.T, api *fakeWorkloadAPI) Options {
+	t.Helper()
+
+	srv := grpc.NewServer(grpc.ForceServerCodec(codec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "SpiffeWorkloadAPI",
+		HandlerType: (*interface{})(nil),
+		Streams: []grpc.StreamDesc{{
+			StreamName:    "FetchX509SVID",
+			Handler:       api.fetchX509SVID,
+			ServerStreams: true,
+		}},
+	}, api)
+
+	l := bufconn.Listen(1 << 20)
+	go srv.Serve(l) // nolint: errcheck
+	t.Cleanup(srv.Stop)
+
+	return Options{
+		Addr:   "unix:///run/spire/sockets/agent.sock",
+		Logger: zap.NewNop(),
+		DialOptions: []grpc.DialOption{
+			grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+				return l.DialContext(ctx)
+			}),
+		},
+	}
+}
+
+func newFakeWorkloadAPI() *fakeWorkloadAPI {
+	return &fakeWorkloadAPI{
+		responses: make(chan *x509SVIDResponse, 10),
+		errs:      make(chan error, 10),
+	}
+}
+
+func TestCertSource_Rotation(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	api := newFakeWorkloadAPI()
+	svid := ca.svid(t, "spiffe://example.org/proxy", time.Hour)
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{svid}}
+
+	s, err := New(context.Background(), startWorkloadAPI(t, api))
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Certificate, qt.DeepEquals, [][]byte{svid.certs})
+	c.Assert(cert.ClientCert.Leaf.URIs[0].String(), qt.Equals, "spiffe://example.org/proxy")
+	c.Assert(cert.CACerts, qt.HasLen, 1)
+	c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+	c.Assert(cert.Expiry.Equal(cert.ClientCert.Leaf.NotAfter), qt.IsTrue)
+	c.Assert(cert.AccessHost, qt.Equals, "")
+
+	// the rotated SVID replaces the previous one
+	reloaded := s.Reloaded()
+	rotated := ca.svid(t, "spiffe://example.org/proxy", 2*time.Hour)
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{rotated}}
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotated SVID not received")
+	}
+	cert, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Certificate, qt.DeepEquals, [][]byte{rotated.certs})
+}
+
+func TestCertSource_Reconnect(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	api := newFakeWorkloadAPI()
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{ca.svid(t, "spiffe://example.org/proxy", time.Hour)}}
+
+	s, err := New(context.Background(), startWorkloadAPI(t, api))
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	// the stream fails, the SVID is kept until the next one is received
+	reloaded := s.Reloaded()
+	api.errs <- status.Error(codes.Unavailable, "agent restarting")
+	for api.streamCount() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Leaf.URIs[0].String(), qt.Equals, "spiffe://example.org/proxy")
+
+	rotated := ca.svid(t, "spiffe://example.org/proxy", time.Hour)
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{rotated}}
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("rotated SVID not received")
+	}
+	cert, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Certificate, qt.DeepEquals, [][]byte{rotated.certs})
+	c.Assert(api.streamCount(), qt.Equals, 2)
+}
+
+func TestCertSource_SPIFFEID(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	api := newFakeWorkloadAPI()
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{
+		ca.svid(t, "spiffe://example.org/default", time.Hour),
+		ca.svid(t, "spiffe://example.org/proxy", time.Hour),
+	}}
+
+	opts := startWorkloadAPI(t, api)
+	opts.SPIFFEID = "spiffe://example.org/proxy"
+	s, err := New(context.Background(), opts)
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Leaf.URIs[0].String(), qt.Equals, "spiffe://example.org/proxy")
+}
+
+func TestNew_Errors(t *testing.T) {
+	ca := newTestCA(t)
+	valid := ca.svid(t, "spiffe://example.org/proxy", time.Hour)
+	other := ca.svid(t, "spiffe://example.org/other", time.Hour)
+
+	tests := []struct {
+		name     string
+		resp     *x509SVIDResponse
+		err      error
+		spiffeID string
+		wantErr  string
+	}{
+		{
+			name:    "not entitled",
+			err:     status.Error(codes.PermissionDenied, "no identity issued"),
+			wantErr: "couldn't fetch the X.509-SVID: rpc error: code = PermissionDenied desc = no identity issued",
+		},
+		{
+			name:     "other SPIFFE ID",
+			resp:     &x509SVIDResponse{svids: []x509SVID{valid}},
+			spiffeID: "spiffe://example.org/db",
+			wantErr:  `couldn't fetch the X.509-SVID: no X.509-SVID for "spiffe://example.org/db"`,
+		},
+		{
+			name: "key of another SVID",
+			resp: &x509SVIDResponse{svids: []x509SVID{{
+				spiffeID: valid.spiffeID,
+				certs:    valid.certs,
+				key:      other.key,
+				bundle:   valid.bundle,
+			}}},
+			wantErr: `couldn't fetch the X.509-SVID: private key of "spiffe://example.org/proxy" doesn't match its certificate`,
+		},
+		{
+			name: "SPIFFE ID of another SVID",
+			resp: &x509SVIDResponse{svids: []x509SVID{{
+				spiffeID: other.spiffeID,
+				certs:    valid.certs,
+				key:      valid.key,
+				bundle:   valid.bundle,
+			}}},
+			wantErr: `couldn't fetch the X.509-SVID: certificate of "spiffe://example.org/other" doesn't hold its SPIFFE ID as its single URI SAN`,
+		},
+		{
+			name: "no bundle",
+			resp: &x509SVIDResponse{svids: []x509SVID{{
+				spiffeID: valid.spiffeID,
+				certs:    valid.certs,
+				key:      valid.key,
+			}}},
+			wantErr: `couldn't fetch the X.509-SVID: no bundle for "spiffe://example.org/proxy"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			api := newFakeWorkloadAPI()
+			if tt.resp != nil {
+				api.responses <- tt.resp
+			}
+			if tt.err != nil {
+				api.errs <- tt.err
+			}
+			opts := startWorkloadAPI(t, api)
+			opts.SPIFFEID = tt.spiffeID
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			_, err := New(ctx, opts)
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
+
+func TestNew_Addr(t *testing.T) {
+	c := qt.New(t)
+
+	t.Setenv(EndpointSocketEnv, "")
+	_, err := New(context.Background(), Options{})
+	c.Assert(err, qt.ErrorMatches, "Addr must be set, or the SPIFFE_ENDPOINT_SOCKET environment variable")
+
+	t.Setenv(EndpointSocketEnv, "http://localhost:8081")
+	_, err = New(context.Background(), Options{})
+	c.Assert(err, qt.ErrorMatches, `invalid Addr: "http://localhost:8081" must be a unix or tcp URL`)
+}
+
+func TestDialTarget(t *testing.T) {
+	tests := []struct {
+		addr    string
+		want    string
+		wantErr string
+	}{
+		{addr: "unix:///run/spire/sockets/agent.sock", want: "unix:///run/spire/sockets/agent.sock"},
+		{addr: "tcp://127.0.0.1:8081", want: "passthrough:///127.0.0.1:8081"},
+		{addr: "tcp://[::1]:8081", want: "passthrough:///[::1]:8081"},
+		{addr: "unix:agent.sock", wantErr: `"unix:agent.sock" must be a unix URL with an absolute path, .*`},
+		{addr: "unix://agent.sock", wantErr: `"unix://agent.sock" must be a unix URL with an absolute path, .*`},
+		{addr: "tcp://localhost:8081", wantErr: `"tcp://localhost:8081" must be a tcp URL with an IP address and a port, .*`},
+		{addr: "tcp://127.0.0.1", wantErr: `"tcp://127.0.0.1" must be a tcp URL with an IP address and a port, .*`},
+		{addr: "/run/spire/sockets/agent.sock", wantErr: `"/run/spire/sockets/agent.sock" must be a unix or tcp URL`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			c := qt.New(t)
+			got, err := dialTarget(tt.addr)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestCertSource_Proxy(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the backend authenticates with an SVID too, and only accepts the
+	// SVIDs of its trust domain
+	backendSVID := ca.svid(t, "spiffe://example.org/db/main", time.Hour)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{backendSVID.tlsCertificate(t)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    func() *x509.CertPool { p := x509.NewCertPool(); p.AddCert(ca.cert); return p }(),
+		MaxVersion:   tls.VersionTLS12,
+		VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			if id := chains[0][0].URIs[0].String(); id != "spiffe://example.org/proxy" {
+				return errors.New("unexpected client " + id)
+			}
+			return nil
+		},
+	})
+	c.Assert(err, qt.IsNil)
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn) // nolint: errcheck
+			}()
+		}
+	}()
+
+	api := newFakeWorkloadAPI()
+	api.responses <- &x509SVIDResponse{svids: []x509SVID{ca.svid(t, "spiffe://example.org/proxy", time.Hour)}}
+	s, err := New(context.Background(), startWorkloadAPI(t, api))
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	client, err := proxy.NewClient(proxy.Options{
+		CertSource:     s,
+		RemoteAddr:     l.Addr().String(),
+		ServerSPIFFEID: "spiffe://example.org/db/main",
+		Logger:         zap.NewNop(),
+	})
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/main")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "ping")
+}
@@ -0,0 +1,148 @@
+package spiffe
+
+import (
+	"fmt"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+// fetchX509SVIDMethod is the method of the Workload API streaming the
+// X.509-SVIDs of the workload.
+const fetchX509SVIDMethod = "/SpiffeWorkloadAPI/FetchX509SVID"
+
+// The messages of the Workload API are decoded by hand rather than
+// generated: its proto file has no package, so registering its messages
+// would conflict with the ones of go-spiffe in the binaries linking both.
+//
+//	message X509SVIDRequest {}
+//
+//	message X509SVIDResponse {
+//	  repeated X509SVID svids = 1;
+//	  repeated bytes crl = 2;
+//	  map<string, bytes> federated_bundles = 3;
+//	}
+//
+//	message X509SVID {
+//	  string spiffe_id = 1;
+//	  bytes x509_svid = 2;
+//	  bytes x509_svid_key = 3;
+//	  bytes bundle = 4;
+//	  string hint = 5;
+//	}
+
+// x509SVIDRequest is the X509SVIDRequest message, which has no fields.
+type x509SVIDRequest struct{}
+
+func (*x509SVIDRequest) marshal() ([]byte, error) { return nil, nil }
+
+func (*x509SVIDRequest) unmarshal([]byte) error { return nil }
+
+// x509SVIDResponse is the X509SVIDResponse message, without the CRLs and
+// the federated bundles.
+type x509SVIDResponse struct {
+	svids []x509SVID
+}
+
+func (r *x509SVIDResponse) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num != 1 || typ != protowire.BytesType {
+			return 0, nil
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		var svid x509SVID
+		if err := svid.unmarshal(v); err != nil {
+			return 0, err
+		}
+		r.svids = append(r.svids, svid)
+		return n, nil
+	})
+}
+
+// x509SVID is the X509SVID message, without the hint.
+type x509SVID struct {
+	// spiffeID is the SPIFFE ID of the SVID.
+	spiffeID string
+	// certs holds the DER encoded certificates of the SVID, the leaf first
+	// and then its intermediates, concatenated.
+	certs []byte
+	// key is the PKCS #8 DER encoded private key of the SVID.
+	key []byte
+	// bundle holds the DER encoded CA certificates of the trust domain of
+	// the SVID, concatenated.
+	bundle []byte
+}
+
+func (s *x509SVID) unmarshal(b []byte) error {
+	return consumeFields(b, func(num protowire.Number, typ protowire.Type, b []byte) (int, error) {
+		if num < 1 || num > 4 {
+			return 0, nil
+		}
+		if typ != protowire.BytesType {
+			return 0, fmt.Errorf("invalid wire type %d of field %d", typ, num)
+		}
+		v, n := protowire.ConsumeBytes(b)
+		if n < 0 {
+			return 0, protowire.ParseError(n)
+		}
+		switch num {
+		case 1:
+			s.spiffeID = string(v)
+		case 2:
+			s.certs = append([]byte(nil), v...)
+		case 3:
+			s.key = append([]byte(nil), v...)
+		case 4:
+			s.bundle = append([]byte(nil), v...)
+		}
+		return n, nil
+	})
+}
+
+// consumeFields calls consume with the number, the type and the value of
+// every field of the given message, which returns the length of the value
+// it consumed, or zero to skip it.
+func consumeFields(b []byte, consume func(num protowire.Number, typ protowire.Type, b []byte) (int, error)) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return protowire.ParseError(n)
+		}
+		b = b[n:]
+
+		n, err := consume(num, typ, b)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			if n = protowire.ConsumeFieldValue(num, typ, b); n < 0 {
+				return protowire.ParseError(n)
+			}
+		}
+		b = b[n:]
+	}
+	return nil
+}
+
+// codec encodes the messages of the Workload API.
+type codec struct{}
+
+func (codec) Name() string { return "proto" }
+
+func (codec) Marshal(v interface{}) ([]byte, error) {
+	m, ok := v.(interface{ marshal() ([]byte, error) })
+	if !ok {
+		return nil, fmt.Errorf("can't marshal %T", v)
+	}
+	return m.marshal()
+}
+
+func (codec) Unmarshal(data []byte, v interface{}) error {
+	m, ok := v.(interface{ unmarshal([]byte) error })
+	if !ok {
+		return fmt.Errorf("can't unmarshal %T", v)
+	}
+	return m.unmarshal(data)
+}
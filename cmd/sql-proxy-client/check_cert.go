@@ -0,0 +1,317 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/planetscale/sql-proxy/proxy"
+)
+
+// checkCertTimeout bounds retrieving the certs and connecting to the remote
+// server in check-cert.
+const checkCertTimeout = 30 * time.Second
+
+// errCheckCertFailed is returned by check-cert if a certificate wouldn't
+// pass verification.
+var errCheckCertFailed = errors.New("certificate check failed")
+
+// runCheckCert runs the check-cert subcommand with the given arguments. It
+// only accepts the cert source flags of the proxy, and --json and --connect.
+func runCheckCert(args []string) error {
+	fs := flag.NewFlagSet("check-cert", flag.ExitOnError)
+	source := registerCertSourceFlags(fs)
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	connect := fs.Bool("connect", false, "Also connect to the remote server and check the certificate it presents")
+	fs.Parse(args) // nolint: errcheck
+
+	certSource, instance, err := source.certSource()
+	if err != nil {
+		return err
+	}
+	if certSource == nil {
+		return errors.New("check-cert requires a cert source")
+	}
+
+	report, err := checkCert(context.Background(), certSource, instance, source.remoteAddr(), *connect, time.Now())
+	if err != nil {
+		return err
+	}
+	if err := printCheckCertReport(os.Stdout, report, *asJSON); err != nil {
+		return err
+	}
+	if report.failed() {
+		return errCheckCertFailed
+	}
+	return nil
+}
+
+// certInfo describes a certificate checked by check-cert.
+type certInfo struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	Serial    string    `json:"serial"`
+	SANs      []string  `json:"sans,omitempty"`
+	NotBefore time.Time `json:"not_before"`
+	NotAfter  time.Time `json:"not_after"`
+	// ExpiresIn is the time left until NotAfter, negative once expired.
+	ExpiresIn string `json:"expires_in"`
+	Key       string `json:"key"`
+
+	// Verified is set if the certificate passed verification. If neither
+	// Verified nor VerifyError are set, it couldn't be verified.
+	Verified    bool   `json:"verified"`
+	VerifyError string `json:"verify_error,omitempty"`
+}
+
+// checkCertReport is the result of check-cert.
+type checkCertReport struct {
+	Instance string `json:"instance"`
+
+	// ClientCert is nil if the cert source doesn't return a client
+	// certificate.
+	ClientCert *certInfo   `json:"client_cert,omitempty"`
+	CACerts    []*certInfo `json:"ca_certs,omitempty"`
+
+	// RemoteAddr and ServerCert are only set if check-cert connected to the
+	// remote server.
+	RemoteAddr   string    `json:"remote_addr,omitempty"`
+	ServerCert   *certInfo `json:"server_cert,omitempty"`
+	ConnectError string    `json:"connect_error,omitempty"`
+}
+
+// failed reports whether any of the checks failed.
+func (r *checkCertReport) failed() bool {
+	if r.ClientCert != nil && r.ClientCert.VerifyError != "" {
+		return true
+	}
+	if r.ServerCert != nil && r.ServerCert.VerifyError != "" {
+		return true
+	}
+	return r.ConnectError != ""
+}
+
+// checkCert retrieves the certs of the instance from the cert source and
+// checks them, as well as the certificate of the remote server if connect is
+// set. remoteAddr overrides the remote address returned by the cert source.
+func checkCert(ctx context.Context, certSource proxy.CertSource, instance, remoteAddr string, connect bool, now time.Time) (*checkCertReport, error) {
+	ctx, cancel := context.WithTimeout(ctx, checkCertTimeout)
+	defer cancel()
+
+	var org, db, branch string
+	if parts := strings.SplitN(instance, "/", 3); len(parts) == 3 {
+		org, db, branch = parts[0], parts[1], parts[2]
+	}
+
+	cert, err := certSource.Cert(ctx, org, db, branch)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't retrieve certs from cert source: %s", err)
+	}
+
+	report := &checkCertReport{Instance: instance}
+
+	// the roots used to verify the remote server, the client certificate is
+	// checked against them as well
+	var roots *x509.CertPool
+	if len(cert.CACerts) > 0 {
+		roots = x509.NewCertPool()
+		for _, ca := range cert.CACerts {
+			roots.AddCert(ca)
+			report.CACerts = append(report.CACerts, newCertInfo(ca, now))
+		}
+	}
+
+	if !cert.ServerAuthOnly && len(cert.ClientCert.Certificate) > 0 {
+		chain, err := parseChain(cert.ClientCert.Certificate)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse client certificate: %s", err)
+		}
+		report.ClientCert = newCertInfo(chain[0], now)
+		switch {
+		case now.Before(chain[0].NotBefore) || now.After(chain[0].NotAfter):
+			report.ClientCert.VerifyError = "certificate is expired or not yet valid"
+		case roots != nil:
+			verifyChain(report.ClientCert, chain, x509.VerifyOptions{
+				Roots:       roots,
+				CurrentTime: now,
+				KeyUsages:   []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			})
+		}
+	}
+
+	if !connect {
+		return report, nil
+	}
+
+	serverName := strings.TrimSpace(cert.AccessHost)
+	report.RemoteAddr = remoteAddr
+	if report.RemoteAddr == "" {
+		report.RemoteAddr = net.JoinHostPort(serverName, strconv.Itoa(cert.Ports.Proxy))
+	}
+
+	// the chain is verified below, the same way the proxy does it, so the
+	// presented certificate can be reported even if it's rejected
+	cfg := &tls.Config{
+		ServerName:         serverName,
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // nolint: gosec
+	}
+	if !cert.ServerAuthOnly {
+		cfg.Certificates = []tls.Certificate{cert.ClientCert}
+	}
+	d := tls.Dialer{Config: cfg}
+	conn, err := d.DialContext(ctx, "tcp", report.RemoteAddr)
+	if err != nil {
+		report.ConnectError = err.Error()
+		return report, nil
+	}
+	defer conn.Close()
+
+	peerCerts := conn.(*tls.Conn).ConnectionState().PeerCertificates
+	if len(peerCerts) == 0 {
+		report.ConnectError = "remote server presented no certificate"
+		return report, nil
+	}
+	report.ServerCert = newCertInfo(peerCerts[0], now)
+	// the server may leave the intermediates of the cert source out
+	chain := append(append([]*x509.Certificate(nil), peerCerts...), cert.Intermediates...)
+	verifyChain(report.ServerCert, chain, x509.VerifyOptions{
+		Roots:       roots,
+		DNSName:     serverName,
+		CurrentTime: now,
+	})
+	return report, nil
+}
+
+// verifyChain verifies the leaf of chain, the first certificate, with the
+// rest of it as intermediates and records the result in info.
+func verifyChain(info *certInfo, chain []*x509.Certificate, opts x509.VerifyOptions) {
+	opts.Intermediates = x509.NewCertPool()
+	for _, cert := range chain[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	if _, err := chain[0].Verify(opts); err != nil {
+		info.VerifyError = err.Error()
+		return
+	}
+	info.Verified = true
+}
+
+func parseChain(certs [][]byte) ([]*x509.Certificate, error) {
+	chain := make([]*x509.Certificate, 0, len(certs))
+	for _, der := range certs {
+		cert, err := x509.ParseCertificate(der)
+		if err != nil {
+			return nil, err
+		}
+		chain = append(chain, cert)
+	}
+	return chain, nil
+}
+
+func newCertInfo(cert *x509.Certificate, now time.Time) *certInfo {
+	info := &certInfo{
+		Subject:   cert.Subject.String(),
+		Issuer:    cert.Issuer.String(),
+		Serial:    cert.SerialNumber.String(),
+		NotBefore: cert.NotBefore,
+		NotAfter:  cert.NotAfter,
+		ExpiresIn: cert.NotAfter.Sub(now).Round(time.Second).String(),
+		Key:       keyDescription(cert.PublicKey),
+	}
+	info.SANs = append(info.SANs, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		info.SANs = append(info.SANs, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		info.SANs = append(info.SANs, uri.String())
+	}
+	info.SANs = append(info.SANs, cert.EmailAddresses...)
+	return info
+}
+
+// keyDescription returns the type and size of a public key.
+func keyDescription(pub interface{}) string {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return fmt.Sprintf("RSA %d bits", k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return "ECDSA " + k.Curve.Params().Name
+	case ed25519.PublicKey:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("unknown (%T)", pub)
+	}
+}
+
+// printCheckCertReport prints the report as JSON or human-readable text.
+func printCheckCertReport(w io.Writer, report *checkCertReport, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(report)
+	}
+
+	fmt.Fprintf(w, "Instance: %s\n", report.Instance)
+
+	if report.ClientCert != nil {
+		fmt.Fprintf(w, "\nClient certificate:\n")
+		printCertInfo(w, report.ClientCert, "no CA certificates to verify against")
+	} else {
+		fmt.Fprintf(w, "\nClient certificate: none, server authentication only\n")
+	}
+
+	if len(report.CACerts) > 0 {
+		fmt.Fprintf(w, "\nCA certificates:\n")
+		for _, ca := range report.CACerts {
+			fmt.Fprintf(w, "  - %s (serial %s, expires in %s)\n", ca.Subject, ca.Serial, ca.ExpiresIn)
+		}
+	} else {
+		fmt.Fprintf(w, "\nCA certificates: none, the system roots are used\n")
+	}
+
+	if report.RemoteAddr != "" {
+		fmt.Fprintf(w, "\nServer certificate of %s:\n", report.RemoteAddr)
+		if report.ConnectError != "" {
+			fmt.Fprintf(w, "  Couldn't connect: %s\n", report.ConnectError)
+		} else {
+			printCertInfo(w, report.ServerCert, "")
+		}
+	}
+
+	return nil
+}
+
+func printCertInfo(w io.Writer, info *certInfo, unverified string) {
+	fmt.Fprintf(w, "  Subject:    %s\n", info.Subject)
+	fmt.Fprintf(w, "  Issuer:     %s\n", info.Issuer)
+	fmt.Fprintf(w, "  Serial:     %s\n", info.Serial)
+	if len(info.SANs) > 0 {
+		fmt.Fprintf(w, "  SANs:       %s\n", strings.Join(info.SANs, ", "))
+	}
+	fmt.Fprintf(w, "  Not before: %s\n", info.NotBefore.Format(time.RFC3339))
+	fmt.Fprintf(w, "  Not after:  %s (expires in %s)\n", info.NotAfter.Format(time.RFC3339), info.ExpiresIn)
+	fmt.Fprintf(w, "  Key:        %s\n", info.Key)
+
+	switch {
+	case info.Verified:
+		fmt.Fprintf(w, "  Verified:   yes\n")
+	case info.VerifyError != "":
+		fmt.Fprintf(w, "  Verified:   no, %s\n", info.VerifyError)
+	default:
+		fmt.Fprintf(w, "  Verified:   skipped, %s\n", unverified)
+	}
+}
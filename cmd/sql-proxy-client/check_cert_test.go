@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"math/big"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// issueCert issues a certificate from the template, self-signed if parent is
+// nil.
+func issueCert(c *qt.C, tmpl *x509.Certificate, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+
+	parentCert, parentKey := tmpl, interface{}(key)
+	if parent != nil {
+		parentCert, parentKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parentCert, &key.PublicKey, parentKey)
+	c.Assert(err, qt.IsNil)
+	leaf, err := x509.ParseCertificate(der)
+	c.Assert(err, qt.IsNil)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func newCA(c *qt.C, commonName string) tls.Certificate {
+	return issueCert(c, &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}, nil)
+}
+
+// startCheckCertServer starts a TLS server requiring client certificates
+// issued by ca, presenting a certificate for "localhost" issued by ca.
+func startCheckCertServer(c *qt.C, ca tls.Certificate) int {
+	serverCert := issueCert(c, &x509.Certificate{
+		SerialNumber: big.NewInt(42),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, &ca)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    pool,
+	})
+	c.Assert(err, qt.IsNil)
+	c.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			conn.(*tls.Conn).Handshake() // nolint: errcheck
+			conn.Close()
+		}
+	}()
+
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestCheckCert(t *testing.T) {
+	c := qt.New(t)
+
+	ca := newCA(c, "Test CA")
+	port := startCheckCertServer(c, ca)
+	clientCert := issueCert(c, &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "myorg/mydb/main"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	certSource := &localCertSource{
+		cert:       clientCert,
+		caCerts:    []*x509.Certificate{ca.Leaf},
+		remoteAddr: "localhost",
+		remotePort: port,
+	}
+
+	report, err := checkCert(context.Background(), certSource, "myorg/mydb/main", "", true, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(report.failed(), qt.IsFalse)
+	c.Assert(report.ClientCert.Serial, qt.Equals, "7")
+	c.Assert(report.ClientCert.Key, qt.Equals, "ECDSA P-256")
+	c.Assert(report.ClientCert.Verified, qt.IsTrue)
+	c.Assert(report.CACerts, qt.HasLen, 1)
+	c.Assert(report.RemoteAddr, qt.Equals, net.JoinHostPort("localhost", strconv.Itoa(port)))
+	c.Assert(report.ServerCert.Subject, qt.Equals, "CN=localhost")
+	c.Assert(report.ServerCert.SANs, qt.DeepEquals, []string{"localhost"})
+	c.Assert(report.ServerCert.Verified, qt.IsTrue)
+
+	var buf bytes.Buffer
+	c.Assert(printCheckCertReport(&buf, report, false), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "Client certificate:\n  Subject:    CN=myorg/mydb/main\n")
+	c.Assert(buf.String(), qt.Contains, "Server certificate of localhost:")
+	c.Assert(bytes.Count(buf.Bytes(), []byte("Verified:   yes")), qt.Equals, 2)
+
+	buf.Reset()
+	c.Assert(printCheckCertReport(&buf, report, true), qt.IsNil)
+	var decoded checkCertReport
+	c.Assert(json.Unmarshal(buf.Bytes(), &decoded), qt.IsNil)
+	c.Assert(decoded.ServerCert.Serial, qt.Equals, "42")
+
+	// a day later, everything expired
+	report, err = checkCert(context.Background(), certSource, "myorg/mydb/main", "", true, time.Now().Add(24*time.Hour))
+	c.Assert(err, qt.IsNil)
+	c.Assert(report.failed(), qt.IsTrue)
+	c.Assert(report.ClientCert.VerifyError, qt.Equals, "certificate is expired or not yet valid")
+	c.Assert(report.ServerCert.VerifyError, qt.Matches, "x509: certificate has expired or is not yet valid.*")
+}
+
+func TestCheckCert_UnknownAuthority(t *testing.T) {
+	c := qt.New(t)
+
+	ca := newCA(c, "Test CA")
+	port := startCheckCertServer(c, ca)
+	clientCert := issueCert(c, &x509.Certificate{
+		SerialNumber: big.NewInt(7),
+		Subject:      pkix.Name{CommonName: "myorg/mydb/main"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, &ca)
+
+	certSource := &localCertSource{
+		cert:       clientCert,
+		caCerts:    []*x509.Certificate{newCA(c, "Other CA").Leaf},
+		remoteAddr: "localhost",
+		remotePort: port,
+	}
+
+	report, err := checkCert(context.Background(), certSource, "myorg/mydb/main", "", true, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(report.failed(), qt.IsTrue)
+	c.Assert(report.ClientCert.VerifyError, qt.Matches, "x509: certificate signed by unknown authority.*")
+	c.Assert(report.ServerCert.VerifyError, qt.Matches, "x509: certificate signed by unknown authority.*")
+
+	var buf bytes.Buffer
+	c.Assert(printCheckCertReport(&buf, report, false), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "Verified:   no, x509: certificate signed by unknown authority")
+}
+
+func TestCheckCert_ConnectError(t *testing.T) {
+	c := qt.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	certSource := &localCertSource{
+		remoteAddr:     "127.0.0.1",
+		remotePort:     port,
+		serverAuthOnly: true,
+	}
+
+	report, err := checkCert(context.Background(), certSource, "local/127.0.0.1/1", "", true, time.Now())
+	c.Assert(err, qt.IsNil)
+	c.Assert(report.failed(), qt.IsTrue)
+	c.Assert(report.ClientCert, qt.IsNil)
+	c.Assert(report.ConnectError, qt.Not(qt.Equals), "")
+}
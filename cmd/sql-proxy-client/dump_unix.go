@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyDumpState relays SIGUSR1, which requests a dump of the proxy state,
+// to ch.
+func notifyDumpState(ch chan<- os.Signal) {
+	signal.Notify(ch, syscall.SIGUSR1)
+}
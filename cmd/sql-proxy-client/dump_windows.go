@@ -0,0 +1,7 @@
+package main
+
+import "os"
+
+// notifyDumpState does nothing, there is no SIGUSR1 on Windows. Use the
+// admin API instead.
+func notifyDumpState(ch chan<- os.Signal) {}
@@ -1,26 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"crypto/ecdsa"
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/pem"
 	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	nanoid "github.com/matoous/go-nanoid/v2"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 
 	ps "github.com/planetscale/planetscale-go/planetscale"
 
+	"github.com/planetscale/sql-proxy/internal/logfile"
 	"github.com/planetscale/sql-proxy/proxy"
 )
 
@@ -33,6 +41,10 @@ var (
 const PublicIdAlphabet = "0123456789abcdefghijklmnopqrstuvwxyz"
 const PublicIdLength = 6
 
+// insecureRemoteConfirmation is the exact value --insecure-remote-confirm
+// must be set to, so plaintext mode can't be enabled by accident.
+const insecureRemoteConfirmation = "i-understand-traffic-is-unencrypted"
+
 func main() {
 	if err := realMain(); err != nil {
 		fmt.Fprintln(os.Stderr, err)
@@ -41,92 +53,691 @@ func main() {
 }
 
 func realMain() error {
+	// check-cert checks the certs of the configured cert source and
+	// instance instead of running the proxy
+	args := os.Args[1:]
+	if len(args) > 0 && args[0] == "check-cert" {
+		return runCheckCert(args[1:])
+	}
+
 	host := flag.String("host", "127.0.0.1", "Local host to bind and listen for connections")
 	port := flag.String("port", "3306", "Local port to bind and listen for connections")
-
-	remoteHost := flag.String("remote-host", "", "MySQL remote host")
-	remotePort := flag.Int("remote-port", 3307, "MySQL remote port")
-
-	orgName := flag.String("org", os.Getenv("PLANETSCALE_ORG"),
-		"The PlanetScale Organization")
-	dbName := flag.String("database", os.Getenv("PLANETSCALE_DATABASE"),
-		"The PlanetScale Database")
-	branchName := flag.String("branch", os.Getenv("PLANETSCALE_BRANCH"),
-		"The PlanetScale Branch")
-
-	token := flag.String("token", os.Getenv("PLANETSCALE_ACCESS_TOKEN"), "The PlanetScale API access token (PLANETSCALE_ACCESS_TOKEN)")
-	serviceToken := flag.String("service-token", os.Getenv("PLANETSCALE_SERVICE_TOKEN"), "The PlanetScale API service token (PLANETSCALE_SERVICE_TOKEN)")
-	serviceTokenName := flag.String("service-token-name", os.Getenv("PLANETSCALE_SERVICE_TOKEN_NAME"), "The PlanetScale API service token name (PLANETSCALE_SERVICE_TOKEN_NAME)")
+	socket := flag.String("socket", "", "Local unix socket path to listen for connections, instead of --host and --port")
+	listenerRestarts := flag.Int("listener-restarts", 10, "Number of attempts to re-create the local listener if it fails, before exiting. 0 exits right away")
+	socketMode := flag.String("socket-mode", "0600", "File mode of --socket, in octal")
+	socketGroup := flag.String("socket-group", "", "Group, by name or GID, owning --socket. Use with --socket-mode 0660 to let its members connect")
+	allowedPeerUIDs := flag.String("allowed-peer-uids", "", "Comma separated list of UIDs of local processes allowed to connect to --socket (Linux only)")
+	allowedPeerGIDs := flag.String("allowed-peer-gids", "", "Comma separated list of GIDs of local processes allowed to connect to --socket (Linux only)")
+	allowedNetworks := flag.String("allowed-networks", "", "Comma separated list of CIDR networks allowed to connect to --host. By default only loopback addresses may connect if --host isn't a loopback address")
+	allowAllNetworks := flag.Bool("allow-all-networks", false, "Allow connections to --host from any address, even if it isn't a loopback address")
+	xPort := flag.String("x-port", "", "Local port to bind and listen for MySQL X Protocol connections, on --host. Requires --x-remote-addr")
+	xRemoteAddr := flag.String("x-remote-addr", "", "host:port of the MySQL X Protocol port of the instance, i.e: \"host:33060\", the X Protocol connections of --x-port are proxied to")
+
+	remoteAddrs := flag.String("remote-addrs", "", "Comma separated list of alternative host:port remote endpoints, instead of --remote-host. New connections go to the healthy endpoint with the lowest latency, and fail over to the others in order")
+	remoteProbe := flag.String("remote-probe", "tcp", "How --remote-addrs are probed: \"tcp\" measures the connect time, \"tls\" the TLS handshake as well")
+	remoteProbeInterval := flag.Duration("remote-probe-interval", 10*time.Second, "Interval to probe --remote-addrs")
+	resolveInterval := flag.Duration("resolve-interval", 0, "Interval to re-resolve the remote host names, trying all their addresses in turn. 0 leaves resolving to every dial")
+	remoteNetwork := flag.String("remote-network", "tcp", "Network of the remote connections: \"tcp4\" or \"tcp6\" to use a single IP family, \"tcp\" to race both if the remote host resolves to both")
+
+	setupTimeout := flag.Duration("setup-timeout", 0, "Maximum time to establish the tunnel for a new connection, including cert retrieval, dial and TLS handshake. 0 means no timeout")
+	setupRetries := flag.Int("setup-retries", 0, "Number of times to retry a transient failure while establishing the tunnel for a new connection")
+	certRetries := flag.Int("cert-retries", 0, "Number of times to retry right away a transient failure of the cert source, before the setup of the tunnel fails. Defaults to 2, a negative value disables the retries")
+	certRetryBackoff := flag.Duration("cert-retry-backoff", 0, "Time to wait before the first retry of the cert source, doubling with each retry. Defaults to 100ms")
+	clockSkewTolerance := flag.Duration("clock-skew-tolerance", 0, "How long to wait for a client certificate issued in the future by the cert source to become valid, when the clock of the host is behind. Defaults to 5 seconds, a negative value disables the wait")
+	certExpiryWarning := flag.Duration("cert-expiry-warning", 0, "How long before they expire the client and CA certificates are warned about. Defaults to 72 hours, a negative value disables the warnings")
+	dialTimeout := flag.Duration("dial-timeout", 10*time.Second, "Maximum time to connect to the remote address. 0 means no timeout")
+	handshakeTimeout := flag.Duration("handshake-timeout", 10*time.Second, "Maximum time for the TLS handshake with the remote server. 0 means no timeout")
+	keepAlivePeriod := flag.Duration("keep-alive-period", 0, "Period of the TCP keep alive probes of the local and remote connections. 0 keeps the defaults")
+	disableKeepAlive := flag.Bool("disable-keep-alive", false, "Disable the TCP keep alives of the local and remote connections")
+	noDelay := flag.Bool("no-delay", false, "Disable Nagle's algorithm on the local and remote connections, for lower latency at the cost of more packets")
+	tcpUserTimeout := flag.Duration("tcp-user-timeout", 0, "Maximum time sent data may remain unacknowledged before a connection is closed (Linux only). 0 uses the OS default")
+
+	recentEvents := flag.Int("recent-events", 1000, "Number of recent events served by the /events admin endpoint. 0 disables keeping them")
+	eventsFile := flag.String("events-file", "", "File to append connection events to as newline delimited JSON. Use \"-\" for stdout")
+
+	labels := flag.String("labels", "", "Comma separated list of key:value labels attached to the events, logs and metrics of the proxy")
+	statsdAddr := flag.String("statsd-addr", "", "UDP address of a StatsD server to push metrics to, i.e: 127.0.0.1:8125. Disabled if empty")
+	statsdInterval := flag.Duration("statsd-interval", 10*time.Second, "Interval to push metrics to --statsd-addr")
+	statsdTags := flag.String("statsd-tags", "", "Comma separated list of key:value tags attached to the metrics pushed to --statsd-addr")
+
+	logFile := flag.String("log-file", "", "File to write the logs to instead of stderr. It's reopened on SIGHUP")
+	logFileMaxSize := flag.Int64("log-file-max-size", 100, "Size in megabytes after which --log-file is rotated. 0 disables rotation")
+	logFileMaxBackups := flag.Int("log-file-max-backups", 3, "Number of rotated log files to keep")
+	logFileCompress := flag.Bool("log-file-compress", false, "Compress rotated log files with gzip")
+
+	captureDir := flag.String("capture-dir", "", "Directory to capture the unencrypted traffic of every connection to, for debugging. Captures contain all queries and results, requires --i-understand-this-logs-data")
+	captureMaxSize := flag.Int64("capture-max-size", 100, "Total size in megabytes of the captures after which capturing stops")
+	captureConfirm := flag.Bool("i-understand-this-logs-data", false, "Confirm that --capture-dir writes all queries and results to disk, unredacted")
+	keyLogFile := flag.String("key-log-file", "", "File to append the secrets of the TLS connections to the remote servers to, like SSLKEYLOGFILE, to decrypt captures of the tunnels with Wireshark. Requires --insecure-key-log")
+	keyLogConfirm := flag.Bool("insecure-key-log", false, "Confirm that --key-log-file lets anyone reading it decrypt the traffic of the tunnels")
+	maxPacketSize := flag.Int64("max-packet-size", 0, "Maximum size in bytes of a MySQL packet sent by a local client, continuations included. Clients sending bigger packets are disconnected. 0 forwards the traffic as is")
+	parseServerGreetings := flag.Bool("parse-server-greetings", false, "Read the greeting of the MySQL server of every tunnel, to report its version and the id of the connection on it in the logs, the events and the stats")
+	maxBytesPerConn := flag.Int64("max-bytes-per-connection", 0, "Maximum bytes a single connection may transfer in both directions together before it's closed. 0 means unlimited")
+	maxConnLifetime := flag.Duration("max-connection-lifetime", 0, "Maximum time a connection stays open, it's closed at its next quiet moment after that. 0 means unlimited")
+	stallTimeout := flag.Duration("stall-timeout", 0, "Maximum time to wait for the remote server to answer the data sent by a client before the connection is closed as stalled. Must be longer than the slowest query. 0 means no limit")
+	halfCloseTimeout := flag.Duration("half-close-timeout", 30*time.Second, "Maximum time a connection keeps relaying one direction once the other one was closed. A negative value closes both directions right away")
+	copyBufferSize := flag.Int("copy-buffer-size", 32*1024, "Size in bytes of the buffer each direction of a connection is copied through, between 512 and 16777216")
+	printPins := flag.String("print-pins", "", "Print the SHA-256 pins of the certificates in the PEM file at the given path, for --pinned-fingerprints, and exit")
+	decodeCapture := flag.String("decode-capture", "", "Print the capture file at the given path and exit")
 
 	showVersion := flag.Bool("version", false, "Show version of the proxy")
 
-	clientCertPath := flag.String("cert", "", "MySQL Client Cert path")
-	clientKeyPath := flag.String("key", "", "MySQL Client Key path")
-
-	flag.Parse()
+	serverName := flag.String("server-name", "", "Name to verify the certificate of the remote server against, instead of the remote host, i.e: the common name of the certificates MySQL generates")
+	pinnedFingerprints := flag.String("pinned-fingerprints", "", "Comma separated list of SHA-256 hashes, hex or base64 encoded, of the certificates or public keys the remote servers must present. See --print-pins")
+	crlFile := flag.String("crl-file", "", "File holding the PEM or DER encoded CRLs the certificates of the remote servers and their intermediates are checked against. It's read again when it changes")
+	crlReloadInterval := flag.Duration("crl-reload-interval", 0, "How often --crl-file is checked for changes. Defaults to 10 minutes")
+	allowExpiredCRL := flag.Bool("allow-expired-crl", false, "Keep checking the certificates against the CRLs past their next update instead of rejecting them")
+	ocspStapling := flag.String("ocsp-stapling", "", "Verify the OCSP responses stapled by the remote servers, and tell what to do when a server staples none: \"allow\", \"warn\" or \"fail\". By default they aren't verified")
+	minTLSVersion := flag.String("min-tls-version", "1.2", "Minimum TLS version of the remote connections: \"1.2\" or \"1.3\"")
+	maxTLSVersion := flag.String("max-tls-version", "", "Maximum TLS version of the remote connections: \"1.2\" or \"1.3\". Empty means the latest")
+	cipherSuites := flag.String("cipher-suites", "", "Comma separated list of the cipher suites of the remote connections using TLS 1.2, i.e: TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384. Empty keeps the defaults")
+	securityPolicy := flag.String("security-policy", "", "Preset of the TLS versions, cipher suites and curves of the remote connections: \"default\", \"modern\" for TLS 1.3 only, or \"fips\" for the FIPS approved algorithms only. Can't be set along with --min-tls-version, --max-tls-version or --cipher-suites")
+	tlsSessionCacheSize := flag.Int("tls-session-cache-size", 64, "Number of TLS sessions kept per instance to resume them instead of doing full handshakes. A negative value disables the resumption")
+	nameVerification := flag.String("name-verification", "either", "How the name of the remote server is matched against its certificate: \"san\" for its SANs, \"cn\" for its common name, \"either\" for its SANs or its common name if it has no SANs")
+	serverSPIFFEID := flag.String("server-spiffe-id", "", "SPIFFE ID the certificate of the remote server must hold as its URI SAN, i.e: spiffe://example.org/db/main, verified instead of its name")
+
+	adminAddr := flag.String("admin-addr", "", "Address to serve the admin endpoints (/healthz, /readyz, /stats, /events) on. Disabled if empty")
+	quitQuitQuit := flag.Bool("quitquitquit", false, "Enable the POST /quitquitquit admin endpoint, which triggers a graceful shutdown")
+	adminInvalidateCerts := flag.Bool("admin-invalidate-certs", false, "Enable the POST /invalidate-certs admin endpoint, which drops the cached certificates of the instance parameter, or of all instances, so the new connections retrieve new ones")
+	minSigtermDelay := flag.Duration("min-sigterm-delay", 0, "Time to keep accepting new connections after receiving SIGTERM, before shutting down")
+
+	source := registerCertSourceFlags(flag.CommandLine)
+
+	flag.CommandLine.Parse(args) // nolint: errcheck
 
 	if *showVersion {
 		printVersion(version, commit, date)
 		return nil
 	}
 
-	if *token != "" && *serviceToken != "" && *serviceTokenName != "" {
-		return errors.New("--token and --service-token/--service-token-name cannot be set at the same time")
+	if *printPins != "" {
+		data, err := os.ReadFile(*printPins)
+		if err != nil {
+			return err
+		}
+		pins, err := proxy.PinsFromPEM(data)
+		if err != nil {
+			return fmt.Errorf("couldn't read the certificates of %s: %w", *printPins, err)
+		}
+		for _, pin := range pins {
+			fmt.Printf("%s\n  certificate: %s\n  spki:        %s\n", pin.Subject, pin.Certificate, pin.SPKI)
+		}
+		return nil
+	}
+
+	if *decodeCapture != "" {
+		f, err := os.Open(*decodeCapture)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return proxy.PrintCapture(os.Stdout, f)
 	}
 
-	var certSource proxy.CertSource
-	var err error
-	var instance string
+	if *captureDir != "" && !*captureConfirm {
+		return errors.New("--capture-dir writes all queries and results to disk, set --i-understand-this-logs-data to enable it")
+	}
 
-	if *token != "" || (*serviceToken != "" && *serviceTokenName != "") {
-		if *orgName == "" || *dbName == "" || *branchName == "" {
-			return errors.New("--org, --database or --branch is not set with a token")
-		}
-		instance = fmt.Sprintf("%s/%s/%s", *orgName, *dbName, *branchName)
+	if *keyLogFile != "" && !*keyLogConfirm {
+		return errors.New("--key-log-file lets anyone reading it decrypt the traffic of the tunnels, set --insecure-key-log to enable it")
+	}
+
+	certSource, instance, err := source.certSource()
+	if err != nil {
+		return err
+	}
 
-		certSource, err = newRemoteCertSource(*token, *serviceToken, *serviceTokenName)
+	if *quitQuitQuit && *adminAddr == "" {
+		return errors.New("--quitquitquit requires --admin-addr to be set")
+	}
+	if *adminInvalidateCerts && *adminAddr == "" {
+		return errors.New("--admin-invalidate-certs requires --admin-addr to be set")
+	}
+
+	if certSource == nil && !*source.insecureRemote {
+		return errors.New("no configuration found, need either a token and org / datbase / branch parameters or separate specified certificate source and remote host")
+	}
+
+	if (*xPort == "") != (*xRemoteAddr == "") {
+		return errors.New("--x-port and --x-remote-addr must be set together")
+	}
+	var xLocalAddr string
+	if *xPort != "" {
+		xLocalAddr = net.JoinHostPort(*host, *xPort)
+	}
+
+	localAddr := net.JoinHostPort(*host, *port)
+	var localSocketMode os.FileMode
+	if *socket != "" {
+		localAddr = "unix://" + *socket
+
+		mode, err := strconv.ParseUint(*socketMode, 8, 32)
 		if err != nil {
-			return err
+			return fmt.Errorf("invalid --socket-mode: %s", err)
+		}
+		localSocketMode = os.FileMode(mode)
+	}
+
+	// the client disables restarts with a negative value, zero is the
+	// default
+	restarts := *listenerRestarts
+	if restarts == 0 {
+		restarts = -1
+	}
+
+	keptEvents := *recentEvents
+	if keptEvents == 0 {
+		keptEvents = -1
+	}
+
+	// 0 disables the timeouts, while the client uses its default then
+	dialTimeoutOpt, handshakeTimeoutOpt := *dialTimeout, *handshakeTimeout
+	if dialTimeoutOpt == 0 {
+		dialTimeoutOpt = -1
+	}
+	if handshakeTimeoutOpt == 0 {
+		handshakeTimeoutOpt = -1
+	}
+
+	peerUIDs, err := parseIDs(*allowedPeerUIDs)
+	if err != nil {
+		return fmt.Errorf("invalid --allowed-peer-uids: %s", err)
+	}
+	peerGIDs, err := parseIDs(*allowedPeerGIDs)
+	if err != nil {
+		return fmt.Errorf("invalid --allowed-peer-gids: %s", err)
+	}
+	networks, err := parseNetworks(*allowedNetworks)
+	if err != nil {
+		return fmt.Errorf("invalid --allowed-networks: %s", err)
+	}
+	minTLS, err := parseTLSVersion(*minTLSVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --min-tls-version: %s", err)
+	}
+	maxTLS, err := parseTLSVersion(*maxTLSVersion)
+	if err != nil {
+		return fmt.Errorf("invalid --max-tls-version: %s", err)
+	}
+	suites, err := parseCipherSuites(*cipherSuites)
+	if err != nil {
+		return fmt.Errorf("invalid --cipher-suites: %s", err)
+	}
+	if *securityPolicy != "" {
+		// the policy replaces the TLS flags, their defaults don't count
+		var conflicting []string
+		flag.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "min-tls-version", "max-tls-version", "cipher-suites":
+				conflicting = append(conflicting, "--"+f.Name)
+			}
+		})
+		if len(conflicting) > 0 {
+			return fmt.Errorf("--security-policy can't be set along with %s", strings.Join(conflicting, ", "))
+		}
+		minTLS = 0
+	}
+
+	remoteAddr := source.remoteAddr()
+
+	var endpoints []string
+	for _, addr := range strings.Split(*remoteAddrs, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			endpoints = append(endpoints, addr)
 		}
 	}
+	var pins []string
+	for _, pin := range strings.Split(*pinnedFingerprints, ",") {
+		if pin = strings.TrimSpace(pin); pin != "" {
+			pins = append(pins, pin)
+		}
+	}
+
+	tags, err := parseTags(*statsdTags)
+	if err != nil {
+		return fmt.Errorf("invalid --statsd-tags: %s", err)
+	}
+	clientLabels, err := parseTags(*labels)
+	if err != nil {
+		return fmt.Errorf("invalid --labels: %s", err)
+	}
 
-	if *remoteHost != "" && *clientCertPath != "" && *clientKeyPath != "" {
-		localCertSource, err := newLocalCertSource(*clientCertPath, *clientKeyPath, *remoteHost, *remotePort)
+	var logger *zap.Logger
+	var logOutput io.Writer = os.Stderr
+	if *logFile != "" {
+		w, err := logfile.Open(logfile.Options{
+			Path:       *logFile,
+			MaxSize:    *logFileMaxSize * 1024 * 1024,
+			MaxBackups: *logFileMaxBackups,
+			Compress:   *logFileCompress,
+		})
 		if err != nil {
 			return err
 		}
-		certSource = localCertSource
-		cert, err := x509.ParseCertificate(localCertSource.cert.Certificate[0])
+		defer w.Close()
+
+		logger = newFileLogger(w)
+		logOutput = w
+		defer logger.Sync() // nolint: errcheck
+
+		// reopen the log file on SIGHUP, for users with an external
+		// logrotate
+		hupCh := make(chan os.Signal, 1)
+		signal.Notify(hupCh, syscall.SIGHUP)
+		defer signal.Stop(hupCh)
+		go func() {
+			for range hupCh {
+				if err := w.Reopen(); err != nil {
+					fmt.Fprintf(os.Stderr, "couldn't reopen log file: %s\n", err)
+				}
+			}
+		}()
+	}
+
+	var keyLog io.Writer
+	if *keyLogFile != "" {
+		f, err := os.OpenFile(*keyLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
 		if err != nil {
-			return err
+			return fmt.Errorf("couldn't open key log file: %s", err)
 		}
-		instance = cert.Subject.String()
+		defer f.Close()
+		keyLog = f
 	}
 
-	if certSource == nil {
-		return errors.New("no configuration found, need either a token and org / datbase / branch parameters or separate specified certificate source and remote host")
+	listener, err := systemdListener()
+	if err != nil {
+		return err
+	}
+	if listener != nil {
+		localAddr = ""
 	}
 
 	p, err := proxy.NewClient(proxy.Options{
-		CertSource: certSource,
-		LocalAddr:  net.JoinHostPort(*host, *port),
-		RemoteAddr: net.JoinHostPort(*remoteHost, strconv.Itoa(*remotePort)),
-		Instance:   instance,
+		CertSource:  certSource,
+		LocalAddr:   localAddr,
+		XLocalAddr:  xLocalAddr,
+		XRemoteAddr: *xRemoteAddr,
+		Listener:    listener,
+		RemoteAddr:  remoteAddr,
+		RemoteAddrs: endpoints,
+		RemoteProbe: proxy.ProbeOptions{
+			Mode:     proxy.ProbeMode(*remoteProbe),
+			Interval: *remoteProbeInterval,
+		},
+		Instance:            instance,
+		ServerName:          *serverName,
+		NameVerification:    proxy.NameVerification(*nameVerification),
+		ServerSPIFFEID:      *serverSPIFFEID,
+		PinnedFingerprints:  pins,
+		CRLFile:             *crlFile,
+		CRLReloadInterval:   *crlReloadInterval,
+		AllowExpiredCRL:     *allowExpiredCRL,
+		OCSPStapling:        proxy.OCSPStaplePolicy(*ocspStapling),
+		MinTLSVersion:       minTLS,
+		MaxTLSVersion:       maxTLS,
+		CipherSuites:        suites,
+		SecurityPolicy:      proxy.SecurityPolicy(*securityPolicy),
+		TLSSessionCacheSize: *tlsSessionCacheSize,
+		KeyLogWriter:        keyLog,
+		SetupTimeout:        *setupTimeout,
+		SetupRetries:        *setupRetries,
+		CertRetries:         *certRetries,
+		CertRetryBackoff:    *certRetryBackoff,
+		ClockSkewTolerance:  *clockSkewTolerance,
+		CertExpiryWarning:   *certExpiryWarning,
+
+		DialTimeout:      dialTimeoutOpt,
+		HandshakeTimeout: handshakeTimeoutOpt,
+
+		KeepAlivePeriod:  *keepAlivePeriod,
+		DisableKeepAlive: *disableKeepAlive,
+		TCPUserTimeout:   *tcpUserTimeout,
+		NoDelay:          *noDelay,
+
+		ResolveInterval: *resolveInterval,
+		RemoteNetwork:   *remoteNetwork,
+
+		InsecureRemotePlaintext: *source.insecureRemote,
+		AllowedPeerUIDs:         peerUIDs,
+		AllowedPeerGIDs:         peerGIDs,
+		AllowedNetworks:         networks,
+		AllowAllNetworks:        *allowAllNetworks,
+		ListenerRestarts:        restarts,
+		LocalSocketMode:         localSocketMode,
+		LocalSocketGroup:        *socketGroup,
+		StatsD: proxy.StatsDOptions{
+			Addr:     *statsdAddr,
+			Interval: *statsdInterval,
+			Tags:     tags,
+		},
+		Labels:       clientLabels,
+		RecentEvents: keptEvents,
+		Logger:       logger,
+
+		CaptureDir:            *captureDir,
+		CaptureMaxBytes:       *captureMaxSize * 1024 * 1024,
+		MaxPacketSize:         *maxPacketSize,
+		ParseServerGreetings:  *parseServerGreetings,
+		MaxBytesPerConnection: *maxBytesPerConn,
+		MaxConnectionLifetime: *maxConnLifetime,
+		StallTimeout:          *stallTimeout,
+		HalfCloseTimeout:      *halfCloseTimeout,
+		CopyBufferSize:        *copyBufferSize,
 	})
 	if err != nil {
 		return fmt.Errorf("couldn't create proxy client: %s", err)
 	}
 
-	ctx, cancel := signal.NotifyContext(context.Background(), os.Interrupt, os.Kill)
+	// dump the state to the log on SIGUSR1, for debugging when the admin
+	// API can't be reached
+	dumpCh := make(chan os.Signal, 1)
+	notifyDumpState(dumpCh)
+	defer signal.Stop(dumpCh)
+	go func() {
+		for range dumpCh {
+			// written at once, so it's not interleaved with the logs
+			var buf bytes.Buffer
+			if err := p.DumpState(&buf); err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't dump state: %s\n", err)
+				continue
+			}
+			if _, err := logOutput.Write(buf.Bytes()); err != nil {
+				fmt.Fprintf(os.Stderr, "couldn't dump state: %s\n", err)
+			}
+		}
+	}()
+
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sigCh)
+
+	ctx, cancel := shutdownContext(context.Background(), sigCh, *minSigtermDelay)
 	defer cancel()
 
+	if *eventsFile != "" {
+		w := os.Stdout
+		if *eventsFile != "-" {
+			f, err := os.OpenFile(*eventsFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+			if err != nil {
+				return fmt.Errorf("couldn't open events file: %s", err)
+			}
+			defer f.Close()
+			w = f
+		}
+
+		go func() {
+			if err := proxy.WriteEvents(ctx, w, p.Events()); err != nil && err != context.Canceled {
+				fmt.Fprintf(os.Stderr, "couldn't write events: %s\n", err)
+			}
+		}()
+	}
+
+	if *adminAddr != "" {
+		srv := &http.Server{
+			Addr: *adminAddr,
+			Handler: p.AdminHandler(proxy.AdminOptions{
+				QuitQuitQuit:    *quitQuitQuit,
+				InvalidateCerts: *adminInvalidateCerts,
+			}),
+		}
+		go func() {
+			if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				fmt.Fprintf(os.Stderr, "admin server error: %s\n", err)
+				p.Stop()
+			}
+		}()
+		defer srv.Close()
+	}
+
 	return p.Run(ctx)
 }
 
+// certSourceFlags are the flags selecting the cert source and the instance,
+// shared by the proxy and check-cert.
+type certSourceFlags struct {
+	remoteHost *string
+	remotePort *int
+
+	orgName    *string
+	dbName     *string
+	branchName *string
+
+	token            *string
+	serviceToken     *string
+	serviceTokenName *string
+
+	clientCertPath *string
+	clientKeyPath  *string
+	caPath         *string
+
+	insecureRemote        *bool
+	insecureRemoteConfirm *string
+	noClientCert          *bool
+	dev                   *bool
+	devDir                *string
+}
+
+// registerCertSourceFlags defines the cert source flags on fs.
+func registerCertSourceFlags(fs *flag.FlagSet) *certSourceFlags {
+	return &certSourceFlags{
+		remoteHost: fs.String("remote-host", "", "MySQL remote host"),
+		remotePort: fs.Int("remote-port", 3307, "MySQL remote port"),
+
+		orgName: fs.String("org", os.Getenv("PLANETSCALE_ORG"),
+			"The PlanetScale Organization"),
+		dbName: fs.String("database", os.Getenv("PLANETSCALE_DATABASE"),
+			"The PlanetScale Database"),
+		branchName: fs.String("branch", os.Getenv("PLANETSCALE_BRANCH"),
+			"The PlanetScale Branch"),
+
+		token:            fs.String("token", os.Getenv("PLANETSCALE_ACCESS_TOKEN"), "The PlanetScale API access token (PLANETSCALE_ACCESS_TOKEN)"),
+		serviceToken:     fs.String("service-token", os.Getenv("PLANETSCALE_SERVICE_TOKEN"), "The PlanetScale API service token (PLANETSCALE_SERVICE_TOKEN)"),
+		serviceTokenName: fs.String("service-token-name", os.Getenv("PLANETSCALE_SERVICE_TOKEN_NAME"), "The PlanetScale API service token name (PLANETSCALE_SERVICE_TOKEN_NAME)"),
+
+		clientCertPath: fs.String("cert", "", "MySQL Client Cert path"),
+		clientKeyPath:  fs.String("key", "", "MySQL Client Key path"),
+		caPath:         fs.String("ca", "", "Path to a PEM bundle of CA certificates to verify the remote server with, for --cert/--key and --no-client-cert. Defaults to the system roots"),
+
+		insecureRemote:        fs.Bool("insecure-remote", false, "Connect to --remote-host in plaintext, without TLS. Only for local development, requires --insecure-remote-confirm"),
+		insecureRemoteConfirm: fs.String("insecure-remote-confirm", "", fmt.Sprintf("Must be set to %q to enable --insecure-remote", insecureRemoteConfirmation)),
+		noClientCert:          fs.Bool("no-client-cert", false, "Connect to --remote-host without presenting a client certificate, for servers that only authenticate with MySQL credentials"),
+		dev:                   fs.Bool("dev", false, "INSECURE, for local development only: generate an ephemeral CA with client and server certificates, and connect to --remote-host, localhost by default, with them. The certificates of the remote server are written to --dev-dir"),
+		devDir:                fs.String("dev-dir", "", "Directory to write the CA, server and client certificates and keys of --dev to. By default a new temporary directory"),
+	}
+}
+
+// certSource returns the cert source and the instance selected by the flags.
+// The cert source is nil if none is configured.
+func (f *certSourceFlags) certSource() (proxy.CertSource, string, error) {
+	if *f.token != "" && *f.serviceToken != "" && *f.serviceTokenName != "" {
+		return nil, "", errors.New("--token and --service-token/--service-token-name cannot be set at the same time")
+	}
+
+	var certSource proxy.CertSource
+	var err error
+	var instance string
+
+	if *f.token != "" || (*f.serviceToken != "" && *f.serviceTokenName != "") {
+		if *f.orgName == "" || *f.dbName == "" || *f.branchName == "" {
+			return nil, "", errors.New("--org, --database or --branch is not set with a token")
+		}
+		instance = fmt.Sprintf("%s/%s/%s", *f.orgName, *f.dbName, *f.branchName)
+
+		certSource, err = newRemoteCertSource(*f.token, *f.serviceToken, *f.serviceTokenName)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	if *f.remoteHost != "" && *f.clientCertPath != "" && *f.clientKeyPath != "" {
+		localCertSource, err := newLocalCertSource(*f.clientCertPath, *f.clientKeyPath, *f.remoteHost, *f.remotePort)
+		if err != nil {
+			return nil, "", err
+		}
+		certSource = localCertSource
+		cert, err := x509.ParseCertificate(localCertSource.cert.Certificate[0])
+		if err != nil {
+			return nil, "", err
+		}
+		// the certificate is usually issued for the instance, use the
+		// remote address if its common name isn't an instance name
+		instance = cert.Subject.CommonName
+		if *f.orgName != "" && *f.dbName != "" && *f.branchName != "" {
+			instance = fmt.Sprintf("%s/%s/%s", *f.orgName, *f.dbName, *f.branchName)
+		} else if _, _, _, err := proxy.ParseInstance(instance); err != nil {
+			instance = fmt.Sprintf("local/%s/%d", *f.remoteHost, *f.remotePort)
+		}
+	}
+
+	if *f.noClientCert {
+		if *f.clientCertPath != "" || *f.clientKeyPath != "" {
+			return nil, "", errors.New("--no-client-cert cannot be set together with --cert or --key")
+		}
+		if *f.remoteHost == "" {
+			return nil, "", errors.New("--no-client-cert requires --remote-host to be set")
+		}
+
+		certSource = &localCertSource{
+			remoteAddr:     *f.remoteHost,
+			remotePort:     *f.remotePort,
+			serverAuthOnly: true,
+		}
+		instance = fmt.Sprintf("%s/%s/%s", *f.orgName, *f.dbName, *f.branchName)
+		if *f.orgName == "" || *f.dbName == "" || *f.branchName == "" {
+			instance = fmt.Sprintf("local/%s/%d", *f.remoteHost, *f.remotePort)
+		}
+	}
+
+	if *f.dev {
+		if certSource != nil || *f.noClientCert {
+			return nil, "", errors.New("--dev cannot be used together with a cert source")
+		}
+		if *f.remoteHost == "" {
+			*f.remoteHost = "localhost"
+		}
+
+		devSource, dir, err := newDevCertSource(*f.devDir)
+		if err != nil {
+			return nil, "", err
+		}
+		fmt.Fprintf(os.Stderr, "WARNING: --dev is INSECURE, only use it for local development.\n"+
+			"The remote server must present %s and %s of %s, and verify the client certificates with its CA:\n\n%s\n",
+			proxy.DevServerCertFile, proxy.DevServerKeyFile, dir, devSource.CAPEM())
+
+		certSource = devSource
+		instance = fmt.Sprintf("%s/%s/%s", *f.orgName, *f.dbName, *f.branchName)
+		if *f.orgName == "" || *f.dbName == "" || *f.branchName == "" {
+			instance = fmt.Sprintf("local/%s/%d", *f.remoteHost, *f.remotePort)
+		}
+	} else if *f.devDir != "" {
+		return nil, "", errors.New("--dev-dir is set, but --dev is not")
+	}
+
+	if *f.caPath != "" {
+		local, ok := certSource.(*localCertSource)
+		if !ok {
+			return nil, "", errors.New("--ca requires --cert and --key, or --no-client-cert to be set")
+		}
+
+		caCerts, err := loadCABundle(*f.caPath)
+		if err != nil {
+			return nil, "", err
+		}
+		local.caCerts = caCerts
+	}
+
+	if *f.insecureRemote {
+		if *f.insecureRemoteConfirm != insecureRemoteConfirmation {
+			return nil, "", fmt.Errorf("--insecure-remote sends all traffic unencrypted, set --insecure-remote-confirm=%s to enable it", insecureRemoteConfirmation)
+		}
+		if *f.remoteHost == "" {
+			return nil, "", errors.New("--insecure-remote requires --remote-host to be set")
+		}
+		if certSource != nil || *f.noClientCert {
+			return nil, "", errors.New("--insecure-remote cannot be used together with a cert source")
+		}
+
+		instance = fmt.Sprintf("local/%s/%d", *f.remoteHost, *f.remotePort)
+	} else if *f.insecureRemoteConfirm != "" {
+		return nil, "", errors.New("--insecure-remote-confirm is set, but --insecure-remote is not")
+	}
+
+	return certSource, instance, nil
+}
+
+// remoteAddr returns the remote address set by the flags. It's empty unless
+// --remote-host is set, so the remote address of the cert source is only
+// overwritten if it's set explicitly.
+func (f *certSourceFlags) remoteAddr() string {
+	if *f.remoteHost == "" {
+		return ""
+	}
+	return net.JoinHostPort(strings.Trim(*f.remoteHost, "[]"), strconv.Itoa(*f.remotePort))
+}
+
+// shutdownContext returns a context that is cancelled once a signal is
+// received on sigCh. On SIGTERM the cancellation is delayed by
+// minSigtermDelay, so the proxy keeps serving new connections while the
+// orchestrator (i.e: Kubernetes) stops routing traffic to it. Any other
+// signal, or a second SIGTERM, cancels the context immediately.
+func shutdownContext(parent context.Context, sigCh <-chan os.Signal, minSigtermDelay time.Duration) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	go func() {
+		var delay <-chan time.Time
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-delay:
+				cancel()
+				return
+			case sig := <-sigCh:
+				if sig != syscall.SIGTERM || minSigtermDelay <= 0 || delay != nil {
+					cancel()
+					return
+				}
+				fmt.Fprintf(os.Stderr, "received SIGTERM, shutting down in %s\n", minSigtermDelay)
+				delay = time.After(minSigtermDelay)
+			}
+		}
+	}()
+
+	return ctx, cancel
+}
+
 type remoteCertSource struct {
 	client *ps.Client
 }
 
+// systemdListenFDsStart is the first file descriptor passed by systemd
+// socket activation.
+const systemdListenFDsStart = 3
+
+// systemdListener returns the socket passed by systemd socket activation, or
+// nil if the proxy wasn't started that way.
+func systemdListener() (net.Listener, error) {
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+
+	n, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || n < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q from systemd", os.Getenv("LISTEN_FDS"))
+	}
+	if n > 1 {
+		return nil, fmt.Errorf("systemd passed %d sockets, only one is supported", n)
+	}
+
+	f := os.NewFile(systemdListenFDsStart, "systemd-socket")
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't use the socket passed by systemd: %s", err)
+	}
+	return l, nil
+}
+
 func newRemoteCertSource(token, serviceToken, serviceTokenName string) (*remoteCertSource, error) {
 	var opts []ps.ClientOption
 	if token != "" {
@@ -161,6 +772,17 @@ func (r *remoteCertSource) Cert(ctx context.Context, org, db, branch string) (*p
 
 	cert, err := r.client.Certificates.Create(ctx, request)
 	if err != nil {
+		var psErr *ps.Error
+		if errors.As(err, &psErr) {
+			switch psErr.Code {
+			case ps.ErrPermission:
+				return nil, &proxy.CertSourceError{Kind: proxy.CertErrorUnauthorized, Err: err}
+			case ps.ErrNotFound:
+				return nil, &proxy.CertSourceError{Kind: proxy.CertErrorNotFound, Err: err}
+			case ps.ErrRetry:
+				return nil, &proxy.CertSourceError{Kind: proxy.CertErrorUnavailable, Err: err}
+			}
+		}
 		return nil, err
 	}
 
@@ -184,6 +806,9 @@ func newLocalCertSource(certPath, keyPath, remoteAddr string, remotePort int) (*
 	if err != nil {
 		return nil, err
 	}
+	if cert.Leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+		return nil, err
+	}
 
 	return &localCertSource{
 		cert:       cert,
@@ -194,21 +819,186 @@ func newLocalCertSource(certPath, keyPath, remoteAddr string, remotePort int) (*
 }
 
 type localCertSource struct {
-	cert       tls.Certificate
-	remoteAddr string
-	remotePort int
+	cert           tls.Certificate
+	caCerts        []*x509.Certificate
+	remoteAddr     string
+	remotePort     int
+	serverAuthOnly bool
 }
 
 func (c *localCertSource) Cert(ctx context.Context, org, db, branch string) (*proxy.Cert, error) {
+	var expiry time.Time
+	if c.cert.Leaf != nil {
+		expiry = c.cert.Leaf.NotAfter
+	}
 	return &proxy.Cert{
-		ClientCert: c.cert,
-		AccessHost: c.remoteAddr,
+		ClientCert:     c.cert,
+		ServerAuthOnly: c.serverAuthOnly,
+		CACerts:        c.caCerts,
+		AccessHost:     c.remoteAddr,
 		Ports: proxy.RemotePorts{
 			Proxy: c.remotePort,
 		},
+		Expiry: expiry,
 	}, nil
 }
 
+// newDevCertSource returns a new DevCertSource, with its files written to
+// the given directory, or a new temporary one if it's empty, which is
+// returned.
+func newDevCertSource(dir string) (*proxy.DevCertSource, string, error) {
+	s, err := proxy.NewDevCertSource()
+	if err != nil {
+		return nil, "", err
+	}
+	if dir == "" {
+		if dir, err = os.MkdirTemp("", "sql-proxy-dev-"); err != nil {
+			return nil, "", fmt.Errorf("couldn't create the directory of the dev certificates: %s", err)
+		}
+	}
+	if err := s.WriteFiles(dir); err != nil {
+		return nil, "", fmt.Errorf("couldn't write the dev certificates: %s", err)
+	}
+	return s, dir, nil
+}
+
+// loadCABundle loads all certificates of the PEM bundle at the given path.
+func loadCABundle(path string) ([]*x509.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read CA bundle: %s", err)
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse certificate in CA bundle %s: %s", path, err)
+		}
+		certs = append(certs, cert)
+	}
+
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("CA bundle %s doesn't contain any certificates", path)
+	}
+	return certs, nil
+}
+
+// parseIDs parses a comma separated list of numeric user or group IDs.
+func parseIDs(s string) ([]uint32, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var ids []uint32
+	for _, field := range strings.Split(s, ",") {
+		id, err := strconv.ParseUint(strings.TrimSpace(field), 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, uint32(id))
+	}
+	return ids, nil
+}
+
+// parseNetworks parses a comma separated list of CIDR networks.
+func parseNetworks(s string) ([]net.IPNet, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var networks []net.IPNet
+	for _, field := range strings.Split(s, ",") {
+		_, n, err := net.ParseCIDR(strings.TrimSpace(field))
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, *n)
+	}
+	return networks, nil
+}
+
+// parseTLSVersion parses a TLS version, "1.2" or "1.3". An empty version is
+// zero.
+func parseTLSVersion(s string) (uint16, error) {
+	switch strings.TrimSpace(s) {
+	case "":
+		return 0, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unsupported TLS version %q, must be \"1.2\" or \"1.3\"", s)
+}
+
+// parseCipherSuites parses a comma separated list of cipher suite names.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	ids := make(map[string]uint16)
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		ids[suite.Name] = suite.ID
+	}
+	var suites []uint16
+	for _, field := range strings.Split(s, ",") {
+		id, ok := ids[strings.TrimSpace(field)]
+		if !ok {
+			return nil, fmt.Errorf("unknown cipher suite %q", field)
+		}
+		suites = append(suites, id)
+	}
+	return suites, nil
+}
+
+// newFileLogger returns a development logger, like the one used by
+// default by the proxy client, which writes to the given log file.
+func newFileLogger(w *logfile.Writer) *zap.Logger {
+	core := zapcore.NewCore(
+		zapcore.NewConsoleEncoder(zap.NewDevelopmentEncoderConfig()),
+		w,
+		zap.DebugLevel,
+	)
+
+	logger := zap.New(core,
+		zap.Development(),
+		zap.AddCaller(),
+		zap.AddStacktrace(zap.WarnLevel),
+		zap.ErrorOutput(w),
+		zap.Fields(zap.String("app", "sql-proxy-client")),
+	)
+	zap.ReplaceGlobals(logger)
+	return logger
+}
+
+// parseTags parses a comma separated list of key:value tags or labels.
+func parseTags(s string) (map[string]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	tags := make(map[string]string)
+	for _, field := range strings.Split(s, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), ":", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("tag %q must be in the form key:value", field)
+		}
+		tags[kv[0]] = kv[1]
+	}
+	return tags, nil
+}
+
 // printVersion formats a version string with the given information.
 func printVersion(ver, commit, buildDate string) {
 	if ver == "" && buildDate == "" && commit == "" {
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/planetscale/sql-proxy/proxy"
+)
+
+func TestShutdownContext_Interrupt(t *testing.T) {
+	c := qt.New(t)
+	sigCh := make(chan os.Signal, 1)
+
+	ctx, cancel := shutdownContext(context.Background(), sigCh, time.Hour)
+	defer cancel()
+
+	sigCh <- os.Interrupt
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context wasn't cancelled after an interrupt")
+	}
+}
+
+func TestShutdownContext_SigtermDelay(t *testing.T) {
+	c := qt.New(t)
+	sigCh := make(chan os.Signal, 1)
+	delay := 200 * time.Millisecond
+
+	ctx, cancel := shutdownContext(context.Background(), sigCh, delay)
+	defer cancel()
+
+	start := time.Now()
+	sigCh <- syscall.SIGTERM
+
+	select {
+	case <-ctx.Done():
+		c.Assert(time.Since(start) >= delay, qt.IsTrue)
+	case <-time.After(5 * time.Second):
+		c.Fatal("context wasn't cancelled after SIGTERM")
+	}
+}
+
+func TestShutdownContext_SecondSigterm(t *testing.T) {
+	c := qt.New(t)
+	sigCh := make(chan os.Signal, 1)
+
+	ctx, cancel := shutdownContext(context.Background(), sigCh, time.Hour)
+	defer cancel()
+
+	sigCh <- syscall.SIGTERM
+	sigCh <- syscall.SIGTERM
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context wasn't cancelled after a second SIGTERM")
+	}
+}
+
+func TestShutdownContext_NoDelay(t *testing.T) {
+	c := qt.New(t)
+	sigCh := make(chan os.Signal, 1)
+
+	ctx, cancel := shutdownContext(context.Background(), sigCh, 0)
+	defer cancel()
+
+	sigCh <- syscall.SIGTERM
+
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		c.Fatal("context wasn't cancelled after SIGTERM")
+	}
+}
+
+// selfSignedPEM returns a PEM encoded self-signed CA certificate with the
+// given common name.
+func selfSignedPEM(c *qt.C, commonName string) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, qt.IsNil)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	c.Assert(err, qt.IsNil)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestLoadCABundle(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+
+	var bundle []byte
+	bundle = append(bundle, selfSignedPEM(c, "Old CA")...)
+	bundle = append(bundle, pem.EncodeToMemory(&pem.Block{Type: "EC PARAMETERS", Bytes: []byte{1}})...)
+	bundle = append(bundle, selfSignedPEM(c, "New CA")...)
+
+	path := filepath.Join(dir, "ca.pem")
+	c.Assert(os.WriteFile(path, bundle, 0600), qt.IsNil)
+
+	certs, err := loadCABundle(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(certs, qt.HasLen, 2)
+	c.Assert(certs[0].Subject.CommonName, qt.Equals, "Old CA")
+	c.Assert(certs[1].Subject.CommonName, qt.Equals, "New CA")
+
+	empty := filepath.Join(dir, "empty.pem")
+	c.Assert(os.WriteFile(empty, []byte("not a bundle"), 0600), qt.IsNil)
+	_, err = loadCABundle(empty)
+	c.Assert(err, qt.ErrorMatches, ".* doesn't contain any certificates")
+}
+
+func TestNewDevCertSource(t *testing.T) {
+	c := qt.New(t)
+
+	dir := filepath.Join(t.TempDir(), "dev")
+	s, gotDir, err := newDevCertSource(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(gotDir, qt.Equals, dir)
+	caPEM, err := os.ReadFile(filepath.Join(dir, proxy.DevCAFile))
+	c.Assert(err, qt.IsNil)
+	c.Assert(caPEM, qt.DeepEquals, s.CAPEM())
+
+	// a temporary directory by default
+	_, gotDir, err = newDevCertSource("")
+	c.Assert(err, qt.IsNil)
+	defer os.RemoveAll(gotDir)
+	_, err = os.Stat(filepath.Join(gotDir, proxy.DevServerKeyFile))
+	c.Assert(err, qt.IsNil)
+}
+
+func TestSystemdListener(t *testing.T) {
+	c := qt.New(t)
+
+	// not started by systemd
+	t.Setenv("LISTEN_PID", "")
+	l, err := systemdListener()
+	c.Assert(err, qt.IsNil)
+	c.Assert(l, qt.IsNil)
+
+	// the sockets are for another process
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	l, err = systemdListener()
+	c.Assert(err, qt.IsNil)
+	c.Assert(l, qt.IsNil)
+
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	_, err = systemdListener()
+	c.Assert(err, qt.ErrorMatches, "systemd passed 2 sockets, only one is supported")
+
+	t.Setenv("LISTEN_FDS", "")
+	_, err = systemdListener()
+	c.Assert(err, qt.ErrorMatches, `invalid LISTEN_FDS "" from systemd`)
+}
+
+func TestParseCipherSuites(t *testing.T) {
+	c := qt.New(t)
+
+	suites, err := parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_RSA_WITH_RC4_128_SHA")
+	c.Assert(err, qt.IsNil)
+	// the insecure suites are parsed, for NewClient to reject them
+	c.Assert(suites, qt.DeepEquals, []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_RC4_128_SHA})
+
+	_, err = parseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,AES")
+	c.Assert(err, qt.ErrorMatches, `unknown cipher suite "AES"`)
+
+	version, err := parseTLSVersion("1.3")
+	c.Assert(err, qt.IsNil)
+	c.Assert(version, qt.Equals, uint16(tls.VersionTLS13))
+	_, err = parseTLSVersion("1.1")
+	c.Assert(err, qt.ErrorMatches, `unsupported TLS version "1.1", must be "1.2" or "1.3"`)
+}
@@ -0,0 +1,198 @@
+// Package logfile provides a log file writer with size-based rotation.
+package logfile
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+)
+
+// Options are the options for opening a log file.
+type Options struct {
+	// Path is the path of the log file. Rotated files are kept next to it,
+	// with a ".1", ".2", ... suffix, where ".1" is the most recent one.
+	Path string
+
+	// MaxSize is the size in bytes after which the file is rotated. 0 means
+	// the file is never rotated.
+	MaxSize int64
+
+	// MaxBackups is the number of rotated files to keep. Older files are
+	// removed. 0 means rotated files are removed right away.
+	MaxBackups int
+
+	// Compress compresses the rotated files with gzip, in which case they
+	// get an additional ".gz" suffix.
+	Compress bool
+}
+
+// Writer writes to a log file and rotates it once it reaches its maximum
+// size. It's safe for concurrent use.
+type Writer struct {
+	opts Options
+
+	mu   sync.Mutex // protects file and size
+	file *os.File
+	size int64
+}
+
+// Open opens the log file for appending, creating it if needed.
+func Open(opts Options) (*Writer, error) {
+	if opts.Path == "" {
+		return nil, errors.New("log file path is empty")
+	}
+	if opts.MaxSize < 0 || opts.MaxBackups < 0 {
+		return nil, errors.New("log file max size and max backups must not be negative")
+	}
+
+	w := &Writer{opts: opts}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Write writes p to the log file, rotating the file first if p would
+// exceed its maximum size. A single write is never split across files.
+func (w *Writer) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.opts.MaxSize > 0 && w.size > 0 && w.size+int64(len(p)) > w.opts.MaxSize {
+		if err := w.rotate(); err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Sync commits the written data to stable storage.
+func (w *Writer) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Sync()
+}
+
+// Reopen closes and reopens the log file. Use it after the file was moved
+// away by an external tool, i.e: logrotate.
+func (w *Writer) Reopen() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	return w.open()
+}
+
+// Close closes the log file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.file.Close()
+}
+
+func (w *Writer) open() error {
+	f, err := os.OpenFile(w.opts.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return fmt.Errorf("couldn't open log file: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("couldn't stat log file: %w", err)
+	}
+
+	w.file = f
+	w.size = info.Size()
+	return nil
+}
+
+// rotate moves the current file to the first backup, shifting the existing
+// backups, and opens a new file. It must be called with mu held.
+func (w *Writer) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+
+	if w.opts.MaxBackups == 0 {
+		if err := os.Remove(w.opts.Path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("couldn't remove log file: %w", err)
+		}
+		return w.open()
+	}
+
+	// backups may or may not be compressed, depending on the options they
+	// were written with.
+	for i := w.opts.MaxBackups; i >= 1; i-- {
+		for _, ext := range []string{"", ".gz"} {
+			name := w.backupName(i) + ext
+			var err error
+			if i == w.opts.MaxBackups {
+				err = os.Remove(name)
+			} else {
+				err = os.Rename(name, w.backupName(i+1)+ext)
+			}
+			if err != nil && !os.IsNotExist(err) {
+				return fmt.Errorf("couldn't rotate log file: %w", err)
+			}
+		}
+	}
+
+	if err := os.Rename(w.opts.Path, w.backupName(1)); err != nil {
+		return fmt.Errorf("couldn't rotate log file: %w", err)
+	}
+
+	if w.opts.Compress {
+		if err := compress(w.backupName(1)); err != nil {
+			return fmt.Errorf("couldn't compress rotated log file: %w", err)
+		}
+	}
+
+	return w.open()
+}
+
+func (w *Writer) backupName(i int) string {
+	return fmt.Sprintf("%s.%d", w.opts.Path, i)
+}
+
+// compress compresses the given file to a file with a ".gz" suffix and
+// removes it.
+func compress(name string) error {
+	src, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(name+".gz", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(dst)
+	if _, err := io.Copy(gz, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// the file must be closed before it can be removed on Windows
+	src.Close()
+	return os.Remove(name)
+}
@@ -0,0 +1,173 @@
+package logfile
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func readFile(c *qt.C, name string) string {
+	b, err := os.ReadFile(name)
+	c.Assert(err, qt.IsNil)
+	return string(b)
+}
+
+func TestWriter_Rotate(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	w, err := Open(Options{Path: path, MaxSize: 10, MaxBackups: 2})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err := w.Write([]byte(line))
+		c.Assert(err, qt.IsNil)
+	}
+
+	c.Assert(readFile(c, path), qt.Equals, "dddddddd\n")
+	c.Assert(readFile(c, path+".1"), qt.Equals, "cccccccc\n")
+	c.Assert(readFile(c, path+".2"), qt.Equals, "bbbbbbbb\n")
+
+	_, err = os.Stat(path + ".3")
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestWriter_RotateExistingFile(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "proxy.log")
+	c.Assert(os.WriteFile(path, []byte("existing\n"), 0600), qt.IsNil)
+
+	w, err := Open(Options{Path: path, MaxSize: 10, MaxBackups: 1})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	_, err = w.Write([]byte("new\n"))
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(readFile(c, path), qt.Equals, "new\n")
+	c.Assert(readFile(c, path+".1"), qt.Equals, "existing\n")
+}
+
+func TestWriter_RotateNoBackups(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	w, err := Open(Options{Path: path, MaxSize: 10})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n"} {
+		_, err := w.Write([]byte(line))
+		c.Assert(err, qt.IsNil)
+	}
+
+	c.Assert(readFile(c, path), qt.Equals, "bbbbbbbb\n")
+	_, err = os.Stat(path + ".1")
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestWriter_Compress(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	w, err := Open(Options{Path: path, MaxSize: 10, MaxBackups: 2, Compress: true})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n"} {
+		_, err := w.Write([]byte(line))
+		c.Assert(err, qt.IsNil)
+	}
+
+	for name, want := range map[string]string{
+		path + ".1.gz": "bbbbbbbb\n",
+		path + ".2.gz": "aaaaaaaa\n",
+	} {
+		f, err := os.Open(name)
+		c.Assert(err, qt.IsNil)
+		gz, err := gzip.NewReader(f)
+		c.Assert(err, qt.IsNil)
+		b, err := io.ReadAll(gz)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(b), qt.Equals, want)
+		f.Close()
+	}
+
+	_, err = os.Stat(path + ".1")
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestWriter_ConcurrentWrites(t *testing.T) {
+	c := qt.New(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.log")
+
+	w, err := Open(Options{Path: path, MaxSize: 1000, MaxBackups: 100})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	line := strings.Repeat("x", 99) + "\n"
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if _, err := w.Write([]byte(line)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every line must be written exactly once, without being split across
+	// files
+	files, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(files, qt.HasLen, 50)
+
+	var total int
+	for _, f := range files {
+		content := readFile(c, filepath.Join(dir, f.Name()))
+		c.Assert(len(content) <= 1000, qt.IsTrue)
+		for _, l := range strings.SplitAfter(content, "\n") {
+			if l == "" {
+				continue
+			}
+			c.Assert(l, qt.Equals, line)
+			total++
+		}
+	}
+	c.Assert(total, qt.Equals, 500)
+}
+
+func TestWriter_Reopen(t *testing.T) {
+	c := qt.New(t)
+	path := filepath.Join(t.TempDir(), "proxy.log")
+
+	w, err := Open(Options{Path: path})
+	c.Assert(err, qt.IsNil)
+	defer w.Close()
+
+	_, err = w.Write([]byte("before\n"))
+	c.Assert(err, qt.IsNil)
+
+	// an external tool moves the file away
+	c.Assert(os.Rename(path, path+".old"), qt.IsNil)
+	c.Assert(w.Reopen(), qt.IsNil)
+
+	_, err = w.Write([]byte("after\n"))
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(readFile(c, path+".old"), qt.Equals, "before\n")
+	c.Assert(readFile(c, path), qt.Equals, "after\n")
+}
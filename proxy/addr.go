@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"strconv"
+	"strings"
+)
+
+// normalizeAddr parses the given "host:port" address and returns it in its
+// canonical form: surrounding whitespace is removed and IP addresses,
+// including IPv6 addresses with a zone, are formatted the way the net
+// package expects them, i.e: "[2001:db8::1]:3306". The host may be empty to
+// denote all local addresses.
+func normalizeAddr(addr string) (string, error) {
+	trimmed := strings.TrimSpace(addr)
+	if trimmed == "" {
+		return "", errors.New("address is empty")
+	}
+
+	host, port, err := net.SplitHostPort(trimmed)
+	if err != nil {
+		unbracketed := strings.TrimSuffix(strings.TrimPrefix(trimmed, "["), "]")
+		if ip, perr := netip.ParseAddr(unbracketed); perr == nil && ip.Is6() {
+			return "", fmt.Errorf("address %q is missing a port, IPv6 addresses must be in the form [host]:port", addr)
+		}
+
+		var addrErr *net.AddrError
+		if errors.As(err, &addrErr) {
+			return "", fmt.Errorf("address %q is invalid: %s, it must be in the form host:port", addr, addrErr.Err)
+		}
+		return "", fmt.Errorf("address %q is invalid: %s", addr, err)
+	}
+
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", fmt.Errorf("address %q has an invalid port %q, it must be a number between 0 and 65535", addr, port)
+	}
+
+	if ip, err := netip.ParseAddr(host); err == nil {
+		host = ip.String()
+	} else if strings.ContainsAny(host, " \t[]/") {
+		return "", fmt.Errorf("address %q has an invalid host %q", addr, host)
+	}
+
+	return net.JoinHostPort(host, port), nil
+}
+
+// normalizeRemoteAddr is like normalizeAddr, but requires the host and port
+// to be set, so the address can be dialed.
+func normalizeRemoteAddr(addr string) (string, error) {
+	normalized, err := normalizeAddr(addr)
+	if err != nil {
+		return "", err
+	}
+
+	host, port, _ := net.SplitHostPort(normalized)
+	if host == "" {
+		return "", fmt.Errorf("address %q is missing a host", addr)
+	}
+	if port == "0" {
+		return "", fmt.Errorf("address %q has an invalid port 0", addr)
+	}
+
+	return normalized, nil
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// AddrResolver resolves the remote address of an instance, i.e: a control
+// plane knowing the host:port of every database branch. The Client uses
+// Options.AddrResolver, or the CertSource if it implements it, to find where
+// to dial rather than Options.RemoteAddr. The errors it returns can be a
+// CertSourceError to classify them, like the ones of CertSource.
+type AddrResolver interface {
+	Addr(ctx context.Context, org, db, branch string) (string, error)
+}
+
+// resolveAddr resolves the remote address of the given instance with the
+// AddrResolver.
+func (c *Client) resolveAddr(ctx context.Context, instance string) (string, error) {
+	org, db, branch, err := ParseInstance(instance)
+	if err != nil {
+		return "", err
+	}
+
+	addr, err := c.addrResolver.Addr(ctx, org, db, branch)
+	if err != nil {
+		return "", fmt.Errorf("couldn't resolve the remote address of the instance: %w", err)
+	}
+	normalized, err := normalizeRemoteAddr(strings.TrimSpace(addr))
+	if err != nil {
+		return "", fmt.Errorf("AddrResolver returned an invalid remote address: %w", err)
+	}
+	return normalized, nil
+}
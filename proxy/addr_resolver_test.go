@@ -0,0 +1,242 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// resolvingCertSource is a fake cert source resolving the remote addresses
+// of the instances too.
+type resolvingCertSource struct {
+	*fakeCertSource
+	AddrFn func(ctx context.Context, org, db, branch string) (string, error)
+
+	mu    sync.Mutex
+	calls int
+}
+
+var _ AddrResolver = (*resolvingCertSource)(nil)
+
+func (s *resolvingCertSource) Addr(ctx context.Context, org, db, branch string) (string, error) {
+	s.mu.Lock()
+	s.calls++
+	s.mu.Unlock()
+	return s.AddrFn(ctx, org, db, branch)
+}
+
+func (s *resolvingCertSource) resolved() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.calls
+}
+
+// closedAddr returns a local address nothing listens on.
+func closedAddr(t testing.TB) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	return addr
+}
+
+// resolvingBackendCertSource returns a cert source that trusts the given CA
+// and resolves the remote addresses with addrFn, while the certs point
+// elsewhere.
+func resolvingBackendCertSource(t testing.TB, ca *testCA, addrFn func() (string, error)) *resolvingCertSource {
+	certSource := backendCertSource(t, ca, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 1})
+	return &resolvingCertSource{
+		fakeCertSource: certSource,
+		AddrFn: func(ctx context.Context, org, db, branch string) (string, error) {
+			return addrFn()
+		},
+	}
+}
+
+func TestClient_AddrResolver(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+	_, port, _ := net.SplitHostPort(addr.String())
+
+	certSource := resolvingBackendCertSource(t, ca, func() (string, error) {
+		return " localhost:" + port + " ", nil
+	})
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	// the resolved address wins over the one of the options
+	testOpts.RemoteAddr = closedAddr(t)
+	testOpts.SetupRetries = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	dial := func() {
+		conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+		c.Assert(err, qt.IsNil)
+		c.Assert(conn.Close(), qt.IsNil)
+	}
+
+	// the address is cached along with the certs
+	dial()
+	dial()
+	c.Assert(certSource.resolved(), qt.Equals, 1)
+	_, remoteAddr, err := client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(remoteAddr, qt.Equals, "localhost:"+port)
+
+	// and refreshed with them
+	client.InvalidateInstance("myorg/mydb/mybranch")
+	dial()
+	c.Assert(certSource.resolved(), qt.Equals, 2)
+}
+
+func TestClient_AddrResolver_Options(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := resolvingBackendCertSource(t, ca, func() (string, error) {
+		return closedAddr(t), nil
+	})
+	resolver := resolvingBackendCertSource(t, ca, func() (string, error) {
+		return addr.String(), nil
+	})
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	testOpts.AddrResolver = resolver
+	testOpts.ServerName = "localhost"
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.Close(), qt.IsNil)
+	c.Assert(certSource.resolved(), qt.Equals, 0)
+	c.Assert(resolver.resolved(), qt.Equals, 1)
+}
+
+func TestClient_AddrResolver_Moved(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	// the instance moved once the address was resolved
+	addrs := []string{closedAddr(t), addr.String()}
+	var mu sync.Mutex
+	certSource := resolvingBackendCertSource(t, ca, func() (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		next := addrs[0]
+		if len(addrs) > 1 {
+			addrs = addrs[1:]
+		}
+		return next, nil
+	})
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	testOpts.ServerName = "localhost"
+	testOpts.SetupRetries = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.Close(), qt.IsNil)
+	c.Assert(certSource.resolved(), qt.Equals, 2)
+
+	// the new address replaced the cached one
+	_, remoteAddr, err := client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(remoteAddr, qt.Equals, addr.String())
+	c.Assert(certSource.resolved(), qt.Equals, 2)
+}
+
+func TestClient_AddrResolver_Unchanged(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	unused := closedAddr(t)
+	certSource := resolvingBackendCertSource(t, ca, func() (string, error) {
+		return unused, nil
+	})
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	testOpts.SetupRetries = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// the address is resolved again only once
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	var dialErr *DialError
+	c.Assert(errors.As(err, &dialErr), qt.IsTrue)
+	c.Assert(dialErr.Addr, qt.Equals, unused)
+	c.Assert(certSource.resolved(), qt.Equals, 2)
+}
+
+func TestClient_AddrResolver_Errors(t *testing.T) {
+	ca := newTestCA(t)
+
+	tests := []struct {
+		name     string
+		addrFn   func() (string, error)
+		wantErr  string
+		wantKind CertErrorKind
+	}{
+		{
+			name: "not found",
+			addrFn: func() (string, error) {
+				return "", &CertSourceError{Kind: CertErrorNotFound, Err: errors.New("no such branch")}
+			},
+			wantErr:  "couldn't resolve the remote address of the instance: no such branch",
+			wantKind: CertErrorNotFound,
+		},
+		{
+			name: "invalid address",
+			addrFn: func() (string, error) {
+				return "db.example.com", nil
+			},
+			wantErr:  `AddrResolver returned an invalid remote address: address "db.example.com" .*`,
+			wantKind: CertErrorUnknown,
+		},
+		{
+			name: "port 0",
+			addrFn: func() (string, error) {
+				return net.JoinHostPort("db.example.com", strconv.Itoa(0)), nil
+			},
+			wantErr:  `AddrResolver returned an invalid remote address: address "db.example.com:0" has an invalid port 0`,
+			wantKind: CertErrorUnknown,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = resolvingBackendCertSource(t, ca, tt.addrFn)
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+			c.Assert(certErrorKind(err), qt.Equals, tt.wantKind)
+		})
+	}
+}
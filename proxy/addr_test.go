@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNormalizeAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr string
+	}{
+		{name: "hostname", addr: "db.example.com:3306", want: "db.example.com:3306"},
+		{name: "ipv4", addr: "127.0.0.1:3306", want: "127.0.0.1:3306"},
+		{name: "surrounding whitespace", addr: " 127.0.0.1:3306\n", want: "127.0.0.1:3306"},
+		{name: "empty host", addr: ":3306", want: ":3306"},
+		{name: "random port", addr: "127.0.0.1:0", want: "127.0.0.1:0"},
+		{name: "bracketed ipv6", addr: "[::1]:3306", want: "[::1]:3306"},
+		{name: "non canonical ipv6", addr: "[2001:DB8:0:0::1]:3306", want: "[2001:db8::1]:3306"},
+		{name: "ipv6 with zone", addr: "[fe80::1%eth0]:3306", want: "[fe80::1%eth0]:3306"},
+		{name: "ipv4 mapped ipv6", addr: "[::ffff:127.0.0.1]:3306", want: "[::ffff:127.0.0.1]:3306"},
+		{
+			name:    "empty",
+			addr:    "  ",
+			wantErr: "address is empty",
+		},
+		{
+			name:    "unbracketed ipv6",
+			addr:    "::1",
+			wantErr: `address "::1" is missing a port, IPv6 addresses must be in the form \[host\]:port`,
+		},
+		{
+			name:    "unbracketed ipv6 with port",
+			addr:    "2001:db8::1:3306",
+			wantErr: `address "2001:db8::1:3306" is missing a port, IPv6 addresses must be in the form \[host\]:port`,
+		},
+		{
+			name:    "bracketed ipv6 without port",
+			addr:    "[::1]",
+			wantErr: `address "\[::1\]" is missing a port, IPv6 addresses must be in the form \[host\]:port`,
+		},
+		{
+			name:    "unbracketed ipv6 with zone",
+			addr:    "fe80::1%eth0",
+			wantErr: `address "fe80::1%eth0" is missing a port, IPv6 addresses must be in the form \[host\]:port`,
+		},
+		{
+			name:    "hostname without port",
+			addr:    "db.example.com",
+			wantErr: `address "db.example.com" is invalid: missing port in address, it must be in the form host:port`,
+		},
+		{
+			name:    "named port",
+			addr:    "db.example.com:mysql",
+			wantErr: `address "db.example.com:mysql" has an invalid port "mysql", it must be a number between 0 and 65535`,
+		},
+		{
+			name:    "port out of range",
+			addr:    "db.example.com:65536",
+			wantErr: `address "db.example.com:65536" has an invalid port "65536", it must be a number between 0 and 65535`,
+		},
+		{
+			name:    "whitespace in host",
+			addr:    "db example.com:3306",
+			wantErr: `address "db example.com:3306" has an invalid host "db example.com"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			got, err := normalizeAddr(tt.addr)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestNormalizeRemoteAddr(t *testing.T) {
+	tests := []struct {
+		name    string
+		addr    string
+		want    string
+		wantErr string
+	}{
+		{name: "hostname", addr: "db.example.com:3307", want: "db.example.com:3307"},
+		{name: "ipv6", addr: "[0:0::1]:3307", want: "[::1]:3307"},
+		{
+			name:    "empty host",
+			addr:    ":3307",
+			wantErr: `address ":3307" is missing a host`,
+		},
+		{
+			name:    "zero port",
+			addr:    "db.example.com:0",
+			wantErr: `address "db.example.com:0" has an invalid port 0`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			got, err := normalizeRemoteAddr(tt.addr)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestNewClient_InvalidAddr(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testOptions(t)
+	opts.RemoteAddr = "::1"
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, `invalid RemoteAddr: address "::1" is missing a port, .*`)
+
+	opts = testOptions(t)
+	opts.LocalAddr = "localhost"
+	_, err = NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, `invalid LocalAddr: address "localhost" is invalid: missing port in address, .*`)
+
+	opts = testOptions(t)
+	opts.RemoteAddr = " [::1]:3307 "
+	opts.LocalAddr = "[::1]:0"
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.remoteAddr, qt.Equals, "[::1]:3307")
+	c.Assert(client.listeners[0].addr, qt.Equals, "[::1]:0")
+}
+
+func TestClient_clientCerts_AccessHost(t *testing.T) {
+	tests := []struct {
+		name       string
+		accessHost string
+		want       string
+		wantErr    string
+	}{
+		{name: "hostname", accessHost: "db.example.com", want: "db.example.com:3307"},
+		{name: "ipv6", accessHost: "2001:db8::1", want: "[2001:db8::1]:3307"},
+		{name: "trailing whitespace", accessHost: "db.example.com\n", want: "db.example.com:3307"},
+		{
+			name:       "empty",
+			accessHost: "",
+			wantErr:    `cert source returned an invalid remote address: address ":3307" is missing a host`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			clientCert := newTestCA(t).clientCert(t, "client")
+			testOpts := testOptions(t)
+			testOpts.CertSource = &fakeCertSource{
+				CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					return &Cert{
+						ClientCert: clientCert,
+						AccessHost: tt.accessHost,
+						Ports:      RemotePorts{Proxy: 3307},
+					}, nil
+				},
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			_, remoteAddr, err := client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(remoteAddr, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestClient_CertRemoteAddr(t *testing.T) {
+	// nothing listens on the remote addresses of the options
+	unused := startPlaintextBackend(t, func(net.Conn) {})
+
+	tests := []struct {
+		name string
+		opts func(opts *Options)
+	}{
+		{
+			name: "over the access host",
+			opts: func(opts *Options) {},
+		},
+		{
+			name: "over the remote address",
+			opts: func(opts *Options) { opts.RemoteAddr = unused },
+		},
+		{
+			name: "over the remote addresses",
+			opts: func(opts *Options) { opts.RemoteAddrs = []string{unused, unused} },
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+			}, echoHandler)
+
+			certSource := backendCertSource(t, ca, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				cert, err := certFn(ctx, org, db, branch)
+				if err != nil {
+					return nil, err
+				}
+				cert.Ports.Proxy = 1
+				cert.RemoteAddr = " " + addr.String() + " "
+				return cert, nil
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			testOpts.ServerName = "localhost"
+			testOpts.SetupRetries = -1
+			tt.opts(&testOpts)
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			_, remoteAddr, err := client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.IsNil)
+			c.Assert(remoteAddr, qt.Equals, addr.String())
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+		})
+	}
+}
+
+func TestClient_CertRemoteAddr_Invalid(t *testing.T) {
+	c := qt.New(t)
+
+	clientCert := newTestCA(t).clientCert(t, "client")
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return &Cert{
+				ClientCert: clientCert,
+				RemoteAddr: "db.example.com",
+			}, nil
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, `cert source returned an invalid remote address: address "db.example.com" .*`)
+}
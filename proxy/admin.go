@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// AdminOptions are the options for creating the admin HTTP handler of a
+// Client.
+type AdminOptions struct {
+	// QuitQuitQuit enables the "POST /quitquitquit" endpoint, which triggers
+	// a graceful shutdown of the client. This is useful when the proxy runs
+	// as a sidecar container, so the main container can stop it once it's
+	// done.
+	QuitQuitQuit bool
+
+	// InvalidateCerts enables the "POST /invalidate-certs" endpoint, which
+	// drops the cached certificates so the new connections retrieve new
+	// ones, i.e: once they were rotated.
+	InvalidateCerts bool
+}
+
+// AdminHandler returns an http.Handler that serves the admin endpoints of the
+// client:
+//
+//	GET  /healthz       always returns 200 while the process is running
+//	GET  /readyz        returns 200 once the client listens for connections
+//	GET  /stats         returns the client's counters and labels as JSON
+//	GET  /events        returns the recent events as JSON, newest first. The
+//	                    since parameter, a RFC 3339 time or a duration such
+//	                    as "5m", only returns the events after it
+//	POST /quitquitquit  triggers a graceful shutdown, if enabled
+//	POST /invalidate-certs
+//	                    drops the cached certificates of the instance
+//	                    parameter, or of all instances without it, and
+//	                    returns the number of instances they were cached
+//	                    for, if enabled. The established connections are
+//	                    left alone
+func (c *Client) AdminHandler(opts AdminOptions) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n")) // nolint: errcheck
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !c.ready() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("ok\n")) // nolint: errcheck
+	})
+
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		resp := struct {
+			Stats          Stats                        `json:"stats"`
+			Labels         map[string]string            `json:"labels,omitempty"`
+			InstanceLabels map[string]map[string]string `json:"instance_labels,omitempty"`
+		}{
+			Stats:          c.Stats(),
+			Labels:         c.labels,
+			InstanceLabels: c.instanceLabels,
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp) // nolint: errcheck
+	})
+
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		if c.recentEvents == nil {
+			http.Error(w, "recent events are disabled", http.StatusNotFound)
+			return
+		}
+
+		var since time.Time
+		if s := r.URL.Query().Get("since"); s != "" {
+			var err error
+			since, err = parseSince(s, time.Now())
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		resp := struct {
+			Events []Event `json:"events"`
+		}{
+			Events: c.recentEvents.recent(since),
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(resp) // nolint: errcheck
+	})
+
+	if opts.QuitQuitQuit {
+		mux.HandleFunc("/quitquitquit", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			c.log.Info("received shutdown request via /quitquitquit",
+				zap.String("remote_addr", r.RemoteAddr))
+			c.Stop()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte("ok\n")) // nolint: errcheck
+		})
+	}
+
+	if opts.InvalidateCerts {
+		mux.HandleFunc("/invalidate-certs", func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				w.Header().Set("Allow", http.MethodPost)
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			c.log.Info("received certificates invalidation request via /invalidate-certs",
+				zap.String("remote_addr", r.RemoteAddr))
+
+			instance := r.URL.Query().Get("instance")
+			resp := struct {
+				Instances int `json:"instances"`
+			}{}
+			if instance == "" {
+				resp.Instances = c.InvalidateAllCerts()
+			} else {
+				if _, _, _, err := ParseInstance(instance); err != nil {
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+				if _, ok := c.configCache.entries()[instance]; ok {
+					resp.Instances = 1
+				}
+				c.InvalidateCerts(instance)
+			}
+
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(resp) // nolint: errcheck
+		})
+	}
+
+	return mux
+}
+
+// parseSince parses the since parameter of the events endpoint, either a
+// RFC 3339 time or a duration before now.
+func parseSince(s string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339Nano, s); err == nil {
+		return t, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d < 0 {
+		return time.Time{}, fmt.Errorf("invalid since %q: must be a RFC 3339 time or a positive duration", s)
+	}
+	return now.Add(-d), nil
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_AdminHandler_Readyz(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testListenOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	h := client.AdminHandler(AdminOptions{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusServiceUnavailable)
+
+	startClient(t, client)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+}
+
+func TestClient_AdminHandler_QuitQuitQuit(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testListenOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	h := client.AdminHandler(AdminOptions{QuitQuitQuit: true})
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(context.Background())
+	}()
+
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+
+	// only POST requests should trigger the shutdown
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/quitquitquit", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusMethodNotAllowed)
+
+	select {
+	case err := <-done:
+		c.Fatalf("Run returned after a GET request: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/quitquitquit", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return after /quitquitquit")
+	}
+
+	// a second request should be harmless
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/quitquitquit", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+}
+
+func TestClient_AdminHandler_QuitQuitQuitDisabled(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	h := client.AdminHandler(AdminOptions{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/quitquitquit", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusNotFound)
+}
+
+func TestClient_AdminHandler_Events(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	now := time.Now()
+	client.emit(Event{Type: EventConnect, Time: now.Add(-10 * time.Minute)})
+	client.emit(Event{Type: EventDisconnect, Time: now.Add(-time.Minute)})
+
+	h := client.AdminHandler(AdminOptions{})
+
+	get := func(url string) []Event {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, url, nil))
+		c.Assert(rec.Code, qt.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/json")
+
+		var resp struct {
+			Events []Event `json:"events"`
+		}
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), qt.IsNil)
+		return resp.Events
+	}
+
+	events := get("/events")
+	c.Assert(events, qt.HasLen, 2)
+	c.Assert(events[0].Type, qt.Equals, EventDisconnect)
+
+	events = get("/events?since=5m")
+	c.Assert(events, qt.HasLen, 1)
+	c.Assert(events[0].Type, qt.Equals, EventDisconnect)
+
+	events = get("/events?since=" + now.Add(-20*time.Minute).Format(time.RFC3339))
+	c.Assert(events, qt.HasLen, 2)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events?since=yesterday", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest)
+}
+
+func TestClient_AdminHandler_InvalidateCerts(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	h := client.AdminHandler(AdminOptions{InvalidateCerts: true})
+
+	client.configCache.Add("myorg/mydb/mybranch", &tls.Config{}, "localhost:3307")
+	client.configCache.Add("myorg/otherdb/main", &tls.Config{}, "localhost:3307")
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/invalidate-certs", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusMethodNotAllowed)
+	c.Assert(rec.Header().Get("Allow"), qt.Equals, http.MethodPost)
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/invalidate-certs?instance=mydb", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusBadRequest)
+
+	invalidate := func(target string) int {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, target, nil))
+		c.Assert(rec.Code, qt.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/json")
+
+		var resp struct {
+			Instances int `json:"instances"`
+		}
+		c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), qt.IsNil)
+		return resp.Instances
+	}
+
+	c.Assert(invalidate("/invalidate-certs?instance=myorg/mydb/mybranch"), qt.Equals, 1)
+	_, err = client.configCache.Get("myorg/mydb/mybranch")
+	c.Assert(err, qt.Equals, errConfigNotFound)
+	_, err = client.configCache.Get("myorg/otherdb/main")
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(invalidate("/invalidate-certs?instance=myorg/mydb/mybranch"), qt.Equals, 0)
+	c.Assert(invalidate("/invalidate-certs"), qt.Equals, 1)
+	c.Assert(client.configCache.entries(), qt.HasLen, 0)
+}
+
+func TestClient_AdminHandler_InvalidateCertsDisabled(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	h := client.AdminHandler(AdminOptions{})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/invalidate-certs", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusNotFound)
+}
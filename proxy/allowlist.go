@@ -0,0 +1,82 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// loopbackNetworks are the only networks the local connections are accepted
+// from by default if the local address isn't a loopback address.
+var loopbackNetworks = []net.IPNet{
+	{IP: net.IPv4(127, 0, 0, 0).To4(), Mask: net.CIDRMask(8, 32)},
+	{IP: net.IPv6loopback, Mask: net.CIDRMask(128, 128)},
+}
+
+// normalizeNetworks validates the given networks and converts the ones of
+// IPv4-mapped IPv6 addresses to IPv4, so they match the IPv4 peers as well.
+func normalizeNetworks(networks []net.IPNet) ([]net.IPNet, error) {
+	normalized := make([]net.IPNet, 0, len(networks))
+	for i, n := range networks {
+		ones, bits := n.Mask.Size()
+		if bits == 0 || (len(n.IP) != net.IPv4len && len(n.IP) != net.IPv6len) {
+			return nil, fmt.Errorf("invalid AllowedNetworks[%d]: %v", i, &n)
+		}
+		if ip4 := n.IP.To4(); ip4 != nil && bits == 8*net.IPv6len && ones >= 96 {
+			n = net.IPNet{IP: ip4, Mask: net.CIDRMask(ones-96, 8*net.IPv4len)}
+		}
+		normalized = append(normalized, n)
+	}
+	return normalized, nil
+}
+
+// allowedNetworksOf returns the networks the connections accepted on the
+// given local address may come from, nil if they may come from anywhere.
+func (c *Client) allowedNetworksOf(addr net.Addr) []net.IPNet {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok || c.allowAllNetworks {
+		return nil
+	}
+	if len(c.allowedNetworks) > 0 {
+		return c.allowedNetworks
+	}
+	if tcpAddr.IP.IsLoopback() {
+		return nil
+	}
+	return loopbackNetworks
+}
+
+// allowNetwork reports whether the peer of the given connection is in one of
+// the allowed networks. All peers are allowed if allowed is nil. Rejections
+// are logged to the given logger of the connection.
+func (c *Client) allowNetwork(log *zap.Logger, conn net.Conn, allowed []net.IPNet) bool {
+	if allowed == nil {
+		return true
+	}
+
+	ip := peerIP(conn.RemoteAddr())
+	for _, n := range allowed {
+		if ip != nil && n.Contains(ip) {
+			return true
+		}
+	}
+
+	log.Warn("rejected connection from a network that isn't allowed",
+		zap.String("peer_addr", conn.RemoteAddr().String()),
+	)
+	return false
+}
+
+// peerIP returns the IP address of the given peer address, nil if it has
+// none.
+func peerIP(addr net.Addr) net.IP {
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		return tcpAddr.IP
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return nil
+	}
+	return net.ParseIP(host)
+}
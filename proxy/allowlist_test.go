@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// peerConn is a connection from the given peer address.
+type peerConn struct {
+	net.Conn
+	peer net.Addr
+}
+
+func (c peerConn) RemoteAddr() net.Addr { return c.peer }
+
+func mustParseCIDRs(c *qt.C, cidrs ...string) []net.IPNet {
+	var networks []net.IPNet
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		c.Assert(err, qt.IsNil)
+		networks = append(networks, *n)
+	}
+	return networks
+}
+
+func TestClient_allowNetwork(t *testing.T) {
+	tests := []struct {
+		name    string
+		peer    string
+		allowed []string
+		want    bool
+	}{
+		{name: "IPv4", peer: "10.1.2.3", allowed: []string{"10.0.0.0/8"}, want: true},
+		{name: "IPv4 outside", peer: "192.168.1.1", allowed: []string{"10.0.0.0/8"}},
+		{name: "IPv6", peer: "2001:db8::1", allowed: []string{"2001:db8::/32"}, want: true},
+		{name: "IPv6 outside", peer: "2001:db9::1", allowed: []string{"2001:db8::/32"}},
+		{name: "IPv6 peer, IPv4 network", peer: "2001:db8::1", allowed: []string{"10.0.0.0/8"}},
+		{name: "mapped IPv4 peer", peer: "::ffff:10.1.2.3", allowed: []string{"10.0.0.0/8"}, want: true},
+		{name: "mapped IPv4 peer outside", peer: "::ffff:192.168.1.1", allowed: []string{"10.0.0.0/8"}},
+		{name: "mapped IPv4 network", peer: "10.1.2.3", allowed: []string{"::ffff:10.0.0.0/104"}, want: true},
+		{name: "mapped IPv4 network outside", peer: "192.168.1.1", allowed: []string{"::ffff:10.0.0.0/104"}},
+		{name: "loopback", peer: "127.0.0.1", allowed: []string{"10.0.0.0/8", "127.0.0.0/8"}, want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			opts := testListenOptions(t)
+			opts.AllowedNetworks = mustParseCIDRs(c, tt.allowed...)
+			client, err := NewClient(opts)
+			c.Assert(err, qt.IsNil)
+
+			conn := peerConn{peer: &net.TCPAddr{IP: net.ParseIP(tt.peer), Port: 50000}}
+			allowed := client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv6unspecified, Port: 3306})
+			c.Assert(client.allowNetwork(client.log, conn, allowed), qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestClient_allowedNetworksOf(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := NewClient(testListenOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	// loopback addresses can only be reached from the loopback addresses
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)}), qt.IsNil)
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv6loopback}), qt.IsNil)
+	c.Assert(client.allowedNetworksOf(&net.UnixAddr{Name: "/tmp/proxy.sock", Net: "unix"}), qt.IsNil)
+
+	// others only accept them by default
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv4zero}), qt.DeepEquals, loopbackNetworks)
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv6unspecified}), qt.DeepEquals, loopbackNetworks)
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv4(10, 0, 0, 1)}), qt.DeepEquals, loopbackNetworks)
+
+	loopback := peerConn{peer: &net.TCPAddr{IP: net.ParseIP("::ffff:127.0.0.1")}}
+	c.Assert(client.allowNetwork(client.log, loopback, loopbackNetworks), qt.IsTrue)
+	loopback.peer = &net.TCPAddr{IP: net.IPv6loopback}
+	c.Assert(client.allowNetwork(client.log, loopback, loopbackNetworks), qt.IsTrue)
+
+	client.allowAllNetworks = true
+	c.Assert(client.allowedNetworksOf(&net.TCPAddr{IP: net.IPv4zero}), qt.IsNil)
+}
+
+func TestClient_AllowedNetworks(t *testing.T) {
+	c := qt.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	opts := testOptions(t)
+	opts.Logger = zap.New(core)
+	opts.LocalAddr = "127.0.0.1:0"
+	opts.Instance = "local/db/main"
+	opts.RemoteAddr = startPlaintextEchoBackend(t)
+	opts.InsecureRemotePlaintext = true
+	opts.AllowedNetworks = mustParseCIDRs(c, "10.0.0.0/8")
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	conn, err := net.Dial("tcp", client.currentListener().Addr().String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(client.Stats().RejectedPeers, qt.Equals, uint64(1))
+	c.Assert(logs.FilterMessage("rejected connection from a network that isn't allowed").Len(), qt.Equals, 1)
+}
+
+func TestNewClient_AllowedNetworks(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testListenOptions(t)
+	opts.AllowedNetworks = mustParseCIDRs(c, "10.0.0.0/8")
+	opts.AllowAllNetworks = true
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, "AllowedNetworks and AllowAllNetworks can't be set together")
+
+	opts.AllowAllNetworks = false
+	opts.AllowedNetworks = []net.IPNet{{IP: net.IPv4(10, 0, 0, 0)}}
+	_, err = NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, `invalid AllowedNetworks\[0\]: .*`)
+}
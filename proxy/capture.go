@@ -0,0 +1,223 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// captureMagic is written at the start of every capture file.
+	captureMagic = "SQLPCAP1"
+
+	// captureFrameHeaderSize is the size of a frame header: the direction
+	// (1 byte), the time in Unix nanoseconds (8 bytes) and the length of the
+	// data (4 bytes), all big endian.
+	captureFrameHeaderSize = 13
+
+	// maxCaptureFrameSize caps the size of a frame when reading captures.
+	maxCaptureFrameSize = 16 << 20
+)
+
+// CaptureDirection is the direction of the data in a CaptureFrame.
+type CaptureDirection byte
+
+const (
+	// CaptureIn is data sent by the local client to the remote server.
+	CaptureIn CaptureDirection = 0
+	// CaptureOut is data sent by the remote server to the local client.
+	CaptureOut CaptureDirection = 1
+)
+
+func (d CaptureDirection) String() string {
+	switch d {
+	case CaptureIn:
+		return "client -> server"
+	case CaptureOut:
+		return "server -> client"
+	}
+	return fmt.Sprintf("unknown direction %d", byte(d))
+}
+
+// CaptureFrame is a chunk of data that crossed a tunnel.
+type CaptureFrame struct {
+	Direction CaptureDirection
+	Time      time.Time
+	Data      []byte
+}
+
+// capturer writes the traffic of every tunnel to its own file in dir, until
+// the total size of all files reaches maxBytes.
+type capturer struct {
+	// written is the total number of bytes written to all capture files. It
+	// must be accessed atomically, it's first so it's 64-bit aligned on
+	// 32-bit platforms too.
+	written int64
+	// seq numbers the capture files. It must be accessed atomically.
+	seq uint64
+
+	dir      string
+	maxBytes int64
+	log      *zap.Logger
+
+	capOnce sync.Once
+}
+
+// reserve reserves n bytes of the size cap. It returns false once the cap is
+// reached, after which nothing is captured anymore.
+func (c *capturer) reserve(n int64) bool {
+	if atomic.AddInt64(&c.written, n) <= c.maxBytes {
+		return true
+	}
+
+	c.capOnce.Do(func() {
+		c.log.Warn("capture size cap reached, traffic is not captured anymore",
+			zap.Int64("max_bytes", c.maxBytes))
+	})
+	return false
+}
+
+// open creates the capture file for a new tunnel of the given instance. It
+// returns nil if the cap is reached or the file can't be created.
+func (c *capturer) open(instance string) *connCapture {
+	if atomic.LoadInt64(&c.written) >= c.maxBytes {
+		return nil
+	}
+
+	name := filepath.Join(c.dir, fmt.Sprintf("%s-%d.cap",
+		time.Now().UTC().Format("20060102T150405"), atomic.AddUint64(&c.seq, 1)))
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		c.log.Error("couldn't create capture file", zap.Error(err))
+		return nil
+	}
+
+	cc := &connCapture{capturer: c, file: f}
+	if !c.reserve(int64(len(captureMagic))) {
+		cc.close()
+		return nil
+	}
+	if _, err := f.Write([]byte(captureMagic)); err != nil {
+		c.log.Error("couldn't write capture file", zap.Error(err))
+		cc.close()
+		return nil
+	}
+
+	c.log.Warn("capturing the traffic of the connection",
+		zap.String("instance", instance),
+		zap.String("file", name))
+	return cc
+}
+
+// connCapture writes the traffic of a single tunnel to its capture file.
+type connCapture struct {
+	capturer *capturer
+
+	mu     sync.Mutex // protects file and closed
+	file   *os.File
+	closed bool
+}
+
+// write records the given data, if the size cap isn't reached yet.
+func (cc *connCapture) write(dir CaptureDirection, data []byte) {
+	if len(data) == 0 {
+		return
+	}
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	if cc.closed {
+		return
+	}
+
+	if !cc.capturer.reserve(int64(captureFrameHeaderSize + len(data))) {
+		cc.closeLocked()
+		return
+	}
+
+	frame := make([]byte, captureFrameHeaderSize, captureFrameHeaderSize+len(data))
+	frame[0] = byte(dir)
+	binary.BigEndian.PutUint64(frame[1:9], uint64(time.Now().UnixNano()))
+	binary.BigEndian.PutUint32(frame[9:13], uint32(len(data)))
+	frame = append(frame, data...)
+
+	if _, err := cc.file.Write(frame); err != nil {
+		cc.capturer.log.Error("couldn't write capture file", zap.Error(err))
+		cc.closeLocked()
+	}
+}
+
+func (cc *connCapture) close() {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	cc.closeLocked()
+}
+
+func (cc *connCapture) closeLocked() {
+	if cc.closed {
+		return
+	}
+	cc.closed = true
+	cc.file.Close()
+}
+
+// ReadCapture reads the frames of a capture file written by a Client with
+// CaptureDir set, and calls fn for each of them.
+func ReadCapture(r io.Reader, fn func(CaptureFrame) error) error {
+	br := bufio.NewReader(r)
+
+	magic := make([]byte, len(captureMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != captureMagic {
+		return errors.New("not a capture file")
+	}
+
+	header := make([]byte, captureFrameHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return fmt.Errorf("couldn't read frame header: %w", err)
+		}
+
+		n := binary.BigEndian.Uint32(header[9:13])
+		if n > maxCaptureFrameSize {
+			return fmt.Errorf("frame of %d bytes exceeds the maximum frame size", n)
+		}
+
+		data := make([]byte, n)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return fmt.Errorf("couldn't read frame data: %w", err)
+		}
+
+		err := fn(CaptureFrame{
+			Direction: CaptureDirection(header[0]),
+			Time:      time.Unix(0, int64(binary.BigEndian.Uint64(header[1:9]))),
+			Data:      data,
+		})
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// PrintCapture pretty-prints the frames of a capture file to w, with a hex
+// dump of the data of each frame.
+func PrintCapture(w io.Writer, r io.Reader) error {
+	return ReadCapture(r, func(f CaptureFrame) error {
+		_, err := fmt.Fprintf(w, "%s %s (%d bytes)\n%s\n",
+			f.Time.UTC().Format(time.RFC3339Nano), f.Direction, len(f.Data), hex.Dump(f.Data))
+		return err
+	})
+}
@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+)
+
+func TestClient_Capture(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	dir := t.TempDir()
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.CaptureDir = dir
+	testOpts.CaptureMaxBytes = 1 << 20
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	_, err = conn.Write([]byte("SELECT 1"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 8))
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cap"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(files, qt.HasLen, 1)
+
+	f, err := os.Open(files[0])
+	c.Assert(err, qt.IsNil)
+	defer f.Close()
+
+	var frames []CaptureFrame
+	err = ReadCapture(f, func(frame CaptureFrame) error {
+		frames = append(frames, frame)
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+
+	var in, out []byte
+	for _, frame := range frames {
+		c.Assert(frame.Time.IsZero(), qt.IsFalse)
+		switch frame.Direction {
+		case CaptureIn:
+			in = append(in, frame.Data...)
+		case CaptureOut:
+			out = append(out, frame.Data...)
+		}
+	}
+	c.Assert(string(in), qt.Equals, "SELECT 1")
+	c.Assert(string(out), qt.Equals, "SELECT 1")
+
+	_, err = f.Seek(0, io.SeekStart)
+	c.Assert(err, qt.IsNil)
+
+	var buf bytes.Buffer
+	c.Assert(PrintCapture(&buf, f), qt.IsNil)
+	c.Assert(buf.String(), qt.Contains, "client -> server (8 bytes)")
+	c.Assert(buf.String(), qt.Contains, "server -> client (8 bytes)")
+	c.Assert(buf.String(), qt.Contains, "|SELECT 1|")
+}
+
+func TestClient_Capture_SizeCap(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	capture := &capturer{
+		dir:      dir,
+		maxBytes: int64(len(captureMagic)) + 2*(captureFrameHeaderSize+10),
+		log:      zap.NewNop(),
+	}
+
+	cc := capture.open("myorg/mydb/mybranch")
+	c.Assert(cc, qt.Not(qt.IsNil))
+
+	for i := 0; i < 5; i++ {
+		cc.write(CaptureIn, []byte(strings.Repeat("x", 10)))
+	}
+	cc.close()
+
+	// no new captures once the cap is reached
+	c.Assert(capture.open("myorg/mydb/mybranch"), qt.IsNil)
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.cap"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(files, qt.HasLen, 1)
+
+	data, err := os.ReadFile(files[0])
+	c.Assert(err, qt.IsNil)
+	c.Assert(int64(len(data)), qt.Equals, capture.maxBytes)
+
+	var frames int
+	err = ReadCapture(bytes.NewReader(data), func(CaptureFrame) error {
+		frames++
+		return nil
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(frames, qt.Equals, 2)
+}
+
+func TestReadCapture_Invalid(t *testing.T) {
+	c := qt.New(t)
+
+	noop := func(CaptureFrame) error { return nil }
+
+	err := ReadCapture(strings.NewReader("not a capture"), noop)
+	c.Assert(err, qt.ErrorMatches, "not a capture file")
+
+	// truncated frame header
+	err = ReadCapture(strings.NewReader(captureMagic+"\x00\x00"), noop)
+	c.Assert(err, qt.ErrorMatches, "couldn't read frame header: unexpected EOF")
+
+	// adversarial length
+	header := captureMagic + "\x00" + strings.Repeat("\x00", 8) + "\xff\xff\xff\xff"
+	err = ReadCapture(strings.NewReader(header), noop)
+	c.Assert(err, qt.ErrorMatches, "frame of 4294967295 bytes exceeds the maximum frame size")
+}
+
+func TestNewClient_CaptureRequiresMaxBytes(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.CaptureDir = t.TempDir()
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "CaptureMaxBytes must be set to capture traffic")
+}
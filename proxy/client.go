@@ -2,13 +2,20 @@ package proxy
 
 import (
 	"context"
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"math/rand"
 	"net"
 	"os"
+	"runtime"
+	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -16,32 +23,171 @@ import (
 )
 
 const (
-	keepAlivePeriod = time.Minute
+	// defaultKeepAlivePeriod is the keep alive period of the local
+	// connections if KeepAlivePeriod isn't set.
+	defaultKeepAlivePeriod = time.Minute
+
+	// setupRetryBackoff is the time to wait before the first retry of a
+	// failed connection setup. It doubles with each retry, and up to half of
+	// it is added as jitter, so connections failing together don't retry in
+	// lockstep.
+	setupRetryBackoff = 100 * time.Millisecond
+
+	// minRateLimitedBackoff is the minimum time to wait before retrying
+	// after the cert source rate limited us.
+	minRateLimitedBackoff = time.Second
+
+	// failedCertsInvalidationInterval is the minimum time between two
+	// invalidations of the certificates of an instance after handshakes
+	// failed on them.
+	failedCertsInvalidationInterval = 30 * time.Second
+
+	// maxRateLimitedBackoff caps the RetryAfter hint of a rate limiting cert
+	// source, so a bogus hint can't stall the connection setups.
+	maxRateLimitedBackoff = 30 * time.Second
+
+	// defaultCertRetries is how many times retrieving the certificates is
+	// retried by default, after defaultCertRetryBackoff, doubling with each
+	// retry.
+	defaultCertRetries      = 2
+	defaultCertRetryBackoff = 100 * time.Millisecond
+
+	// listenerRestartBackoff is the time to wait before the first attempt to
+	// re-create a failed listener. It doubles with each attempt, up to
+	// maxListenerRestartBackoff.
+	listenerRestartBackoff    = 100 * time.Millisecond
+	maxListenerRestartBackoff = 10 * time.Second
+
+	defaultListenerRestarts = 10
+
+	// defaultSlowSetupThreshold is the time after which a connection setup
+	// is logged as slow, with a breakdown of where the time went.
+	defaultSlowSetupThreshold = 2 * time.Second
+
+	// defaultLifetimeGrace is how long a connection past its
+	// MaxConnectionLifetime is given to become quiet before it's closed
+	// anyway.
+	defaultLifetimeGrace = 10 * time.Second
+
+	// defaultHalfCloseTimeout is how long a tunnel keeps relaying the data
+	// of one direction once the other one was closed.
+	defaultHalfCloseTimeout = 30 * time.Second
+
+	// defaultCopyBufferSize is the size of the buffers the data of the
+	// tunnels is copied through, the same as io.Copy's. minCopyBufferSize
+	// and maxCopyBufferSize bound CopyBufferSize.
+	defaultCopyBufferSize = 32 << 10
+	minCopyBufferSize     = 512
+	maxCopyBufferSize     = 16 << 20
+
+	// defaultDialTimeout and defaultHandshakeTimeout bound dialing the
+	// remote address and the TLS handshake if DialTimeout and
+	// HandshakeTimeout aren't set.
+	defaultDialTimeout      = 10 * time.Second
+	defaultHandshakeTimeout = 10 * time.Second
+
+	// defaultResolveInterval is how often the remote hosts are resolved if
+	// only HostResolver is set.
+	defaultResolveInterval = 30 * time.Second
+
+	// defaultTLSSessionCacheSize is how many TLS sessions of each instance
+	// are kept to be resumed if TLSSessionCacheSize isn't set.
+	defaultTLSSessionCacheSize = 64
 )
 
-// CertError represents a Cert operation error.
-type CertError struct{ msg string }
+// CertError represents a Cert operation error. Err is the error of the
+// CertSource, i.e: a CertSourceError, which errors.As and errors.Is see
+// through it.
+type CertError struct{ Err error }
 
-func (c *CertError) Error() string { return c.msg }
+func (c *CertError) Error() string {
+	if c.Err == nil {
+		return ""
+	}
+	return c.Err.Error()
+}
+
+func (c *CertError) Unwrap() error { return c.Err }
 
 // Cert represents the client certificate key pair in the root certiciate
 // authority that the client uses to verify server certificates.
 
 type Cert struct {
+	// ClientCert is the certificate the client presents to the remote
+	// server. It must be set, unless ServerAuthOnly is set.
 	ClientCert tls.Certificate
+
+	// ServerAuthOnly must be set if the remote server doesn't require a
+	// client certificate, i.e: because it authenticates users with their
+	// MySQL credentials only. The client then doesn't present any
+	// certificate, but still verifies the certificate of the server.
+	ServerAuthOnly bool
+
+	// CACerts are the certificate authorities used to verify the certificate
+	// of the remote server. A certificate issued by any of them is trusted,
+	// so both the old and the new CA can be given during a CA rotation. If
+	// empty, the host's root CA set is used.
+	CACerts []*x509.Certificate
+
+	// Intermediates are the intermediate certificate authorities between
+	// CACerts and the certificate of the remote server, for the servers
+	// that don't present them along with their certificate. They're only
+	// used to build the chain, a certificate issued by them is trusted only
+	// if they were issued by one of CACerts.
+	Intermediates []*x509.Certificate
+
 	AccessHost string
 	Ports      RemotePorts
+
+	// Expiry is when the certificates expire, i.e: the NotAfter of the
+	// client certificate. The client retrieves them again then, even if
+	// they were cached for less than 10 minutes. Zero if not provided.
+	Expiry time.Time
+
+	// ServerName is the name the certificate of the remote server is
+	// verified against. It overrides Options.ServerName and AccessHost.
+	// Empty if not provided.
+	ServerName string
+
+	// RemoteAddr is the address of the remote server, in the "host:port"
+	// form, for the cert sources returning it rather than AccessHost and
+	// Ports. It overrides the remote addresses of the Options, and
+	// AccessHost. Empty if not provided.
+	RemoteAddr string
 }
 
+// NameVerification selects how the name of the remote server is matched
+// against its certificate.
+type NameVerification string
+
+const (
+	// VerifyEither matches the name against the DNS and IP SANs of the
+	// certificate, or against its common name if it has no SANs, such as
+	// the certificates MySQL generates. It's the default.
+	VerifyEither NameVerification = "either"
+
+	// VerifySAN matches the name against the DNS and IP SANs of the
+	// certificate only, like crypto/tls.
+	VerifySAN NameVerification = "san"
+
+	// VerifyCN matches the name against the common name of the certificate
+	// only.
+	VerifyCN NameVerification = "cn"
+)
+
 type RemotePorts struct {
 	Proxy int
 	MySQL int
 }
 
-// CertSource is used
+// CertSource is used to retrieve the certificates of the instances. The
+// ones signing client certificates for keys generated by the client
+// implement CSRSigner too.
 type CertSource interface {
 	// Cert returns the required certs needed to establish a TLS connection
-	// from the client to the server.
+	// from the client to the server. Errors should be classified by
+	// returning a CertSourceError, which decides whether the connection
+	// setup is retried and whether the instance is invalidated.
 	Cert(ctx context.Context, org, db, branch string) (*Cert, error)
 }
 
@@ -49,26 +195,244 @@ type CertSource interface {
 // localhost port and tunneling them securely over a TLS connection to a remote
 // database instance defined by its PlanetScale unique branch identifier.
 type Client struct {
-	// connectionsCounter is used to enforce the optional maxConnections limit
+	// connectionsCounter is the number of active connections
 	// NOTE: don't move this field, as we need to make sure the fields are
 	// 64-bit aligned
 	connectionsCounter uint64
 
+	// lastConnID is the ID given to the last connection, see nextConnID.
+	// NOTE: keep it 64-bit aligned as well
+	lastConnID uint64
+
 	remoteAddr     string
-	localAddr      string
 	instance       string
 	maxConnections uint64
-	certSource     CertSource
+	setupTimeout   time.Duration
+	setupRetries   int
+	// clockSkewTolerance is how long a client certificate that isn't valid
+	// yet is waited for.
+	clockSkewTolerance time.Duration
+	// certRetries and certRetryBackoff bound the retries of the CertSource.
+	certRetries      int
+	certRetryBackoff time.Duration
+	// certExpiry tracks the expiry of the certificates of the instances.
+	certExpiry *certExpiry
+	// csrKeys holds the local keys of the instances, for the CertSources
+	// implementing CSRSigner.
+	csrKeys *csrKeys
+
+	// connSlots enforces maxConnections, it's nil if there's no limit.
+	// maxConnectionsWait is how long a connection waits for a slot.
+	connSlots          *connSemaphore
+	maxConnectionsWait time.Duration
+
+	// protocolAwareErrors makes the refused local clients get a MySQL error,
+	// or an X Protocol one.
+	protocolAwareErrors bool
+
+	// dialTimeout and handshakeTimeout bound the dial and handshake phases
+	// of the setup, zero means no timeout.
+	dialTimeout      time.Duration
+	handshakeTimeout time.Duration
+
+	// instanceRemoteAddrs and instanceLimits are the remote addresses and
+	// connection limits of Options.Instances, keyed by instance name.
+	instanceRemoteAddrs map[string]string
+	instanceLimits      map[string]*connSemaphore
+
+	// instanceXRemoteAddrs are the remote addresses of the X Protocol
+	// connections, keyed by instance name.
+	instanceXRemoteAddrs map[string]string
+
+	// slowSetupThreshold is the time after which setting up a connection,
+	// including the time it was queued, is logged as slow.
+	slowSetupThreshold time.Duration
+
+	// maxConnLifetime is the maximum age of a connection, zero means no
+	// limit. lifetimeGrace is how long an older connection may stay open
+	// until it's quiet.
+	maxConnLifetime time.Duration
+	lifetimeGrace   time.Duration
+
+	// stallTimeout is how long a tunnel may wait for the response to the
+	// data it forwarded before it's closed, zero means forever.
+	stallTimeout time.Duration
+
+	// halfCloseTimeout is how long a half-closed tunnel keeps relaying the
+	// other direction, zero if the tunnels aren't half-closed.
+	halfCloseTimeout time.Duration
+
+	// copyBufferSize is the size of the buffer of each direction of a
+	// tunnel.
+	copyBufferSize int
+
+	insecurePlaintext bool
+
+	allowedPeerUIDs []uint32
+	allowedPeerGIDs []uint32
+	socketMode      os.FileMode
+	socketGID       int
+	certSource      CertSource
+	statsd          StatsDOptions
+
+	// allowedNetworks are the networks the local connections may come from,
+	// see allowedNetworksOf.
+	allowedNetworks  []net.IPNet
+	allowAllNetworks bool
+
+	labels         map[string]string
+	instanceLabels map[string]map[string]string
+	// mergedLabels are the labels of the instances with InstanceLabels,
+	// merged with labels. They're shared by all the events of the instance
+	// and must not be modified.
+	mergedLabels map[string]map[string]string
+
+	// capture is nil unless capturing the traffic is enabled
+	capture *capturer
+
+	// endpoints is nil unless RemoteAddrs are set
+	endpoints *endpointSelector
+
+	// maxPacketSize is zero unless local clients' packets are framed
+	maxPacketSize uint64
+
+	// parseGreetings is set if the greetings of the MySQL servers are read
+	// when the tunnels are established.
+	parseGreetings bool
+
+	// maxBytesPerConn and instanceMaxBytesPerConn are the byte quotas of
+	// the tunnels, zero means unlimited.
+	maxBytesPerConn         int64
+	instanceMaxBytesPerConn map[string]int64
+
+	verifyPeerCertificate func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error
+
+	// onConnectHook, onHandshakeHook and onCloseHook are the hooks of
+	// the connections, see Options.
+	onConnectHook   func(ctx context.Context, info ConnInfo) error
+	onHandshakeHook func(info ConnInfo, state tls.ConnectionState)
+	onCloseHook     func(info ConnInfo, bytesIn, bytesOut int64, err error)
+
+	// addrResolver resolves the remote addresses of the instances, nil if
+	// neither the options nor the cert source provide one.
+	addrResolver AddrResolver
+
+	// tlsConfigHook is the TLSConfigHook of the options.
+	tlsConfigHook func(instance string, cfg *tls.Config) *tls.Config
+
+	// dialer dials the connections to the remote server.
+	dialer Dialer
+
+	// hosts is nil unless the client resolves the remote hosts itself
+	hosts *hostCache
+
+	// remoteNetwork is the network of the remote connections: "tcp",
+	// "tcp4" or "tcp6".
+	remoteNetwork string
+	fallbackDelay time.Duration
+
+	// keepAlivePeriod, disableKeepAlive and tcpUserTimeout configure the
+	// TCP connections. The remote connections keep the settings of the
+	// dialer unless remoteKeepAlive is set.
+	keepAlivePeriod  time.Duration
+	disableKeepAlive bool
+	tcpUserTimeout   time.Duration
+	remoteKeepAlive  bool
+
+	// noDelay disables Nagle's algorithm on the local and the remote TCP
+	// connections.
+	noDelay bool
+
+	// serverName overrides the AccessHost of the certs to verify the remote
+	// server against, if set. nameVerification tells how it's matched.
+	serverName       string
+	nameVerification NameVerification
+	// serverSPIFFEID is the SPIFFE ID the remote servers are verified
+	// against instead of their name, if set.
+	serverSPIFFEID string
+	// serverVerifier replaces the built-in verification, if set. pins must
+	// be matched by the leaf certificate on top of it.
+	serverVerifier func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	pins           []certPin
+	// crls are the CRLs the verified chains are checked against, nil if
+	// none were given.
+	crls *crlSet
+	// ocspStapling tells how the stapled OCSP responses are verified, they
+	// aren't if it's empty.
+	ocspStapling OCSPStaplePolicy
+
+	// minTLSVersion, maxTLSVersion and cipherSuites restrict the TLS
+	// connections to the remote servers.
+	minTLSVersion uint16
+	maxTLSVersion uint16
+	cipherSuites  []uint16
+	// securityPolicy is the SecurityPolicy of the options, if any, which
+	// restricts the curves and the negotiated cipher suites as well.
+	securityPolicy   SecurityPolicy
+	curvePreferences []tls.CurveID
+	allowedSuites    []uint16
+
+	// tlsSessionCacheSize is the size of the TLS session cache of each
+	// instance, zero if the sessions aren't resumed.
+	tlsSessionCacheSize int
+
+	// keyLog receives the TLS secrets, nil unless KeyLogWriter is set.
+	keyLog io.Writer
+
+	stats *clientStats
+
+	// conns holds the established connections
+	conns   map[*trackedConn]struct{}
+	connsMu sync.Mutex // protects conns
+
+	// events is the channel returned by Events. eventsSubscribed is set
+	// atomically to 1 once Events was called.
+	events           chan Event
+	eventsSubscribed int32
+
+	// recentEvents is nil unless recent events are kept
+	recentEvents *eventRing
 
 	log *zap.Logger
 
 	// configCache contains the TLS certificate chache for each indiviual
 	// database
 	configCache *tlsCache
+	// certFetches holds the retrievals of certificates in progress, so
+	// concurrent cache misses of an instance share a single one.
+	certFetches *certFetches
+
+	// listeners are the local addresses the client accepts connections on,
+	// one per instance.
+	listeners []*localListener
+
+	// done is closed after a successfull net.Listen bind, or once Run failed
+	// before it.
+	done     chan struct{}
+	doneOnce sync.Once
+
+	// listenerRestarts is the number of attempts to re-create the listener
+	// after it failed, it's not re-created if zero.
+	listenerRestarts int
+
+	// quit is closed by Stop to trigger a graceful shutdown.
+	quit     chan struct{}
+	quitOnce sync.Once
+
+	// draining is 1 once Shutdown began, new connections are refused from
+	// then on. forceClosing is 1 once its deadline passed, the connections
+	// established from then on are closed right away. Must be accessed
+	// atomically.
+	draining     int32
+	forceClosing int32
+
+	// created is the time the client was created, for its uptime.
+	created time.Time
+}
 
-	listener net.Listener
-	// done is closed after a successfull net.Listen bind.
-	done chan struct{}
+// Dialer dials network connections. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
 // Options are the options for creating a new Client.
@@ -78,367 +442,2468 @@ type Options struct {
 	// option can be used to overwrite it.
 	RemoteAddr string
 
+	// RemoteAddrs are alternative addresses of the remote server, such as
+	// endpoints in different regions. They're probed periodically while the
+	// client runs and new connections go to the healthy endpoint with the
+	// lowest latency. If it can't be connected to, the others are tried in
+	// the given order, the one that worked is tried first by the next
+	// connections. It can't be combined with RemoteAddr.
+	RemoteAddrs []string
+
+	// RemoteProbe configures how the RemoteAddrs are probed.
+	RemoteProbe ProbeOptions
+
 	// LocalAddr defines the address to listen for new connection
 	LocalAddr string
 
-	// Instance defines the remote DB instance to proxy new connection
+	// XLocalAddr and XRemoteAddr, if set, make the client proxy the X
+	// Protocol connections to Instance as well, like the fields of the same
+	// name of InstanceConfig.
+	XLocalAddr  string
+	XRemoteAddr string
+
+	// Instances, if set, makes the client proxy several instances, each on
+	// its own local address, instead of Instance on LocalAddr. It can't be
+	// combined with Instance, LocalAddr, XLocalAddr, Listener and
+	// RemoteAddrs.
+	Instances []InstanceConfig
+
+	// Listener, if set, is used to accept the local connections instead of
+	// listening to LocalAddr, i.e: a socket passed by systemd socket
+	// activation. The client owns it and closes it when it shuts down. It
+	// can't be combined with LocalAddr and it's not re-created if it fails.
+	Listener net.Listener
+
+	// Instance defines the remote DB instance to proxy new connection, in
+	// the form of "organization/database/branch", see ParseInstance.
 	Instance string
 
 	// MaxConnections is the maximum number of connections to establish
-	// before refusing new connections. 0 means no limit.
+	// before refusing new connections, to all instances together. 0 means no
+	// limit.
 	MaxConnections uint64
 
+	// ProtocolAwareErrors makes the client reply to the local clients it
+	// refuses because of MaxConnections, or the MaxConnections of their
+	// instance, with a MySQL ER_CON_COUNT_ERROR "Too many connections"
+	// error in place of the server greeting, like a MySQL server does, so
+	// the drivers report why. Otherwise the connection is just closed. The
+	// local clients must speak the MySQL protocol, the ones of the X
+	// Protocol listeners get the equivalent Mysqlx.Error message.
+	ProtocolAwareErrors bool
+
+	// MaxConnectionsWait makes the new connections over MaxConnections, or
+	// the MaxConnections of their instance, wait up to the given duration
+	// for a slot to free up instead of being refused right away. The freed
+	// slots go to the waiting connections in the order they arrived. A
+	// local client going away stops its wait.
+	MaxConnectionsWait time.Duration
+
+	// SetupTimeout bounds the whole setup of a new connection, which
+	// includes retrieving the certs, dialing the remote address and the TLS
+	// handshake. Whichever phase is in progress when it expires is cancelled
+	// and the local connection is closed. 0 means no timeout.
+	SetupTimeout time.Duration
+
+	// DialTimeout bounds dialing the remote address and HandshakeTimeout the
+	// TLS handshake with it, so a blackholed remote address fails fast
+	// instead of after the timeout of the OS. They apply to every attempt
+	// of the setup, within the SetupTimeout. By default both are 10
+	// seconds, a negative value disables the timeout.
+	DialTimeout      time.Duration
+	HandshakeTimeout time.Duration
+
+	// SetupRetries is the number of times a failed connection setup is
+	// retried before the local connection is closed. Only transient failures
+	// are retried, and only while the SetupTimeout hasn't expired and the
+	// local client is still connected. The backoff between the attempts
+	// starts at 100ms and doubles with each retry, with some jitter. 0 means
+	// no retries.
+	SetupRetries int
+
+	// ClockSkewTolerance is how long the setup waits for a client
+	// certificate the cert source issued in the future to become valid, so
+	// the hosts whose clock is a bit behind the one of the cert source don't
+	// present it before it's valid. The skew is logged. Regardless of it, a
+	// handshake failing on the validity period of a certificate refreshes
+	// the certs of the instance and is retried once right away. By default
+	// it's 5 seconds, a negative value disables the wait.
+	ClockSkewTolerance time.Duration
+
+	// CertRetries is how many times retrieving the certificates of an
+	// instance from the CertSource is retried right away when it failed
+	// transiently, i.e: because the cert source returned a 503, before the
+	// connection setup fails, and is retried itself per SetupRetries. The
+	// errors of kind CertErrorUnavailable and CertErrorRateLimited are
+	// transient, and the errors implementing TemporaryError tell. The
+	// backoff between the attempts starts at CertRetryBackoff, 100ms by
+	// default, and doubles with each retry, with some jitter, or is the
+	// RetryAfter hint of a CertErrorRateLimited error if it's longer, up to
+	// 30 seconds. The
+	// retries stop with the context of the connection. By default it's 2,
+	// a negative value disables the retries.
+	CertRetries      int
+	CertRetryBackoff time.Duration
+
+	// CertExpiryWarning is how long before they expire the certificates of
+	// the instances, the client certificate and the CAs, are warned about.
+	// They're checked every time they're retrieved from the cert source,
+	// and every hour while Run runs. Stats tells when they expire either
+	// way. By default it's 72 hours, a negative value disables the
+	// warnings.
+	CertExpiryWarning time.Duration
+
 	// CertSource defines the certificate source to obtain the required TLS
-	// certificates for the client.
+	// certificates for the client. It's required unless
+	// InsecureRemotePlaintext is set.
 	CertSource CertSource
 
+	// AllowedPeerUIDs and AllowedPeerGIDs restrict which local processes may
+	// connect to a unix socket LocalAddr. A connection is accepted if the
+	// UID or the GID of the connecting process is in the respective list.
+	// Connections from other processes are closed right after they're
+	// accepted. If both are empty, all processes that can access the socket
+	// may connect. Only supported on Linux.
+	AllowedPeerUIDs []uint32
+	AllowedPeerGIDs []uint32
+
+	// AllowedNetworks restricts which networks the connections to a TCP
+	// LocalAddr may come from. Connections from other addresses are closed
+	// right after they're accepted. IPv4 networks match the IPv4-mapped IPv6
+	// addresses as well. If empty and LocalAddr isn't a loopback address,
+	// i.e: 0.0.0.0, only the connections from the loopback addresses are
+	// accepted, so the plaintext traffic isn't exposed to the network by
+	// mistake.
+	AllowedNetworks []net.IPNet
+
+	// AllowAllNetworks accepts the connections to LocalAddr from any
+	// address, even if it isn't a loopback address. It can't be combined
+	// with AllowedNetworks.
+	AllowAllNetworks bool
+
+	// ListenerRestarts is the number of attempts to re-create the local
+	// listener if it fails while the client runs, i.e. because the network
+	// namespace changed. The client isn't ready while the listener is
+	// re-created and Run fails once all attempts failed. By default it's 10,
+	// a negative value disables re-creating the listener.
+	ListenerRestarts int
+
+	// LocalSocketMode is the file mode of a unix socket LocalAddr. By
+	// default it's 0600, so only the user running the client may connect.
+	LocalSocketMode os.FileMode
+
+	// LocalSocketGroup is the group, by name or GID, a unix socket
+	// LocalAddr is owned by. Use it with a LocalSocketMode such as 0660 to
+	// let the members of a group connect. By default the socket is owned by
+	// the primary group of the user running the client.
+	LocalSocketGroup string
+
+	// InsecureRemotePlaintext disables TLS for the connections to the remote
+	// address, which must be set with RemoteAddr. No certificates are
+	// retrieved and the traffic is sent unencrypted and unauthenticated. This
+	// is only meant for local development, i.e: against a MySQL server in a
+	// container on the same machine.
+	InsecureRemotePlaintext bool
+
+	// ServerName is the name the certificate of the remote server is
+	// verified against, instead of the AccessHost returned by the
+	// CertSource, i.e: the common name of the certificates MySQL generates,
+	// "MySQL_Server_8.0.34_Auto_Generated_Server_Certificate". If neither is
+	// set, only the chain of the certificate is verified.
+	ServerName string
+
+	// NameVerification tells how the name of the remote server is matched
+	// against its certificate. By default it's VerifyEither, the SANs of the
+	// certificate or its common name if it has no SANs.
+	NameVerification NameVerification
+
+	// ServerSPIFFEID, if set, is the SPIFFE ID the certificate of the
+	// remote server is verified against instead of its name, i.e:
+	// "spiffe://example.org/db/main" for the servers presenting an
+	// X.509-SVID. The certificate must hold the ID as its single URI SAN.
+	// ServerName is still sent to the server, but not verified. It can't
+	// be combined with ServerVerifier.
+	ServerSPIFFEID string
+
+	// Dialer dials the TCP connections to the remote server, i.e: to go
+	// through a proxy or from a given local address. The timeouts and keep
+	// alive settings of a *net.Dialer are respected, unless KeepAlivePeriod,
+	// DisableKeepAlive or TCPUserTimeout are set. By default a zero
+	// net.Dialer is used.
+	Dialer Dialer
+
+	// ResolveInterval makes the client resolve the host name of the remote
+	// address itself, instead of the Dialer, and re-resolve it every
+	// interval, i.e: to follow a failover by DNS even if the resolved
+	// addresses are cached upstream. The resolved addresses of each IP
+	// family are tried in turn, racing the families as FallbackDelay
+	// describes, and the next connections start with the address after the
+	// one that failed. The addresses resolved before are used if
+	// resolving fails. Changes of the resolved addresses are logged. By
+	// default the host names are resolved by the Dialer on every dial.
+	ResolveInterval time.Duration
+
+	// HostResolver resolves the host names of the remote addresses if
+	// ResolveInterval is set. If only HostResolver is set, ResolveInterval
+	// is 30 seconds. By default net.DefaultResolver is used.
+	HostResolver HostResolver
+
+	// RemoteNetwork restricts the connections to the remote server to an IP
+	// family, "tcp4" or "tcp6". By default, "tcp", either is used.
+	RemoteNetwork string
+
+	// FallbackDelay is how long a connection to the remote server over the
+	// IP family resolved first gets, before one over the other family is
+	// raced against it, if the remote host resolves to both (RFC 6555). The
+	// first connection wins. It's done by the client if it resolves the
+	// remote hosts itself. Otherwise it's up to the Dialer, the default one
+	// uses FallbackDelay as well. The default is 300ms, a negative value
+	// tries the addresses one at a time.
+	FallbackDelay time.Duration
+
+	// KeepAlivePeriod is the period of the TCP keep alive probes of the
+	// local and the remote connections, i.e: to keep idle connections open
+	// behind a NAT gateway with a short idle timeout. By default it's a
+	// minute for the local connections, the remote ones use the default of
+	// the Dialer.
+	KeepAlivePeriod time.Duration
+
+	// DisableKeepAlive disables the TCP keep alives of the local and the
+	// remote connections.
+	DisableKeepAlive bool
+
+	// TCPUserTimeout is how long data sent on the local and the remote
+	// connections may remain unacknowledged before they're closed, so dead
+	// peers are detected even if the keep alive probes are dropped. 0 uses
+	// the OS default. Only supported on Linux.
+	TCPUserTimeout time.Duration
+
+	// NoDelay disables Nagle's algorithm (TCP_NODELAY) on the local and the
+	// remote TCP connections, so the small packets of chatty protocols are
+	// sent right away instead of waiting for the acknowledgment of the
+	// previous ones. It trades throughput for latency: bulk transfers send
+	// more, smaller packets. Go already sets it on the connections it
+	// creates, it matters for the connections of a custom Listener or
+	// Dialer. It's ignored for the other connections, i.e: unix sockets.
+	NoDelay bool
+
+	// VerifyPeerCertificate, if not nil, is called during the TLS handshake
+	// with the leaf certificate of the remote server and its verified chains.
+	// It's only called after the built-in verification of the chain and the
+	// server name succeeded, so it can add checks but never relax them.
+	// Returning an error rejects the connection.
+	VerifyPeerCertificate func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error
+
+	// ServerVerifier, if not nil, replaces the built-in verification of the
+	// certificate of the remote server, i.e: to match a SPIFFE ID in its URI
+	// SANs instead of its name. It's called with the cert of each instance
+	// and the name it's reached by, and returns the function verifying the
+	// certificates the server presents during the TLS handshake, which is
+	// then responsible for the whole verification, chain included. Returning
+	// an error rejects the connection. DefaultServerVerifier returns the
+	// built-in verification, to wrap rather than rewrite it. It can't be
+	// combined with VerifyPeerCertificate.
+	ServerVerifier func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+
+	// PinnedFingerprints are SHA-256 hashes, hex or base64 encoded, of the
+	// certificates of the remote servers or of their public keys (SPKI).
+	// If set, the certificate a server presents must match one of them on
+	// top of being verified, so a compromised CA can't impersonate the
+	// servers. Several pins can be given to rotate them, the pin that
+	// matched is logged. PinsFromPEM computes them from a PEM file.
+	PinnedFingerprints []string
+
+	// CRL holds certificate revocation lists, PEM or DER encoded, the chains
+	// of the remote servers are checked against on top of being verified.
+	// A server is rejected if its certificate, or an intermediate, is listed
+	// in a CRL signed by its issuer. The certificates whose issuer has no
+	// CRL pass. CRLFile is a file holding CRLs the same way, which is read
+	// again once it changed, checked every CRLReloadInterval, 10 minutes by
+	// default. The previous CRLs are kept if it can't be read anymore. The
+	// resumed TLS sessions aren't checked again, see TLSSessionCacheSize.
+	// They can't be combined with ServerVerifier.
+	CRL               []byte
+	CRLFile           string
+	CRLReloadInterval time.Duration
+
+	// OCSPStapling, if set, verifies the OCSP responses the remote servers
+	// staple to the handshake, which crypto/tls always requests. The
+	// response must be signed by the issuer of the certificate of the
+	// server, or a responder it delegated to, be within its validity window
+	// and tell the certificate is good, or the connection is rejected before
+	// anything is relayed. It tells what to do when a server staples none:
+	// OCSPStapleAllow, OCSPStapleWarn or OCSPStapleFail. Unlike the CRLs,
+	// the responses of resumed TLS sessions are checked again.
+	OCSPStapling OCSPStaplePolicy
+
+	// AllowExpiredCRL makes the CRLs past their next update still be
+	// checked, with a warning, instead of rejecting the servers whose chain
+	// they cover, i.e: while the CA is late to publish the next ones.
+	AllowExpiredCRL bool
+
+	// MinTLSVersion and MaxTLSVersion restrict the TLS versions of the
+	// connections to the remote servers, tls.VersionTLS12 or
+	// tls.VersionTLS13, i.e: to require TLS 1.3. By default TLS 1.2 and
+	// later are used.
+	MinTLSVersion uint16
+	MaxTLSVersion uint16
+
+	// CipherSuites restricts the cipher suites of the connections to the
+	// remote servers that use TLS 1.2, by default the ones of crypto/tls are
+	// used. Only the secure suites of tls.CipherSuites can be given. The
+	// suites of TLS 1.3 can't be configured, so CipherSuites can't be set
+	// if MinTLSVersion is TLS 1.3.
+	CipherSuites []uint16
+
+	// SecurityPolicy restricts the connections to the remote servers to a
+	// preset of TLS versions, cipher suites and curves, i.e:
+	// SecurityPolicyFIPS for the deployments that must only negotiate FIPS
+	// approved algorithms. It can't be set along with MinTLSVersion,
+	// MaxTLSVersion or CipherSuites. By default they're used instead.
+	SecurityPolicy SecurityPolicy
+
+	// TLSSessionCacheSize is how many TLS sessions with the remote server of
+	// each instance are kept, so the next connections resume them with an
+	// abbreviated handshake rather than a full one, which dominates the
+	// setup of the connections of the pools churning them. A resumed
+	// session isn't verified again, the certificate of the server was when
+	// the session was established. The sessions are dropped along with the
+	// certs of the instance, once they're refreshed or invalidated. By
+	// default it's 64, a negative value disables the resumption.
+	TLSSessionCacheSize int
+
+	// KeyLogWriter, if set, receives the secrets of the TLS connections to
+	// the remote servers in the NSS key log format, the one of
+	// SSLKEYLOGFILE, so tools like Wireshark can decrypt captures of the
+	// tunnels while debugging. Anyone with the secrets can decrypt the
+	// traffic, it must never be set in production. It's called by one
+	// handshake at a time.
+	KeyLogWriter io.Writer
+
+	// AddrResolver, if set, resolves the remote address of the instances
+	// along with their certs, the address is cached and refreshed with
+	// them. It overrides RemoteAddr and RemoteAddrs, and is overridden by
+	// Cert.RemoteAddr. If the connection to the resolved address fails, the
+	// address is resolved again once before failing. By default the
+	// CertSource is used if it implements AddrResolver.
+	AddrResolver AddrResolver
+
+	// TLSConfigHook, if set, is called with the TLS config of every
+	// connection to the remote servers right before its handshake, i.e: to
+	// set a custom ClientSessionCache or experimental CurvePreferences, or
+	// the KeyLogWriter of a single instance. The configs of the instances
+	// are cached, the hook runs on a clone of the cached one for every
+	// connection, so it may modify it, or return another config. Returning
+	// nil keeps the given config. A returned config inherits the client
+	// certificates, the root CAs, the server name and the verification of
+	// the given one it doesn't set, so they can only be dropped by clearing
+	// them on the given config. A panic of the hook is logged and fails the
+	// connection, without retrying it. The hooks of different connections
+	// run concurrently.
+	TLSConfigHook func(instance string, cfg *tls.Config) *tls.Config
+
+	// OnConnect, OnHandshake and OnClose, if not nil, are called along the
+	// life of every connection, the ones accepted on the local addresses
+	// and the ones returned by Dial. For a given connection they're called
+	// in that order, from the goroutine establishing it for the first two,
+	// and never while the client holds a lock. The hooks of different
+	// connections run concurrently. A panic of a hook is logged and
+	// recovered.
+	//
+	// OnConnect is called before anything is dialed, with the ID, the
+	// instance and the client address of the connection. Returning an
+	// error, or panicking, rejects the connection.
+	OnConnect func(ctx context.Context, info ConnInfo) error
+
+	// OnHandshake is called once the TLS handshake with the remote server
+	// succeeded, before any data is relayed. It's not called with
+	// InsecureRemotePlaintext.
+	OnHandshake func(info ConnInfo, state tls.ConnectionState)
+
+	// OnClose is called exactly once for every connection OnConnect
+	// accepted, once it's closed or its setup failed. err is the setup
+	// error, a *CloseError if the proxy closed the connection, or nil if
+	// one of its peers did.
+	OnClose func(info ConnInfo, bytesIn, bytesOut int64, err error)
+
+	// EventBufferSize is the size of the buffer of the Events channel. By
+	// default it's 256.
+	EventBufferSize int
+
+	// RecentEvents is the number of recent events kept in memory and served
+	// by the admin handler, whether Events is called or not. By default it's
+	// 1000, a negative value disables keeping them.
+	RecentEvents int
+
+	// StatsD configures pushing the client's metrics to a StatsD server
+	// while the client is running. Disabled by default.
+	StatsD StatsDOptions
+
+	// Labels are attached to every event, log line and metric of the client,
+	// and are returned by the admin API, i.e: to attribute them to a
+	// deployment, team or environment. Keys must match
+	// [a-zA-Z_][a-zA-Z0-9_]* and must not start with "__".
+	Labels map[string]string
+
+	// InstanceLabels overrides or extends Labels for the events of the given
+	// instances, keyed by instance name.
+	InstanceLabels map[string]map[string]string
+
+	// CaptureDir enables capturing the unencrypted traffic of every tunnel
+	// to its own file in the given directory, for debugging. The files
+	// contain the queries and results as they are, nothing is redacted. Use
+	// PrintCapture to read them. Capturing stops once the files reach
+	// CaptureMaxBytes in total, which must be set.
+	CaptureDir      string
+	CaptureMaxBytes int64
+
+	// MaxPacketSize enables framing the MySQL packets sent by local clients
+	// and caps their size, continuations included. A client sending a bigger
+	// packet gets an ER_NET_PACKET_TOO_LARGE error and is disconnected. The
+	// payloads are never buffered. If zero, the traffic is forwarded as is.
+	// The X Protocol connections are always forwarded as they are, and so
+	// are the MySQL sessions once the client negotiated TLS or compression
+	// in its handshake response, which have no limit.
+	MaxPacketSize int64
+
+	// ParseServerGreetings reads the greeting of the MySQL server when a
+	// classic protocol tunnel is established, before OnHandshake is called,
+	// to record the version of the server and the id of the connection on
+	// it in the ConnInfo, the EventDisconnect events and
+	// Stats.ServerVersions. The greeting is relayed to the client unchanged.
+	// A server that doesn't greet within 10 seconds is tunneled as it is.
+	ParseServerGreetings bool
+
+	// MaxBytesPerConnection caps the bytes a single tunnel may transfer, both
+	// directions together, i.e: to limit how much data a leaked credential
+	// can exfiltrate. The tunnel is closed once the quota is exceeded. With
+	// MaxPacketSize set, a local client sending data past the quota gets an
+	// ER_USER_LIMIT_REACHED error first. Zero means unlimited.
+	MaxBytesPerConnection int64
+
+	// InstanceMaxBytesPerConnection overrides MaxBytesPerConnection for the
+	// given instances, keyed by instance name. Zero means unlimited.
+	InstanceMaxBytesPerConnection map[string]int64
+
+	// MaxConnectionLifetime caps how long a tunnel stays open, so the
+	// clients reconnect and pick up rotated certificates and new remote
+	// endpoints. Once a tunnel is older, it's closed as soon as no bytes
+	// went through it for a moment, or after a grace period of 10 seconds
+	// at the latest. Its EventDisconnect has the reason "max_lifetime".
+	// Zero means unlimited.
+	MaxConnectionLifetime time.Duration
+
+	// StallTimeout closes the tunnels whose remote server didn't send a
+	// single byte for that long after the local client sent it data, e.g:
+	// a query, so a remote connection that silently died, i.e: once a
+	// firewall forgot about it, doesn't hold the client forever. Idle
+	// tunnels, with no data left unanswered, are never considered stalled.
+	// It must be longer than the slowest query, which doesn't answer until
+	// it's done. Their EventDisconnect has the reason "stalled". Zero
+	// means no limit, otherwise it must be at least a millisecond.
+	StallTimeout time.Duration
+
+	// HalfCloseTimeout is how long a tunnel keeps relaying the data of one
+	// direction once the peer of the other direction closed its writing
+	// side, e.g: the response the server is still sending after the client
+	// sent its last request. The end of the closed direction is passed on
+	// as a half-close to the other peer. By default it's 30 seconds, a
+	// negative value closes both directions right away instead.
+	HalfCloseTimeout time.Duration
+
+	// CopyBufferSize is the size of the buffer each direction of a tunnel
+	// is copied through. Larger buffers need fewer reads and writes for
+	// large result sets and bulk loads, at the cost of memory per
+	// connection. By default it's 32KiB, it must be between 512 bytes and
+	// 16MiB.
+	CopyBufferSize int
+
 	// Logger defines which zap.Logger to use. Use it to override the default
-	// Development logger . Useful for tests.
+	// Development logger . Useful for tests. Applications logging with
+	// another library can bridge it with their own zapcore.Core. The details
+	// of every connection are logged at the debug level.
 	Logger *zap.Logger
 }
 
 // NewClient creates a new proxy client instance
 func NewClient(opts Options) (*Client, error) {
 	c := &Client{
-		certSource:  opts.CertSource,
-		localAddr:   opts.LocalAddr,
-		remoteAddr:  opts.RemoteAddr,
-		instance:    opts.Instance,
-		configCache: newtlsCache(),
-		done:        make(chan struct{}),
+		certSource:     opts.CertSource,
+		remoteAddr:     opts.RemoteAddr,
+		instance:       opts.Instance,
+		maxConnections: opts.MaxConnections,
+		setupTimeout:   opts.SetupTimeout,
+		setupRetries:   opts.SetupRetries,
+
+		maxConnectionsWait:  opts.MaxConnectionsWait,
+		protocolAwareErrors: opts.ProtocolAwareErrors,
+
+		slowSetupThreshold: defaultSlowSetupThreshold,
+		maxConnLifetime:    opts.MaxConnectionLifetime,
+		lifetimeGrace:      defaultLifetimeGrace,
+
+		insecurePlaintext: opts.InsecureRemotePlaintext,
+		allowedPeerUIDs:   opts.AllowedPeerUIDs,
+		allowedPeerGIDs:   opts.AllowedPeerGIDs,
+		allowAllNetworks:  opts.AllowAllNetworks,
+		socketMode:        opts.LocalSocketMode,
+		socketGID:         -1,
+		statsd:            opts.StatsD,
+		stats:             newClientStats(),
+		conns:             make(map[*trackedConn]struct{}),
+
+		verifyPeerCertificate: opts.VerifyPeerCertificate,
+		serverVerifier:        opts.ServerVerifier,
+		onConnectHook:         opts.OnConnect,
+		onHandshakeHook:       opts.OnHandshake,
+		onCloseHook:           opts.OnClose,
+		tlsConfigHook:         opts.TLSConfigHook,
+		parseGreetings:        opts.ParseServerGreetings,
+		addrResolver:          opts.AddrResolver,
+		serverName:            strings.TrimSpace(opts.ServerName),
+		dialer:                opts.Dialer,
+		configCache:           newtlsCache(),
+		certFetches:           newCertFetches(),
+		csrKeys:               newCSRKeys(),
+		done:                  make(chan struct{}),
+		quit:                  make(chan struct{}),
+		created:               time.Now(),
 	}
 
-	if opts.Logger != nil {
-		c.log = opts.Logger
-	} else {
-		logger, err := zap.NewDevelopment(
-			zap.Fields(zap.String("app", "sql-proxy-client")),
-		)
+	pins, err := parsePins(opts.PinnedFingerprints)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PinnedFingerprints: %w", err)
+	}
+	c.pins = pins
+
+	if err := validateTLSVersions(opts.MinTLSVersion, opts.MaxTLSVersion, opts.CipherSuites); err != nil {
+		return nil, err
+	}
+	c.minTLSVersion = opts.MinTLSVersion
+	if c.minTLSVersion == 0 {
+		c.minTLSVersion = tls.VersionTLS12
+	}
+	c.maxTLSVersion = opts.MaxTLSVersion
+	c.cipherSuites = opts.CipherSuites
+	if opts.SecurityPolicy != "" {
+		policy, err := lookupSecurityPolicy(opts.SecurityPolicy, opts.MinTLSVersion, opts.MaxTLSVersion, opts.CipherSuites)
 		if err != nil {
 			return nil, err
 		}
-		zap.ReplaceGlobals(logger)
-		c.log = logger
+		c.securityPolicy = opts.SecurityPolicy
+		c.minTLSVersion = policy.minVersion
+		c.maxTLSVersion = policy.maxVersion
+		c.cipherSuites = policy.cipherSuites
+		c.curvePreferences = policy.curves
+		c.allowedSuites = policy.allowedSuites
+	}
+	if opts.KeyLogWriter != nil {
+		c.keyLog = &keyLogWriter{w: opts.KeyLogWriter}
+	}
+	switch {
+	case opts.TLSSessionCacheSize == 0:
+		c.tlsSessionCacheSize = defaultTLSSessionCacheSize
+	case opts.TLSSessionCacheSize > 0:
+		c.tlsSessionCacheSize = opts.TLSSessionCacheSize
 	}
 
-	return c, nil
-}
-
-// Conn represents a connection from a client to a specific instance.
-type Conn struct {
-	Instance string
-	Conn     net.Conn
-}
+	if opts.ServerVerifier != nil && opts.VerifyPeerCertificate != nil {
+		return nil, errors.New("VerifyPeerCertificate can't be combined with ServerVerifier, wrap DefaultServerVerifier instead")
+	}
 
-// Run runs the proxy. It listens to the configured localhost address and
-// proxies the connection over a TLS tunnel to the remote DB instance.
-func (c *Client) Run(ctx context.Context) error {
-	// cache the certs for the given instance. This will also validate the
-	// input and ensure to exit early.
-	_, _, err := c.clientCerts(context.Background(), c.instance)
-	if err != nil {
-		return &CertError{msg: err.Error()}
+	switch opts.NameVerification {
+	case "":
+		c.nameVerification = VerifyEither
+	case VerifyEither, VerifySAN, VerifyCN:
+		c.nameVerification = opts.NameVerification
+	default:
+		return nil, fmt.Errorf("NameVerification must be %q, %q or %q, got %q", VerifyEither, VerifySAN, VerifyCN, opts.NameVerification)
 	}
 
-	c.log.Info("ready for new connections")
-	l, err := c.getListener()
-	if err != nil {
-		return fmt.Errorf("error net.Listen: %w", err)
+	if opts.ServerSPIFFEID != "" {
+		if opts.ServerVerifier != nil {
+			return nil, errors.New("ServerSPIFFEID can't be combined with ServerVerifier")
+		}
+		id, err := parseSPIFFEID(strings.TrimSpace(opts.ServerSPIFFEID))
+		if err != nil {
+			return nil, fmt.Errorf("invalid ServerSPIFFEID: %w", err)
+		}
+		c.serverSPIFFEID = id
 	}
-	defer c.log.Sync() // nolint: errcheck
 
-	c.listener = l
-	close(c.done)
+	switch opts.OCSPStapling {
+	case "", OCSPStapleAllow, OCSPStapleWarn, OCSPStapleFail:
+		c.ocspStapling = opts.OCSPStapling
+	default:
+		return nil, fmt.Errorf("OCSPStapling must be %q, %q or %q, got %q", OCSPStapleAllow, OCSPStapleWarn, OCSPStapleFail, opts.OCSPStapling)
+	}
 
-	return c.run(ctx, l)
-}
+	switch opts.RemoteNetwork {
+	case "", "tcp":
+		c.remoteNetwork = "tcp"
+	case "tcp4", "tcp6":
+		c.remoteNetwork = opts.RemoteNetwork
+	default:
+		return nil, fmt.Errorf("RemoteNetwork must be \"tcp\", \"tcp4\" or \"tcp6\", got %q", opts.RemoteNetwork)
+	}
 
-// LocalAddr returns the address of the local listener. This is by default
-// blocking and will only return if the proxy is invoked with the Run() method.
-func (c *Client) LocalAddr() (net.Addr, error) {
-	<-c.done
+	c.fallbackDelay = opts.FallbackDelay
+	if c.fallbackDelay == 0 {
+		c.fallbackDelay = defaultFallbackDelay
+	}
+	if c.dialer == nil {
+		c.dialer = &net.Dialer{FallbackDelay: c.fallbackDelay}
+	}
 
-	if c.listener == nil {
-		return nil, errors.New("listener is not set")
+	c.dialTimeout = phaseTimeout(opts.DialTimeout, defaultDialTimeout)
+	c.handshakeTimeout = phaseTimeout(opts.HandshakeTimeout, defaultHandshakeTimeout)
 
+	if opts.KeepAlivePeriod < 0 {
+		return nil, errors.New("KeepAlivePeriod must not be negative")
+	}
+	if opts.MaxConnectionsWait < 0 {
+		return nil, errors.New("MaxConnectionsWait must not be negative")
+	}
+	if c.maxConnections > 0 {
+		c.connSlots = newConnSemaphore(c.maxConnections)
+	}
+	if opts.ResolveInterval < 0 {
+		return nil, errors.New("ResolveInterval must not be negative")
+	}
+	if opts.TCPUserTimeout < 0 {
+		return nil, errors.New("TCPUserTimeout must not be negative")
+	}
+	if opts.TCPUserTimeout > 0 && !tcpUserTimeoutSupported {
+		return nil, fmt.Errorf("TCPUserTimeout is not supported on %s", runtime.GOOS)
+	}
+	c.keepAlivePeriod = opts.KeepAlivePeriod
+	c.disableKeepAlive = opts.DisableKeepAlive
+	c.tcpUserTimeout = opts.TCPUserTimeout
+	c.remoteKeepAlive = opts.KeepAlivePeriod > 0 || opts.DisableKeepAlive || opts.TCPUserTimeout > 0
+	c.noDelay = opts.NoDelay
+	if c.keepAlivePeriod == 0 {
+		c.keepAlivePeriod = defaultKeepAlivePeriod
 	}
-	return c.listener.Addr(), nil
-}
 
-func (c *Client) getListener() (net.Listener, error) {
-	if strings.HasPrefix(c.localAddr, "unix://") {
-		p := strings.TrimPrefix(c.localAddr, "unix://")
-		if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
-			return nil, fmt.Errorf("failed to remove unix domain socket file %s, error: %s", p, err)
+	if opts.Instance != "" {
+		if _, _, _, err := ParseInstance(opts.Instance); err != nil {
+			return nil, fmt.Errorf("invalid Instance: %w", err)
 		}
-		return net.Listen("unix", p)
 	}
-	return net.Listen("tcp", c.localAddr)
-}
 
-// run is an internal function for testing the Client proxy event loop for
-// handling TCP connections
-func (c *Client) run(ctx context.Context, l net.Listener) error {
-	connSrc := make(chan Conn, 1)
-	go func() {
-		if err := c.listen(l, connSrc); err != nil {
-			c.log.Error("listen to local address", zap.Error(err))
+	if opts.InsecureRemotePlaintext && opts.RemoteAddr == "" && len(opts.RemoteAddrs) == 0 && len(opts.Instances) == 0 {
+		return nil, errors.New("InsecureRemotePlaintext requires RemoteAddr to be set")
+	}
+
+	// without certificates, the first connection would be the one failing
+	if opts.CertSource == nil && !opts.InsecureRemotePlaintext {
+		return nil, errors.New("CertSource must be set unless InsecureRemotePlaintext is set")
+	}
+	if c.addrResolver == nil {
+		if resolver, ok := opts.CertSource.(AddrResolver); ok {
+			c.addrResolver = resolver
 		}
-	}()
+	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			termTimeout := time.Second * 1
-			c.log.Info("received context cancellation, waiting until timeout",
-				zap.Duration("timeout", termTimeout))
+	if opts.RemoteAddr != "" {
+		remoteAddr, err := normalizeRemoteAddr(opts.RemoteAddr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RemoteAddr: %w", err)
+		}
+		c.remoteAddr = remoteAddr
+	}
 
-			err := c.Shutdown(termTimeout)
+	var remoteAddrs []string
+	if len(opts.RemoteAddrs) > 0 {
+		if opts.RemoteAddr != "" {
+			return nil, errors.New("RemoteAddr and RemoteAddrs can't be set together")
+		}
+		for _, addr := range opts.RemoteAddrs {
+			remoteAddr, err := normalizeRemoteAddr(addr)
 			if err != nil {
-				return fmt.Errorf("error during shutdown: %v", err)
+				return nil, fmt.Errorf("invalid RemoteAddrs: %w", err)
 			}
-			return nil
-		case conn := <-connSrc:
-			go func(lc Conn) {
-				// TODO(fatih): detach context from parent
-				err := c.handleConn(ctx, lc.Conn, lc.Instance)
-				if err != nil {
-					c.log.Error("error proxying conns", zap.Error(err))
-				}
-			}(conn)
+			remoteAddrs = append(remoteAddrs, remoteAddr)
 		}
 	}
-}
+	switch opts.RemoteProbe.Mode {
+	case "", ProbeTCP:
+	case ProbeTLS:
+		if opts.InsecureRemotePlaintext {
+			return nil, errors.New("RemoteProbe.Mode tls can't be used with InsecureRemotePlaintext")
+		}
+		if opts.Instance == "" {
+			return nil, errors.New("RemoteProbe.Mode tls requires Instance to be set")
+		}
+	default:
+		return nil, fmt.Errorf("unknown RemoteProbe.Mode %q", opts.RemoteProbe.Mode)
+	}
 
-// listen listens to the client's localAddres and sends each incoming
-// connections to the given connSrc channel.
-func (c *Client) listen(l net.Listener, connSrc chan<- Conn) error {
-	c.log.Info("listening remote DB instance",
-		zap.String("local_addr", c.localAddr),
-		zap.String("instance", c.instance),
-	)
+	if err := validateLabels(opts.Labels); err != nil {
+		return nil, fmt.Errorf("invalid Labels: %w", err)
+	}
+	c.labels = mergeLabels(nil, opts.Labels)
 
-	for {
-		start := time.Now()
-		conn, err := l.Accept()
-		if err != nil {
-			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
-				d := 10*time.Millisecond - time.Since(start)
-				if d > 0 {
-					time.Sleep(d)
-				}
-				continue
-			}
-			l.Close()
+	for instance, labels := range opts.InstanceLabels {
+		if _, _, _, err := ParseInstance(instance); err != nil {
+			return nil, fmt.Errorf("invalid InstanceLabels: %w", err)
+		}
+		if err := validateLabels(labels); err != nil {
+			return nil, fmt.Errorf("invalid InstanceLabels for instance %q: %w", instance, err)
+		}
+		if c.instanceLabels == nil {
+			c.instanceLabels = make(map[string]map[string]string)
+		}
+		c.instanceLabels[instance] = mergeLabels(nil, labels)
+	}
+	for instance, labels := range c.instanceLabels {
+		if c.mergedLabels == nil {
+			c.mergedLabels = make(map[string]map[string]string)
+		}
+		c.mergedLabels[instance] = mergeLabels(c.labels, labels)
+	}
 
-			return fmt.Errorf("error in accept for on %v: %w", c.localAddr, err)
+	if opts.CaptureDir != "" {
+		if opts.CaptureMaxBytes <= 0 {
+			return nil, errors.New("CaptureMaxBytes must be set to capture traffic")
+		}
+		if err := os.MkdirAll(opts.CaptureDir, 0700); err != nil {
+			return nil, fmt.Errorf("couldn't create capture directory: %w", err)
 		}
+		c.capture = &capturer{
+			dir:      opts.CaptureDir,
+			maxBytes: opts.CaptureMaxBytes,
+		}
+	}
 
-		c.log.Info("new connection", zap.String("conn_addr", l.Addr().String()))
+	if opts.MaxPacketSize < 0 {
+		return nil, errors.New("MaxPacketSize must not be negative")
+	}
+	c.maxPacketSize = uint64(opts.MaxPacketSize)
 
-		switch clientConn := conn.(type) {
-		case *net.TCPConn:
-			clientConn.SetKeepAlive(true)                  //nolint: errcheck
-			clientConn.SetKeepAlivePeriod(1 * time.Minute) //nolint: errcheck
+	if opts.MaxBytesPerConnection < 0 {
+		return nil, errors.New("MaxBytesPerConnection must not be negative")
+	}
+	c.maxBytesPerConn = opts.MaxBytesPerConnection
+	for instance, quota := range opts.InstanceMaxBytesPerConnection {
+		if _, _, _, err := ParseInstance(instance); err != nil {
+			return nil, fmt.Errorf("invalid InstanceMaxBytesPerConnection: %w", err)
 		}
-
-		connSrc <- Conn{
-			Conn:     conn,
-			Instance: c.instance,
+		if quota < 0 {
+			return nil, fmt.Errorf("InstanceMaxBytesPerConnection for instance %q must not be negative", instance)
 		}
+		if c.instanceMaxBytesPerConn == nil {
+			c.instanceMaxBytesPerConn = make(map[string]int64)
+		}
+		c.instanceMaxBytesPerConn[instance] = quota
 	}
-}
 
-func (c *Client) handleConn(ctx context.Context, conn net.Conn, instance string) error {
-	log := c.log.With(zap.String("instance", instance))
-	active := atomic.AddUint64(&c.connectionsCounter, 1)
+	if opts.MaxConnectionLifetime < 0 {
+		return nil, errors.New("MaxConnectionLifetime must not be negative")
+	}
+	if opts.StallTimeout < 0 {
+		return nil, errors.New("StallTimeout must not be negative")
+	}
+	if opts.StallTimeout > 0 && opts.StallTimeout < minStallTimeout {
+		return nil, fmt.Errorf("StallTimeout must be at least %s, got %s", minStallTimeout, opts.StallTimeout)
+	}
+	c.stallTimeout = opts.StallTimeout
+	if opts.CertRetryBackoff < 0 {
+		return nil, errors.New("CertRetryBackoff must not be negative")
+	}
+	switch {
+	case opts.CertRetries == 0:
+		c.certRetries = defaultCertRetries
+	case opts.CertRetries > 0:
+		c.certRetries = opts.CertRetries
+	}
+	c.certRetryBackoff = opts.CertRetryBackoff
+	if c.certRetryBackoff == 0 {
+		c.certRetryBackoff = defaultCertRetryBackoff
+	}
+	switch {
+	case opts.ClockSkewTolerance == 0:
+		c.clockSkewTolerance = defaultClockSkewTolerance
+	case opts.ClockSkewTolerance > 0:
+		c.clockSkewTolerance = opts.ClockSkewTolerance
+	}
+	c.halfCloseTimeout = phaseTimeout(opts.HalfCloseTimeout, defaultHalfCloseTimeout)
 
-	// Deferred decrement of ConnectionsCounter upon connection closing
-	defer atomic.AddUint64(&c.connectionsCounter, ^uint64(0))
+	c.copyBufferSize = opts.CopyBufferSize
+	if c.copyBufferSize == 0 {
+		c.copyBufferSize = defaultCopyBufferSize
+	}
+	if c.copyBufferSize < minCopyBufferSize || c.copyBufferSize > maxCopyBufferSize {
+		return nil, fmt.Errorf("CopyBufferSize must be between %d and %d bytes, got %d",
+			minCopyBufferSize, maxCopyBufferSize, opts.CopyBufferSize)
+	}
 
-	if c.maxConnections > 0 && active > c.maxConnections {
-		conn.Close()
-		return fmt.Errorf("too many open connections (max %d)", c.maxConnections)
+	if opts.StatsD.Addr != "" {
+		statsdAddr, err := normalizeRemoteAddr(opts.StatsD.Addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid StatsD.Addr: %w", err)
+		}
+		c.statsd.Addr = statsdAddr
+	}
+	if opts.StatsD.Interval < 0 {
+		return nil, errors.New("StatsD.Interval must not be negative")
 	}
 
-	cfg, remoteAddr, err := c.clientCerts(ctx, instance)
-	if err != nil {
-		return fmt.Errorf("couldn't retrieve certs for instance: %q: %w", instance, err)
+	c.listenerRestarts = opts.ListenerRestarts
+	if c.listenerRestarts == 0 {
+		c.listenerRestarts = defaultListenerRestarts
+	} else if c.listenerRestarts < 0 {
+		c.listenerRestarts = 0
 	}
 
-	// TODO(fatih): implement refreshing certs
-	// go p.refreshCeartAfter(instance, timeToRefresh)
+	if len(opts.Instances) > 0 {
+		if err := c.setInstances(opts); err != nil {
+			return nil, err
+		}
+	} else {
+		ll := &localListener{addr: opts.LocalAddr, instance: opts.Instance, protocol: ProtocolClassic}
+		if opts.LocalAddr != "" {
+			localAddr, err := normalizeLocalAddr(opts.LocalAddr)
+			if err != nil {
+				return nil, fmt.Errorf("invalid LocalAddr: %w", err)
+			}
+			ll.addr = localAddr
+		}
+
+		if opts.Listener != nil {
+			if opts.LocalAddr != "" {
+				return nil, errors.New("Listener and LocalAddr can't be set together")
+			}
+			ll.given = opts.Listener
+			ll.addr = opts.Listener.Addr().String()
+			// there's no way to re-create it
+			c.listenerRestarts = 0
+		}
+		c.listeners = []*localListener{ll}
 
-	// overwrite the remote address if the user explicitly set it
-	if c.remoteAddr != "" {
-		remoteAddr = c.remoteAddr
+		if opts.XLocalAddr != "" || opts.XRemoteAddr != "" {
+			if _, err := c.addXListener(opts.Instance, opts.XLocalAddr, opts.XRemoteAddr); err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	c.log.Info("connecting to remote server", zap.String("remote_addr", remoteAddr))
+	// the unix socket options apply to every local address
+	unixSockets := true
+	for _, ll := range c.listeners {
+		if !strings.HasPrefix(ll.addr, "unix://") {
+			unixSockets = false
+		}
+	}
 
-	var d net.Dialer
-	remoteConn, err := d.DialContext(ctx, "tcp", remoteAddr)
-	if err != nil {
-		conn.Close()
-		return fmt.Errorf("couldn't connect to %q: %v", remoteAddr, err)
+	if len(opts.AllowedPeerUIDs) > 0 || len(opts.AllowedPeerGIDs) > 0 {
+		if !peerCredentialsSupported {
+			return nil, fmt.Errorf("AllowedPeerUIDs and AllowedPeerGIDs are not supported on %s", runtime.GOOS)
+		}
+		if !unixSockets {
+			return nil, errors.New("AllowedPeerUIDs and AllowedPeerGIDs require a unix socket LocalAddr")
+		}
 	}
 
-	type setKeepAliver interface {
-		SetKeepAlive(keepalive bool) error
-		SetKeepAlivePeriod(d time.Duration) error
+	if len(opts.AllowedNetworks) > 0 {
+		if opts.AllowAllNetworks {
+			return nil, errors.New("AllowedNetworks and AllowAllNetworks can't be set together")
+		}
+		networks, err := normalizeNetworks(opts.AllowedNetworks)
+		if err != nil {
+			return nil, err
+		}
+		c.allowedNetworks = networks
 	}
 
-	if s, ok := conn.(setKeepAliver); ok {
-		if err := s.SetKeepAlive(true); err != nil {
-			log.Error("couldn't set KeepAlive to true", zap.Error(err))
-		} else if err := s.SetKeepAlivePeriod(keepAlivePeriod); err != nil {
-			log.Error("couldn't set KeepAlivePeriod", zap.Error(err), zap.Duration("keep_alive_period", keepAlivePeriod))
+	if opts.LocalSocketMode != 0 || opts.LocalSocketGroup != "" {
+		if !unixSockets {
+			return nil, errors.New("LocalSocketMode and LocalSocketGroup require a unix socket LocalAddr")
+		}
+	}
+	if c.socketMode == 0 {
+		c.socketMode = defaultSocketMode
+	}
+	if opts.LocalSocketMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("invalid LocalSocketMode %v: only permission bits may be set", opts.LocalSocketMode)
+	}
+	if opts.LocalSocketGroup != "" {
+		gid, err := lookupGroup(opts.LocalSocketGroup)
+		if err != nil {
+			return nil, fmt.Errorf("invalid LocalSocketGroup: %w", err)
 		}
+		c.socketGID = gid
+	}
+
+	eventBufferSize := opts.EventBufferSize
+	if eventBufferSize <= 0 {
+		eventBufferSize = defaultEventBufferSize
+	}
+	c.events = make(chan Event, eventBufferSize)
+
+	recentEvents := opts.RecentEvents
+	if recentEvents == 0 {
+		recentEvents = defaultRecentEvents
+	}
+	if recentEvents > 0 {
+		c.recentEvents = newEventRing(recentEvents)
+	}
+
+	if opts.Logger != nil {
+		c.log = opts.Logger
 	} else {
-		log.Warn("KeepAlive not supported: long-running tcp connections may be killed by the OS.")
+		logger, err := zap.NewDevelopment(
+			zap.Fields(zap.String("app", "sql-proxy-client")),
+		)
+		if err != nil {
+			return nil, err
+		}
+		zap.ReplaceGlobals(logger)
+		c.log = logger
 	}
 
-	secureConn := tls.Client(remoteConn, cfg)
-	if err := secureConn.Handshake(); err != nil {
-		secureConn.Close()
-		return fmt.Errorf("couldn't initiate TLS handshake to remote addr: %s", err)
+	if len(c.labels) > 0 {
+		c.log = c.log.With(zap.Strings("labels", sortedLabels(c.labels)))
 	}
 
-	// Hasta la vista, baby
-	copyThenClose(
-		secureConn,
-		conn,
-		"remote connection",
-		"local connection on "+conn.LocalAddr().String(),
-	)
-	return nil
-}
+	if c.capture != nil {
+		c.capture.log = c.log
+	}
 
-// clientCerts returns the TLS configuration needed for the TLS handshake and
-// connection
-func (c *Client) clientCerts(ctx context.Context, instance string) (*tls.Config, string, error) {
-	cacheEntry, err := c.configCache.Get(instance)
-	if err == nil {
-		c.log.Info("using tls.Config from the cache", zap.String("instance", instance))
-		return cacheEntry.cfg, cacheEntry.remoteAddr, nil
+	if opts.CertExpiryWarning < 0 {
+		c.certExpiry = newCertExpiry(c.log, 0)
+	} else {
+		c.certExpiry = newCertExpiry(c.log, phaseTimeout(opts.CertExpiryWarning, defaultCertExpiryWarning))
 	}
 
-	if err != errConfigNotFound {
-		return nil, "", err // we don't handle non errConfigNotFound errors
+	if len(opts.CRL) > 0 || opts.CRLFile != "" {
+		if opts.ServerVerifier != nil {
+			return nil, errors.New("CRL and CRLFile can't be combined with ServerVerifier")
+		}
+		if opts.CRLReloadInterval < 0 {
+			return nil, errors.New("CRLReloadInterval must not be negative")
+		}
+		interval := opts.CRLReloadInterval
+		if interval == 0 {
+			interval = defaultCRLReloadInterval
+		}
+		crls, err := newCRLSet(c.log, opts.CRL, opts.CRLFile, interval, opts.AllowExpiredCRL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid CRL: %w", err)
+		}
+		c.crls = crls
 	}
 
-	s := strings.Split(instance, "/")
-	if len(s) != 3 {
-		return nil, "", fmt.Errorf("instance format is malformed, should be in form organization/dbname/branch, have: %q", instance)
+	if c.securityPolicy != "" {
+		suites := make([]string, 0, len(c.allowedSuites))
+		for _, id := range c.allowedSuites {
+			suites = append(suites, tls.CipherSuiteName(id))
+		}
+		curves := make([]string, 0, len(c.curvePreferences))
+		for _, curve := range c.curvePreferences {
+			curves = append(curves, curve.String())
+		}
+		c.log.Info("using TLS security policy",
+			zap.String("policy", string(c.securityPolicy)),
+			zap.String("min_tls_version", tlsVersionName(c.minTLSVersion)),
+			zap.Strings("cipher_suites", suites),
+			zap.Strings("curves", curves))
 	}
 
-	cert, err := c.certSource.Cert(ctx, s[0], s[1], s[2])
-	if err != nil {
-		return nil, "", fmt.Errorf("couldn't retrieve certs from cert source: %s", err)
+	if _, ok := c.certSource.(*DevCertSource); ok {
+		c.log.Warn("INSECURE: using the ephemeral certificates of DevCertSource, which anyone with its files can impersonate both sides with. Only use it for local development")
 	}
 
-	fullAddr := fmt.Sprintf("%s:%d", cert.AccessHost, cert.Ports.Proxy)
+	if c.keyLog != nil {
+		c.log.Warn("the TLS secrets of the remote connections are written to KeyLogWriter, anyone with them can decrypt the traffic of the tunnels. Only use it for debugging")
+	}
 
-	cfg := &tls.Config{
-		ServerName:   cert.AccessHost,
-		Certificates: []tls.Certificate{cert.ClientCert},
-		MinVersion:   tls.VersionTLS12,
+	if len(remoteAddrs) > 0 {
+		c.endpoints = newEndpointSelector(remoteAddrs, opts.RemoteProbe, c.log)
+		c.endpoints.probe = c.probeEndpoint
 	}
 
-	c.log.Info("adding tls.Config to the cache", zap.String("instance", instance))
-	c.configCache.Add(instance, cfg, fullAddr)
-	return cfg, fullAddr, nil
+	if opts.ResolveInterval > 0 || opts.HostResolver != nil {
+		interval, resolver := opts.ResolveInterval, opts.HostResolver
+		if interval == 0 {
+			interval = defaultResolveInterval
+		}
+		if resolver == nil {
+			resolver = net.DefaultResolver
+		}
+		c.hosts = newHostCache(resolver, interval, c.log)
+	}
+
+	return c, nil
 }
 
-// Shutdown waits up to a given amount of time for all active connections to
-// close. Returns an error if there are still active connections after waiting
-// for the whole length of the timeout.
-func (c *Client) Shutdown(timeout time.Duration) error {
-	term, ticker := time.After(timeout), time.NewTicker(100*time.Millisecond)
-	defer ticker.Stop()
+// Conn represents a connection from a client to a specific instance.
+type Conn struct {
+	// ID identifies the connection in the logs, the events and the
+	// snapshots of the active connections.
+	ID       uint64
+	Instance string
+	Conn     net.Conn
 
-	for {
-		select {
-		case <-ticker.C:
-			if atomic.LoadUint64(&c.connectionsCounter) > 0 {
+	// Protocol is the protocol of the local listener that accepted the
+	// connection.
+	Protocol Protocol
+
+	// accepted is when the connection was accepted
+	accepted time.Time
+}
+
+// Run runs the proxy. It listens to the configured localhost address and
+// proxies the connection over a TLS tunnel to the remote DB instance. With
+// Instances set, it listens to the local address of each of them and fails
+// if any of them can't be bound, closing the others.
+func (c *Client) Run(ctx context.Context) error {
+	if c.insecurePlaintext {
+		for _, ll := range c.listeners {
+			c.log.Warn("INSECURE: connections to the remote address are NOT encrypted nor authenticated, never use this outside of local development",
+				zap.String("instance", ll.instance),
+				zap.String("remote_addr", c.remoteAddrFor(ll.instance, ll.protocol)))
+		}
+	} else {
+		// cache the certs for the given instances. This will also validate
+		// the input and ensure to exit early.
+		for _, ll := range c.listeners {
+			// the X Protocol listeners share the certs of their instance
+			if ll.protocol == ProtocolX {
 				continue
 			}
-			c.log.Info("no connections to wait, bailing out")
-		case <-term:
+			_, _, err := c.clientCerts(ctx, ll.instance)
+			if err != nil {
+				c.closeListeners()
+				c.closeDone()
+				return &CertError{Err: err}
+			}
 		}
-		break
 	}
 
-	active := atomic.LoadUint64(&c.connectionsCounter)
-	if active == 0 {
-		return nil
+	for _, ll := range c.listeners {
+		l, err := c.getListener(ll)
+		if err != nil {
+			c.closeListeners()
+			c.closeDone()
+			return fmt.Errorf("error net.Listen: %w", err)
+		}
+		ll.set(l)
 	}
-	return fmt.Errorf("%d active connections still exist after waiting for %v", active, timeout)
-}
+	c.log.Info("ready for new connections")
+	defer c.log.Sync() // nolint: errcheck
 
-func copyThenClose(remote, local io.ReadWriteCloser, remoteDesc, localDesc string) {
-	firstErr := make(chan error, 1)
+	c.closeDone()
 
-	go func() {
-		readErr, err := myCopy(remote, local)
-		select {
-		case firstErr <- err:
-			if readErr && err == io.EOF {
-				zap.L().Info("client closed connection",
-					zap.String("local_desc", localDesc))
-			} else {
-				logError(localDesc, remoteDesc, readErr, err)
-			}
-			remote.Close()
-			local.Close()
-		default:
+	if c.statsd.Addr != "" {
+		exporter, err := newStatsDExporter(c.statsd, c.labels, c.log)
+		if err != nil {
+			c.closeListeners()
+			return err
 		}
-	}()
 
-	readErr, err := myCopy(local, remote)
-	select {
-	case firstErr <- err:
-		if readErr && err == io.EOF {
-			zap.L().Info("instance closed connection",
-				zap.String("remote_desc", remoteDesc))
-		} else {
-			logError(remoteDesc, localDesc, readErr, err)
-		}
-		remote.Close()
-		local.Close()
-	default:
-		// In this case, the other goroutine exited first and already printed its
-		// error (and closed the things).
+		// the metrics are pushed a last time once all connections are
+		// closed.
+		stop, exported := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(exported)
+			exporter.run(stop, c.metrics)
+		}()
+		defer func() {
+			close(stop)
+			<-exported
+		}()
 	}
-}
 
-func logError(readDesc, writeDesc string, readErr bool, err error) {
+	if c.certExpiry.threshold > 0 {
+		stop, checked := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(checked)
+			c.certExpiry.run(stop)
+		}()
+		defer func() {
+			close(stop)
+			<-checked
+		}()
+	}
+
+	if c.endpoints != nil {
+		stop, probed := make(chan struct{}), make(chan struct{})
+		go func() {
+			defer close(probed)
+			c.endpoints.run(stop)
+		}()
+		defer func() {
+			close(stop)
+			<-probed
+		}()
+	}
+
+	return c.run(ctx)
+}
+
+// Ready returns a channel that is closed once Run bound the local listeners,
+// before the first connection is accepted. LocalAddr returns the bound
+// address then, i.e: with the port picked for a LocalAddr with port 0.
+// Connections made after it's closed wait in the backlog of the listener until
+// they're accepted. It's also closed if Run fails before listening, LocalAddr
+// returns an error in that case.
+func (c *Client) Ready() <-chan struct{} {
+	return c.done
+}
+
+func (c *Client) closeDone() {
+	c.doneOnce.Do(func() { close(c.done) })
+}
+
+// LocalAddr returns the address of the local listener. This is by default
+// blocking and will only return if the proxy is invoked with the Run() method.
+// With Instances set, it's the address of the first of them, see LocalAddrs.
+func (c *Client) LocalAddr() (net.Addr, error) {
+	<-c.done
+
+	l := c.currentListener()
+	if l == nil {
+		return nil, errors.New("listener is not set")
+
+	}
+	return l.Addr(), nil
+}
+
+// Stop triggers a graceful shutdown of the client, the same way cancelling the
+// context passed to Run does. It's safe to call Stop multiple times.
+func (c *Client) Stop() {
+	c.quitOnce.Do(func() { close(c.quit) })
+}
+
+// ready reports whether the client is listening for new connections on all
+// of its local addresses.
+func (c *Client) ready() bool {
+	if c.isDraining() {
+		return false
+	}
+	select {
+	case <-c.done:
+	default:
+		return false
+	}
+	for _, ll := range c.listeners {
+		if !ll.ready() {
+			return false
+		}
+	}
+	return true
+}
+
+// isDraining reports whether Shutdown began.
+func (c *Client) isDraining() bool {
+	return atomic.LoadInt32(&c.draining) == 1
+}
+
+// nextConnID returns the ID of a new connection. The IDs increase
+// monotonically, starting from 1.
+func (c *Client) nextConnID() uint64 {
+	return atomic.AddUint64(&c.lastConnID, 1)
+}
+
+// currentListener returns the listener the client accepts connections on,
+// the one of the first instance if there are several.
+func (c *Client) currentListener() net.Listener {
+	return c.listeners[0].current()
+}
+
+// closeListeners closes the listeners bound so far and the given ones.
+func (c *Client) closeListeners() {
+	for _, ll := range c.listeners {
+		if l := ll.current(); l != nil {
+			l.Close()
+		} else if ll.given != nil {
+			ll.given.Close()
+		}
+	}
+}
+
+func (c *Client) getListener(ll *localListener) (net.Listener, error) {
+	if ll.given != nil {
+		return ll.given, nil
+	}
+	if strings.HasPrefix(ll.addr, "unix://") {
+		return listenUnix(strings.TrimPrefix(ll.addr, "unix://"), c.socketMode, c.socketGID)
+	}
+	return net.Listen("tcp", ll.addr)
+}
+
+// listenerError is the error a listener failed with.
+type listenerError struct {
+	ll  *localListener
+	err error
+}
+
+// run is an internal function for testing the Client proxy event loop for
+// handling TCP connections
+func (c *Client) run(ctx context.Context) error {
+	connSrc := make(chan Conn, 1)
+	stop := make(chan struct{})
+	listenErr := make(chan listenerError, len(c.listeners))
+	var listenWg sync.WaitGroup
+	serve := func(ll *localListener, l net.Listener) {
+		listenWg.Add(1)
+		go func() {
+			defer listenWg.Done()
+			if err := c.listen(ll, l, connSrc, stop); err != nil {
+				listenErr <- listenerError{ll: ll, err: err}
+			}
+		}()
+	}
+	for _, ll := range c.listeners {
+		serve(ll, ll.current())
+	}
+
+	shutdown := func() error {
+		c.emit(Event{Type: EventShutdown})
+
+		// closing the listeners unblocks Accept right away, so we stop
+		// accepting new connections without waiting for the next one.
+		close(stop)
+		for _, ll := range c.listeners {
+			ll.current().Close()
+		}
+		listenWg.Wait()
+
+		termTimeout := time.Second * 1
+		c.log.Info("waiting for active connections to close",
+			zap.Duration("timeout", termTimeout))
+
+		err := c.Shutdown(termTimeout)
+		if err != nil {
+			return fmt.Errorf("error during shutdown: %v", err)
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			c.log.Info("received context cancellation")
+			return shutdown()
+		case <-c.quit:
+			c.log.Info("received stop request")
+			return shutdown()
+		case lerr := <-listenErr:
+			c.log.Error("listen to local address",
+				zap.String("instance", lerr.ll.instance),
+				zap.Error(lerr.err))
+			c.emit(Event{Type: EventListenerFailed, Instance: lerr.ll.instance, Error: lerr.err.Error()})
+			l, err := c.relisten(ctx, lerr.ll, lerr.err)
+			if err != nil {
+				if serr := shutdown(); serr != nil {
+					c.log.Error("shutdown after the listener failed", zap.Error(serr))
+				}
+				return err
+			}
+			if l == nil {
+				// stopped while re-creating the listener
+				return shutdown()
+			}
+			serve(lerr.ll, l)
+		case conn := <-connSrc:
+			if c.isDraining() {
+				atomic.AddUint64(&c.stats.queued, ^uint64(0))
+				conn.Conn.Close()
+				continue
+			}
+			go func(lc Conn) {
+				queued := time.Since(lc.accepted)
+				atomic.AddUint64(&c.stats.queued, ^uint64(0))
+				c.stats.queueWait.observe(queued)
+
+				// TODO(fatih): detach context from parent
+				err := c.handleConn(ctx, lc.Conn, lc.ID, lc.Instance, lc.Protocol, queued)
+				if err != nil && !errors.Is(err, errLocalClosed) {
+					fields := []zap.Field{
+						zap.Uint64("conn_id", lc.ID),
+						zap.String("instance", lc.Instance),
+						zap.Error(err),
+					}
+					if kind, ok := certErrorKindOf(err); ok {
+						fields = append(fields, zap.String("cert_error", string(kind)))
+					}
+					c.log.Error("error proxying conns", fields...)
+				}
+			}(conn)
+		}
+	}
+}
+
+// relisten re-creates the given local listener after it failed with the
+// given error, with a capped exponential backoff between attempts. It returns
+// a nil listener if the client is stopped in the meantime.
+func (c *Client) relisten(ctx context.Context, ll *localListener, cause error) (net.Listener, error) {
+	atomic.StoreInt32(&ll.listening, 0)
+	if c.listenerRestarts == 0 {
+		return nil, cause
+	}
+
+	backoff := listenerRestartBackoff
+	var err error
+	for attempt := 1; attempt <= c.listenerRestarts; attempt++ {
+		c.log.Warn("re-creating local listener",
+			zap.String("local_addr", ll.addr),
+			zap.Int("attempt", attempt),
+			zap.Int("max_attempts", c.listenerRestarts),
+			zap.Duration("backoff", backoff))
+
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, nil
+		case <-c.quit:
+			timer.Stop()
+			return nil, nil
+		}
+		if c.isDraining() {
+			return nil, nil
+		}
+
+		var l net.Listener
+		l, err = c.getListener(ll)
+		if err == nil {
+			atomic.AddUint64(&c.stats.listenerRestarts, 1)
+			ll.set(l)
+			c.log.Info("re-created local listener",
+				zap.String("local_addr", l.Addr().String()),
+				zap.Int("attempt", attempt))
+			return l, nil
+		}
+		c.log.Error("couldn't re-create local listener", zap.Int("attempt", attempt), zap.Error(err))
+
+		backoff *= 2
+		if backoff > maxListenerRestartBackoff {
+			backoff = maxListenerRestartBackoff
+		}
+	}
+
+	return nil, fmt.Errorf("couldn't re-create local listener after %d attempts: %w", c.listenerRestarts, err)
+}
+
+// listen accepts the connections to the given local listener and sends each
+// of them to the given connSrc channel, tagged with the listener's instance.
+// It returns once the listener is closed after stop is closed.
+func (c *Client) listen(ll *localListener, l net.Listener, connSrc chan<- Conn, stop <-chan struct{}) error {
+	c.log.Info("listening remote DB instance",
+		zap.String("local_addr", ll.addr),
+		zap.String("instance", ll.instance),
+		zap.String("protocol", string(ll.protocol)),
+	)
+
+	allowedNetworks := c.allowedNetworksOf(l.Addr())
+	if len(c.allowedNetworks) == 0 && allowedNetworks != nil {
+		c.log.Warn("local address isn't a loopback address, only accepting connections from the loopback addresses, set AllowedNetworks or AllowAllNetworks to accept others",
+			zap.String("local_addr", l.Addr().String()),
+		)
+	}
+
+	for {
+		start := time.Now()
+		conn, err := l.Accept()
+		if err != nil {
+			select {
+			case <-stop:
+				return nil
+			default:
+			}
+			// closed by Shutdown, it's not re-created
+			if c.isDraining() {
+				return nil
+			}
+
+			if nerr, ok := err.(net.Error); ok && nerr.Temporary() {
+				d := 10*time.Millisecond - time.Since(start)
+				if d > 0 {
+					time.Sleep(d)
+				}
+				continue
+			}
+			l.Close()
+
+			return fmt.Errorf("error in accept for on %v: %w", ll.addr, err)
+		}
+
+		accepted := time.Now()
+		id := c.nextConnID()
+		log := c.log.With(zap.Uint64("conn_id", id))
+		log.Debug("new connection", zap.String("conn_addr", l.Addr().String()))
+
+		// accepted right before Shutdown closed the listener
+		if c.isDraining() {
+			conn.Close()
+			continue
+		}
+
+		if !c.allowNetwork(log, conn, allowedNetworks) || !c.allowPeer(log, conn) {
+			atomic.AddUint64(&c.stats.rejectedPeers, 1)
+			conn.Close()
+			continue
+		}
+
+		atomic.AddUint64(&c.stats.queued, 1)
+		select {
+		case connSrc <- Conn{
+			ID:       id,
+			Conn:     conn,
+			Instance: ll.instance,
+			Protocol: ll.protocol,
+			accepted: accepted,
+		}:
+		case <-stop:
+			atomic.AddUint64(&c.stats.queued, ^uint64(0))
+			conn.Close()
+			return nil
+		}
+	}
+}
+
+// handleConn tunnels the given local connection, identified by id, to the
+// instance, over the given protocol. queued is how long the connection waited
+// to be handled after being accepted.
+func (c *Client) handleConn(ctx context.Context, conn net.Conn, id uint64, instance string, protocol Protocol, queued time.Duration) error {
+	log := c.log.With(zap.Uint64("conn_id", id), zap.String("instance", instance))
+	if protocol == ProtocolX {
+		log = log.With(zap.String("protocol", string(protocol)))
+	}
+	if labels := c.instanceLabels[instance]; len(labels) > 0 {
+		log = log.With(zap.Strings("instance_labels", sortedLabels(labels)))
+	}
+
+	if s, ok := conn.(setKeepAliver); ok {
+		if err := c.setKeepAlive(s); err != nil {
+			log.Error("couldn't configure the keep alives of the local connection", zap.Error(err))
+		}
+	} else if conn.LocalAddr().Network() != "unix" && !c.disableKeepAlive {
+		// unix sockets can't be cut by the network, they don't need keep
+		// alives
+		log.Warn("KeepAlive not supported: long-running tcp connections may be killed by the OS.")
+	}
+	c.setNoDelay(log, conn, "local")
+
+	// connCtx is cancelled once the local client goes away during the setup,
+	// so we don't keep fetching certs or dialing for nobody.
+	connCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	watcher := watchAbandon(conn, cancel)
+	setupStart := time.Now()
+	remoteConn, err := c.dial(connCtx, id, instance, protocol, conn.RemoteAddr().String())
+	setup := time.Since(setupStart)
+	if queued+setup >= c.slowSetupThreshold {
+		log.Warn("slow connection setup",
+			zap.Duration("queued", queued),
+			zap.Duration("setup", setup),
+			zap.Bool("established", err == nil))
+	}
+	localConn, werr := watcher.stop()
+	if werr != nil {
+		if remoteConn != nil {
+			remoteConn.Close()
+		}
+		if errors.Is(werr, errLocalClosed) {
+			// not an error: the client connected and went away without
+			// sending anything, like load balancer health checks do
+			atomic.AddUint64(&c.stats.probeConnections, 1)
+			log.Debug("local client closed the connection without sending any data, probably a health check",
+				zap.Duration("setup", setup))
+		}
+		err = werr
+	}
+	if err != nil {
+		if werr == nil && c.protocolAwareErrors && errors.Is(err, ErrTooManyConnections) {
+			// best effort, the client might be gone already
+			if protocol == ProtocolX {
+				_ = writeXError(conn, erConCountError, "08004", "Too many connections")
+			} else {
+				_ = writeMySQLError(conn, 0, erConCountError, "08004", "Too many connections")
+			}
+		}
+		conn.Close()
+		return err
+	}
+
+	remoteConn.tracked.attach(localConn)
+
+	// the X Protocol has its own framing, its tunnels are relayed as they are
+	if c.maxPacketSize > 0 && protocol == ProtocolClassic {
+		limited := newPacketLimitConn(localConn, c.maxPacketSize)
+		if remoteConn.quota > 0 {
+			remoteConn.onQuotaExceeded = func(fromLocal bool) {
+				// only the client waiting for the response to its command can
+				// make sense of an error
+				if fromLocal {
+					limited.writeError(limited.lastSeq()+1, erUserLimitReached, "42000",
+						"Connection exceeded the proxy's byte quota")
+				}
+			}
+		}
+		localConn = limited
+	}
+
+	// Hasta la vista, baby
+	c.copyThenClose(
+		log,
+		remoteConn,
+		localConn,
+		"remote connection",
+		"local connection on "+conn.LocalAddr().String(),
+	)
+
+	// copyThenClose might return while the other copy direction is still
+	// closing the tunnel, make sure it's released before we return.
+	remoteConn.Close()
+	return nil
+}
+
+// setupWithRetries establishes the TLS tunnel to the remote address of the
+// given instance for the given protocol, retrying transient failures up to
+// the configured number of setup retries, with an exponential backoff and
+// jitter. If a setup timeout is configured, it bounds all attempts together.
+func (c *Client) setupWithRetries(ctx context.Context, instance string, protocol Protocol) (net.Conn, error) {
+	if c.setupTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.setupTimeout)
+		defer cancel()
+	}
+
+	backoff := setupRetryBackoff
+	refreshed := false
+	for attempt := 1; ; attempt++ {
+		conn, err := c.setup(ctx, instance, protocol)
+		if err != nil && !refreshed && isValidityError(err) && certsInvalidated(err) && ctx.Err() == nil {
+			// the certs may have been issued or verified with a skewed
+			// clock, fresh ones are worth a try before anything else. The
+			// failed ones were dropped by the setup, at most once per
+			// failedCertsInvalidationInterval, so the connections failing
+			// in the meantime don't all retrieve new ones.
+			refreshed = true
+			c.log.Warn("TLS handshake may have failed on the validity period of a certificate, refreshing the certs of the instance and retrying",
+				zap.String("instance", instance),
+				zap.Error(err))
+			conn, err = c.setup(ctx, instance, protocol)
+		}
+		if err == nil {
+			if attempt > 1 {
+				c.log.Info("connection setup succeeded after retrying",
+					zap.String("instance", instance),
+					zap.Int("attempts", attempt))
+			}
+			return conn, nil
+		}
+
+		if attempt > c.setupRetries || !isRetryable(err) || ctx.Err() != nil {
+			if attempt > 1 {
+				c.log.Warn("connection setup failed after retrying",
+					zap.String("instance", instance),
+					zap.Int("attempts", attempt),
+					zap.Error(err))
+			}
+			return nil, err
+		}
+
+		wait := retryBackoff(err, backoff)
+
+		c.log.Warn("connection setup failed, retrying",
+			zap.String("instance", instance),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+		atomic.AddUint64(&c.stats.setupRetries, 1)
+
+		select {
+		case <-ctx.Done():
+			return nil, err
+		case <-time.After(wait):
+		}
+		backoff *= 2
+	}
+}
+
+// phaseTimeout returns the timeout of a setup phase for the given option,
+// zero means no timeout.
+func phaseTimeout(opt, def time.Duration) time.Duration {
+	switch {
+	case opt == 0:
+		return def
+	case opt < 0:
+		return 0
+	default:
+		return opt
+	}
+}
+
+// withPhaseTimeout returns a context bounding a setup phase to the given
+// timeout, if any.
+func withPhaseTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// retryBackoff returns how long to wait before retrying after the given
+// error, the given backoff with some jitter. The cert source is backed off
+// harder if it's rate limiting us: its hint is honored up to
+// maxRateLimitedBackoff, and it's waited for at least minRateLimitedBackoff
+// without one.
+func retryBackoff(err error, backoff time.Duration) time.Duration {
+	wait := withJitter(backoff)
+	if certErrorKind(err) != CertErrorRateLimited {
+		return wait
+	}
+	if wait < minRateLimitedBackoff {
+		wait = minRateLimitedBackoff
+	}
+	if hint := retryAfter(err); hint > wait {
+		wait = hint
+	}
+	if wait > maxRateLimitedBackoff {
+		wait = maxRateLimitedBackoff
+	}
+	return wait
+}
+
+// withJitter returns the given backoff with a random jitter of up to half of
+// it added.
+func withJitter(backoff time.Duration) time.Duration {
+	return backoff + time.Duration(rand.Int63n(int64(backoff)/2+1))
+}
+
+// setup establishes the TLS tunnel to the remote address of the given
+// instance for the given protocol. With RemoteAddrs set, the endpoints are
+// tried in turn until one of them connects.
+func (c *Client) setup(ctx context.Context, instance string, protocol Protocol) (net.Conn, error) {
+	var timings SetupTimings
+	fail := func(phase SetupPhase, err error) error {
+		setupErr := &SetupError{Phase: phase, Timings: timings, Err: err}
+		if ctx.Err() == context.DeadlineExceeded {
+			setupErr.Timeout = c.setupTimeout
+		}
+		return setupErr
+	}
+	// failPhase is fail for a phase bounded by its own timeout, with the
+	// given context of the phase.
+	failPhase := func(phase SetupPhase, phaseCtx context.Context, timeout time.Duration, err error) error {
+		setupErr := fail(phase, err).(*SetupError)
+		// the deadline of the connection might expire right before the one
+		// of the context
+		if deadline, ok := phaseCtx.Deadline(); ok && setupErr.Timeout == 0 && !time.Now().Before(deadline) {
+			setupErr.Timeout = timeout
+			// the phase was bounded by the deadline of the whole setup
+			if setupDeadline, ok := ctx.Deadline(); ok && c.setupTimeout > 0 && !setupDeadline.After(deadline) {
+				setupErr.Timeout = c.setupTimeout
+			}
+		}
+		return setupErr
+	}
+
+	var cfg *tls.Config
+	var remoteAddr string
+	var certRemoteAddr, resolved bool
+	if !c.insecurePlaintext {
+		start := time.Now()
+		e, err := c.certEntry(ctx, instance)
+		timings.Cert = time.Since(start)
+		if err != nil {
+			return nil, fail(PhaseCert, fmt.Errorf("couldn't retrieve certs for instance: %q: %w", instance, err))
+		}
+		cfg, remoteAddr, certRemoteAddr, resolved = e.cfg, e.remoteAddr, e.certRemoteAddr, e.resolved
+
+		// TODO(fatih): implement refreshing certs
+		// go p.refreshCeartAfter(instance, timeToRefresh)
+	}
+
+	// overwrite the remote address if the user explicitly set it, unless
+	// the cert source did
+	if addr := c.remoteAddrOf(instance); addr != "" && !certRemoteAddr {
+		remoteAddr = addr
+	}
+
+	connect := func(remoteAddr string, fields []zap.Field) (net.Conn, error) {
+		c.log.Debug("connecting to remote server",
+			append([]zap.Field{zap.String("instance", instance), zap.String("remote_addr", remoteAddr)}, fields...)...)
+
+		start := time.Now()
+		dialCtx, cancel := withPhaseTimeout(ctx, c.dialTimeout)
+		remoteConn, err := c.dialRemote(dialCtx, remoteAddr)
+		timings.Dial = time.Since(start)
+		cancel()
+		if err != nil {
+			return nil, failPhase(PhaseDial, dialCtx, c.dialTimeout, &DialError{Addr: remoteAddr, Err: err})
+		}
+		if cfg == nil {
+			return remoteConn, nil
+		}
+
+		start = time.Now()
+		// the cached config is shared by all connections to the instance,
+		// every connection gets its own copy of it, which shares the cert
+		// pool, the verification and the sessions to resume, so crypto/tls
+		// and the hook are free to use it.
+		connCfg, err := c.tlsConfigFor(instance, cfg.Clone())
+		if err != nil {
+			remoteConn.Close()
+			return nil, fail(PhaseHandshake, err)
+		}
+		var recorder handshakeRecorder
+		recorder.wrap(connCfg)
+		secureConn := tls.Client(remoteConn, connCfg)
+		handshakeCtx, cancel := withPhaseTimeout(ctx, c.handshakeTimeout)
+		defer cancel()
+		// the deadline also bounds the reads and writes of a connection of a
+		// Dialer that doesn't respect the context
+		if deadline, ok := handshakeCtx.Deadline(); ok {
+			remoteConn.SetDeadline(deadline) // nolint: errcheck
+		}
+		err = secureConn.HandshakeContext(handshakeCtx)
+		timings.Handshake = time.Since(start)
+		if err == nil {
+			err = remoteConn.SetDeadline(time.Time{})
+		}
+		if err != nil {
+			secureConn.Close()
+
+			handshakeErr := &HandshakeError{
+				RemoteAddr: remoteAddr,
+				ServerName: connCfg.ServerName,
+				Chain:      recorder.summaries(),
+				Version:    secureConn.ConnectionState().Version,
+				Err:        err,
+			}
+			if cert := rejectedCertificate(err); cert != nil {
+				handshakeErr.Peer = summarizeCertificate(cert)
+			}
+			handshakeErr.Failure, handshakeErr.Alert = classifyHandshakeError(err)
+			handshakeErr.MinVersion, handshakeErr.MaxVersion = offeredVersions(connCfg)
+			c.logHandshakeError(instance, handshakeErr)
+			if handshakeErr.Failure.certRelated() {
+				handshakeErr.certsInvalidated = c.invalidateFailedCerts(instance, cfg, handshakeErr.Failure)
+			}
+			return nil, failPhase(PhaseHandshake, handshakeCtx, c.handshakeTimeout, handshakeErr)
+		}
+
+		state := secureConn.ConnectionState()
+		c.log.Debug("negotiated TLS with remote server",
+			zap.String("instance", instance),
+			zap.String("remote_addr", remoteAddr),
+			zap.String("tls_version", tlsVersionName(state.Version)),
+			zap.String("cipher_suite", tls.CipherSuiteName(state.CipherSuite)),
+			zap.Bool("resumed", state.DidResume))
+		return secureConn, nil
+	}
+
+	if protocol == ProtocolX {
+		// the X Protocol port is always set explicitly, it's neither
+		// resolved nor one of the RemoteAddrs
+		return connect(c.instanceXRemoteAddrs[instance], nil)
+	}
+	if resolved {
+		conn, err := connect(remoteAddr, nil)
+		var setupErr *SetupError
+		if err == nil || !errors.As(err, &setupErr) || setupErr.Phase != PhaseDial || ctx.Err() != nil {
+			return conn, err
+		}
+
+		// the instance may have moved since the address was resolved
+		addr, rerr := c.resolveAddr(ctx, instance)
+		if rerr != nil || addr == remoteAddr {
+			return nil, err
+		}
+		c.log.Info("remote address of the instance changed, connecting to the new one",
+			zap.String("instance", instance),
+			zap.String("previous_remote_addr", remoteAddr),
+			zap.String("remote_addr", addr))
+		c.configCache.setRemoteAddr(instance, addr)
+		return connect(addr, nil)
+	}
+	if c.endpoints == nil || certRemoteAddr {
+		return connect(remoteAddr, nil)
+	}
+
+	var err error
+	for _, e := range c.endpoints.candidates(time.Now()) {
+		var conn net.Conn
+		conn, err = connect(e.Addr, []zap.Field{zap.Duration("remote_latency", e.Latency)})
+		if err == nil {
+			c.endpoints.succeeded(e.Addr)
+			c.log.Debug("connected to remote endpoint",
+				zap.String("instance", instance),
+				zap.String("remote_addr", e.Addr))
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			// the connection was given up on, that says nothing about the
+			// endpoint
+			break
+		}
+
+		c.endpoints.failed(e.Addr, time.Now())
+		c.log.Warn("couldn't connect to remote endpoint",
+			zap.String("instance", instance),
+			zap.String("remote_addr", e.Addr),
+			zap.Error(err))
+	}
+	return nil, err
+}
+
+// clientCerts returns the TLS configuration needed for the TLS handshake and
+// connection
+func (c *Client) clientCerts(ctx context.Context, instance string) (*tls.Config, string, error) {
+	e, err := c.certEntry(ctx, instance)
+	if err != nil {
+		return nil, "", err
+	}
+	return e.cfg, e.remoteAddr, nil
+}
+
+// certEntry returns the cached TLS configuration of the instance, and the
+// remote address to connect to, retrieving the certificates of the instance
+// from the CertSource if they aren't cached. Concurrent calls missing the
+// cache share a single retrieval.
+func (c *Client) certEntry(ctx context.Context, instance string) (cacheEntry, error) {
+	for {
+		cacheEntry, err := c.configCache.Get(instance)
+		if err == nil {
+			c.log.Debug("using tls.Config from the cache", zap.String("instance", instance))
+			return cacheEntry, nil
+		}
+
+		if err != errConfigNotFound {
+			return cacheEntry, err // we don't handle non errConfigNotFound errors
+		}
+
+		fetch, started := c.certFetches.join(instance)
+		if started {
+			fetch.entry, fetch.err = c.fetchCertEntry(ctx, instance)
+			fetch.abandoned = fetch.err != nil && ctx.Err() != nil
+			c.certFetches.finish(instance, fetch)
+			return fetch.entry, fetch.err
+		}
+
+		select {
+		case <-ctx.Done():
+			return cacheEntry, fmt.Errorf("couldn't retrieve certs from cert source: %w", ctx.Err())
+		case <-fetch.done:
+		}
+		if !fetch.abandoned {
+			return fetch.entry, fetch.err
+		}
+	}
+}
+
+// fetchCertEntry retrieves the certificates of the instance from the
+// CertSource and caches the TLS configuration built from them.
+func (c *Client) fetchCertEntry(ctx context.Context, instance string) (cacheEntry, error) {
+	var cacheEntry cacheEntry
+	org, db, branch, err := ParseInstance(instance)
+	if err != nil {
+		return cacheEntry, err
+	}
+
+	// retrieved before the certificates so a reload in between isn't missed
+	if src, ok := c.certSource.(ReloadingCertSource); ok {
+		cacheEntry.reloaded = src.Reloaded()
+	}
+
+	cert, err := c.fetchCert(ctx, instance, org, db, branch)
+	if err != nil {
+		// the access to the instance was revoked or it was deleted, make
+		// sure the existing connections don't outlive it.
+		switch certErrorKind(err) {
+		case CertErrorUnauthorized, CertErrorNotFound:
+			c.InvalidateInstance(instance)
+		}
+		return cacheEntry, fmt.Errorf("couldn't retrieve certs from cert source: %w", &CertSourceError{
+			Kind:       certErrorKind(err),
+			RetryAfter: retryAfter(err),
+			Instance:   instance,
+			Err:        err,
+		})
+	}
+
+	if err := validateCert(cert); err != nil {
+		return cacheEntry, fmt.Errorf("cert source returned an invalid cert: %w", err)
+	}
+	if err := c.waitClientCertValid(ctx, instance, cert); err != nil {
+		return cacheEntry, fmt.Errorf("couldn't wait for the client certificate to become valid: %w", err)
+	}
+	c.certExpiry.record(instance, cert)
+
+	// the remote address of the cert source isn't needed if it's
+	// overwritten
+	switch {
+	case strings.TrimSpace(cert.RemoteAddr) != "":
+		cacheEntry.remoteAddr, err = normalizeRemoteAddr(strings.TrimSpace(cert.RemoteAddr))
+		cacheEntry.certRemoteAddr = true
+	case c.addrResolver != nil:
+		if cacheEntry.remoteAddr, err = c.resolveAddr(ctx, instance); err != nil {
+			return cacheEntry, err
+		}
+		cacheEntry.certRemoteAddr = true
+		cacheEntry.resolved = true
+	case strings.TrimSpace(cert.AccessHost) != "" || (c.remoteAddrOf(instance) == "" && c.endpoints == nil):
+		cacheEntry.remoteAddr, err = normalizeRemoteAddr(net.JoinHostPort(strings.TrimSpace(cert.AccessHost), strconv.Itoa(cert.Ports.Proxy)))
+	}
+	if err != nil {
+		return cacheEntry, fmt.Errorf("cert source returned an invalid remote address: %w", err)
+	}
+	cacheEntry.cfg = c.newTLSConfig(instance, cert)
+	cacheEntry.expiry = cert.Expiry
+
+	c.emit(Event{
+		Type:       EventCertRefresh,
+		Instance:   instance,
+		RemoteAddr: cacheEntry.remoteAddr,
+	})
+
+	c.log.Info("adding tls.Config to the cache", zap.String("instance", instance))
+	c.configCache.put(instance, cacheEntry)
+	return cacheEntry, nil
+}
+
+// fetchCert retrieves the certificates of the instance from the CertSource,
+// retrying the transient failures up to certRetries times while ctx isn't
+// done.
+func (c *Client) fetchCert(ctx context.Context, instance, org, db, branch string) (*Cert, error) {
+	backoff := c.certRetryBackoff
+	for attempt := 1; ; attempt++ {
+		cert, err := c.retrieveCert(ctx, instance, org, db, branch)
+		if err == nil || attempt > c.certRetries || !isTransientCertError(err) || ctx.Err() != nil {
+			return cert, err
+		}
+
+		wait := retryBackoff(err, backoff)
+		c.log.Warn("couldn't retrieve certs from cert source, retrying",
+			zap.String("instance", instance),
+			zap.Int("attempt", attempt),
+			zap.Duration("backoff", wait),
+			zap.Error(err))
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, err
+		case <-timer.C:
+		}
+		backoff *= 2
+	}
+}
+
+// retrieveCert retrieves the certificates of the instance from the
+// CertSource, having it sign the client certificate for a local key if it's
+// a CSRSigner.
+func (c *Client) retrieveCert(ctx context.Context, instance, org, db, branch string) (*Cert, error) {
+	cert, err := c.certSource.Cert(ctx, org, db, branch)
+	if err != nil {
+		return nil, err
+	}
+	if signer, ok := c.certSource.(CSRSigner); ok && cert != nil {
+		if err := c.signClientCert(ctx, signer, instance, cert); err != nil {
+			return nil, err
+		}
+	}
+	return cert, nil
+}
+
+// newTLSConfig builds the TLS config for connections to the remote server
+// of the given instance. The config is cached and shared by all connections
+// to the instance, so it must not be modified once it's built.
+func (c *Client) newTLSConfig(instance string, cert *Cert) *tls.Config {
+	cfg := &tls.Config{
+		ServerName:       strings.TrimSpace(cert.AccessHost),
+		MinVersion:       c.minTLSVersion,
+		MaxVersion:       c.maxTLSVersion,
+		CipherSuites:     c.cipherSuites,
+		CurvePreferences: c.curvePreferences,
+	}
+	if c.keyLog != nil {
+		cfg.KeyLogWriter = c.keyLog
+		c.log.Warn("writing the TLS secrets of the instance to KeyLogWriter",
+			zap.String("instance", instance))
+	}
+	// the sessions live and die with the config, so they're dropped once
+	// the certs of the instance are refreshed
+	if c.tlsSessionCacheSize > 0 {
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(c.tlsSessionCacheSize)
+	}
+
+	if c.serverName != "" {
+		cfg.ServerName = c.serverName
+	}
+	if serverName := strings.TrimSpace(cert.ServerName); serverName != "" {
+		cfg.ServerName = serverName
+	}
+	if !cert.ServerAuthOnly {
+		cfg.Certificates = []tls.Certificate{cert.ClientCert}
+		cfg.GetClientCertificate = clientCertificate(cert.ClientCert)
+	}
+	if c.ocspStapling != "" {
+		issuers := append(append([]*x509.Certificate{}, cert.Intermediates...), cert.CACerts...)
+		cfg.VerifyConnection = c.verifyOCSPStaple(instance, issuers)
+	}
+	if len(c.allowedSuites) > 0 {
+		verifySuite := verifyCipherSuite(c.securityPolicy, c.allowedSuites)
+		if verifyOCSP := cfg.VerifyConnection; verifyOCSP != nil {
+			cfg.VerifyConnection = func(state tls.ConnectionState) error {
+				if err := verifySuite(state); err != nil {
+					return err
+				}
+				return verifyOCSP(state)
+			}
+		} else {
+			cfg.VerifyConnection = verifySuite
+		}
+	}
+
+	if c.serverVerifier != nil {
+		// crypto/tls mustn't verify anything itself, it's all up to the
+		// custom verifier
+		cfg.InsecureSkipVerify = true // nolint: gosec
+		cfg.VerifyPeerCertificate = c.customServerVerifier(instance, c.serverVerifier(cert, cfg.ServerName))
+		return cfg
+	}
+
+	// crypto/tls only matches the server name against the SANs and doesn't
+	// take extra intermediates, the verification is done below for names
+	// that may be common names, to verify the chain only if there is no
+	// name, or with the intermediates of the cert.
+	manualVerify := len(cert.Intermediates) > 0 || c.nameVerification != VerifySAN
+	switch {
+	case c.serverSPIFFEID != "":
+		// the SVIDs usually have no DNS SANs, the chain is verified without
+		// the name, and the SPIFFE ID in its place
+		manualVerify = true
+	case cfg.ServerName == "":
+		c.log.Warn("no server name to verify the remote server certificate against, only its chain is verified",
+			zap.String("instance", instance))
+		manualVerify = true
+	}
+	cfg.InsecureSkipVerify = manualVerify // nolint: gosec
+	cfg.RootCAs = certPool(cert.CACerts)
+
+	// crypto/tls calls VerifyPeerCertificate only after it verified the
+	// chain and the server name itself, so the custom verification can only
+	// add checks on top of it.
+	verify := c.verifyPeerCertificate
+	roots, intermediates, serverName := cfg.RootCAs, cert.Intermediates, cfg.ServerName
+	nameVerification := c.nameVerification
+	spiffeID := c.serverSPIFFEID
+	if spiffeID != "" {
+		serverName = ""
+	}
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if manualVerify {
+			var err error
+			verifiedChains, err = verifyServerCertificate(rawCerts, roots, intermediates, serverName, nameVerification)
+			if err != nil {
+				return err
+			}
+		}
+		if spiffeID != "" && len(verifiedChains) > 0 && len(verifiedChains[0]) > 0 {
+			if err := verifySPIFFEID(verifiedChains[0][0], spiffeID); err != nil {
+				return &peerRejectedError{cert: verifiedChains[0][0], err: err}
+			}
+		}
+
+		if len(verifiedChains) == 0 || len(verifiedChains[0]) == 0 {
+			return fmt.Errorf("%w: no verified chains", errPeerRejected)
+		}
+
+		// log the root that anchored the chain, so it's visible when a
+		// rotated out CA isn't used anymore.
+		chain := verifiedChains[0]
+		root := chain[len(chain)-1]
+		fingerprint := sha256.Sum256(root.Raw)
+		c.log.Debug("verified remote server certificate",
+			zap.String("instance", instance),
+			zap.String("root_ca", root.Subject.String()),
+			zap.String("root_ca_sha256", hex.EncodeToString(fingerprint[:])),
+		)
+
+		if c.crls != nil {
+			if err := c.crls.verify(instance, verifiedChains); err != nil {
+				return err
+			}
+		}
+		if err := c.verifyPins(instance, chain[0]); err != nil {
+			return err
+		}
+		if verify == nil {
+			return nil
+		}
+		if err := verify(chain[0], verifiedChains); err != nil {
+			return &peerRejectedError{cert: chain[0], err: err}
+		}
+		return nil
+	}
+
+	return cfg
+}
+
+// customServerVerifier wraps the verifier of ServerVerifier for the given
+// instance, so the rejected certificates are reported like the ones the
+// built-in verification rejects.
+func (c *Client) customServerVerifier(instance string, verify func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if verify == nil {
+			return fmt.Errorf("%w: ServerVerifier returned no verifier", errPeerRejected)
+		}
+		if err := verify(rawCerts, verifiedChains); err != nil {
+			if rejectedCertificate(err) != nil {
+				return err
+			}
+			var leaf *x509.Certificate
+			if len(rawCerts) > 0 {
+				leaf, _ = x509.ParseCertificate(rawCerts[0])
+			}
+			return &peerRejectedError{cert: leaf, err: err}
+		}
+
+		c.log.Debug("verified remote server certificate with ServerVerifier",
+			zap.String("instance", instance))
+
+		if len(c.pins) == 0 {
+			return nil
+		}
+		leaf, err := x509.ParseCertificate(rawCerts[0])
+		if err != nil {
+			return fmt.Errorf("couldn't parse the certificate of the remote server: %w", err)
+		}
+		return c.verifyPins(instance, leaf)
+	}
+}
+
+// DefaultServerVerifier returns the built-in verification of the certificate
+// of the remote server, for the given cert of an instance and the name it's
+// reached by: the chain is verified against the CACerts of the cert, or the
+// host's root CA set if there are none, and the name as mode tells. The name
+// isn't verified if it's empty. It's meant to be wrapped by a
+// ServerVerifier, which passes it the certificates the server presented.
+func DefaultServerVerifier(cert *Cert, serverName string, mode NameVerification) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+	roots := certPool(cert.CACerts)
+	if mode == "" {
+		mode = VerifyEither
+	}
+	return func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		_, err := verifyServerCertificate(rawCerts, roots, cert.Intermediates, serverName, mode)
+		return err
+	}
+}
+
+// certPool returns a pool of the given certificates, nil if there are none.
+func certPool(certs []*x509.Certificate) *x509.CertPool {
+	if len(certs) == 0 {
+		return nil
+	}
+	pool := x509.NewCertPool()
+	for _, cert := range certs {
+		pool.AddCert(cert)
+	}
+	return pool
+}
+
+// verifyServerCertificate verifies the chain of the certificates presented
+// by the remote server the way crypto/tls does, with the given extra
+// intermediates, and that the leaf is issued for serverName as mode tells.
+// The name isn't verified if it's empty.
+func verifyServerCertificate(rawCerts [][]byte, roots *x509.CertPool, intermediates []*x509.Certificate, serverName string, mode NameVerification) ([][]*x509.Certificate, error) {
+	if len(rawCerts) == 0 {
+		return nil, errors.New("remote server presented no certificate")
+	}
+
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the certificate of the remote server: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+
+	opts := x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: x509.NewCertPool(),
+	}
+	for _, cert := range certs[1:] {
+		opts.Intermediates.AddCert(cert)
+	}
+	for _, cert := range intermediates {
+		opts.Intermediates.AddCert(cert)
+	}
+	chains, err := certs[0].Verify(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if serverName != "" {
+		if err := verifyServerName(certs[0], serverName, mode); err != nil {
+			return nil, err
+		}
+	}
+	return chains, nil
+}
+
+// verifyServerName verifies that the certificate is issued for the given
+// name, in its SANs or its common name as mode tells.
+func verifyServerName(cert *x509.Certificate, name string, mode NameVerification) error {
+	switch mode {
+	case VerifySAN:
+		return cert.VerifyHostname(name)
+	case VerifyCN:
+		if cert.Subject.CommonName != name {
+			return fmt.Errorf("x509: certificate common name is %q, not %s", cert.Subject.CommonName, name)
+		}
+		return nil
+	}
+
+	// the common name only counts for the certificates without SANs
+	hasSANs := len(cert.DNSNames) > 0 || len(cert.IPAddresses) > 0 ||
+		len(cert.EmailAddresses) > 0 || len(cert.URIs) > 0
+	if !hasSANs && cert.Subject.CommonName == name {
+		return nil
+	}
+	return cert.VerifyHostname(name)
+}
+
+// validateCert validates the cert returned by a CertSource.
+func validateCert(cert *Cert) error {
+	if cert == nil {
+		return errors.New("cert is nil")
+	}
+
+	if cert.ServerAuthOnly {
+		if len(cert.ClientCert.Certificate) > 0 {
+			return errors.New("client certificate is set, but the cert is marked as server auth only")
+		}
+		return nil
+	}
+
+	if len(cert.ClientCert.Certificate) == 0 {
+		return errors.New("client certificate is empty")
+	}
+
+	if cert.ClientCert.PrivateKey == nil {
+		return errors.New("client certificate has no private key")
+	}
+
+	return nil
+}
+
+// ParseInstance parses an instance name in the form of
+// "organization/database/branch" into its components, which are passed to
+// CertSource.Cert. None of them can be empty or contain a slash.
+func ParseInstance(instance string) (org, db, branch string, err error) {
+	s := strings.Split(instance, "/")
+	if len(s) != 3 || s[0] == "" || s[1] == "" || s[2] == "" {
+		return "", "", "", fmt.Errorf("instance format is malformed, should be in form organization/dbname/branch, have: %q", instance)
+	}
+	return s[0], s[1], s[2], nil
+}
+
+// Shutdown is like ShutdownContext, with a drain deadline of the given
+// timeout from now.
+func (c *Client) Shutdown(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return c.ShutdownContext(ctx)
+}
+
+// ShutdownContext waits until all active connections closed, or until the
+// given context is done. The local listeners are closed first and new
+// connections, including the ones of Dial, are refused from then on, so the
+// active connections can only go down while waiting. The connections still
+// active once the context is done are closed by the proxy, along with their
+// remote connections, and a *ShutdownError with their number is returned.
+func (c *Client) ShutdownContext(ctx context.Context) error {
+	atomic.StoreInt32(&c.draining, 1)
+	c.closeListeners()
+
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadUint64(&c.connectionsCounter) > 0 {
+		select {
+		case <-ticker.C:
+			if atomic.LoadUint64(&c.connectionsCounter) > 0 {
+				continue
+			}
+			c.log.Info("no connections to wait, bailing out")
+		case <-ctx.Done():
+		}
+		break
+	}
+
+	if atomic.LoadUint64(&c.connectionsCounter) == 0 {
+		return nil
+	}
+
+	// the connections being set up now are closed once they're established
+	atomic.StoreInt32(&c.forceClosing, 1)
+	c.connsMu.Lock()
+	conns := make([]*trackedConn, 0, len(c.conns))
+	for t := range c.conns {
+		conns = append(conns, t)
+	}
+	c.connsMu.Unlock()
+	if len(conns) == 0 {
+		return nil
+	}
+
+	c.log.Warn("closing the connections still active after the drain deadline",
+		zap.Int("connections", len(conns)))
+	for _, t := range conns {
+		t.close(CloseReasonShutdown)
+	}
+	return &ShutdownError{ForceClosed: len(conns)}
+}
+
+// copyResult is how the copy of one direction of a tunnel ended, see myCopy.
+type copyResult struct {
+	n       int64
+	readErr bool
+	err     error
+}
+
+// copyThenClose copies data between the remote and local connections until
+// one of them is closed, then closes both. It returns the number of bytes
+// copied from the local to the remote connection (bytesIn) and from the
+// remote to the local connection (bytesOut). It logs to the given logger of
+// the connection.
+//
+// If HalfCloseTimeout isn't negative and a peer closes its writing side, the
+// other peer's writing side is closed as well, and the data of the other
+// direction keeps being copied for up to HalfCloseTimeout, so a response in
+// flight isn't cut.
+func (c *Client) copyThenClose(log *zap.Logger, remote, local io.ReadWriteCloser, remoteDesc, localDesc string) (bytesIn, bytesOut int64) {
+	halfCloseTimeout := c.halfCloseTimeout
+	inCh := make(chan copyResult, 1)
+	outCh := make(chan copyResult, 1)
+	go func() {
+		n, readErr, err := myCopy(remote, local, c.copyBufferSize)
+		inCh <- copyResult{n: n, readErr: readErr, err: err}
+	}()
+	go func() {
+		n, readErr, err := myCopy(local, remote, c.copyBufferSize)
+		outCh <- copyResult{n: n, readErr: readErr, err: err}
+	}()
+
+	// done logs how the copy of one direction ended. It reports whether
+	// the peer closed it cleanly, and its writing side only.
+	done := func(res copyResult, fromLocal bool) bool {
+		if res.readErr && res.err == io.EOF {
+			if fromLocal {
+				log.Debug("client closed connection",
+					zap.String("local_desc", localDesc))
+			} else {
+				log.Debug("instance closed connection",
+					zap.String("remote_desc", remoteDesc))
+			}
+			return true
+		}
+		if fromLocal {
+			logError(log, localDesc, remoteDesc, res.readErr, res.err)
+		} else {
+			logError(log, remoteDesc, localDesc, res.readErr, res.err)
+		}
+		return false
+	}
+
+	var in, out copyResult
+	var inDone, outDone bool
+	select {
+	case in = <-inCh:
+		inDone = true
+		if done(in, true) && halfCloseTimeout > 0 && closeWrite(remote) == nil {
+			out, outDone = waitHalfClosed(log, outCh, halfCloseTimeout)
+			if outDone {
+				done(out, false)
+			}
+		}
+	case out = <-outCh:
+		outDone = true
+		if done(out, false) && halfCloseTimeout > 0 && closeWrite(local) == nil {
+			in, inDone = waitHalfClosed(log, inCh, halfCloseTimeout)
+			if inDone {
+				done(in, true)
+			}
+		}
+	}
+
+	remote.Close()
+	local.Close()
+
+	// the other direction fails once the connections are closed, which
+	// isn't worth logging
+	if !inDone {
+		in = <-inCh
+	}
+	if !outDone {
+		out = <-outCh
+	}
+	return in.n, out.n
+}
+
+// waitHalfClosed waits for the copy of the direction that is still open
+// after the other one was half-closed, for up to the given timeout.
+func waitHalfClosed(log *zap.Logger, results <-chan copyResult, timeout time.Duration) (copyResult, bool) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-results:
+		return res, true
+	case <-timer.C:
+		log.Debug("half-closed connection timed out, closing it",
+			zap.Duration("timeout", timeout))
+		return copyResult{}, false
+	}
+}
+
+func logError(log *zap.Logger, readDesc, writeDesc string, readErr bool, err error) {
 	var desc string
 	if readErr {
 		desc = "reading data from " + readDesc
 	} else {
 		desc = "writing data to " + writeDesc
 	}
-	zap.L().Error("copy error", zap.String("desc", desc), zap.Error(err))
+	log.Error("copy error", zap.String("desc", desc), zap.Error(err))
 }
 
 // myCopy is similar to io.Copy, but reports whether the returned error was due
-// to a bad read or write. The returned error will never be nil
-func myCopy(dst io.Writer, src io.Reader) (readErr bool, err error) {
-	buf := make([]byte, 4096)
+// to a bad read or write. The returned error will never be nil. It copies
+// through a buffer of the given size, unless the kernel can copy the data
+// between dst and src, see spliceConns.
+func myCopy(dst io.Writer, src io.Reader, bufSize int) (written int64, readErr bool, err error) {
+	if dstConn, srcConn, count, ok := spliceConns(dst, src); ok {
+		return spliceCopy(dstConn, srcConn, count)
+	}
+
+	buf := make([]byte, bufSize)
 	for {
 		n, err := src.Read(buf)
 		if n > 0 {
-			if _, werr := dst.Write(buf[:n]); werr != nil {
+			nw, werr := dst.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
 				if err == nil {
-					return false, werr
+					return written, false, werr
 				}
 				// Read and write error; just report read error (it happened first).
-				return true, err
+				return written, true, err
 			}
 		}
 		if err != nil {
-			return true, err
+			return written, true, err
 		}
 	}
 }
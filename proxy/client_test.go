@@ -1,14 +1,23 @@
 package proxy
 
 import (
+	"bytes"
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 	"unsafe"
 
 	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
 	"go.uber.org/zap/zaptest"
+	"go.uber.org/zap/zaptest/observer"
 )
 
 func TestClient_Run_Cancellation(t *testing.T) {
@@ -28,11 +37,295 @@ func TestClient_Run_Cancellation(t *testing.T) {
 	<-done
 }
 
+func TestClient_Run_ShutdownIdle(t *testing.T) {
+	c := qt.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testListenOptions(t)
+	testOpts.Logger = zap.New(core)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	addr, err := client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+
+	start := time.Now()
+	cancel()
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return after the context was cancelled")
+	}
+	c.Assert(time.Since(start) < 500*time.Millisecond, qt.IsTrue, qt.Commentf("shutdown took %s", time.Since(start)))
+
+	// the listener must be closed
+	_, err = net.Dial("tcp", addr.String())
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	c.Assert(logs.FilterLevelExact(zap.ErrorLevel).All(), qt.HasLen, 0)
+}
+
+func TestClient_Shutdown_RefusesNewConnections(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	addr := startClient(t, client)
+
+	ping := func(conn net.Conn) error {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			return err
+		}
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+		_, err := io.ReadFull(conn, make([]byte, 4))
+		return err
+	}
+
+	held, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer held.Close()
+	c.Assert(ping(held), qt.IsNil)
+
+	// keep connecting while the client shuts down
+	stop := make(chan struct{})
+	var servedDuringDrain, refused int32
+	dialerDone := make(chan struct{})
+	go func() {
+		defer close(dialerDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			draining := client.isDraining()
+			conn, err := net.Dial("tcp", addr.String())
+			if err != nil {
+				atomic.AddInt32(&refused, 1)
+				continue
+			}
+			err = ping(conn)
+			conn.Close()
+			if err == nil && draining {
+				atomic.AddInt32(&servedDuringDrain, 1)
+			}
+			if err != nil {
+				atomic.AddInt32(&refused, 1)
+			}
+		}
+	}()
+
+	shutdown := make(chan error, 1)
+	go func() {
+		shutdown <- client.Shutdown(5 * time.Second)
+	}()
+	for !client.isDraining() {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(200 * time.Millisecond)
+	held.Close()
+
+	select {
+	case err := <-shutdown:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(10 * time.Second):
+		c.Fatal("Shutdown didn't return although the last connection was closed")
+	}
+	close(stop)
+	<-dialerDone
+
+	c.Assert(atomic.LoadInt32(&servedDuringDrain), qt.Equals, int32(0))
+	c.Assert(atomic.LoadInt32(&refused) > 0, qt.IsTrue)
+	c.Assert(client.ready(), qt.IsFalse)
+
+	_, err = client.Dial(context.Background(), "local/db/main")
+	c.Assert(err, qt.Equals, errShuttingDown)
+}
+
+func TestClient_Run_CancellationReleasesAddress(t *testing.T) {
+	c := qt.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testListenOptions(t)
+	testOpts.Logger = zap.New(core)
+
+	// the same address is bound again right after each run
+	for i := 0; i < 3; i++ {
+		client, err := NewClient(testOpts)
+		c.Assert(err, qt.IsNil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+		go func() {
+			done <- client.Run(ctx)
+		}()
+
+		addr, err := client.LocalAddr()
+		c.Assert(err, qt.IsNil)
+		testOpts.LocalAddr = addr.String()
+
+		cancel()
+		select {
+		case err := <-done:
+			c.Assert(err, qt.IsNil)
+		case <-time.After(5 * time.Second):
+			c.Fatal("Run didn't return after the context was cancelled")
+		}
+	}
+
+	l, err := net.Listen("tcp", testOpts.LocalAddr)
+	c.Assert(err, qt.IsNil)
+	l.Close()
+
+	c.Assert(logs.FilterLevelExact(zap.ErrorLevel).All(), qt.HasLen, 0)
+}
+
+func TestClient_Run_AddressInUse(t *testing.T) {
+	c := qt.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+
+	testOpts := testListenOptions(t)
+	testOpts.LocalAddr = l.Addr().String()
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, "error net.Listen: .*")
+		var opErr *net.OpError
+		c.Assert(errors.As(err, &opErr), qt.IsTrue)
+		c.Assert(opErr.Op, qt.Equals, "listen")
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return although the address is in use")
+	}
+
+	// the waiters don't hang
+	<-client.Ready()
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.ErrorMatches, "listener is not set")
+}
+
+func TestClient_Ready(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := NewClient(testListenOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	select {
+	case <-client.Ready():
+		c.Fatal("ready before Run was called")
+	default:
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+	defer func() {
+		cancel()
+		<-done
+	}()
+
+	select {
+	case <-client.Ready():
+	case <-time.After(5 * time.Second):
+		c.Fatal("not ready after Run was called")
+	}
+
+	addr, err := client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+	c.Assert(addr.(*net.TCPAddr).Port, qt.Not(qt.Equals), 0)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+}
+
+func TestClient_Run_Listener(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	l := newPipeListener()
+	testOpts := testOptions(t)
+	testOpts.Listener = l
+	testOpts.Instance = "myorg/mydb/mybranch"
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	localAddr, err := client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+	c.Assert(localAddr.String(), qt.Equals, "pipe")
+
+	conn, err := l.dial()
+	c.Assert(err, qt.IsNil)
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "hello")
+	conn.Close()
+
+	cancel()
+	select {
+	case err := <-done:
+		c.Assert(err, qt.IsNil)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return after the context was cancelled")
+	}
+
+	// the client closed the listener
+	_, err = l.dial()
+	c.Assert(err, qt.Equals, net.ErrClosed)
+}
+
+func TestClient_Listener_LocalAddr(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.Listener = newPipeListener()
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "Listener and LocalAddr can't be set together")
+}
+
 func TestClient_clientCerts(t *testing.T) {
 	c := qt.New(t)
 	ctx := context.Background()
 
-	clientCert := tls.Certificate{}
+	clientCert := newTestCA(t).clientCert(t, "client")
 	remoteAddr := "branchid.turtle.example.com"
 	wantRemoteAddr := "branchid.turtle.example.com:3306"
 	org, db, branch := "myorg", "mydb", "mybranch"
@@ -105,20 +398,1088 @@ func TestClient_SyncAtomicAlignment(t *testing.T) {
 	c.Assert(int(offset%64), qt.Equals, 0, qt.Commentf("Client.connectionsCounter is not aligned"))
 }
 
+func TestSyncAtomicAlignment(t *testing.T) {
+	// the 64-bit fields updated atomically must be 64-bit aligned on 32-bit
+	// platforms too, they're first in their struct, which is allocated on
+	// its own. Run with GOARCH=386 to check it.
+	var (
+		client    Client
+		dialed    dialedConn
+		stats     clientStats
+		counts    ByteCounts
+		histogram histogram
+		capturer  capturer
+	)
+	offsets := map[string]uintptr{
+		"Client.lastConnID":               unsafe.Offsetof(client.lastConnID),
+		"dialedConn.bytesIn":              unsafe.Offsetof(dialed.bytesIn),
+		"dialedConn.bytesOut":             unsafe.Offsetof(dialed.bytesOut),
+		"dialedConn.quota":                unsafe.Offsetof(dialed.quota),
+		"clientStats.connections":         unsafe.Offsetof(stats.connections),
+		"clientStats.setupFailures":       unsafe.Offsetof(stats.setupFailures),
+		"clientStats.setupRetries":        unsafe.Offsetof(stats.setupRetries),
+		"clientStats.eventsDropped":       unsafe.Offsetof(stats.eventsDropped),
+		"clientStats.rejectedPeers":       unsafe.Offsetof(stats.rejectedPeers),
+		"clientStats.listenerRestarts":    unsafe.Offsetof(stats.listenerRestarts),
+		"clientStats.queued":              unsafe.Offsetof(stats.queued),
+		"clientStats.quotaExceeded":       unsafe.Offsetof(stats.quotaExceeded),
+		"clientStats.probeConnections":    unsafe.Offsetof(stats.probeConnections),
+		"clientStats.connectionsWaited":   unsafe.Offsetof(stats.connectionsWaited),
+		"clientStats.connectionsRejected": unsafe.Offsetof(stats.connectionsRejected),
+		"ByteCounts.In":                   unsafe.Offsetof(counts.In),
+		"ByteCounts.Out":                  unsafe.Offsetof(counts.Out),
+		"histogram.count":                 unsafe.Offsetof(histogram.count),
+		"histogram.sum":                   unsafe.Offsetof(histogram.sum),
+		"capturer.written":                unsafe.Offsetof(capturer.written),
+		"capturer.seq":                    unsafe.Offsetof(capturer.seq),
+	}
+	for field, offset := range offsets {
+		t.Run(field, func(t *testing.T) {
+			qt.Assert(t, int(offset%8), qt.Equals, 0, qt.Commentf("%s is not aligned", field))
+		})
+	}
+}
+
 func testOptions(t *testing.T) Options {
 	return Options{
 		Logger: zaptest.NewLogger(t),
+		// tests connecting to an instance set their own
+		CertSource: &fakeCertSource{
+			CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				return nil, errors.New("the test has no cert source")
+			},
+		},
 	}
 }
 
+// testListenOptions returns options for a client that is able to listen on a
+// random local port, backed by a fake cert source.
+func testListenOptions(t *testing.T) Options {
+	opts := testOptions(t)
+	opts.LocalAddr = "127.0.0.1:0"
+	opts.Instance = "myorg/mydb/mybranch"
+	clientCert := newTestCA(t).clientCert(t, "client")
+	opts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return &Cert{
+				ClientCert: clientCert,
+				AccessHost: "branchid.turtle.example.com",
+				Ports: RemotePorts{
+					Proxy: 3307,
+				},
+			}, nil
+		},
+	}
+	return opts
+}
+
 type fakeCertSource struct {
 	CertFn        func(ctx context.Context, org, db, branch string) (*Cert, error)
 	CertFnInvoked bool
+
+	mu sync.Mutex // protects CertFnInvoked for concurrent calls
 }
 
 func (f *fakeCertSource) Cert(ctx context.Context, org, db, branch string) (*Cert, error) {
+	f.mu.Lock()
 	f.CertFnInvoked = true
+	f.mu.Unlock()
 
 	return f.CertFn(ctx, org, db, branch)
 
 }
+
+func TestClient_handleConn_SetupTimeout_Cert(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.SetupTimeout = 100 * time.Millisecond
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseCert)
+	c.Assert(setupErr.Timeout, qt.Equals, testOpts.SetupTimeout)
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, "connection setup timed out after 100ms during cert phase .*")
+}
+
+func TestClient_handleConn_SetupTimeout_Handshake(t *testing.T) {
+	c := qt.New(t)
+
+	// the remote accepts connections, but never responds to the handshake
+	testOpts := testListenOptions(t)
+	testOpts.RemoteAddr = startSilentBackend(t)
+	testOpts.SetupTimeout = 100 * time.Millisecond
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, testOpts.Instance, ProtocolClassic, 0)
+
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseHandshake)
+	c.Assert(setupErr.Timeout, qt.Equals, testOpts.SetupTimeout)
+	c.Assert(setupErr.Timings.Handshake > 0, qt.IsTrue)
+}
+
+// startSilentBackend starts a TCP server that accepts connections, but never
+// responds on them.
+func startSilentBackend(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestClient_handleConn_HandshakeTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.RemoteAddr = startSilentBackend(t)
+	testOpts.HandshakeTimeout = 100 * time.Millisecond
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, testOpts.Instance, ProtocolClassic, 0)
+
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseHandshake)
+	c.Assert(setupErr.Timeout, qt.Equals, testOpts.HandshakeTimeout)
+	c.Assert(err, qt.ErrorMatches, "connection setup timed out after 100ms during handshake phase .*: couldn't initiate TLS handshake to remote addr "+testOpts.RemoteAddr+" .*")
+
+	// the local connection is closed
+	_, err = remote.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+}
+
+// blackholeDialer never connects, until the context is done.
+type blackholeDialer struct{}
+
+func (blackholeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	<-ctx.Done()
+	return nil, &net.OpError{Op: "dial", Net: network, Err: ctx.Err()}
+}
+
+func TestClient_handleConn_DialTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.Dialer = blackholeDialer{}
+	testOpts.DialTimeout = 100 * time.Millisecond
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, testOpts.Instance, ProtocolClassic, 0)
+
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseDial)
+	c.Assert(setupErr.Timeout, qt.Equals, testOpts.DialTimeout)
+	c.Assert(err, qt.ErrorMatches, `connection setup timed out after 100ms during dial phase .*: couldn't connect to "branchid.turtle.example.com:3307": .*`)
+}
+
+func TestPhaseTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(phaseTimeout(0, defaultDialTimeout), qt.Equals, defaultDialTimeout)
+	c.Assert(phaseTimeout(time.Second, defaultDialTimeout), qt.Equals, time.Second)
+	c.Assert(phaseTimeout(-1, defaultDialTimeout), qt.Equals, time.Duration(0))
+}
+
+func TestClient_handleConn_LocalClientAbandons(t *testing.T) {
+	c := qt.New(t)
+
+	certCancelled := make(chan struct{})
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			<-ctx.Done()
+			close(certCancelled)
+			return nil, ctx.Err()
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	}()
+
+	remote.Close()
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, "local client closed the connection during setup: .*")
+		c.Assert(errors.Is(err, errLocalClosed), qt.IsTrue)
+	case <-time.After(5 * time.Second):
+		c.Fatal("handleConn didn't return after the local client closed the connection")
+	}
+
+	select {
+	case <-certCancelled:
+	default:
+		c.Fatal("cert retrieval wasn't cancelled")
+	}
+
+	// it's counted as a probe, not as a failure
+	stats := client.Stats()
+	c.Assert(stats.ProbeConnections, qt.Equals, uint64(1))
+	c.Assert(stats.SetupFailures, qt.Equals, uint64(0))
+}
+
+func TestClient_handleConn_FailedSetupIsNotProbe(t *testing.T) {
+	c := qt.New(t)
+
+	sent := make(chan struct{})
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			<-sent
+			return nil, errors.New("boom")
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	}()
+
+	// the client sent something before the setup failed, that's not a probe
+	_, err = remote.Write([]byte("x"))
+	c.Assert(err, qt.IsNil)
+	close(sent)
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, ".*boom")
+		c.Assert(errors.Is(err, errLocalClosed), qt.IsFalse)
+	case <-time.After(5 * time.Second):
+		c.Fatal("handleConn didn't return after the setup failed")
+	}
+
+	stats := client.Stats()
+	c.Assert(stats.ProbeConnections, qt.Equals, uint64(0))
+	c.Assert(stats.SetupFailures, qt.Equals, uint64(1))
+}
+
+// noDeadlineConn is a net.Conn that doesn't support deadlines.
+type noDeadlineConn struct {
+	net.Conn
+}
+
+func (noDeadlineConn) SetReadDeadline(time.Time) error {
+	return errors.New("deadlines not supported")
+}
+
+func TestAbandonWatcher_NoDeadline(t *testing.T) {
+	c := qt.New(t)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	// the pending read can only be unblocked by closing the connection
+	w := watchAbandon(noDeadlineConn{local}, func() {})
+	stopped := make(chan error, 1)
+	go func() {
+		_, err := w.stop()
+		stopped <- err
+	}()
+	select {
+	case err := <-stopped:
+		c.Assert(err, qt.ErrorMatches, "couldn't unblock the read of the local connection: deadlines not supported")
+		c.Assert(errors.Is(err, errLocalClosed), qt.IsFalse)
+	case <-time.After(5 * time.Second):
+		c.Fatal("stop blocked on the pending read")
+	}
+	_, err := remote.Write([]byte("x"))
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	// the read returned already
+	local, remote = net.Pipe()
+	defer remote.Close()
+	w = watchAbandon(noDeadlineConn{local}, func() {})
+	go remote.Write([]byte("x")) // nolint: errcheck
+	<-w.done
+	conn, err := w.stop()
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 1)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "x")
+}
+
+func TestClient_handleConn_WatchErrorIsNotProbe(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), noDeadlineConn{local}, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(err, qt.ErrorMatches, "couldn't unblock the read of the local connection: .*")
+	c.Assert(client.Stats().ProbeConnections, qt.Equals, uint64(0))
+}
+
+func TestClient_handleConn_SetupRetries(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.SetupRetries = 2
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			calls++
+			return nil, errors.New("service unavailable")
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(err, qt.ErrorMatches, ".*service unavailable")
+	c.Assert(calls, qt.Equals, 3)
+	c.Assert(client.Stats().SetupRetries, qt.Equals, uint64(2))
+
+	failed := logs.FilterMessage("connection setup failed after retrying").All()
+	c.Assert(failed, qt.HasLen, 1)
+	c.Assert(failed[0].ContextMap()["attempts"], qt.Equals, int64(3))
+}
+
+// flakyDialer fails the first dials, then dials for real.
+type flakyDialer struct {
+	failures int32
+}
+
+func (d *flakyDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if atomic.AddInt32(&d.failures, -1) >= 0 {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: errors.New("connection refused")}
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func TestClient_Dial_SetupRetries(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.Dialer = &flakyDialer{failures: 2}
+	testOpts.SetupRetries = 3
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	c.Assert(client.Stats().SetupRetries, qt.Equals, uint64(2))
+
+	succeeded := logs.FilterMessage("connection setup succeeded after retrying").All()
+	c.Assert(succeeded, qt.HasLen, 1)
+	c.Assert(succeeded[0].ContextMap()["attempts"], qt.Equals, int64(3))
+}
+
+func TestWithJitter(t *testing.T) {
+	c := qt.New(t)
+
+	for i := 0; i < 100; i++ {
+		d := withJitter(100 * time.Millisecond)
+		c.Assert(d >= 100*time.Millisecond && d <= 150*time.Millisecond, qt.IsTrue, qt.Commentf("%v", d))
+	}
+}
+
+func TestClient_handleConn_SetupRetries_Unauthorized(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	testOpts := testOptions(t)
+	testOpts.SetupRetries = 2
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			calls++
+			return nil, fmt.Errorf("%w: token was revoked", ErrUnauthorized)
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+	c.Assert(calls, qt.Equals, 1)
+	c.Assert(client.Stats().SetupRetries, qt.Equals, uint64(0))
+}
+
+func TestClient_handleConn_CertErrorKinds(t *testing.T) {
+	tests := []struct {
+		kind            CertErrorKind
+		wantCalls       int
+		wantMinWait     time.Duration
+		wantInvalidated bool
+	}{
+		{kind: CertErrorUnknown, wantCalls: 3},
+		{kind: CertErrorUnavailable, wantCalls: 3},
+		// the cert source is backed off for at least a second when it's
+		// rate limiting us
+		{kind: CertErrorRateLimited, wantCalls: 3, wantMinWait: 2 * time.Second},
+		{kind: CertErrorUnauthorized, wantCalls: 1, wantInvalidated: true},
+		{kind: CertErrorNotFound, wantCalls: 1, wantInvalidated: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.kind), func(t *testing.T) {
+			c := qt.New(t)
+
+			var calls int
+			testOpts := testOptions(t)
+			testOpts.SetupRetries = 2
+			// only the retries of the setup are counted
+			testOpts.CertRetries = -1
+			testOpts.CertSource = &fakeCertSource{
+				CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					calls++
+					return nil, &CertSourceError{Kind: tt.kind, Err: errors.New("cert source failed")}
+				},
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			// an established connection of the instance
+			existing, existingRemote := net.Pipe()
+			defer existingRemote.Close()
+			tracked := &trackedConn{instance: "myorg/mydb/mybranch", remote: existing}
+			client.track(tracked)
+
+			local, remote := net.Pipe()
+			defer remote.Close()
+
+			events := client.Events()
+			start := time.Now()
+			err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+			c.Assert(time.Since(start) >= tt.wantMinWait, qt.IsTrue)
+			c.Assert(err, qt.ErrorMatches, ".*cert source failed")
+			c.Assert(certErrorKind(err), qt.Equals, tt.kind)
+			e := <-events
+			c.Assert(e.Type, qt.Equals, EventSetupFailed)
+			c.Assert(e.CertError, qt.Equals, tt.kind)
+			c.Assert(calls, qt.Equals, tt.wantCalls)
+			c.Assert(client.Stats().SetupRetries, qt.Equals, uint64(tt.wantCalls-1))
+			c.Assert(client.Stats().CertErrorsByKind, qt.DeepEquals, map[string]uint64{string(tt.kind): 1})
+
+			wantReason := CloseReason("")
+			if tt.wantInvalidated {
+				wantReason = CloseReasonInvalidated
+			}
+			c.Assert(tracked.closeReason(), qt.Equals, wantReason)
+		})
+	}
+}
+
+func TestClient_handleConn_RateLimitedRetryAfter(t *testing.T) {
+	c := qt.New(t)
+
+	var calls []time.Time
+	testOpts := testOptions(t)
+	testOpts.SetupRetries = 1
+	testOpts.CertRetries = -1
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			calls = append(calls, time.Now())
+			return nil, &CertSourceError{
+				Kind:       CertErrorRateLimited,
+				RetryAfter: 300 * time.Millisecond,
+				Err:        errors.New("too many requests"),
+			}
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(err, qt.ErrorMatches, ".*too many requests")
+	c.Assert(calls, qt.HasLen, 2)
+
+	// the hint is longer than the backoff of the first retry
+	c.Assert(calls[1].Sub(calls[0]) >= 300*time.Millisecond, qt.IsTrue)
+}
+
+func TestRetryBackoff_RateLimitedCap(t *testing.T) {
+	c := qt.New(t)
+
+	err := &CertSourceError{
+		Kind:       CertErrorRateLimited,
+		RetryAfter: 24 * time.Hour,
+		Err:        errors.New("too many requests"),
+	}
+	c.Assert(retryBackoff(err, 100*time.Millisecond), qt.Equals, maxRateLimitedBackoff)
+}
+
+func TestClient_Run_CancelCertRetries(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.CertRetries = 5
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return nil, &CertSourceError{
+				Kind:       CertErrorRateLimited,
+				RetryAfter: time.Hour,
+				Err:        errors.New("too many requests"),
+			}
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	select {
+	case err := <-done:
+		var certErr *CertError
+		c.Assert(errors.As(err, &certErr), qt.IsTrue)
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't return after its context was cancelled")
+	}
+}
+
+func TestClient_handleConn_SetupRetries_Timeout(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	testOpts := testOptions(t)
+	testOpts.SetupRetries = 100
+	testOpts.SetupTimeout = 250 * time.Millisecond
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			calls++
+			return nil, errors.New("service unavailable")
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(err, qt.ErrorMatches, ".*service unavailable")
+
+	// the 100ms and 200ms backoffs only leave room for a single retry
+	c.Assert(calls, qt.Equals, 2)
+}
+
+var parseInstanceTests = []struct {
+	instance             string
+	org, db, branch, err string
+}{
+	{instance: "myorg/mydb/mybranch", org: "myorg", db: "mydb", branch: "mybranch"},
+	{instance: "myorg/mydb", err: "instance format is malformed.*"},
+	{instance: "myorg/mydb/mybranch/extra", err: "instance format is malformed.*"},
+	{instance: "myorg//mybranch", err: "instance format is malformed.*"},
+	{instance: "", err: "instance format is malformed.*"},
+}
+
+func TestNewClient_InvalidInstance(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.Instance = "myorg/mydb"
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `invalid Instance: instance format is malformed, .*`)
+}
+
+func TestParseInstance(t *testing.T) {
+	for _, tt := range parseInstanceTests {
+		t.Run(tt.instance, func(t *testing.T) {
+			c := qt.New(t)
+
+			org, db, branch, err := ParseInstance(tt.instance)
+			if tt.err != "" {
+				c.Assert(err, qt.ErrorMatches, tt.err)
+				return
+			}
+
+			c.Assert(err, qt.IsNil)
+			c.Assert(org, qt.Equals, tt.org)
+			c.Assert(db, qt.Equals, tt.db)
+			c.Assert(branch, qt.Equals, tt.branch)
+		})
+	}
+}
+
+func TestClient_InsecureRemotePlaintext(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "hello")
+}
+
+func TestNewClient_RequiresCertSource(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = nil
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "CertSource must be set unless InsecureRemotePlaintext is set")
+
+	testOpts.RemoteAddr = "127.0.0.1:3306"
+	testOpts.InsecureRemotePlaintext = true
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestClient_InsecureRemotePlaintext_RequiresRemoteAddr(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.InsecureRemotePlaintext = true
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "InsecureRemotePlaintext requires RemoteAddr to be set")
+}
+
+func TestClient_Run_ListenerRestart(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	startClient(t, client)
+	c.Assert(client.ready(), qt.IsTrue)
+
+	// the listener goes away behind the client's back
+	client.currentListener().Close()
+
+	for client.Stats().ListenerRestarts == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(client.ready(), qt.IsTrue)
+
+	localAddr, err := client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+}
+
+func TestClient_Run_ListenerRestartDisabled(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.ListenerRestarts = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(context.Background())
+	}()
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+
+	client.currentListener().Close()
+	c.Assert(<-done, qt.ErrorMatches, "error in accept .*")
+}
+
+func TestClient_Shutdown_ForceClosesLocalConnections(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	addr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	c.Assert(err, qt.IsNil)
+
+	err = client.Shutdown(200 * time.Millisecond)
+	c.Assert(err, qt.ErrorMatches, "1 active connections were force closed after the drain deadline")
+
+	// the local client is disconnected and the tunnel is released
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	for atomic.LoadUint64(&client.connectionsCounter) > 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestClient_ConnIDs(t *testing.T) {
+	c := qt.New(t)
+
+	core, logs := observer.New(zap.DebugLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	events := client.Events()
+	addr := startClient(t, client)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", addr.String())
+		c.Assert(err, qt.IsNil)
+		_, err = conn.Write([]byte("ping"))
+		c.Assert(err, qt.IsNil)
+		_, err = io.ReadFull(conn, make([]byte, 4))
+		c.Assert(err, qt.IsNil)
+
+		conns := client.Connections()
+		c.Assert(conns, qt.HasLen, 1)
+		c.Assert(conns[0].ID, qt.Equals, uint64(i+1))
+		conn.Close()
+
+		for e := range events {
+			if e.Type == EventDisconnect {
+				c.Assert(e.ConnID, qt.Equals, uint64(i+1))
+				break
+			}
+		}
+	}
+
+	// every line about a connection tells which one it is
+	for _, msg := range []string{"new connection", "client closed connection"} {
+		var ids []interface{}
+		for _, entry := range logs.FilterMessage(msg).All() {
+			ids = append(ids, entry.ContextMap()["conn_id"])
+		}
+		c.Assert(ids, qt.DeepEquals, []interface{}{uint64(1), uint64(2)}, qt.Commentf(msg))
+	}
+
+	// the connections returned by Dial get their own
+	conn, err := client.Dial(context.Background(), "local/db/main")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	c.Assert(client.Connections()[0].ID, qt.Equals, uint64(3))
+}
+
+func TestClient_ConnectionDetailsAtDebugLevel(t *testing.T) {
+	c := qt.New(t)
+
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	events := client.Events()
+	startClient(t, client)
+
+	pingClient(c, client)
+	for e := range events {
+		if e.Type == EventDisconnect {
+			break
+		}
+	}
+
+	for _, msg := range []string{"new connection", "connecting to remote server", "client closed connection"} {
+		c.Assert(logs.FilterMessage(msg).Len(), qt.Equals, 0, qt.Commentf(msg))
+	}
+}
+
+// drainThenRespond reads everything the client sends until it closes its
+// writing side, then responds with size bytes.
+func drainThenRespond(size int) func(conn net.Conn) {
+	return func(conn net.Conn) {
+		if _, err := io.Copy(io.Discard, conn); err != nil {
+			return
+		}
+		conn.Write(bytes.Repeat([]byte("x"), size)) // nolint: errcheck
+	}
+}
+
+func TestClient_HalfClose(t *testing.T) {
+	const size = 8 << 20
+
+	tests := []struct {
+		name    string
+		options func(t *testing.T) Options
+	}{
+		{
+			name: "plaintext",
+			options: func(t *testing.T) Options {
+				opts := testOptions(t)
+				opts.Instance = "local/db/main"
+				opts.RemoteAddr = startPlaintextBackend(t, drainThenRespond(size))
+				opts.InsecureRemotePlaintext = true
+				return opts
+			},
+		},
+		{
+			name: "TLS",
+			options: func(t *testing.T) Options {
+				ca := newTestCA(t)
+				addr := startTLSBackend(t, &tls.Config{
+					Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+				}, drainThenRespond(size))
+
+				opts := testOptions(t)
+				opts.Instance = "myorg/mydb/mybranch"
+				opts.CertSource = backendCertSource(t, ca, addr)
+				return opts
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			opts := tt.options(t)
+			opts.LocalAddr = "127.0.0.1:0"
+			client, err := NewClient(opts)
+			c.Assert(err, qt.IsNil)
+			addr := startClient(t, client)
+
+			conn, err := net.Dial("tcp", addr.String())
+			c.Assert(err, qt.IsNil)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("SELECT * FROM big_table"))
+			c.Assert(err, qt.IsNil)
+			c.Assert(conn.(*net.TCPConn).CloseWrite(), qt.IsNil)
+
+			// the whole response makes it through after the request was
+			// closed
+			conn.SetReadDeadline(time.Now().Add(10 * time.Second)) // nolint: errcheck
+			n, err := io.Copy(io.Discard, conn)
+			c.Assert(err, qt.IsNil)
+			c.Assert(n, qt.Equals, int64(size))
+		})
+	}
+}
+
+func TestClient_HalfClose_Timeout(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	// the server never responds nor closes
+	testOpts.RemoteAddr = startPlaintextBackend(t, func(conn net.Conn) {
+		io.Copy(io.Discard, conn) // nolint: errcheck
+		time.Sleep(time.Minute)
+	})
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.HalfCloseTimeout = 100 * time.Millisecond
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	addr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), qt.IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+}
+
+func TestClient_HalfClose_Disabled(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextBackend(t, drainThenRespond(1024))
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.HalfCloseTimeout = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	addr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.(*net.TCPConn).CloseWrite(), qt.IsNil)
+
+	// both directions are closed right away, the response is lost
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	n, _ := io.Copy(io.Discard, conn)
+	c.Assert(n, qt.Equals, int64(0))
+}
+
+func TestNewClient_CopyBufferSize(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.copyBufferSize, qt.Equals, defaultCopyBufferSize)
+
+	for _, size := range []int{-1, 1, 64 << 20} {
+		testOpts := testOptions(t)
+		testOpts.CopyBufferSize = size
+		_, err = NewClient(testOpts)
+		c.Assert(err, qt.ErrorMatches, fmt.Sprintf("CopyBufferSize must be between 512 and 16777216 bytes, got %d", size))
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CopyBufferSize = 1 << 20
+	client, err = NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.copyBufferSize, qt.Equals, 1<<20)
+}
+
+// BenchmarkMyCopy measures copying from a TCP connection through buffers of
+// the previous fixed size and of the default size.
+func BenchmarkMyCopy(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 1<<20)
+
+	for _, size := range []int{4 << 10, defaultCopyBufferSize} {
+		b.Run(fmt.Sprintf("%dKiB", size>>10), func(b *testing.B) {
+			l, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer l.Close()
+
+			go func() {
+				conn, err := l.Accept()
+				if err != nil {
+					return
+				}
+				defer conn.Close()
+				for i := 0; i < b.N; i++ {
+					if _, err := conn.Write(chunk); err != nil {
+						return
+					}
+				}
+			}()
+
+			conn, err := net.Dial("tcp", l.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+
+			b.SetBytes(int64(len(chunk)))
+			b.ResetTimer()
+			n, _, err := myCopy(io.Discard, conn, size)
+			if err != io.EOF {
+				b.Fatal(err)
+			}
+			if n != int64(b.N*len(chunk)) {
+				b.Fatalf("copied %d bytes, want %d", n, b.N*len(chunk))
+			}
+		})
+	}
+}
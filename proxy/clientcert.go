@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// clientCertificate returns the function presenting the given client
+// certificate to the remote servers requesting one. crypto/tls silently
+// presents no certificate when the server accepts none of the signature
+// algorithms its key can sign with, i.e: an Ed25519 key with a server only
+// accepting RSA and ECDSA, which the server then rejects with an opaque
+// alert. The handshake fails with an error naming the key algorithm instead.
+// The certificates not issued by one of the CAs the server asks for are
+// still left out, like crypto/tls does.
+func clientCertificate(cert tls.Certificate) func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(cri *tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		// the CAs are checked separately, they're a configuration matter
+		// on either side rather than a capability of the key.
+		keyOnly := *cri
+		keyOnly.AcceptableCAs = nil
+		if err := keyOnly.SupportsCertificate(&cert); err != nil {
+			schemes := make([]string, 0, len(cri.SignatureSchemes))
+			for _, scheme := range cri.SignatureSchemes {
+				schemes = append(schemes, scheme.String())
+			}
+			return nil, fmt.Errorf("remote server doesn't support the %s key of the client certificate (accepted signature algorithms: %s): %w",
+				keyAlgorithm(cert), strings.Join(schemes, ", "), err)
+		}
+
+		if err := cri.SupportsCertificate(&cert); err != nil {
+			return new(tls.Certificate), nil
+		}
+		return &cert, nil
+	}
+}
+
+// keyAlgorithm returns the name of the algorithm of the private key of the
+// given certificate, with its size or curve, i.e: "ECDSA P-256".
+func keyAlgorithm(cert tls.Certificate) string {
+	switch key := cert.PrivateKey.(type) {
+	case *rsa.PrivateKey:
+		return fmt.Sprintf("RSA %d", key.N.BitLen())
+	case *ecdsa.PrivateKey:
+		return "ECDSA " + key.Curve.Params().Name
+	case ed25519.PrivateKey:
+		return "Ed25519"
+	}
+
+	leaf := cert.Leaf
+	if leaf == nil && len(cert.Certificate) > 0 {
+		leaf, _ = x509.ParseCertificate(cert.Certificate[0])
+	}
+	if leaf != nil {
+		return leaf.PublicKeyAlgorithm.String()
+	}
+	return fmt.Sprintf("%T", cert.PrivateKey)
+}
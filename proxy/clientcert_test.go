@@ -0,0 +1,258 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// testKeys returns a private key of each of the supported types, by name.
+func testKeys(t testing.TB) map[string]crypto.Signer {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p256Key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p384Key, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return map[string]crypto.Signer{
+		"RSA 2048":    rsaKey,
+		"ECDSA P-256": p256Key,
+		"ECDSA P-384": p384Key,
+		"Ed25519":     ed25519Key,
+	}
+}
+
+// clientCertForKey issues a client certificate for the given key.
+func (ca *testCA) clientCertForKey(t testing.TB, key crypto.Signer) tls.Certificate {
+	return ca.issueForKey(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: "client"},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, key)
+}
+
+func TestClient_ClientCertKeyTypes(t *testing.T) {
+	ca := newTestCA(t)
+	keys := testKeys(t)
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		// the backend verifies the client certificates
+		addr := startTLSBackend(t, &tls.Config{
+			Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+			ClientAuth:   tls.RequireAndVerifyClientCert,
+			ClientCAs:    certPool([]*x509.Certificate{ca.cert}),
+			MinVersion:   version,
+			MaxVersion:   version,
+		}, echoHandler)
+
+		for name, key := range keys {
+			t.Run(tlsVersionName(version)+"/"+name, func(t *testing.T) {
+				c := qt.New(t)
+
+				clientCert := ca.clientCertForKey(t, key)
+				c.Assert(keyAlgorithm(clientCert), qt.Equals, name)
+
+				certSource := backendCertSource(t, ca, addr)
+				certFn := certSource.CertFn
+				certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					cert, err := certFn(ctx, org, db, branch)
+					if err == nil {
+						cert.ClientCert = clientCert
+					}
+					return cert, err
+				}
+
+				testOpts := testOptions(t)
+				testOpts.CertSource = certSource
+				testOpts.SetupRetries = -1
+				client, err := NewClient(testOpts)
+				c.Assert(err, qt.IsNil)
+
+				conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+				c.Assert(err, qt.IsNil)
+				defer conn.Close()
+
+				// the server only answers once it verified the certificate
+				_, err = conn.Write([]byte("ping"))
+				c.Assert(err, qt.IsNil)
+				_, err = io.ReadFull(conn, make([]byte, 4))
+				c.Assert(err, qt.IsNil)
+			})
+		}
+	}
+}
+
+func TestClientCertificate(t *testing.T) {
+	ca := newTestCA(t)
+	keys := testKeys(t)
+	otherCA := newNamedTestCA(t, "Other CA")
+
+	tests := []struct {
+		name    string
+		key     string
+		cri     tls.CertificateRequestInfo
+		wantErr string
+		wantNil bool
+	}{
+		{
+			name: "supported",
+			key:  "ECDSA P-256",
+			cri: tls.CertificateRequestInfo{
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				Version:          tls.VersionTLS13,
+			},
+		},
+		{
+			name: "Ed25519 not accepted",
+			key:  "Ed25519",
+			cri: tls.CertificateRequestInfo{
+				SignatureSchemes: []tls.SignatureScheme{tls.PKCS1WithSHA256, tls.ECDSAWithP256AndSHA256},
+				Version:          tls.VersionTLS12,
+			},
+			wantErr: `remote server doesn't support the Ed25519 key of the client certificate \(accepted signature algorithms: PKCS1WithSHA256, ECDSAWithP256AndSHA256\): .*`,
+		},
+		{
+			// TLS 1.3 binds the ECDSA signature algorithms to the curves
+			name: "other curve",
+			key:  "ECDSA P-384",
+			cri: tls.CertificateRequestInfo{
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				Version:          tls.VersionTLS13,
+			},
+			wantErr: `remote server doesn't support the ECDSA P-384 key of the client certificate \(accepted signature algorithms: ECDSAWithP256AndSHA256\): .*`,
+		},
+		{
+			// like crypto/tls, no certificate is presented
+			name: "other CA",
+			key:  "ECDSA P-256",
+			cri: tls.CertificateRequestInfo{
+				AcceptableCAs:    [][]byte{otherCA.cert.RawSubject},
+				SignatureSchemes: []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+				Version:          tls.VersionTLS13,
+			},
+			wantNil: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			clientCert := ca.clientCertForKey(t, keys[tt.key])
+			got, err := clientCertificate(clientCert)(&tt.cri)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			if tt.wantNil {
+				c.Assert(got.Certificate, qt.HasLen, 0)
+			} else {
+				c.Assert(got.Certificate, qt.DeepEquals, clientCert.Certificate)
+			}
+		})
+	}
+}
+
+func TestCertSources_KeyTypes(t *testing.T) {
+	ca := newTestCA(t)
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw})
+
+	// keyPEMs returns the PEM encodings of the key, PKCS #8 and the legacy
+	// ones of its type.
+	keyPEMs := func(t *testing.T, key crypto.Signer) map[string][]byte {
+		pkcs8, err := x509.MarshalPKCS8PrivateKey(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		encodings := map[string][]byte{
+			"PKCS8": pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: pkcs8}),
+		}
+		switch key := key.(type) {
+		case *rsa.PrivateKey:
+			encodings["PKCS1"] = pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+		case *ecdsa.PrivateKey:
+			sec1, err := x509.MarshalECPrivateKey(key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			encodings["SEC1"] = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1})
+		}
+		return encodings
+	}
+
+	for name, key := range testKeys(t) {
+		clientCert := ca.clientCertForKey(t, key)
+		certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: clientCert.Certificate[0]})
+
+		for encoding, keyPEM := range keyPEMs(t, key) {
+			t.Run(name+"/"+encoding, func(t *testing.T) {
+				c := qt.New(t)
+
+				static, err := NewStaticCertSource(certPEM, keyPEM, caPEM)
+				c.Assert(err, qt.IsNil)
+				cert, err := static.Cert(context.Background(), "myorg", "mydb", "main")
+				c.Assert(err, qt.IsNil)
+				c.Assert(keyAlgorithm(cert.ClientCert), qt.Equals, name)
+
+				dir := t.TempDir()
+				for file, data := range map[string][]byte{"client.crt": certPEM, "client.key": keyPEM} {
+					c.Assert(os.WriteFile(filepath.Join(dir, file), data, 0o600), qt.IsNil)
+				}
+				file, err := NewFileCertSource(filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key"), "")
+				c.Assert(err, qt.IsNil)
+				defer file.Close()
+				cert, err = file.Cert(context.Background(), "myorg", "mydb", "main")
+				c.Assert(err, qt.IsNil)
+				c.Assert(keyAlgorithm(cert.ClientCert), qt.Equals, name)
+
+				cert, err = parseExecOutput(append(append(append([]byte{}, certPEM...), keyPEM...), caPEM...))
+				c.Assert(err, qt.IsNil)
+				c.Assert(keyAlgorithm(cert.ClientCert), qt.Equals, name)
+			})
+		}
+	}
+}
+
+func TestKeyAlgorithm_Leaf(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the algorithm of keys held by an HSM comes from the certificate
+	cert := ca.clientCert(t, "client")
+	cert.PrivateKey = struct{ crypto.Signer }{cert.PrivateKey.(crypto.Signer)}
+	c.Assert(keyAlgorithm(cert), qt.Equals, "ECDSA")
+
+	cert.Leaf = nil
+	c.Assert(keyAlgorithm(cert), qt.Equals, "ECDSA")
+}
@@ -0,0 +1,120 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"time"
+)
+
+// errLocalClosed is returned when the local client closed the connection
+// before the tunnel was set up, without sending anything. It's what health
+// checks probing the local listener do.
+var errLocalClosed = errors.New("local client closed the connection during setup")
+
+// abandonWatcher watches a local connection while the tunnel to the remote
+// instance is being set up, and cancels the setup if the local client closes
+// the connection in the meantime.
+type abandonWatcher struct {
+	conn net.Conn
+	done chan struct{}
+
+	// buf holds the data the local client sent during the setup, if any
+	buf [1]byte
+	n   int
+	err error
+}
+
+func watchAbandon(conn net.Conn, cancel context.CancelFunc) *abandonWatcher {
+	w := &abandonWatcher{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+
+	go func() {
+		defer close(w.done)
+		w.n, w.err = conn.Read(w.buf[:])
+		if w.err != nil && !errors.Is(w.err, os.ErrDeadlineExceeded) {
+			cancel()
+		}
+	}()
+
+	return w
+}
+
+// stop stops watching the connection. It returns a net.Conn that replays the
+// data the local client sent while it was watched, or an error if the client
+// closed the connection, or if the connection couldn't be stopped being
+// watched.
+func (w *abandonWatcher) stop() (net.Conn, error) {
+	// unblock the pending read, if there is any
+	deadline := true
+	if err := w.conn.SetReadDeadline(time.Now()); err != nil {
+		select {
+		case <-w.done:
+			// the read returned already, there's no deadline to reset
+			deadline = false
+		default:
+			// closing the connection is the only other way to unblock it
+			w.conn.Close()
+			<-w.done
+			return nil, fmt.Errorf("couldn't unblock the read of the local connection: %w", err)
+		}
+	}
+	<-w.done
+
+	if w.n == 0 && w.err != nil && !errors.Is(w.err, os.ErrDeadlineExceeded) {
+		return nil, fmt.Errorf("%w: %s", errLocalClosed, w.err)
+	}
+
+	if deadline {
+		if err := w.conn.SetReadDeadline(time.Time{}); err != nil {
+			return nil, fmt.Errorf("couldn't reset the read deadline of the local connection: %w", err)
+		}
+	}
+
+	if w.n > 0 {
+		return &prefixConn{Conn: w.conn, prefix: w.buf[:w.n]}, nil
+	}
+
+	return w.conn, nil
+}
+
+// prefixConn is a net.Conn that returns prefix before reading from the
+// underlying connection.
+type prefixConn struct {
+	net.Conn
+	prefix []byte
+}
+
+func (p *prefixConn) Read(b []byte) (int, error) {
+	if len(p.prefix) > 0 {
+		n := copy(b, p.prefix)
+		p.prefix = p.prefix[n:]
+		return n, nil
+	}
+	return p.Conn.Read(b)
+}
+
+func (p *prefixConn) CloseWrite() error { return closeWrite(p.Conn) }
+
+// closeWriter is implemented by the connections whose writing side can be
+// closed on its own, like *net.TCPConn and *tls.Conn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// errCloseWriteUnsupported is returned by closeWrite for the connections that
+// can't be half-closed.
+var errCloseWriteUnsupported = errors.New("connection can't be half-closed")
+
+// closeWrite closes the writing side of the given connection, if it
+// supports it.
+func closeWrite(conn interface{}) error {
+	if cw, ok := conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return errCloseWriteUnsupported
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultCRLReloadInterval is how often CRLFile is checked for changes by
+// default.
+const defaultCRLReloadInterval = 10 * time.Minute
+
+var (
+	// errCertRevoked is returned when a certificate of the remote server's
+	// chain is listed in a CRL of its issuer.
+	errCertRevoked = errors.New("certificate was revoked")
+	// errCRLExpired is returned when the CRL of an issuer of the remote
+	// server's chain is past its next update, unless AllowExpiredCRL is set.
+	errCRLExpired = errors.New("CRL expired")
+)
+
+// parseCRLs parses the CRLs in the given data, either PEM encoded, as many
+// "X509 CRL" blocks as needed, or a single DER encoded one.
+func parseCRLs(data []byte) ([]*pkix.CertificateList, error) {
+	var crls []*pkix.CertificateList
+	rest := data
+	for {
+		var block *pem.Block
+		block, rest = pem.Decode(rest)
+		if block == nil {
+			break
+		}
+		if block.Type != "X509 CRL" {
+			return nil, fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		crl, err := x509.ParseDERCRL(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		crls = append(crls, crl)
+	}
+	if len(crls) > 0 {
+		return crls, nil
+	}
+
+	crl, err := x509.ParseDERCRL(data)
+	if err != nil {
+		return nil, fmt.Errorf("no PEM or DER encoded CRL found: %w", err)
+	}
+	return []*pkix.CertificateList{crl}, nil
+}
+
+// crlSet holds the CRLs the chains of the remote servers are checked
+// against, the ones of CRL and the ones of CRLFile, which is reloaded when
+// it changed once the reload interval elapsed.
+type crlSet struct {
+	log          *zap.Logger
+	static       []*pkix.CertificateList
+	path         string
+	interval     time.Duration
+	allowExpired bool
+
+	// now returns the current time, it's replaced by the tests.
+	now func() time.Time
+
+	mu sync.Mutex // protects the fields below
+	// loaded holds the CRLs of the file as of its last successful load.
+	loaded  []*pkix.CertificateList
+	modTime time.Time
+	checked time.Time
+}
+
+// newCRLSet returns the set of the given CRLs and the ones of the file at
+// path, if any, which must be readable.
+func newCRLSet(log *zap.Logger, data []byte, path string, interval time.Duration, allowExpired bool) (*crlSet, error) {
+	s := &crlSet{
+		log:          log,
+		path:         path,
+		interval:     interval,
+		allowExpired: allowExpired,
+		now:          time.Now,
+	}
+	if len(data) > 0 {
+		crls, err := parseCRLs(data)
+		if err != nil {
+			return nil, err
+		}
+		s.static = crls
+	}
+	if path != "" {
+		if err := s.load(); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// load loads the CRLs of the file if it changed since the last load. The
+// caller must hold s.mu, or be the only one with s.
+func (s *crlSet) load() error {
+	s.checked = s.now()
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return err
+	}
+	if info.ModTime().Equal(s.modTime) {
+		return nil
+	}
+
+	data, err := os.ReadFile(s.path)
+	if err != nil {
+		return err
+	}
+	crls, err := parseCRLs(data)
+	if err != nil {
+		return fmt.Errorf("couldn't parse %s: %w", s.path, err)
+	}
+	s.loaded, s.modTime = crls, info.ModTime()
+	return nil
+}
+
+// current returns the CRLs to check the chains against, reloading the file
+// first if the reload interval elapsed. The CRLs that were loaded last are
+// kept if the file can't be reloaded.
+func (s *crlSet) current() []*pkix.CertificateList {
+	if s.path == "" {
+		return s.static
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.now().Sub(s.checked) >= s.interval {
+		if err := s.load(); err != nil {
+			s.log.Error("couldn't reload the CRL file, keeping the previous CRLs",
+				zap.String("path", s.path),
+				zap.Error(err))
+		}
+	}
+	return append(s.static[:len(s.static):len(s.static)], s.loaded...)
+}
+
+// verify checks the certificates of the given verified chains against the
+// CRLs. A chain is rejected if a certificate but its root is listed in a CRL
+// signed by its issuer, or if that CRL expired and expired CRLs aren't
+// allowed. The certificates without a CRL of their issuer pass. One chain
+// passing is enough, the error of the first one is returned otherwise.
+func (s *crlSet) verify(instance string, chains [][]*x509.Certificate) error {
+	crls := s.current()
+	if len(crls) == 0 {
+		return nil
+	}
+
+	var firstErr error
+	for _, chain := range chains {
+		err := s.verifyChain(instance, chain, crls)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *crlSet) verifyChain(instance string, chain []*x509.Certificate, crls []*pkix.CertificateList) error {
+	now := s.now()
+	for i := 0; i < len(chain)-1; i++ {
+		cert, issuer := chain[i], chain[i+1]
+		for _, crl := range crls {
+			if issuer.CheckCRLSignature(crl) != nil {
+				// not a CRL of the issuer
+				continue
+			}
+
+			if crl.HasExpired(now) {
+				if !s.allowExpired {
+					return &peerRejectedError{cert: cert, err: fmt.Errorf("%w: the CRL of %q expired at %s",
+						errCRLExpired, issuer.Subject, crl.TBSCertList.NextUpdate.Format(time.RFC3339))}
+				}
+				s.log.Warn("CRL expired, checking the remote server certificate against it anyway",
+					zap.String("instance", instance),
+					zap.String("issuer", issuer.Subject.String()),
+					zap.Time("next_update", crl.TBSCertList.NextUpdate))
+			}
+
+			for _, revoked := range crl.TBSCertList.RevokedCertificates {
+				if revoked.SerialNumber.Cmp(cert.SerialNumber) == 0 {
+					return &peerRejectedError{cert: cert, err: fmt.Errorf("%w: %q, serial %s, on %s",
+						errCertRevoked, cert.Subject, cert.SerialNumber, revoked.RevocationTime.Format(time.RFC3339))}
+				}
+			}
+		}
+	}
+	return nil
+}
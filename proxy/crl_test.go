@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// crl returns a PEM encoded CRL of the CA revoking the given serials, valid
+// until nextUpdate.
+func (ca *testCA) crl(t testing.TB, nextUpdate time.Time, serials ...*big.Int) []byte {
+	t.Helper()
+
+	revoked := make([]pkix.RevokedCertificate, 0, len(serials))
+	for _, serial := range serials {
+		revoked = append(revoked, pkix.RevokedCertificate{
+			SerialNumber:   serial,
+			RevocationTime: time.Now().Add(-time.Hour),
+		})
+	}
+	der, err := ca.cert.CreateCRL(rand.Reader, ca.key, revoked, time.Now().Add(-time.Hour), nextUpdate)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "X509 CRL", Bytes: der})
+}
+
+func TestClient_CRL(t *testing.T) {
+	root := newNamedTestCA(t, "Root CA")
+	intermediate := root.intermediateCA(t, "Intermediate CA")
+	nextUpdate := time.Now().Add(time.Hour)
+
+	revokedLeaf := root.serverCert(t, 42)
+	validLeaf := root.serverCert(t, 43)
+	intermediateLeaf := intermediate.serverCert(t, 44)
+
+	tests := []struct {
+		name          string
+		serverCert    tls.Certificate
+		intermediates []*x509.Certificate
+		crl           []byte
+		allowExpired  bool
+		wantErr       error
+	}{
+		{
+			name:       "certificate not revoked",
+			serverCert: validLeaf,
+			crl:        root.crl(t, nextUpdate, big.NewInt(42)),
+		},
+		{
+			name:       "certificate revoked",
+			serverCert: revokedLeaf,
+			crl:        root.crl(t, nextUpdate, big.NewInt(42)),
+			wantErr:    errCertRevoked,
+		},
+		{
+			name:       "DER encoded CRL",
+			serverCert: revokedLeaf,
+			crl: func() []byte {
+				block, _ := pem.Decode(root.crl(t, nextUpdate, big.NewInt(42)))
+				return block.Bytes
+			}(),
+			wantErr: errCertRevoked,
+		},
+		{
+			// only the issuer of a certificate can revoke it
+			name:       "CRL of another CA",
+			serverCert: revokedLeaf,
+			crl:        newNamedTestCA(t, "Root CA").crl(t, nextUpdate, big.NewInt(42)),
+		},
+		{
+			name:          "intermediate revoked",
+			serverCert:    intermediateLeaf,
+			intermediates: []*x509.Certificate{intermediate.cert},
+			crl: append(
+				root.crl(t, nextUpdate, intermediate.cert.SerialNumber),
+				intermediate.crl(t, nextUpdate)...),
+			wantErr: errCertRevoked,
+		},
+		{
+			name:          "leaf of an intermediate revoked",
+			serverCert:    intermediateLeaf,
+			intermediates: []*x509.Certificate{intermediate.cert},
+			crl: append(
+				root.crl(t, nextUpdate),
+				intermediate.crl(t, nextUpdate, big.NewInt(44))...),
+			wantErr: errCertRevoked,
+		},
+		{
+			name:       "expired CRL",
+			serverCert: validLeaf,
+			crl:        root.crl(t, time.Now().Add(-time.Minute)),
+			wantErr:    errCRLExpired,
+		},
+		{
+			name:         "expired CRL allowed",
+			serverCert:   validLeaf,
+			crl:          root.crl(t, time.Now().Add(-time.Minute)),
+			allowExpired: true,
+		},
+		{
+			name:         "expired CRL allowed but certificate revoked",
+			serverCert:   revokedLeaf,
+			crl:          root.crl(t, time.Now().Add(-time.Minute), big.NewInt(42)),
+			allowExpired: true,
+			wantErr:      errCertRevoked,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{tt.serverCert},
+			}, echoHandler)
+
+			certSource := backendCertSource(t, root, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				cert, err := certFn(ctx, org, db, branch)
+				if err == nil {
+					cert.Intermediates = tt.intermediates
+				}
+				return cert, err
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			testOpts.SetupRetries = 0
+			testOpts.CRL = tt.crl
+			testOpts.AllowExpiredCRL = tt.allowExpired
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr == nil {
+				c.Assert(err, qt.IsNil)
+				conn.Close()
+				return
+			}
+			c.Assert(errors.Is(err, tt.wantErr), qt.IsTrue, qt.Commentf("error: %v", err))
+			c.Assert(errors.Is(err, errPeerRejected), qt.IsTrue)
+		})
+	}
+}
+
+func TestClient_CRLFile(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	nextUpdate := time.Now().Add(24 * time.Hour)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	path := filepath.Join(t.TempDir(), "ca.crl")
+	c.Assert(os.WriteFile(path, ca.crl(t, nextUpdate), 0o600), qt.IsNil)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.SetupRetries = 0
+	// every connection must be verified
+	testOpts.TLSSessionCacheSize = -1
+	testOpts.CRLFile = path
+	testOpts.CRLReloadInterval = time.Hour
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	now := time.Now()
+	client.crls.now = func() time.Time { return now }
+	dial := func() error {
+		conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+	c.Assert(dial(), qt.IsNil)
+
+	// the file isn't read again before the reload interval elapsed
+	c.Assert(os.WriteFile(path, ca.crl(t, nextUpdate, big.NewInt(42)), 0o600), qt.IsNil)
+	c.Assert(os.Chtimes(path, now.Add(time.Minute), now.Add(time.Minute)), qt.IsNil)
+	c.Assert(dial(), qt.IsNil)
+
+	now = now.Add(time.Hour)
+	err = dial()
+	c.Assert(errors.Is(err, errCertRevoked), qt.IsTrue, qt.Commentf("error: %v", err))
+
+	// a broken file doesn't drop the CRLs loaded before
+	c.Assert(os.WriteFile(path, []byte("garbage"), 0o600), qt.IsNil)
+	c.Assert(os.Chtimes(path, now.Add(time.Minute), now.Add(time.Minute)), qt.IsNil)
+	now = now.Add(time.Hour)
+	c.Assert(errors.Is(dial(), errCertRevoked), qt.IsTrue)
+}
+
+func TestNewClient_CRL(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.CRL = []byte("garbage")
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "invalid CRL: no PEM or DER encoded CRL found: .*")
+
+	testOpts = testOptions(t)
+	testOpts.CRLFile = filepath.Join(t.TempDir(), "missing.crl")
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "invalid CRL: .*no such file or directory")
+
+	testOpts = testOptions(t)
+	testOpts.CRL = newTestCA(t).crl(t, time.Now().Add(time.Hour))
+	testOpts.ServerVerifier = func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return nil
+	}
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "CRL and CRLFile can't be combined with ServerVerifier")
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// CSRSigner can be implemented by the CertSources that sign the client
+// certificates for keys generated by the client, so the private keys never
+// leave the host. For them, the client generates an ECDSA P-256 key pair
+// for each instance, and has Sign sign a certificate signing request whose
+// subject's common name is the instance name, "org/db/branch". Cert is
+// still called first, for the CA certificates and the remote address of
+// the instance, and must return a Cert without ClientCert, which is set to
+// the signed certificate and the local key.
+//
+// The key of an instance is reused for the next certificates until the
+// last one signed for it expires, or the instance is invalidated. The
+// errors of Sign are classified like the ones of Cert.
+type CSRSigner interface {
+	// Sign signs a client certificate for the public key of the given
+	// certificate signing request, whose signature was checked.
+	Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+}
+
+// csrKey is a private key generated for the certificates of an instance.
+type csrKey struct {
+	key *ecdsa.PrivateKey
+	// notAfter is when the last certificate signed for the key expires,
+	// zero until one is.
+	notAfter time.Time
+}
+
+// csrKeys holds the private keys generated for the certificates of the
+// instances, whose certificates are signed by a CSRSigner. It's safe for
+// concurrent use.
+type csrKeys struct {
+	// now returns the current time, it's replaced by the tests.
+	now func() time.Time
+
+	mu   sync.Mutex
+	keys map[string]csrKey
+}
+
+func newCSRKeys() *csrKeys {
+	return &csrKeys{
+		now:  time.Now,
+		keys: make(map[string]csrKey),
+	}
+}
+
+// get returns the key of the instance, generating a new one if there is
+// none, or if the last certificate signed for it expired.
+func (k *csrKeys) get(instance string) (*ecdsa.PrivateKey, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cached, ok := k.keys[instance]; ok && (cached.notAfter.IsZero() || k.now().Before(cached.notAfter)) {
+		return cached.key, nil
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	k.keys[instance] = csrKey{key: key}
+	return key, nil
+}
+
+// signed records that a certificate expiring at notAfter was signed for the
+// given key of the instance.
+func (k *csrKeys) signed(instance string, key *ecdsa.PrivateKey, notAfter time.Time) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if cached, ok := k.keys[instance]; ok && cached.key == key {
+		k.keys[instance] = csrKey{key: key, notAfter: notAfter}
+	}
+}
+
+// forget drops the key of the instance.
+func (k *csrKeys) forget(instance string) {
+	k.mu.Lock()
+	delete(k.keys, instance)
+	k.mu.Unlock()
+}
+
+// signClientCert has the given signer sign a client certificate for the
+// local key of the instance, and sets it as the client certificate of cert.
+func (c *Client) signClientCert(ctx context.Context, signer CSRSigner, instance string, cert *Cert) error {
+	if cert.ServerAuthOnly {
+		return errors.New("the cert source signs client certificates, but the cert is marked as server auth only")
+	}
+	if len(cert.ClientCert.Certificate) > 0 {
+		return errors.New("the cert source signs client certificates, but returned one along with the cert")
+	}
+
+	key, err := c.csrKeys.get(instance)
+	if err != nil {
+		return fmt.Errorf("couldn't generate private key: %w", err)
+	}
+	der, err := x509.CreateCertificateRequest(rand.Reader, &x509.CertificateRequest{
+		Subject: pkix.Name{CommonName: instance},
+	}, key)
+	if err != nil {
+		return fmt.Errorf("couldn't create certificate signing request: %w", err)
+	}
+	csr, err := x509.ParseCertificateRequest(der)
+	if err != nil {
+		return fmt.Errorf("couldn't create certificate signing request: %w", err)
+	}
+
+	signed, err := signer.Sign(ctx, csr)
+	if err != nil {
+		return err
+	}
+	if signed == nil {
+		return errors.New("cert source signed no certificate")
+	}
+	if !key.PublicKey.Equal(signed.PublicKey) {
+		return errors.New("cert source signed a certificate for another key")
+	}
+	c.csrKeys.signed(instance, key, signed.NotAfter)
+
+	cert.ClientCert = tls.Certificate{
+		Certificate: [][]byte{signed.Raw},
+		PrivateKey:  key,
+		Leaf:        signed,
+	}
+	return nil
+}
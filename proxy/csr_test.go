@@ -0,0 +1,228 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// signingCertSource is a fake cert source signing the client certificates
+// for the keys of the client.
+type signingCertSource struct {
+	*fakeCertSource
+	SignFn func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error)
+
+	mu   sync.Mutex
+	csrs []*x509.CertificateRequest
+}
+
+var _ CSRSigner = (*signingCertSource)(nil)
+
+func (s *signingCertSource) Sign(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+	s.mu.Lock()
+	s.csrs = append(s.csrs, csr)
+	s.mu.Unlock()
+
+	return s.SignFn(ctx, csr)
+}
+
+// signingBackendCertSource returns a cert source that points to the given
+// backend and signs the client certificates with the given CA.
+func signingBackendCertSource(t testing.TB, ca *testCA, addr net.Addr) *signingCertSource {
+	certSource := backendCertSource(t, ca, addr)
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		cert, err := certFn(ctx, org, db, branch)
+		if err != nil {
+			return nil, err
+		}
+		cert.ClientCert = tls.Certificate{}
+		return cert, nil
+	}
+
+	return &signingCertSource{
+		fakeCertSource: certSource,
+		SignFn: func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+			der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+				SerialNumber: big.NewInt(time.Now().UnixNano()),
+				Subject:      csr.Subject,
+				NotBefore:    time.Now().Add(-time.Hour),
+				NotAfter:     time.Now().Add(time.Hour),
+				KeyUsage:     x509.KeyUsageDigitalSignature,
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}, ca.cert, csr.PublicKey, ca.key)
+			if err != nil {
+				return nil, err
+			}
+			return x509.ParseCertificate(der)
+		},
+	}
+}
+
+func TestClient_CSRSigner(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the backend verifies the client certificates
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool([]*x509.Certificate{ca.cert}),
+	}, echoHandler)
+
+	certSource := signingBackendCertSource(t, ca, addr)
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	dial := func() {
+		conn, err := client.Dial(context.Background(), instance)
+		c.Assert(err, qt.IsNil)
+		conn.Close()
+	}
+	// publicKeys returns the public keys of the signed CSRs.
+	publicKeys := func() []*ecdsa.PublicKey {
+		certSource.mu.Lock()
+		defer certSource.mu.Unlock()
+
+		var keys []*ecdsa.PublicKey
+		for _, csr := range certSource.csrs {
+			c.Assert(csr.Subject.CommonName, qt.Equals, instance)
+			keys = append(keys, csr.PublicKey.(*ecdsa.PublicKey))
+		}
+		return keys
+	}
+
+	dial()
+	keys := publicKeys()
+	c.Assert(keys, qt.HasLen, 1)
+
+	// the key is reused for the next certificate
+	client.configCache.Remove(instance)
+	dial()
+	keys = publicKeys()
+	c.Assert(keys, qt.HasLen, 2)
+	c.Assert(keys[1].Equal(keys[0]), qt.IsTrue)
+
+	// until the certificate signed for it expired
+	client.csrKeys.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	client.configCache.Remove(instance)
+	dial()
+	keys = publicKeys()
+	c.Assert(keys, qt.HasLen, 3)
+	c.Assert(keys[2].Equal(keys[1]), qt.IsFalse)
+	client.csrKeys.now = time.Now
+
+	// or the instance was invalidated
+	client.InvalidateInstance(instance)
+	dial()
+	keys = publicKeys()
+	c.Assert(keys, qt.HasLen, 4)
+	c.Assert(keys[3].Equal(keys[2]), qt.IsFalse)
+}
+
+func TestClient_CSRSigner_Errors(t *testing.T) {
+	ca := newTestCA(t)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3306}
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		certFn   func(cert *Cert)
+		signFn   func(csr *x509.CertificateRequest) (*x509.Certificate, error)
+		wantErr  string
+		wantKind CertErrorKind
+	}{
+		{
+			name: "client certificate returned by Cert",
+			certFn: func(cert *Cert) {
+				cert.ClientCert = ca.clientCert(t, "client")
+			},
+			wantErr:  ".*the cert source signs client certificates, but returned one along with the cert",
+			wantKind: CertErrorUnknown,
+		},
+		{
+			name: "server auth only",
+			certFn: func(cert *Cert) {
+				cert.ServerAuthOnly = true
+			},
+			wantErr:  ".*the cert source signs client certificates, but the cert is marked as server auth only",
+			wantKind: CertErrorUnknown,
+		},
+		{
+			name: "certificate for another key",
+			signFn: func(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+				der, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+					SerialNumber: big.NewInt(1),
+					Subject:      pkix.Name{CommonName: "client"},
+					NotBefore:    time.Now().Add(-time.Hour),
+					NotAfter:     time.Now().Add(time.Hour),
+				}, ca.cert, &otherKey.PublicKey, ca.key)
+				if err != nil {
+					return nil, err
+				}
+				return x509.ParseCertificate(der)
+			},
+			wantErr:  ".*cert source signed a certificate for another key",
+			wantKind: CertErrorUnknown,
+		},
+		{
+			name: "signing denied",
+			signFn: func(csr *x509.CertificateRequest) (*x509.Certificate, error) {
+				return nil, &CertSourceError{Kind: CertErrorUnauthorized, Err: errors.New("signing denied")}
+			},
+			wantErr:  ".*signing denied",
+			wantKind: CertErrorUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			certSource := signingBackendCertSource(t, ca, addr)
+			if tt.certFn != nil {
+				certFn := certSource.CertFn
+				certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					cert, err := certFn(ctx, org, db, branch)
+					if err == nil {
+						tt.certFn(cert)
+					}
+					return cert, err
+				}
+			}
+			if tt.signFn != nil {
+				certSource.SignFn = func(ctx context.Context, csr *x509.CertificateRequest) (*x509.Certificate, error) {
+					return tt.signFn(csr)
+				}
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			testOpts.CertRetries = -1
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+			c.Assert(certErrorKind(err), qt.Equals, tt.wantKind)
+		})
+	}
+}
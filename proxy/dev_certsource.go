@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	// devCertValidity is how long the certificates of a DevCertSource are
+	// valid for.
+	devCertValidity = 7 * 24 * time.Hour
+
+	// devServerName is the name the server certificate of a DevCertSource
+	// is issued for, and verified against.
+	devServerName = "localhost"
+
+	// devRemotePort is the port of the remote server of a DevCertSource,
+	// the default port of the proxy of the remote servers.
+	devRemotePort = 3307
+)
+
+// Names of the files written by DevCertSource.WriteFiles.
+const (
+	DevCAFile         = "ca.pem"
+	DevServerCertFile = "server.pem"
+	DevServerKeyFile  = "server-key.pem"
+	DevClientCertFile = "client.pem"
+	DevClientKeyFile  = "client-key.pem"
+)
+
+// DevCertSource serves the certificates of an ephemeral CA it generates in
+// memory, for trying the proxy locally without a certificate API or a PKI.
+// It issues a client certificate for the proxy and a server certificate for
+// "localhost" for the remote server, which is configured with
+// ServerTLSConfig, or with the files of WriteFiles, i.e: a MySQL server with
+// --ssl-ca, --ssl-cert and --ssl-key.
+//
+// It's INSECURE: the CA and its key only live as long as the process, and
+// anyone getting the files of WriteFiles can impersonate both sides. It must
+// only be used for local development.
+type DevCertSource struct {
+	ca     *x509.Certificate
+	client tls.Certificate
+	server tls.Certificate
+
+	// the PEM encoded certificates and keys, for the peer
+	caPEM, clientCertPEM, clientKeyPEM, serverCertPEM, serverKeyPEM []byte
+}
+
+var _ CertSource = (*DevCertSource)(nil)
+
+// NewDevCertSource returns a DevCertSource with a new CA, and client and
+// server certificates issued by it, valid for a week.
+func NewDevCertSource() (*DevCertSource, error) {
+	now := time.Now()
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	caTmpl := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "sql-proxy dev CA"},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	ca, caPEM, _, err := devIssue(caTmpl, nil, caKey, now)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate the dev CA: %w", err)
+	}
+	issuer := &devIssuer{cert: ca.Leaf, key: caKey}
+
+	s := &DevCertSource{ca: ca.Leaf, caPEM: caPEM}
+	s.client, s.clientCertPEM, s.clientKeyPEM, err = devIssue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: "sql-proxy dev client"},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}, issuer, nil, now)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate the dev client certificate: %w", err)
+	}
+	s.server, s.serverCertPEM, s.serverKeyPEM, err = devIssue(&x509.Certificate{
+		Subject:     pkix.Name{CommonName: devServerName},
+		DNSNames:    []string{devServerName},
+		IPAddresses: []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		KeyUsage:    x509.KeyUsageDigitalSignature,
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}, issuer, nil, now)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't generate the dev server certificate: %w", err)
+	}
+	return s, nil
+}
+
+// devIssuer is the CA issuing the certificates of a DevCertSource.
+type devIssuer struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+// devIssue issues a certificate for the given template, with a new key
+// unless key is set, signed by the given issuer, or self-signed if it's nil.
+// It returns the certificate, and it and its key PEM encoded.
+func devIssue(tmpl *x509.Certificate, issuer *devIssuer, key *ecdsa.PrivateKey, now time.Time) (tls.Certificate, []byte, []byte, error) {
+	if key == nil {
+		var err error
+		if key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader); err != nil {
+			return tls.Certificate{}, nil, nil, err
+		}
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	tmpl.SerialNumber = serial
+	// tolerate the clock of the peer being a bit behind
+	tmpl.NotBefore = now.Add(-time.Hour)
+	tmpl.NotAfter = now.Add(devCertValidity)
+
+	parent, signer := tmpl, key
+	if issuer != nil {
+		parent, signer = issuer.cert, issuer.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, parent, key.Public(), signer)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, nil, nil, err
+	}
+
+	cert := tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})
+	return cert, certPEM, keyPEM, nil
+}
+
+// Cert returns the client certificate and the CA, whatever the instance.
+// The remote server is expected on localhost:3307, Options.RemoteAddr
+// overrides it.
+func (s *DevCertSource) Cert(ctx context.Context, org, db, branch string) (*Cert, error) {
+	return &Cert{
+		ClientCert: s.client,
+		CACerts:    []*x509.Certificate{s.ca},
+		AccessHost: devServerName,
+		Ports: RemotePorts{
+			Proxy: devRemotePort,
+		},
+		ServerName: devServerName,
+		Expiry:     s.client.Leaf.NotAfter,
+	}, nil
+}
+
+// CAPEM returns the PEM encoded certificate of the CA, for the remote
+// server to verify the client certificate with.
+func (s *DevCertSource) CAPEM() []byte {
+	return append([]byte(nil), s.caPEM...)
+}
+
+// ServerTLSConfig returns the TLS config of a remote server presenting the
+// server certificate and requiring a client certificate issued by the CA.
+func (s *DevCertSource) ServerTLSConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{s.server},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool([]*x509.Certificate{s.ca}),
+		MinVersion:   tls.VersionTLS12,
+	}
+}
+
+// WriteFiles writes the PEM encoded CA certificate, server and client
+// certificates and keys to the given directory, creating it if needed, for
+// the remote server or other clients to use. The files are only readable by
+// the current user, and the existing ones are replaced.
+func (s *DevCertSource) WriteFiles(dir string) error {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+
+	files := []struct {
+		name string
+		data []byte
+	}{
+		{DevCAFile, s.caPEM},
+		{DevServerCertFile, s.serverCertPEM},
+		{DevServerKeyFile, s.serverKeyPEM},
+		{DevClientCertFile, s.clientCertPEM},
+		{DevClientKeyFile, s.clientKeyPEM},
+	}
+	for _, f := range files {
+		path := filepath.Join(dir, f.name)
+		if err := os.WriteFile(path, f.data, 0600); err != nil {
+			return err
+		}
+		// WriteFile keeps the mode of the existing files
+		if err := os.Chmod(path, 0600); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,126 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDevCertSource(t *testing.T) {
+	c := qt.New(t)
+
+	// the client and the server only use the dev material
+	devSource, err := NewDevCertSource()
+	c.Assert(err, qt.IsNil)
+	addr := startTLSBackend(t, devSource.ServerTLSConfig(), echoHandler)
+
+	core, logs := observer.New(zap.WarnLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = devSource
+	testOpts.RemoteAddr = "localhost:" + strconv.Itoa(addr.(*net.TCPAddr).Port)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(logs.FilterMessageSnippet("INSECURE").Len(), qt.Equals, 1)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "hello")
+
+	cert, err := devSource.Cert(context.Background(), "myorg", "mydb", "mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.AccessHost, qt.Equals, "localhost")
+	c.Assert(cert.Ports.Proxy, qt.Equals, 3307)
+	c.Assert(cert.Expiry, qt.Equals, cert.ClientCert.Leaf.NotAfter)
+}
+
+func TestDevCertSource_Independent(t *testing.T) {
+	c := qt.New(t)
+
+	// a server of another dev source doesn't trust the client, nor the
+	// client the server
+	devSource, err := NewDevCertSource()
+	c.Assert(err, qt.IsNil)
+	otherSource, err := NewDevCertSource()
+	c.Assert(err, qt.IsNil)
+	addr := startTLSBackend(t, otherSource.ServerTLSConfig(), echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = devSource
+	testOpts.RemoteAddr = addr.String()
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, ".*certificate signed by unknown authority.*")
+}
+
+func TestDevCertSource_WriteFiles(t *testing.T) {
+	c := qt.New(t)
+
+	devSource, err := NewDevCertSource()
+	c.Assert(err, qt.IsNil)
+	dir := filepath.Join(t.TempDir(), "dev")
+	c.Assert(devSource.WriteFiles(dir), qt.IsNil)
+
+	read := func(name string) []byte {
+		data, err := os.ReadFile(filepath.Join(dir, name))
+		c.Assert(err, qt.IsNil)
+		if runtime.GOOS != "windows" {
+			info, err := os.Stat(filepath.Join(dir, name))
+			c.Assert(err, qt.IsNil)
+			c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0600))
+		}
+		return data
+	}
+	c.Assert(read(DevCAFile), qt.DeepEquals, devSource.CAPEM())
+
+	// a server and a client configured with the files only talk to each
+	// other
+	serverCert, err := tls.X509KeyPair(read(DevServerCertFile), read(DevServerKeyFile))
+	c.Assert(err, qt.IsNil)
+	clientCAs := x509.NewCertPool()
+	c.Assert(clientCAs.AppendCertsFromPEM(read(DevCAFile)), qt.IsTrue)
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    clientCAs,
+	}, echoHandler)
+
+	staticSource, err := NewStaticCertSource(read(DevClientCertFile), read(DevClientKeyFile), read(DevCAFile))
+	c.Assert(err, qt.IsNil)
+	testOpts := testOptions(t)
+	testOpts.CertSource = staticSource
+	testOpts.RemoteAddr = addr.String()
+	testOpts.ServerName = "localhost"
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+
+	// the files are replaced
+	otherSource, err := NewDevCertSource()
+	c.Assert(err, qt.IsNil)
+	c.Assert(otherSource.WriteFiles(dir), qt.IsNil)
+	c.Assert(read(DevCAFile), qt.DeepEquals, otherSource.CAPEM())
+}
@@ -0,0 +1,510 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// ErrTooManyConnections is returned when a connection is rejected because
+// MaxConnections, of all the instances or of its instance, is reached.
+var ErrTooManyConnections = errors.New("too many open connections")
+
+// errShuttingDown is returned by dial once Shutdown began.
+var errShuttingDown = errors.New("client is shutting down")
+
+// Dial establishes a TLS tunnel to the given instance and returns the ready
+// connection, which speaks the database protocol directly. It retrieves the
+// certs, dials the remote address and verifies the handshake the same way
+// it's done for the connections accepted on the local address, so the
+// client doesn't need to be running. The returned connection counts towards
+// MaxConnections and is waited for by Shutdown until it's closed.
+func (c *Client) Dial(ctx context.Context, instance string) (net.Conn, error) {
+	conn, err := c.dial(ctx, c.nextConnID(), instance, ProtocolClassic, "")
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// dial establishes a tunnel to the given instance for the connection with the
+// given id, over the given protocol. clientAddr is the address of the local
+// client the tunnel is for, if any.
+func (c *Client) dial(ctx context.Context, id uint64, instance string, protocol Protocol, clientAddr string) (_ *dialedConn, err error) {
+	if c.isDraining() {
+		return nil, errShuttingDown
+	}
+
+	info := ConnInfo{ID: id, Instance: instance, ClientAddr: clientAddr}
+	if err := c.onConnect(ctx, info); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			c.onClose(info, 0, 0, err)
+		}
+	}()
+
+	waitStart := time.Now()
+	waited, err := c.acquireSlots(ctx, instance)
+	if err != nil {
+		// the local client went away while waiting for a slot
+		if ctx.Err() == context.Canceled {
+			return nil, err
+		}
+
+		atomic.AddUint64(&c.stats.setupFailures, 1)
+		atomic.AddUint64(&c.stats.connectionsRejected, 1)
+		c.stats.setupFailuresByPhase.add("other")
+		if waited {
+			c.log.Warn("connection rejected after waiting for a free slot",
+				zap.Uint64("conn_id", id),
+				zap.String("instance", instance),
+				zap.Duration("wait", time.Since(waitStart)),
+				zap.Error(err))
+		}
+		c.emit(Event{
+			Type:       EventSetupFailed,
+			ConnID:     id,
+			Instance:   instance,
+			ClientAddr: clientAddr,
+			Error:      err.Error(),
+		})
+		return nil, err
+	}
+	if waited {
+		atomic.AddUint64(&c.stats.connectionsWaited, 1)
+		c.log.Info("connection got a free slot after waiting",
+			zap.Uint64("conn_id", id),
+			zap.String("instance", instance),
+			zap.Duration("wait", time.Since(waitStart)))
+	}
+	atomic.AddUint64(&c.connectionsCounter, 1)
+
+	remoteConn, err := c.setupWithRetries(ctx, instance, protocol)
+	if err != nil {
+		atomic.AddUint64(&c.connectionsCounter, ^uint64(0))
+		c.releaseSlots(instance)
+
+		// the caller gave up on the connection, i.e: the local client went
+		// away, that's not a failure of the setup
+		if ctx.Err() == context.Canceled {
+			return nil, err
+		}
+
+		atomic.AddUint64(&c.stats.setupFailures, 1)
+
+		e := Event{
+			Type:       EventSetupFailed,
+			ConnID:     id,
+			Instance:   instance,
+			ClientAddr: clientAddr,
+			Error:      err.Error(),
+		}
+		phase := "other"
+		var setupErr *SetupError
+		if errors.As(err, &setupErr) {
+			e.Phase = setupErr.Phase
+			phase = string(setupErr.Phase)
+		}
+		if kind, ok := certErrorKindOf(err); ok {
+			e.CertError = kind
+			c.stats.certErrorsByKind.add(string(kind))
+		}
+		c.stats.setupFailuresByPhase.add(phase)
+		c.emit(e)
+		return nil, err
+	}
+
+	atomic.AddUint64(&c.stats.connections, 1)
+	c.stats.protocolConnections.add(string(protocol))
+	c.emit(Event{
+		Type:       EventConnect,
+		ConnID:     id,
+		Instance:   instance,
+		ClientAddr: clientAddr,
+		RemoteAddr: remoteConn.RemoteAddr().String(),
+	})
+
+	var tunnel net.Conn = remoteConn
+	var greeting *serverGreeting
+	if c.parseGreetings && protocol == ProtocolClassic {
+		g, raw, err := readServerGreeting(ctx, remoteConn)
+		if err != nil {
+			// the tunnel relays the data as it is
+			c.log.Debug("couldn't parse the mysql server greeting",
+				zap.Uint64("conn_id", id),
+				zap.String("instance", instance),
+				zap.Error(err))
+		} else {
+			greeting = g
+			c.stats.serverVersions.add(g.version)
+			c.log.Debug("connected to mysql server",
+				zap.Uint64("conn_id", id),
+				zap.String("instance", instance),
+				zap.String("server_version", g.version),
+				zap.Uint32("connection_id", g.connectionID),
+				zap.String("capabilities", fmt.Sprintf("%#08x", g.capabilities)))
+		}
+		if len(raw) > 0 {
+			tunnel = &greetingConn{Conn: remoteConn, greeting: raw}
+		}
+	}
+
+	conn := &dialedConn{
+		Conn:       tunnel,
+		client:     c,
+		clientAddr: clientAddr,
+		quota:      c.byteQuota(instance),
+
+		stallTimeout: c.stallTimeout,
+
+		instanceBytes: c.stats.instanceBytes.forInstance(instance),
+		closed:        make(chan struct{}),
+		tracked: &trackedConn{
+			id:         id,
+			instance:   instance,
+			clientAddr: clientAddr,
+			remote:     remoteConn,
+			started:    time.Now(),
+			greeting:   greeting,
+		},
+	}
+	conn.tracked.bytes = func() (int64, int64) {
+		return atomic.LoadInt64(&conn.bytesIn), atomic.LoadInt64(&conn.bytesOut)
+	}
+	if c.capture != nil {
+		conn.capture = c.capture.open(instance)
+	}
+
+	c.onHandshake(conn.tracked.info(), remoteConn)
+
+	c.track(conn.tracked)
+	if atomic.LoadInt32(&c.forceClosing) == 1 {
+		conn.tracked.close(CloseReasonShutdown)
+	}
+	if c.maxConnLifetime > 0 {
+		go conn.watchLifetime(c.maxConnLifetime, c.lifetimeGrace)
+	}
+	if conn.stallTimeout > 0 {
+		go conn.watchStall()
+	}
+	return conn, nil
+}
+
+// acquireSlots takes a slot of MaxConnections and one of the MaxConnections
+// of the instance, if set. If they're taken, it waits up to
+// MaxConnectionsWait for them to free up, waited reports whether it did.
+func (c *Client) acquireSlots(ctx context.Context, instance string) (waited bool, err error) {
+	limit := c.instanceLimits[instance]
+	if c.connSlots == nil && limit == nil {
+		return false, nil
+	}
+
+	wait := c.maxConnectionsWait > 0
+	waitCtx := ctx
+	if wait {
+		var cancel context.CancelFunc
+		waitCtx, cancel = context.WithTimeout(ctx, c.maxConnectionsWait)
+		defer cancel()
+	}
+
+	if c.connSlots != nil {
+		w, ok := c.connSlots.acquire(waitCtx, wait)
+		waited = w
+		if !ok {
+			if ctx.Err() != nil {
+				return waited, ctx.Err()
+			}
+			return waited, fmt.Errorf("%w (max %d)", ErrTooManyConnections, c.maxConnections)
+		}
+	}
+
+	if limit != nil {
+		w, ok := limit.acquire(waitCtx, wait)
+		waited = waited || w
+		if !ok {
+			if c.connSlots != nil {
+				c.connSlots.release()
+			}
+			if ctx.Err() != nil {
+				return waited, ctx.Err()
+			}
+			return waited, fmt.Errorf("%w to instance %q (max %d)", ErrTooManyConnections, instance, limit.max)
+		}
+	}
+	return waited, nil
+}
+
+// releaseSlots frees the slots taken by acquireSlots.
+func (c *Client) releaseSlots(instance string) {
+	if c.connSlots != nil {
+		c.connSlots.release()
+	}
+	if limit := c.instanceLimits[instance]; limit != nil {
+		limit.release()
+	}
+}
+
+// dialedConn is a tunnel returned by dial. Closing it releases it from the
+// client's connection accounting.
+type dialedConn struct {
+	// bytesIn and bytesOut must be accessed atomically. They're first so
+	// they're 64-bit aligned on 32-bit platforms too.
+	bytesIn  int64
+	bytesOut int64
+	// quota is the maximum of bytesIn and bytesOut together, zero means
+	// unlimited.
+	quota int64
+
+	net.Conn
+
+	client     *Client
+	clientAddr string
+	tracked    *trackedConn
+	capture    *connCapture // nil unless the traffic is captured
+
+	// instanceBytes are the byte counts of the tunnel's instance.
+	instanceBytes *ByteCounts
+	// onQuotaExceeded, if set, is called before the tunnel is closed because
+	// the quota was exceeded, fromLocal is set if it was exceeded by the data
+	// sent by the local client.
+	onQuotaExceeded func(fromLocal bool)
+	quotaOnce       sync.Once
+
+	// stallTimeout is the StallTimeout of the tunnel, zero if it isn't
+	// watched.
+	stallTimeout time.Duration
+
+	closeOnce sync.Once
+	// closed is closed once the tunnel is closed.
+	closed chan struct{}
+}
+
+// lifetimeQuietInterval is how long no bytes must go through a tunnel past
+// its maximum lifetime for it to be considered quiet, and closed.
+const lifetimeQuietInterval = 100 * time.Millisecond
+
+// watchLifetime closes the tunnel once it's older than lifetime, as soon as
+// it's quiet, or once the grace period is over.
+func (d *dialedConn) watchLifetime(lifetime, grace time.Duration) {
+	timer := time.NewTimer(lifetime)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-d.closed:
+		return
+	}
+
+	ticker := time.NewTicker(lifetimeQuietInterval)
+	defer ticker.Stop()
+	graceEnd := time.Now().Add(grace)
+	in, out := d.tracked.bytes()
+	for time.Now().Before(graceEnd) {
+		select {
+		case <-ticker.C:
+		case <-d.closed:
+			return
+		}
+
+		newIn, newOut := d.tracked.bytes()
+		if newIn == in && newOut == out {
+			break
+		}
+		in, out = newIn, newOut
+	}
+	d.tracked.close(CloseReasonMaxLifetime)
+}
+
+// stallChecks is how many times per StallTimeout a tunnel is checked for
+// unanswered data.
+const stallChecks = 4
+
+// minStallTimeout is the shortest StallTimeout, so the tunnels aren't checked
+// more often than every quarter of a millisecond.
+const minStallTimeout = time.Millisecond
+
+// watchStall closes the tunnel once the remote server didn't send anything
+// for longer than its stallTimeout since the local client sent it data. The watchdog
+// is only armed while some data is unanswered, so idle tunnels stay open.
+func (d *dialedConn) watchStall() {
+	timeout := d.stallTimeout
+	ticker := time.NewTicker(timeout / stallChecks)
+	defer ticker.Stop()
+
+	// unanswered is when the data still waiting for a response was first
+	// seen, zero if there is none.
+	var unanswered time.Time
+	in, out := d.tracked.bytes()
+	for {
+		select {
+		case <-ticker.C:
+		case <-d.closed:
+			return
+		}
+
+		newIn, newOut := d.tracked.bytes()
+		switch {
+		case newOut != out:
+			unanswered = time.Time{}
+		case newIn != in && unanswered.IsZero():
+			unanswered = time.Now()
+		}
+		in, out = newIn, newOut
+
+		if !unanswered.IsZero() && time.Since(unanswered) >= timeout {
+			break
+		}
+	}
+
+	d.client.log.Warn("connection stalled, closing it",
+		zap.Uint64("conn_id", d.tracked.id),
+		zap.String("instance", d.tracked.instance),
+		zap.Duration("stall_timeout", timeout),
+		zap.Int64("bytes_in", in),
+		zap.Int64("bytes_out", out),
+	)
+	// the deadline fails the reads and writes blocked on the dead
+	// connection right away, before it's closed
+	_ = d.Conn.SetDeadline(time.Now())
+	d.tracked.close(CloseReasonStalled)
+}
+
+// errQuotaExceeded is returned by the reads and writes of a tunnel once it
+// exceeded its MaxBytesPerConnection quota.
+var errQuotaExceeded = errors.New("connection exceeded its byte quota")
+
+func (d *dialedConn) Read(b []byte) (int, error) {
+	n, err := d.Conn.Read(b)
+	if d.quota > 0 && atomic.LoadInt64(&d.bytesIn)+atomic.LoadInt64(&d.bytesOut)+int64(n) > d.quota {
+		d.exceedQuota(false)
+		return 0, errQuotaExceeded
+	}
+	d.countOut(int64(n))
+	if d.capture != nil {
+		d.capture.write(CaptureOut, b[:n])
+	}
+	return n, err
+}
+
+func (d *dialedConn) Write(b []byte) (int, error) {
+	if d.quota > 0 && atomic.LoadInt64(&d.bytesIn)+atomic.LoadInt64(&d.bytesOut)+int64(len(b)) > d.quota {
+		d.exceedQuota(true)
+		return 0, errQuotaExceeded
+	}
+	n, err := d.Conn.Write(b)
+	d.countIn(int64(n))
+	if d.capture != nil {
+		d.capture.write(CaptureIn, b[:n])
+	}
+	return n, err
+}
+
+// countIn counts n bytes sent by the local client.
+func (d *dialedConn) countIn(n int64) {
+	atomic.AddInt64(&d.bytesIn, n)
+	atomic.AddUint64(&d.instanceBytes.In, uint64(n))
+}
+
+// countOut counts n bytes sent by the remote server.
+func (d *dialedConn) countOut(n int64) {
+	atomic.AddInt64(&d.bytesOut, n)
+	atomic.AddUint64(&d.instanceBytes.Out, uint64(n))
+}
+
+// exceedQuota closes the tunnel once it exceeded its quota.
+func (d *dialedConn) exceedQuota(fromLocal bool) {
+	d.quotaOnce.Do(func() {
+		atomic.AddUint64(&d.client.stats.quotaExceeded, 1)
+		d.client.log.Warn("connection exceeded its byte quota",
+			zap.Uint64("conn_id", d.tracked.id),
+			zap.String("instance", d.tracked.instance),
+			zap.Int64("quota", d.quota),
+			zap.Int64("bytes_in", atomic.LoadInt64(&d.bytesIn)),
+			zap.Int64("bytes_out", atomic.LoadInt64(&d.bytesOut)),
+		)
+		if d.onQuotaExceeded != nil {
+			d.onQuotaExceeded(fromLocal)
+		}
+		d.tracked.close(CloseReasonQuotaExceeded)
+	})
+}
+
+// CloseWrite closes the writing side of the tunnel, if the remote
+// connection supports it.
+func (d *dialedConn) CloseWrite() error { return closeWrite(d.Conn) }
+
+func (d *dialedConn) Close() error {
+	err := d.Conn.Close()
+	var closed Event
+	d.closeOnce.Do(func() {
+		close(d.closed)
+		c := d.client
+		c.untrack(d.tracked)
+		atomic.AddUint64(&c.connectionsCounter, ^uint64(0))
+		c.releaseSlots(d.tracked.instance)
+		if d.capture != nil {
+			d.capture.close()
+		}
+
+		e := Event{
+			Type:       EventDisconnect,
+			ConnID:     d.tracked.id,
+			Instance:   d.tracked.instance,
+			ClientAddr: d.clientAddr,
+			RemoteAddr: d.Conn.RemoteAddr().String(),
+			BytesIn:    atomic.LoadInt64(&d.bytesIn),
+			BytesOut:   atomic.LoadInt64(&d.bytesOut),
+			Reason:     d.tracked.closeReason(),
+		}
+		if g := d.tracked.greeting; g != nil {
+			e.ServerVersion = g.version
+			e.ConnectionID = g.connectionID
+		}
+
+		fields := []zap.Field{
+			zap.Uint64("conn_id", e.ConnID),
+			zap.String("instance", e.Instance),
+			zap.Int64("bytes_in", e.BytesIn),
+			zap.Int64("bytes_out", e.BytesOut),
+		}
+		if e.ServerVersion != "" {
+			fields = append(fields,
+				zap.String("server_version", e.ServerVersion),
+				zap.Uint32("connection_id", e.ConnectionID))
+		}
+		if e.Reason != "" {
+			fields = append(fields, zap.String("reason", string(e.Reason)))
+			c.log.Info("connection closed by the proxy", fields...)
+		} else {
+			c.log.Debug("connection closed", fields...)
+		}
+
+		c.emit(e)
+		closed = e
+	})
+
+	// outside of closeOnce, so the hook doesn't block the concurrent calls
+	if closed.Type == EventDisconnect {
+		var closeErr error
+		if closed.Reason != "" {
+			closeErr = &CloseError{Reason: closed.Reason}
+		}
+		d.client.onClose(d.tracked.info(), closed.BytesIn, closed.BytesOut, closeErr)
+	}
+	return err
+}
+
+// byteQuota returns the MaxBytesPerConnection quota of the given instance.
+func (c *Client) byteQuota(instance string) int64 {
+	if quota, ok := c.instanceMaxBytesPerConn[instance]; ok {
+		return quota
+	}
+	return c.maxBytesPerConn
+}
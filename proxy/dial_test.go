@@ -0,0 +1,474 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_Dial(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	c.Assert(conn.RemoteAddr().String(), qt.Equals, addr.String())
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(1))
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "hello")
+
+	// the connection is closed along with its instance
+	client.InvalidateInstance("myorg/mydb/mybranch")
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(buf)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	conn.Close()
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+	c.Assert(client.Shutdown(time.Second), qt.IsNil)
+}
+
+func TestClient_Dial_MaxBytesPerConnection(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.MaxBytesPerConnection = 1000
+	testOpts.InstanceMaxBytesPerConnection = map[string]int64{"myorg/mydb/mybranch": 10}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	var events []Event
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// 5 bytes each way fit in the quota
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+
+	_, err = conn.Write([]byte("!"))
+	c.Assert(err, qt.Equals, errQuotaExceeded)
+	c.Assert(client.Stats().QuotaExceeded, qt.Equals, uint64(1))
+
+	conn.Close()
+	for _, e := range client.recentEvents.recent(time.Time{}) {
+		if e.Type == EventDisconnect {
+			events = append(events, e)
+		}
+	}
+	c.Assert(events, qt.HasLen, 1)
+	c.Assert(events[0].Reason, qt.Equals, CloseReasonQuotaExceeded)
+	c.Assert(events[0].BytesIn+events[0].BytesOut, qt.Equals, int64(10))
+}
+
+func TestNewClient_MaxBytesPerConnection(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.MaxBytesPerConnection = -1
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "MaxBytesPerConnection must not be negative")
+
+	testOpts.MaxBytesPerConnection = 0
+	testOpts.InstanceMaxBytesPerConnection = map[string]int64{"mydb": 10}
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "invalid InstanceMaxBytesPerConnection: .*")
+
+	testOpts.InstanceMaxBytesPerConnection = map[string]int64{"myorg/mydb/mybranch": -1}
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `InstanceMaxBytesPerConnection for instance "myorg/mydb/mybranch" must not be negative`)
+}
+
+func TestClient_Dial_Error(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return nil, ErrUnauthorized
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(conn, qt.IsNil)
+	c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseCert)
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+}
+
+// recordingDialer records the addresses it dials.
+type recordingDialer struct {
+	mu    sync.Mutex
+	addrs []string
+	err   error
+}
+
+func (d *recordingDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.addrs = append(d.addrs, network+"://"+addr)
+	d.mu.Unlock()
+
+	if d.err != nil {
+		return nil, d.err
+	}
+	var nd net.Dialer
+	return nd.DialContext(ctx, network, addr)
+}
+
+func TestClient_Dialer(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	dialer := &recordingDialer{}
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.Dialer = dialer
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+
+	_, port, err := net.SplitHostPort(addr.String())
+	c.Assert(err, qt.IsNil)
+	c.Assert(dialer.addrs, qt.DeepEquals, []string{"tcp://localhost:" + port})
+
+	// the errors of the dialer fail the dial phase
+	dialer.err = errors.New("proxy refused the connection")
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, `.*couldn't connect to "localhost:`+port+`": proxy refused the connection`)
+	var setupErr *SetupError
+	c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+	c.Assert(setupErr.Phase, qt.Equals, PhaseDial)
+}
+
+func TestClient_Dial_MaxConnectionsWait(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.MaxConnections = 1
+	testOpts.MaxConnectionsWait = 5 * time.Second
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx := context.Background()
+	first, err := client.Dial(ctx, "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	// the second connection waits for the first one to close
+	done := make(chan error, 1)
+	go func() {
+		conn, err := client.Dial(ctx, "myorg/mydb/mybranch")
+		if err == nil {
+			conn.Close()
+		}
+		done <- err
+	}()
+	for waiters(client.connSlots) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	first.Close()
+	c.Assert(<-done, qt.IsNil)
+
+	stats := client.Stats()
+	c.Assert(stats.ConnectionsWaited, qt.Equals, uint64(1))
+	c.Assert(stats.ConnectionsRejected, qt.Equals, uint64(0))
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+
+	// it's rejected if no slot frees up in time
+	client.maxConnectionsWait = 20 * time.Millisecond
+	first, err = client.Dial(ctx, "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer first.Close()
+	_, err = client.Dial(ctx, "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, `too many open connections \(max 1\)`)
+	c.Assert(errors.Is(err, ErrTooManyConnections), qt.IsTrue)
+
+	stats = client.Stats()
+	c.Assert(stats.ConnectionsWaited, qt.Equals, uint64(1))
+	c.Assert(stats.ConnectionsRejected, qt.Equals, uint64(1))
+	c.Assert(stats.SetupFailures, qt.Equals, uint64(1))
+
+	// the wait stops when the caller gives up
+	cancelCtx, cancel := context.WithCancel(ctx)
+	client.maxConnectionsWait = time.Minute
+	go func() {
+		for waiters(client.connSlots) == 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+	}()
+	_, err = client.Dial(cancelCtx, "myorg/mydb/mybranch")
+	c.Assert(err, qt.Equals, context.Canceled)
+	c.Assert(client.Stats().ConnectionsRejected, qt.Equals, uint64(1))
+}
+
+// lifetimeTestClient returns a client with the given MaxConnectionLifetime,
+// tunneling to an echo backend.
+func lifetimeTestClient(t *testing.T, lifetime time.Duration) *Client {
+	ca := newTestCA(t)
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.MaxConnectionLifetime = lifetime
+	client, err := NewClient(testOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// disconnectReasons returns the reasons of the EventDisconnect events
+// received so far.
+func disconnectReasons(events <-chan Event) []CloseReason {
+	var reasons []CloseReason
+	for len(events) > 0 {
+		if e := <-events; e.Type == EventDisconnect {
+			reasons = append(reasons, e.Reason)
+		}
+	}
+	return reasons
+}
+
+func TestClient_Dial_MaxConnectionLifetime(t *testing.T) {
+	c := qt.New(t)
+
+	client := lifetimeTestClient(t, 100*time.Millisecond)
+	events := client.Events()
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// the idle tunnel is closed once it's too old
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsFalse)
+
+	conn.Close()
+	c.Assert(disconnectReasons(events), qt.DeepEquals, []CloseReason{CloseReasonMaxLifetime})
+}
+
+func TestClient_Dial_MaxConnectionLifetime_Grace(t *testing.T) {
+	c := qt.New(t)
+
+	client := lifetimeTestClient(t, 50*time.Millisecond)
+	client.lifetimeGrace = time.Second
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// a busy tunnel stays open during the grace period
+	start := time.Now()
+	buf := make([]byte, 4)
+	for time.Since(start) < 500*time.Millisecond {
+		_, err = conn.Write([]byte("ping"))
+		c.Assert(err, qt.IsNil)
+		_, err = io.ReadFull(conn, buf)
+		c.Assert(err, qt.IsNil)
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// and is closed after it, even if it's still busy
+	var closed bool
+	for time.Since(start) < 5*time.Second {
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			closed = true
+			break
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			closed = true
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(closed, qt.IsTrue)
+	c.Assert(time.Since(start) >= time.Second, qt.IsTrue)
+}
+
+func TestClient_MaxConnectionLifetime_Shutdown(t *testing.T) {
+	c := qt.New(t)
+
+	client := lifetimeTestClient(t, 200*time.Millisecond)
+	events := client.Events()
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	// the tunnel expires while Shutdown drains the connections, it's closed
+	// by its owner once its reads fail
+	go func() {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+		conn.Read(make([]byte, 1))                            // nolint: errcheck
+		conn.Close()
+	}()
+	c.Assert(client.Shutdown(5*time.Second), qt.IsNil)
+
+	// closing it again doesn't release it twice
+	conn.Close()
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+	c.Assert(client.conns, qt.HasLen, 0)
+	c.Assert(disconnectReasons(events), qt.DeepEquals, []CloseReason{CloseReasonMaxLifetime})
+}
+
+func TestClient_ShutdownContext_ForceClose(t *testing.T) {
+	c := qt.New(t)
+
+	client := lifetimeTestClient(t, 0)
+	events := client.Events()
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	err = client.ShutdownContext(ctx)
+	var shutdownErr *ShutdownError
+	c.Assert(errors.As(err, &shutdownErr), qt.IsTrue)
+	c.Assert(shutdownErr.ForceClosed, qt.Equals, 1)
+
+	// the remote connection is closed
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsFalse)
+
+	conn.Close()
+	c.Assert(disconnectReasons(events), qt.DeepEquals, []CloseReason{CloseReasonShutdown})
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+
+	// nothing is left to close
+	c.Assert(client.Shutdown(time.Second), qt.IsNil)
+}
+
+func TestClient_StallTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	// the server answers the first query and hangs on the next one
+	hang := make(chan struct{})
+	t.Cleanup(func() { close(hang) })
+	addr := startPlaintextBackend(t, func(conn net.Conn) {
+		buf := make([]byte, 5)
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		if _, err := conn.Write(buf); err != nil {
+			return
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			return
+		}
+		<-hang
+	})
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = addr
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.StallTimeout = 200 * time.Millisecond
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	events := client.Events()
+	local := startClient(t, client)
+
+	conn, err := net.Dial("tcp", local.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("query"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+
+	// an idle connection isn't stalled
+	time.Sleep(3 * testOpts.StallTimeout)
+	c.Assert(client.Connections(), qt.HasLen, 1)
+
+	// an unanswered query is
+	start := time.Now()
+	_, err = conn.Write([]byte("query"))
+	c.Assert(err, qt.IsNil)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(time.Since(start) >= testOpts.StallTimeout, qt.IsTrue)
+
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventDisconnect {
+				continue
+			}
+			c.Assert(e.Reason, qt.Equals, CloseReasonStalled)
+		case <-timeout:
+			c.Fatal("the connection wasn't closed")
+		}
+		break
+	}
+
+	testOpts.StallTimeout = -time.Second
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "StallTimeout must not be negative")
+
+	// shorter ones would tick every 0ns
+	testOpts.StallTimeout = 3 * time.Nanosecond
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "StallTimeout must be at least 1ms, got 3ns")
+}
@@ -0,0 +1,184 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultFallbackDelay is how long a connection over the preferred IP
+	// family gets before one over the other family is raced against it, as
+	// RFC 6555 suggests, and what *net.Dialer uses.
+	defaultFallbackDelay = 300 * time.Millisecond
+)
+
+// dialResolved dials the resolved addresses of the given host:port address.
+// If they are of both IP families, the addresses of the family resolved
+// first are raced against the ones of the other family, which start
+// fallbackDelay later, or as soon as the first family failed. The first
+// connection wins and the other one is closed.
+func (c *Client) dialResolved(ctx context.Context, addr string) (net.Conn, error) {
+	addrs, err := c.hosts.addrs(ctx, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs = filterNetwork(c.remoteNetwork, addrs)
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no %s addresses found for %s", c.remoteNetwork, addr)
+	}
+	if len(addrs) == 1 {
+		return c.dialer.DialContext(ctx, c.remoteNetwork, addrs[0])
+	}
+
+	primaries, fallbacks := splitFamilies(addrs)
+	if len(fallbacks) == 0 || c.fallbackDelay < 0 {
+		return c.dialSerial(ctx, addr, addrs)
+	}
+	return c.dialParallel(ctx, addr, primaries, fallbacks)
+}
+
+// dialSerial dials the given resolved addresses of addr one at a time, until
+// one of them succeeds.
+func (c *Client) dialSerial(ctx context.Context, addr string, addrs []string) (net.Conn, error) {
+	var err error
+	for _, resolved := range addrs {
+		var conn net.Conn
+		conn, err = c.dialer.DialContext(ctx, c.remoteNetwork, resolved)
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+
+		c.hosts.failed(addr, resolved)
+		c.log.Warn("couldn't connect to resolved address of remote host",
+			zap.String("remote_addr", addr),
+			zap.String("resolved_addr", resolved),
+			zap.Error(err))
+	}
+	return nil, err
+}
+
+// dialParallel races the primaries against the fallbacks, the resolved
+// addresses of addr of either IP family.
+func (c *Client) dialParallel(ctx context.Context, addr string, primaries, fallbacks []string) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type dialResult struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+
+	// buffered so the loser never blocks
+	results := make(chan dialResult, 2)
+	pending := 0
+	dial := func(addrs []string, primary bool) {
+		pending++
+		go func() {
+			conn, err := c.dialSerial(ctx, addr, addrs)
+			results <- dialResult{conn: conn, err: err, primary: primary}
+		}()
+	}
+
+	dial(primaries, true)
+	fallbackTimer := time.NewTimer(c.fallbackDelay)
+	defer fallbackTimer.Stop()
+	fallbackStarted := false
+
+	var primaryErr, fallbackErr error
+	for {
+		select {
+		case <-fallbackTimer.C:
+			if !fallbackStarted {
+				fallbackStarted = true
+				dial(fallbacks, false)
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// the loser is canceled, but it might have connected
+					// already
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+
+			if res.primary {
+				primaryErr = res.err
+			} else {
+				fallbackErr = res.err
+			}
+
+			// don't wait for the delay if the primaries failed already
+			if !fallbackStarted {
+				fallbackStarted = true
+				dial(fallbacks, false)
+				continue
+			}
+			if pending == 0 {
+				if primaryErr != nil {
+					return nil, primaryErr
+				}
+				return nil, fallbackErr
+			}
+		}
+	}
+}
+
+// filterNetwork returns the addresses of the IP family of the given network,
+// "tcp" allows both.
+func filterNetwork(network string, addrs []string) []string {
+	if network == "tcp" {
+		return addrs
+	}
+
+	var filtered []string
+	for _, addr := range addrs {
+		if isIPv4Addr(addr) == (network == "tcp4") {
+			filtered = append(filtered, addr)
+		}
+	}
+	return filtered
+}
+
+// splitFamilies splits the addresses into the ones of the IP family of the
+// first address and the ones of the other family, keeping their order.
+func splitFamilies(addrs []string) (primaries, fallbacks []string) {
+	if len(addrs) == 0 {
+		return nil, nil
+	}
+
+	ipv4 := isIPv4Addr(addrs[0])
+	for _, addr := range addrs {
+		if isIPv4Addr(addr) == ipv4 {
+			primaries = append(primaries, addr)
+		} else {
+			fallbacks = append(fallbacks, addr)
+		}
+	}
+	return primaries, fallbacks
+}
+
+// isIPv4Addr reports whether the host of the given host:port address is an
+// IPv4 address.
+func isIPv4Addr(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.To4() != nil
+}
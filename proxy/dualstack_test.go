@@ -0,0 +1,220 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// ipv6BlackholeDialer never connects to IPv6 addresses, like a broken IPv6
+// path, and dials the IPv4 ones.
+type ipv6BlackholeDialer struct {
+	ipv6Dials int32
+}
+
+func (d *ipv6BlackholeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if !isIPv4Addr(addr) {
+		atomic.AddInt32(&d.ipv6Dials, 1)
+		return blackholeDialer{}.DialContext(ctx, network, addr)
+	}
+	var dialer net.Dialer
+	return dialer.DialContext(ctx, network, addr)
+}
+
+// startIPv6EchoBackend starts an echo backend listening only on the IPv6
+// loopback address, the test is skipped if IPv6 isn't available.
+func startIPv6EchoBackend(t *testing.T) string {
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skip("IPv6 isn't available:", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go echoHandler(conn)
+		}
+	}()
+	return l.Addr().String()
+}
+
+// dualStackOptions returns the options of a client resolving db.example.com
+// to both the IPv6 and the IPv4 loopback addresses, with the given port.
+func dualStackOptions(t *testing.T, port string) Options {
+	resolver := &fakeHostResolver{}
+	resolver.set("db.example.com", "::1", "127.0.0.1")
+
+	opts := testListenOptions(t)
+	opts.InsecureRemotePlaintext = true
+	opts.RemoteAddr = net.JoinHostPort("db.example.com", port)
+	opts.HostResolver = resolver
+	return opts
+}
+
+// pingClient writes to a new connection to the client and checks it's
+// echoed back.
+func pingClient(c *qt.C, client *Client) {
+	conn, err := net.Dial("tcp", client.currentListener().Addr().String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 4)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "ping")
+}
+
+func TestClient_DualStack_BrokenIPv6(t *testing.T) {
+	c := qt.New(t)
+
+	// the backend only listens on IPv4 and IPv6 hangs
+	_, port, err := net.SplitHostPort(startPlaintextEchoBackend(t))
+	c.Assert(err, qt.IsNil)
+	dialer := &ipv6BlackholeDialer{}
+
+	opts := dualStackOptions(t, port)
+	opts.Dialer = dialer
+	opts.FallbackDelay = 50 * time.Millisecond
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	start := time.Now()
+	pingClient(c, client)
+	c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue)
+	c.Assert(atomic.LoadInt32(&dialer.ipv6Dials), qt.Equals, int32(1))
+}
+
+func TestClient_DualStack_IPv6Only(t *testing.T) {
+	c := qt.New(t)
+
+	// the backend only listens on IPv6, IPv4 refuses the connections
+	_, port, err := net.SplitHostPort(startIPv6EchoBackend(t))
+	c.Assert(err, qt.IsNil)
+
+	opts := dualStackOptions(t, port)
+	opts.HostResolver.(*fakeHostResolver).set("db.example.com", "127.0.0.1", "::1")
+	// IPv6 doesn't wait for the delay once IPv4 failed
+	opts.FallbackDelay = time.Minute
+	opts.DialTimeout = 10 * time.Second
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	start := time.Now()
+	pingClient(c, client)
+	c.Assert(time.Since(start) < 5*time.Second, qt.IsTrue)
+}
+
+func TestClient_RemoteNetwork(t *testing.T) {
+	c := qt.New(t)
+
+	_, port, err := net.SplitHostPort(startPlaintextEchoBackend(t))
+	c.Assert(err, qt.IsNil)
+	dialer := &ipv6BlackholeDialer{}
+
+	// a single family doesn't race, IPv6 isn't tried at all
+	opts := dualStackOptions(t, port)
+	opts.Dialer = dialer
+	opts.RemoteNetwork = "tcp4"
+	opts.FallbackDelay = time.Minute
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	pingClient(c, client)
+	c.Assert(atomic.LoadInt32(&dialer.ipv6Dials), qt.Equals, int32(0))
+
+	// and there might be no address of the family
+	opts.HostResolver.(*fakeHostResolver).set("v6.example.com", "::1")
+	_, err = client.dialRemote(context.Background(), "v6.example.com:"+port)
+	c.Assert(err, qt.ErrorMatches, "no tcp4 addresses found for v6.example.com:.*")
+	_, err = client.dialRemote(context.Background(), "[::1]:"+port)
+	c.Assert(err, qt.ErrorMatches, `no tcp4 addresses found for \[::1\]:.*`)
+}
+
+// pipeDialer returns one end of a pipe per dial, after the delay of the IP
+// family of the address.
+type pipeDialer struct {
+	ipv4Delay, ipv6Delay time.Duration
+	conns                chan net.Conn
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	delay := d.ipv6Delay
+	if isIPv4Addr(addr) {
+		delay = d.ipv4Delay
+	}
+	time.Sleep(delay)
+
+	local, remote := net.Pipe()
+	d.conns <- remote
+	return local, nil
+}
+
+func TestClient_dialParallel_ClosesLoser(t *testing.T) {
+	c := qt.New(t)
+
+	dialer := &pipeDialer{
+		ipv6Delay: 200 * time.Millisecond,
+		conns:     make(chan net.Conn, 2),
+	}
+	opts := dualStackOptions(t, "3307")
+	opts.Dialer = dialer
+	opts.FallbackDelay = 10 * time.Millisecond
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.dialResolved(context.Background(), opts.RemoteAddr)
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// IPv4 wins, the IPv6 connection is closed once it's established
+	first, second := <-dialer.conns, <-dialer.conns
+	go conn.Write([]byte("x")) // nolint: errcheck
+	_, err = first.Read(make([]byte, 1))
+	c.Assert(err, qt.IsNil)
+	second.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = second.Read(make([]byte, 1))
+	c.Assert(err, qt.ErrorMatches, "EOF")
+}
+
+func TestSplitFamilies(t *testing.T) {
+	c := qt.New(t)
+
+	addrs := []string{"[2001:db8::1]:3307", "10.0.0.1:3307", "[2001:db8::2]:3307", "10.0.0.2:3307"}
+	primaries, fallbacks := splitFamilies(addrs)
+	c.Assert(primaries, qt.DeepEquals, []string{"[2001:db8::1]:3307", "[2001:db8::2]:3307"})
+	c.Assert(fallbacks, qt.DeepEquals, []string{"10.0.0.1:3307", "10.0.0.2:3307"})
+
+	c.Assert(filterNetwork("tcp", addrs), qt.DeepEquals, addrs)
+	c.Assert(filterNetwork("tcp4", addrs), qt.DeepEquals, fallbacks)
+	c.Assert(filterNetwork("tcp6", addrs), qt.DeepEquals, primaries)
+}
+
+func TestNewClient_RemoteNetwork(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testListenOptions(t)
+	opts.RemoteNetwork = "udp"
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, `RemoteNetwork must be "tcp", "tcp4" or "tcp6", got "udp"`)
+
+	opts.RemoteNetwork = ""
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.remoteNetwork, qt.Equals, "tcp")
+	c.Assert(client.fallbackDelay, qt.Equals, defaultFallbackDelay)
+	c.Assert(client.dialer.(*net.Dialer).FallbackDelay, qt.Equals, defaultFallbackDelay)
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// dumpTopConnections is the number of connections listed by age and by
+// bytes in the state dump.
+const dumpTopConnections = 10
+
+// connSnapshot is the state of a tracked connection at the time of a dump.
+type connSnapshot struct {
+	instance   string
+	clientAddr string
+	remoteAddr string
+	age        time.Duration
+	bytesIn    int64
+	bytesOut   int64
+
+	serverVersion string
+	connectionID  uint32
+}
+
+// DumpState writes a human-readable snapshot of the client's state to w: its
+// uptime, counters, active connections by instance, cached certificates and
+// the oldest and busiest connections. It's meant for debugging when the
+// admin API can't be reached. Connections keep being proxied while the
+// snapshot is taken.
+func (c *Client) DumpState(w io.Writer) error {
+	now := time.Now()
+	bw := bufio.NewWriter(w)
+
+	fmt.Fprintf(bw, "sql-proxy state at %s\n", now.UTC().Format(time.RFC3339))
+	fmt.Fprintf(bw, "uptime: %s\n", now.Sub(c.created).Round(time.Second))
+
+	s := c.Stats()
+	fmt.Fprintf(bw, "\ncounters:\n")
+	fmt.Fprintf(bw, "  active connections: %d\n", atomic.LoadUint64(&c.connectionsCounter))
+	fmt.Fprintf(bw, "  connections: %d\n", s.Connections)
+	fmt.Fprintf(bw, "  queued: %d\n", s.Queued)
+	fmt.Fprintf(bw, "  setup failures: %d%s\n", s.SetupFailures, formatCounts(s.SetupFailuresByPhase))
+	if len(s.CertErrorsByKind) > 0 {
+		var certErrors uint64
+		for _, n := range s.CertErrorsByKind {
+			certErrors += n
+		}
+		fmt.Fprintf(bw, "  cert errors: %d%s\n", certErrors, formatCounts(s.CertErrorsByKind))
+	}
+	fmt.Fprintf(bw, "  setup retries: %d\n", s.SetupRetries)
+	fmt.Fprintf(bw, "  rejected peers: %d\n", s.RejectedPeers)
+	fmt.Fprintf(bw, "  probe connections: %d\n", s.ProbeConnections)
+	fmt.Fprintf(bw, "  quota exceeded: %d\n", s.QuotaExceeded)
+	fmt.Fprintf(bw, "  listener restarts: %d\n", s.ListenerRestarts)
+	fmt.Fprintf(bw, "  events dropped: %d\n", s.EventsDropped)
+
+	conns := c.connSnapshots(now)
+	byInstance := make(map[string]uint64)
+	for _, conn := range conns {
+		byInstance[conn.instance]++
+	}
+	fmt.Fprintf(bw, "\nactive connections by instance:\n")
+	if len(byInstance) == 0 {
+		fmt.Fprintf(bw, "  none\n")
+	}
+	for _, instance := range sortedKeys(byInstance) {
+		fmt.Fprintf(bw, "  %s: %d\n", instance, byInstance[instance])
+	}
+
+	fmt.Fprintf(bw, "\ncert cache:\n")
+	entries := c.configCache.entries()
+	if len(entries) == 0 {
+		fmt.Fprintf(bw, "  empty\n")
+	}
+	instances := make([]string, 0, len(entries))
+	for instance := range entries {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		e := entries[instance]
+		fmt.Fprintf(bw, "  %s: remote %s, cached %s ago, cache expires in %s",
+			instance, e.remoteAddr,
+			now.Sub(e.added).Round(time.Second),
+			e.added.Add(expireTTL).Sub(now).Round(time.Second))
+		if len(e.cfg.Certificates) > 0 && len(e.cfg.Certificates[0].Certificate) > 0 {
+			if cert, err := x509.ParseCertificate(e.cfg.Certificates[0].Certificate[0]); err == nil {
+				fmt.Fprintf(bw, ", client cert expires at %s (in %s)",
+					cert.NotAfter.UTC().Format(time.RFC3339), cert.NotAfter.Sub(now).Round(time.Second))
+			}
+		}
+		fmt.Fprintf(bw, "\n")
+	}
+
+	sort.SliceStable(conns, func(i, j int) bool { return conns[i].age > conns[j].age })
+	writeConnSnapshots(bw, "oldest connections", conns)
+
+	sort.SliceStable(conns, func(i, j int) bool {
+		return conns[i].bytesIn+conns[i].bytesOut > conns[j].bytesIn+conns[j].bytesOut
+	})
+	writeConnSnapshots(bw, "busiest connections", conns)
+
+	return bw.Flush()
+}
+
+// connSnapshots returns the state of the tracked connections, see
+// Connections.
+func (c *Client) connSnapshots(now time.Time) []connSnapshot {
+	infos := c.Connections()
+	conns := make([]connSnapshot, 0, len(infos))
+	for _, info := range infos {
+		conns = append(conns, connSnapshot{
+			instance:   info.Instance,
+			clientAddr: info.ClientAddr,
+			remoteAddr: info.RemoteAddr,
+			age:        now.Sub(info.Started),
+			bytesIn:    info.BytesIn,
+			bytesOut:   info.BytesOut,
+
+			serverVersion: info.ServerVersion,
+			connectionID:  info.ConnectionID,
+		})
+	}
+	return conns
+}
+
+func writeConnSnapshots(w io.Writer, title string, conns []connSnapshot) {
+	fmt.Fprintf(w, "\n%s:\n", title)
+	if len(conns) == 0 {
+		fmt.Fprintf(w, "  none\n")
+	}
+	for i, conn := range conns {
+		if i == dumpTopConnections {
+			fmt.Fprintf(w, "  ... and %d more\n", len(conns)-i)
+			break
+		}
+		clientAddr := conn.clientAddr
+		if clientAddr == "" {
+			clientAddr = "-"
+		}
+		fmt.Fprintf(w, "  %s: client %s, remote %s, age %s, bytes in %d, bytes out %d",
+			conn.instance, clientAddr, conn.remoteAddr, conn.age.Round(time.Second), conn.bytesIn, conn.bytesOut)
+		if conn.serverVersion != "" {
+			fmt.Fprintf(w, ", server %s, connection id %d", conn.serverVersion, conn.connectionID)
+		}
+		fmt.Fprintf(w, "\n")
+	}
+}
+
+// formatCounts formats counts by key as " (key: n, ...)", sorted by key.
+func formatCounts(counts map[string]uint64) string {
+	if len(counts) == 0 {
+		return ""
+	}
+	var out string
+	for i, key := range sortedKeys(counts) {
+		if i > 0 {
+			out += ", "
+		}
+		out += fmt.Sprintf("%s: %d", key, counts[key])
+	}
+	return " (" + out + ")"
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_DumpState(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := backendCertSource(t, ca, addr)
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			if db == "gone" {
+				return nil, &CertSourceError{Kind: CertErrorNotFound, Err: errors.New("no such database")}
+			}
+			return certSource.Cert(ctx, org, db, branch)
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.Dial(context.Background(), "myorg/gone/main")
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	var buf bytes.Buffer
+	c.Assert(client.DumpState(&buf), qt.IsNil)
+	dump := buf.String()
+
+	c.Assert(dump, qt.Matches, `(?s)sql-proxy state at .*\nuptime: .*`)
+	c.Assert(dump, qt.Contains, "  active connections: 1\n")
+	c.Assert(dump, qt.Contains, "  setup failures: 1 (cert: 1)\n")
+	c.Assert(dump, qt.Contains, "  cert errors: 1 (not_found: 1)\n")
+	c.Assert(dump, qt.Contains, "active connections by instance:\n  myorg/mydb/mybranch: 1\n")
+	c.Assert(dump, qt.Matches, `(?s).*cert cache:\n  myorg/mydb/mybranch: remote localhost:\d+, cached \d+s ago, cache expires in [0-9ms]+, client cert expires at .*`)
+	c.Assert(dump, qt.Matches, `(?s).*oldest connections:\n  myorg/mydb/mybranch: client -, remote `+addr.String()+`, age \d+s, bytes in 5, bytes out 5\n.*`)
+	c.Assert(dump, qt.Matches, `(?s).*busiest connections:\n  myorg/mydb/mybranch: client -, .*`)
+
+	c.Assert(client.Stats().SetupFailuresByPhase, qt.DeepEquals, map[string]uint64{"cert": 1})
+}
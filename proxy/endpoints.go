@@ -0,0 +1,332 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultProbeInterval    = 10 * time.Second
+	defaultProbeTimeout     = 2 * time.Second
+	defaultProbeHysteresis  = 5 * time.Millisecond
+	defaultEndpointCooldown = 10 * time.Second
+)
+
+// ProbeMode is what is measured to compare the latency of the remote
+// endpoints.
+type ProbeMode string
+
+const (
+	// ProbeTCP measures the time to establish a TCP connection.
+	ProbeTCP ProbeMode = "tcp"
+
+	// ProbeTLS measures the time to establish a TCP connection and complete
+	// the TLS handshake. It requires Instance to be set, so the client has
+	// certs to handshake with.
+	ProbeTLS ProbeMode = "tls"
+)
+
+// ProbeOptions configures how the RemoteAddrs of a Client are probed.
+type ProbeOptions struct {
+	// Mode is what is measured, ProbeTCP by default.
+	Mode ProbeMode
+
+	// Interval is how often every endpoint is probed. By default it's 10
+	// seconds.
+	Interval time.Duration
+
+	// Timeout is how long a probe may take before the endpoint is
+	// considered unhealthy. By default it's 2 seconds.
+	Timeout time.Duration
+
+	// Hysteresis is how much faster another endpoint has to be before new
+	// connections switch to it, so they don't flap between endpoints with
+	// about the same latency. By default it's 5 milliseconds.
+	Hysteresis time.Duration
+
+	// Cooldown is how long new connections skip an endpoint after they
+	// failed to connect to it, unless all endpoints are cooling down. A
+	// successful probe ends the cooldown early. By default it's 10 seconds.
+	Cooldown time.Duration
+}
+
+// EndpointStats holds the last probe result of a remote endpoint.
+type EndpointStats struct {
+	Addr string `json:"addr"`
+
+	// Healthy is set if the last probe succeeded.
+	Healthy bool `json:"healthy"`
+
+	// Latency is the duration of the last successful probe.
+	Latency time.Duration `json:"latency"`
+
+	// LastProbe is when the endpoint was last probed, it's zero until the
+	// first probe completes.
+	LastProbe time.Time `json:"last_probe"`
+
+	// LastError is the error of the last probe, if it failed.
+	LastError string `json:"last_error,omitempty"`
+
+	// Selected is set for the endpoint new connections are routed to.
+	Selected bool `json:"selected"`
+
+	// CooldownUntil is set until when new connections skip the endpoint,
+	// after they failed to connect to it.
+	CooldownUntil time.Time `json:"cooldown_until"`
+}
+
+// endpointSelector routes new connections to the remote endpoint with the
+// lowest latency, and to the others in turn if it can't be connected to.
+type endpointSelector struct {
+	opts ProbeOptions
+	log  *zap.Logger
+
+	// probe measures the latency of a single endpoint.
+	probe func(ctx context.Context, addr string) (time.Duration, error)
+
+	mu        sync.Mutex // protects endpoints and selected
+	endpoints []EndpointStats
+	selected  int
+}
+
+func newEndpointSelector(addrs []string, opts ProbeOptions, log *zap.Logger) *endpointSelector {
+	if opts.Mode == "" {
+		opts.Mode = ProbeTCP
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = defaultProbeInterval
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = defaultProbeTimeout
+	}
+	if opts.Hysteresis <= 0 {
+		opts.Hysteresis = defaultProbeHysteresis
+	}
+	if opts.Cooldown <= 0 {
+		opts.Cooldown = defaultEndpointCooldown
+	}
+
+	s := &endpointSelector{
+		opts:      opts,
+		log:       log,
+		endpoints: make([]EndpointStats, len(addrs)),
+	}
+	for i, addr := range addrs {
+		s.endpoints[i].Addr = addr
+	}
+	return s
+}
+
+// current returns the endpoint new connections should go to and its last
+// probed latency. Until the endpoints are probed, it's the first one.
+func (s *endpointSelector) current() (string, time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e := s.endpoints[s.selected]
+	return e.Addr, e.Latency
+}
+
+// candidates returns the endpoints a new connection should try in turn: the
+// selected one first, then the others in the order they were given. The
+// ones cooling down after a failure are skipped, unless all of them are.
+func (s *endpointSelector) candidates(now time.Time) []EndpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	order := make([]EndpointStats, 0, len(s.endpoints))
+	order = append(order, s.endpoints[s.selected])
+	for i, e := range s.endpoints {
+		if i != s.selected {
+			order = append(order, e)
+		}
+	}
+
+	var ready []EndpointStats
+	for _, e := range order {
+		if !now.Before(e.CooldownUntil) {
+			ready = append(ready, e)
+		}
+	}
+	if len(ready) == 0 {
+		return order
+	}
+	return ready
+}
+
+// failed puts the given endpoint in cooldown after a connection to it failed.
+func (s *endpointSelector) failed(addr string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.endpoints {
+		if s.endpoints[i].Addr == addr {
+			s.endpoints[i].CooldownUntil = now.Add(s.opts.Cooldown)
+		}
+	}
+}
+
+// succeeded ends the cooldown of the given endpoint after a connection to it
+// succeeded, and selects it if the selected one is cooling down, so new
+// connections try the last one known to work first.
+func (s *endpointSelector) succeeded(addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := range s.endpoints {
+		if s.endpoints[i].Addr != addr {
+			continue
+		}
+		s.endpoints[i].CooldownUntil = time.Time{}
+		if i != s.selected && !s.endpoints[s.selected].CooldownUntil.IsZero() {
+			s.log.Info("switching remote endpoint",
+				zap.String("from", s.endpoints[s.selected].Addr),
+				zap.String("to", addr),
+				zap.String("reason", "failover"))
+			s.selected = i
+		}
+	}
+}
+
+// stats returns the last probe results of every endpoint.
+func (s *endpointSelector) stats() []EndpointStats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stats := make([]EndpointStats, len(s.endpoints))
+	copy(stats, s.endpoints)
+	stats[s.selected].Selected = true
+	return stats
+}
+
+// run probes the endpoints every interval until stop is closed.
+func (s *endpointSelector) run(stop <-chan struct{}) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		<-stop
+		cancel()
+	}()
+
+	ticker := time.NewTicker(s.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		s.probeAll(ctx)
+
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// probeAll probes every endpoint concurrently and updates the selection.
+func (s *endpointSelector) probeAll(ctx context.Context) {
+	type result struct {
+		latency time.Duration
+		err     error
+	}
+
+	results := make([]result, len(s.endpoints))
+	var wg sync.WaitGroup
+	for i := range s.endpoints {
+		wg.Add(1)
+		go func(i int, addr string) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(ctx, s.opts.Timeout)
+			defer cancel()
+			latency, err := s.probe(ctx, addr)
+			results[i] = result{latency: latency, err: err}
+		}(i, s.endpoints[i].Addr)
+	}
+	wg.Wait()
+
+	if ctx.Err() != nil {
+		return
+	}
+
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, r := range results {
+		e := &s.endpoints[i]
+		e.LastProbe = now
+		e.Healthy = r.err == nil
+		e.LastError = ""
+		if r.err != nil {
+			e.LastError = r.err.Error()
+			s.log.Warn("remote endpoint probe failed",
+				zap.String("remote_addr", e.Addr), zap.Error(r.err))
+			continue
+		}
+		e.Latency = r.latency
+		e.CooldownUntil = time.Time{}
+	}
+
+	if selected := s.selectLocked(); selected != s.selected {
+		s.log.Info("switching remote endpoint",
+			zap.String("from", s.endpoints[s.selected].Addr),
+			zap.String("to", s.endpoints[selected].Addr),
+			zap.Duration("latency", s.endpoints[selected].Latency))
+		s.selected = selected
+	}
+}
+
+// selectLocked returns the index of the endpoint to route new connections
+// to: the fastest healthy one, unless the currently selected one is healthy
+// and not slower by more than the hysteresis. s.mu must be held.
+func (s *endpointSelector) selectLocked() int {
+	var healthy []int
+	for i, e := range s.endpoints {
+		if e.Healthy {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		// nothing better to go to, keep trying the current one
+		return s.selected
+	}
+
+	sort.SliceStable(healthy, func(i, j int) bool {
+		return s.endpoints[healthy[i]].Latency < s.endpoints[healthy[j]].Latency
+	})
+	best := healthy[0]
+
+	current := s.endpoints[s.selected]
+	if current.Healthy && current.Latency-s.endpoints[best].Latency <= s.opts.Hysteresis {
+		return s.selected
+	}
+	return best
+}
+
+// probeEndpoint measures the latency of the given remote endpoint according
+// to the configured probe mode.
+func (c *Client) probeEndpoint(ctx context.Context, addr string) (time.Duration, error) {
+	var cfg *tls.Config
+	if c.endpoints.opts.Mode == ProbeTLS {
+		var err error
+		cfg, _, err = c.clientCerts(ctx, c.instance)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	start := time.Now()
+	conn, err := c.dialer.DialContext(ctx, c.remoteNetwork, addr)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	if cfg != nil {
+		secureConn := tls.Client(conn, cfg.Clone())
+		defer secureConn.Close()
+		if err := secureConn.HandshakeContext(ctx); err != nil {
+			return 0, err
+		}
+	}
+	return time.Since(start), nil
+}
@@ -0,0 +1,290 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeProbe returns the latencies or errors set for each address.
+type fakeProbe struct {
+	mu        sync.Mutex
+	latencies map[string]time.Duration
+	errs      map[string]error
+}
+
+func (p *fakeProbe) set(addr string, latency time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.latencies == nil {
+		p.latencies = make(map[string]time.Duration)
+		p.errs = make(map[string]error)
+	}
+	p.latencies[addr] = latency
+	p.errs[addr] = err
+}
+
+func (p *fakeProbe) probe(ctx context.Context, addr string) (time.Duration, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.latencies[addr], p.errs[addr]
+}
+
+func TestEndpointSelector(t *testing.T) {
+	c := qt.New(t)
+
+	probe := &fakeProbe{}
+	s := newEndpointSelector([]string{"a:1", "b:1", "c:1"}, ProbeOptions{Hysteresis: 5 * time.Millisecond}, zap.NewNop())
+	s.probe = probe.probe
+
+	current := func() string {
+		addr, _ := s.current()
+		return addr
+	}
+
+	// the first endpoint is used until they're probed
+	c.Assert(current(), qt.Equals, "a:1")
+
+	probe.set("a:1", 50*time.Millisecond, nil)
+	probe.set("b:1", 20*time.Millisecond, nil)
+	probe.set("c:1", 30*time.Millisecond, nil)
+	s.probeAll(context.Background())
+	c.Assert(current(), qt.Equals, "b:1")
+
+	// within the hysteresis, stay on the current endpoint
+	probe.set("b:1", 34*time.Millisecond, nil)
+	s.probeAll(context.Background())
+	c.Assert(current(), qt.Equals, "b:1")
+
+	// faster by more than the hysteresis, switch
+	probe.set("b:1", 36*time.Millisecond, nil)
+	s.probeAll(context.Background())
+	c.Assert(current(), qt.Equals, "c:1")
+
+	// the current one is unhealthy, switch even if it was fastest
+	probe.set("c:1", time.Millisecond, errors.New("connection refused"))
+	s.probeAll(context.Background())
+	c.Assert(current(), qt.Equals, "b:1")
+
+	// nothing is healthy, keep the current one
+	probe.set("a:1", 0, errors.New("connection refused"))
+	probe.set("b:1", 0, errors.New("connection refused"))
+	s.probeAll(context.Background())
+	c.Assert(current(), qt.Equals, "b:1")
+
+	stats := s.stats()
+	c.Assert(stats, qt.HasLen, 3)
+	for _, e := range stats {
+		c.Assert(e.Healthy, qt.IsFalse)
+		c.Assert(e.LastError, qt.Equals, "connection refused")
+		c.Assert(e.LastProbe.IsZero(), qt.IsFalse)
+		c.Assert(e.Selected, qt.Equals, e.Addr == "b:1")
+	}
+}
+
+func TestClient_RemoteAddrs(t *testing.T) {
+	c := qt.New(t)
+
+	slow := startPlaintextEchoBackend(t)
+	fast := startPlaintextEchoBackend(t)
+
+	probe := &fakeProbe{}
+	probe.set(slow, 80*time.Millisecond, nil)
+	probe.set(fast, 10*time.Millisecond, nil)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddrs = []string{slow, fast}
+	testOpts.RemoteProbe.Interval = 10 * time.Millisecond
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	client.endpoints.probe = probe.probe
+
+	localAddr := startClient(t, client)
+
+	for {
+		addr, _ := client.endpoints.current()
+		if addr == fast {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	c.Assert(err, qt.IsNil)
+
+	client.connsMu.Lock()
+	c.Assert(client.conns, qt.HasLen, 1)
+	for tc := range client.conns {
+		c.Assert(tc.remote.RemoteAddr().String(), qt.Equals, fast)
+	}
+	client.connsMu.Unlock()
+
+	stats := client.Stats()
+	c.Assert(stats.Endpoints, qt.HasLen, 2)
+	c.Assert(stats.Endpoints[1].Addr, qt.Equals, fast)
+	c.Assert(stats.Endpoints[1].Selected, qt.IsTrue)
+	c.Assert(stats.Endpoints[1].Latency, qt.Equals, 10*time.Millisecond)
+}
+
+func TestEndpointSelector_Failover(t *testing.T) {
+	c := qt.New(t)
+
+	s := newEndpointSelector([]string{"a:1", "b:1", "c:1"}, ProbeOptions{Cooldown: time.Minute}, zap.NewNop())
+	addrs := func(now time.Time) []string {
+		var addrs []string
+		for _, e := range s.candidates(now) {
+			addrs = append(addrs, e.Addr)
+		}
+		return addrs
+	}
+
+	now := time.Now()
+	c.Assert(addrs(now), qt.DeepEquals, []string{"a:1", "b:1", "c:1"})
+
+	// the failed endpoints are skipped while cooling down
+	s.failed("a:1", now)
+	s.failed("b:1", now)
+	c.Assert(addrs(now), qt.DeepEquals, []string{"c:1"})
+	c.Assert(addrs(now.Add(time.Minute)), qt.DeepEquals, []string{"a:1", "b:1", "c:1"})
+
+	// the last endpoint known to work is tried first
+	s.succeeded("c:1")
+	c.Assert(addrs(now), qt.DeepEquals, []string{"c:1"})
+	c.Assert(addrs(now.Add(time.Minute)), qt.DeepEquals, []string{"c:1", "a:1", "b:1"})
+
+	// all of them are tried if they're all cooling down
+	s.failed("c:1", now)
+	c.Assert(addrs(now), qt.DeepEquals, []string{"c:1", "a:1", "b:1"})
+
+	stats := s.stats()
+	c.Assert(stats[2].Selected, qt.IsTrue)
+	c.Assert(stats[2].CooldownUntil, qt.Equals, now.Add(time.Minute))
+}
+
+func TestClient_RemoteAddrs_Failover(t *testing.T) {
+	c := qt.New(t)
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	primary := l.Addr().String()
+	l.Close()
+	standby := startPlaintextEchoBackend(t)
+
+	core, logs := observer.New(zap.DebugLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.RemoteAddrs = []string{primary, standby}
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	for i := 0; i < 2; i++ {
+		conn, err := client.Dial(context.Background(), "local/db/main")
+		c.Assert(err, qt.IsNil)
+		c.Assert(conn.RemoteAddr().String(), qt.Equals, standby)
+		conn.Close()
+	}
+
+	// the primary is only tried by the first connection
+	c.Assert(logs.FilterMessage("couldn't connect to remote endpoint").Len(), qt.Equals, 1)
+	connected := logs.FilterMessage("connected to remote endpoint").All()
+	c.Assert(connected, qt.HasLen, 2)
+	c.Assert(connected[0].Level, qt.Equals, zap.DebugLevel)
+	c.Assert(connected[1].ContextMap()["remote_addr"], qt.Equals, standby)
+	c.Assert(client.Stats().Endpoints[1].Selected, qt.IsTrue)
+}
+
+func TestClient_probeEndpoint_TLS(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.Instance = "myorg/mydb/mybranch"
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.RemoteAddrs = []string{addr.String()}
+	testOpts.RemoteProbe.Mode = ProbeTLS
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	latency, err := client.probeEndpoint(context.Background(), addr.String())
+	c.Assert(err, qt.IsNil)
+	c.Assert(latency > 0, qt.IsTrue)
+
+	// a server that doesn't speak TLS is unhealthy
+	_, err = client.probeEndpoint(context.Background(), startPlaintextEchoBackend(t))
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
+func TestNewClient_RemoteAddrs(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    func(*Options)
+		wantErr string
+	}{
+		{
+			name: "with RemoteAddr",
+			opts: func(o *Options) {
+				o.RemoteAddr = "127.0.0.1:3307"
+				o.RemoteAddrs = []string{"127.0.0.1:3308"}
+			},
+			wantErr: "RemoteAddr and RemoteAddrs can't be set together",
+		},
+		{
+			name: "invalid address",
+			opts: func(o *Options) {
+				o.RemoteAddrs = []string{"127.0.0.1"}
+			},
+			wantErr: "invalid RemoteAddrs: .*",
+		},
+		{
+			name: "unknown probe mode",
+			opts: func(o *Options) {
+				o.RemoteAddrs = []string{"127.0.0.1:3307"}
+				o.RemoteProbe.Mode = "icmp"
+			},
+			wantErr: `unknown RemoteProbe.Mode "icmp"`,
+		},
+		{
+			name: "tls probe without instance",
+			opts: func(o *Options) {
+				o.RemoteAddrs = []string{"127.0.0.1:3307"}
+				o.RemoteProbe.Mode = ProbeTLS
+				o.Instance = ""
+			},
+			wantErr: "RemoteProbe.Mode tls requires Instance to be set",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			testOpts := testOptions(t)
+			tt.opts(&testOpts)
+			_, err := NewClient(testOpts)
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrUnauthorized can be wrapped by CertSource implementations to signal that
+// the certificates were denied, i.e: because the credentials are invalid or
+// were revoked. Connection setups failing with it are never retried. It's
+// equivalent to returning a CertSourceError of kind CertErrorUnauthorized.
+var ErrUnauthorized = errors.New("unauthorized")
+
+// CertErrorKind classifies the errors of a CertSource.
+type CertErrorKind string
+
+const (
+	// CertErrorUnknown is the kind of the errors that aren't classified.
+	// Connection setups failing with them are retried.
+	CertErrorUnknown CertErrorKind = "unknown"
+
+	// CertErrorUnavailable means the cert source couldn't be reached or
+	// failed temporarily. The certificates are retrieved again right away,
+	// see Options.CertRetries, and connection setups failing with it are
+	// retried.
+	CertErrorUnavailable CertErrorKind = "unavailable"
+
+	// CertErrorUnauthorized means the certificates were denied. Connection
+	// setups failing with it are never retried, and the cached
+	// certificates and connections of the instance are invalidated.
+	CertErrorUnauthorized CertErrorKind = "unauthorized"
+
+	// CertErrorNotFound means the instance doesn't exist. Connection setups
+	// failing with it are never retried, and the cached certificates and
+	// connections of the instance are invalidated.
+	CertErrorNotFound CertErrorKind = "not_found"
+
+	// CertErrorRateLimited means the cert source rejected the request
+	// because of its rate limits. Connection setups failing with it are
+	// retried after at least a second, or the RetryAfter hint of the error
+	// if it's longer, up to 30 seconds.
+	CertErrorRateLimited CertErrorKind = "rate_limited"
+)
+
+// CertSourceError is returned by CertSource implementations to classify why
+// the certificates couldn't be retrieved, which decides whether and when the
+// connection setup is retried. Errors that don't wrap a CertSourceError are
+// of kind CertErrorUnknown, unless they wrap ErrUnauthorized.
+type CertSourceError struct {
+	Kind CertErrorKind
+
+	// Instance is the instance the certificates were requested for. The
+	// client sets it on the errors it returns, CertSource implementations
+	// can leave it empty.
+	Instance string
+
+	// RetryAfter is how long the cert source asked to wait before trying
+	// again, for CertErrorRateLimited errors. Zero if it gave no hint.
+	RetryAfter time.Duration
+
+	Err error
+}
+
+func (e *CertSourceError) Error() string { return e.Err.Error() }
+
+func (e *CertSourceError) Unwrap() error { return e.Err }
+
+// Is makes errors of kind CertErrorUnauthorized match ErrUnauthorized.
+func (e *CertSourceError) Is(target error) bool {
+	return target == ErrUnauthorized && e.Kind == CertErrorUnauthorized
+}
+
+// TemporaryError can be implemented by the errors of CertSource
+// implementations to tell whether retrieving the certificates might succeed
+// if it's retried, for the errors that aren't classified by the Kind of a
+// CertSourceError. The certificates are retrieved again right away, see
+// Options.CertRetries, for the errors whose Temporary method returns true,
+// and the connection setups failing with the ones whose method returns
+// false are never retried. The errors of the net package implement it.
+type TemporaryError interface {
+	error
+	Temporary() bool
+}
+
+// isTransientCertError reports whether retrieving the certificates might
+// succeed if it's retried right away after the given CertSource error:
+// either the cert source is unavailable or rate limiting, or the error says
+// so.
+func isTransientCertError(err error) bool {
+	switch certErrorKind(err) {
+	case CertErrorUnavailable, CertErrorRateLimited:
+		return true
+	case CertErrorUnknown:
+		var tempErr TemporaryError
+		return errors.As(err, &tempErr) && tempErr.Temporary()
+	}
+	return false
+}
+
+// certErrorKind returns the kind of the given CertSource error.
+func certErrorKind(err error) CertErrorKind {
+	var certErr *CertSourceError
+	if errors.As(err, &certErr) && certErr.Kind != "" {
+		return certErr.Kind
+	}
+	if errors.Is(err, ErrUnauthorized) {
+		return CertErrorUnauthorized
+	}
+	return CertErrorUnknown
+}
+
+// certErrorKindOf returns the kind of the CertSource error the given setup
+// error failed with, if it failed to retrieve the certificates.
+func certErrorKindOf(err error) (CertErrorKind, bool) {
+	var setupErr *SetupError
+	if !errors.As(err, &setupErr) || setupErr.Phase != PhaseCert {
+		return "", false
+	}
+	return certErrorKind(err), true
+}
+
+// retryAfter returns the RetryAfter hint of the CertSourceError wrapped by
+// err, if any.
+func retryAfter(err error) time.Duration {
+	var certErr *CertSourceError
+	if errors.As(err, &certErr) && certErr.Kind == CertErrorRateLimited {
+		return certErr.RetryAfter
+	}
+	return 0
+}
+
+// DialError is returned when the remote address couldn't be dialed.
+type DialError struct {
+	// Addr is the remote address that was dialed.
+	Addr string
+
+	Err error
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("couldn't connect to %q: %s", e.Addr, e.Err)
+}
+
+func (e *DialError) Unwrap() error { return e.Err }
+
+// errPeerRejected is returned when the custom peer verification rejected the
+// certificate of the remote server.
+var errPeerRejected = errors.New("peer certificate rejected")
+
+// SetupPhase identifies a step of establishing the tunnel to the remote
+// instance for a local connection.
+type SetupPhase string
+
+const (
+	// PhaseCert is the retrieval of the certificates from the CertSource.
+	PhaseCert SetupPhase = "cert"
+	// PhaseDial is the TCP dial to the remote address.
+	PhaseDial SetupPhase = "dial"
+	// PhaseHandshake is the TLS handshake with the remote address.
+	PhaseHandshake SetupPhase = "handshake"
+)
+
+// SetupTimings holds the time spent in each phase of a connection setup.
+type SetupTimings struct {
+	Cert      time.Duration
+	Dial      time.Duration
+	Handshake time.Duration
+}
+
+// Total returns the total time spent setting up the connection.
+func (s SetupTimings) Total() time.Duration {
+	return s.Cert + s.Dial + s.Handshake
+}
+
+func (s SetupTimings) String() string {
+	return fmt.Sprintf("cert: %s, dial: %s, handshake: %s", s.Cert, s.Dial, s.Handshake)
+}
+
+// SetupError is returned when the tunnel to the remote instance couldn't be
+// established for a local connection.
+type SetupError struct {
+	// Phase is the setup phase that failed.
+	Phase SetupPhase
+
+	// Timings holds the time spent in each phase until the failure.
+	Timings SetupTimings
+
+	// Timeout is set to the configured setup timeout if the setup failed
+	// because the timeout expired, or to the dial or handshake timeout if
+	// the timeout of the phase expired.
+	Timeout time.Duration
+
+	Err error
+}
+
+func (s *SetupError) Error() string {
+	if s.Timeout > 0 {
+		return fmt.Sprintf("connection setup timed out after %s during %s phase (%s): %s",
+			s.Timeout, s.Phase, s.Timings, s.Err)
+	}
+	return s.Err.Error()
+}
+
+func (s *SetupError) Unwrap() error { return s.Err }
+
+// isRetryable reports whether a failed connection setup might succeed if it's
+// retried. Authorization, missing instance and certificate verification
+// failures are permanent.
+func isRetryable(err error) bool {
+	var setupErr *SetupError
+	if !errors.As(err, &setupErr) {
+		return false
+	}
+
+	if setupErr.Phase == PhaseCert {
+		switch certErrorKind(err) {
+		case CertErrorUnauthorized, CertErrorNotFound:
+			return false
+		case CertErrorUnknown:
+			var tempErr TemporaryError
+			if errors.As(err, &tempErr) && !tempErr.Temporary() {
+				return false
+			}
+		}
+	}
+
+	if errors.Is(err, ErrUnauthorized) || errors.Is(err, errPeerRejected) || errors.Is(err, errHookPanicked) || errors.Is(err, errSecurityPolicy) {
+		return false
+	}
+
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certInvalidErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+	)
+	if errors.As(err, &unknownAuthorityErr) ||
+		errors.As(err, &certInvalidErr) ||
+		errors.As(err, &hostnameErr) {
+		return false
+	}
+
+	return true
+}
+
+// ShutdownError is returned by Shutdown and ShutdownContext if connections
+// were still active once the drain deadline passed, and were closed by the
+// proxy.
+type ShutdownError struct {
+	// ForceClosed is the number of connections that were closed.
+	ForceClosed int
+}
+
+func (e *ShutdownError) Error() string {
+	return fmt.Sprintf("%d active connections were force closed after the drain deadline", e.ForceClosed)
+}
+
+// CloseError is passed to the OnClose hook when the proxy closed the
+// connection, rather than one of its peers.
+type CloseError struct {
+	Reason CloseReason
+}
+
+func (e *CloseError) Error() string {
+	return "connection closed by the proxy: " + string(e.Reason)
+}
@@ -0,0 +1,263 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_Dial_TypedErrors(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	instance := "myorg/mydb/mybranch"
+
+	dial := func(c *qt.C, opts Options) error {
+		opts.SetupRetries = 0
+		client, err := NewClient(opts)
+		c.Assert(err, qt.IsNil)
+		conn, err := client.Dial(context.Background(), instance)
+		if err == nil {
+			conn.Close()
+		}
+		return err
+	}
+
+	c.Run("cert source", func(c *qt.C) {
+		opts := testOptions(t)
+		opts.CertSource = &fakeCertSource{
+			CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				return nil, &CertSourceError{Kind: CertErrorUnavailable, Err: errors.New("api is down")}
+			},
+		}
+		err := dial(c, opts)
+		c.Assert(err, qt.ErrorMatches, `couldn't retrieve certs for instance: .*: couldn't retrieve certs from cert source: api is down`)
+
+		var certErr *CertSourceError
+		c.Assert(errors.As(err, &certErr), qt.IsTrue)
+		c.Assert(certErr.Instance, qt.Equals, instance)
+		c.Assert(certErr.Kind, qt.Equals, CertErrorUnavailable)
+
+		// the errors of the cert source are classified even if they aren't
+		// CertSourceErrors
+		opts.CertSource = &fakeCertSource{
+			CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				return nil, fmt.Errorf("%w: token was revoked", ErrUnauthorized)
+			},
+		}
+		err = dial(c, opts)
+		c.Assert(errors.As(err, &certErr), qt.IsTrue)
+		c.Assert(certErr.Kind, qt.Equals, CertErrorUnauthorized)
+		c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+	})
+
+	c.Run("dial", func(c *qt.C) {
+		// a closed port refuses the connections
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, qt.IsNil)
+		addr := l.Addr()
+		l.Close()
+
+		opts := testOptions(t)
+		opts.CertSource = backendCertSource(t, ca, addr)
+		err = dial(c, opts)
+
+		var dialErr *DialError
+		c.Assert(errors.As(err, &dialErr), qt.IsTrue)
+		c.Assert(dialErr.Addr, qt.Equals, fmt.Sprintf("localhost:%d", addr.(*net.TCPAddr).Port))
+		var setupErr *SetupError
+		c.Assert(errors.As(err, &setupErr), qt.IsTrue)
+		c.Assert(setupErr.Phase, qt.Equals, PhaseDial)
+	})
+
+	c.Run("handshake", func(c *qt.C) {
+		// the server's certificate isn't issued by the CA of the cert source
+		addr := startTLSBackend(t, &tls.Config{
+			Certificates: []tls.Certificate{newNamedTestCA(t, "Other CA").serverCert(t, 42)},
+		}, echoHandler)
+
+		opts := testOptions(t)
+		opts.CertSource = backendCertSource(t, ca, addr)
+		err := dial(c, opts)
+
+		var handshakeErr *HandshakeError
+		c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+		c.Assert(handshakeErr.ServerName, qt.Not(qt.Equals), "")
+		c.Assert(handshakeErr.Peer, qt.Not(qt.IsNil))
+	})
+
+	c.Run("too many connections", func(c *qt.C) {
+		addr := startTLSBackend(t, &tls.Config{
+			Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+		}, echoHandler)
+
+		opts := testOptions(t)
+		opts.CertSource = backendCertSource(t, ca, addr)
+		opts.MaxConnections = 1
+		client, err := NewClient(opts)
+		c.Assert(err, qt.IsNil)
+
+		conn, err := client.Dial(context.Background(), instance)
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+		_, err = client.Dial(context.Background(), instance)
+		c.Assert(errors.Is(err, ErrTooManyConnections), qt.IsTrue)
+	})
+}
+
+func TestClient_Run_TypedCertError(t *testing.T) {
+	c := qt.New(t)
+	opts := testListenOptions(t)
+	opts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return nil, &CertSourceError{Kind: CertErrorUnauthorized, Err: errors.New("token was revoked")}
+		},
+	}
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+
+	err = client.Run(context.Background())
+	var certErr *CertError
+	c.Assert(errors.As(err, &certErr), qt.IsTrue)
+	var sourceErr *CertSourceError
+	c.Assert(errors.As(err, &sourceErr), qt.IsTrue)
+	c.Assert(sourceErr.Kind, qt.Equals, CertErrorUnauthorized)
+	c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+	c.Assert(err, qt.ErrorMatches, ".*token was revoked")
+}
+
+func TestCertError_Zero(t *testing.T) {
+	c := qt.New(t)
+
+	err := &CertError{}
+	c.Assert(err.Error(), qt.Equals, "")
+	c.Assert(errors.Unwrap(err), qt.IsNil)
+}
+
+// temporaryError is a CertSource error telling whether it's temporary.
+type temporaryError struct {
+	temporary bool
+}
+
+func (e temporaryError) Error() string   { return fmt.Sprintf("temporary: %t", e.temporary) }
+func (e temporaryError) Temporary() bool { return e.temporary }
+
+func TestClient_CertRetries(t *testing.T) {
+	unavailable := &CertSourceError{Kind: CertErrorUnavailable, Err: errors.New("503 Service Unavailable")}
+
+	tests := []struct {
+		name      string
+		retries   int
+		errs      []error
+		wantErr   bool
+		wantCalls int
+	}{
+		{
+			name:      "fails twice then succeeds",
+			errs:      []error{unavailable, unavailable},
+			wantCalls: 3,
+		},
+		{
+			name:      "temporary errors",
+			errs:      []error{temporaryError{temporary: true}},
+			wantCalls: 2,
+		},
+		{
+			name:      "retries exhausted",
+			errs:      []error{unavailable, unavailable, unavailable},
+			wantErr:   true,
+			wantCalls: 3,
+		},
+		{
+			name:      "retries disabled",
+			retries:   -1,
+			errs:      []error{unavailable},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "permanent error",
+			errs:      []error{fmt.Errorf("%w: token was revoked", ErrUnauthorized)},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			name:      "error telling it's not temporary",
+			errs:      []error{temporaryError{temporary: false}},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+		{
+			// the errors that aren't classified are left to SetupRetries
+			name:      "unknown error",
+			errs:      []error{errors.New("boom")},
+			wantErr:   true,
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+			}, echoHandler)
+
+			var calls int
+			certSource := backendCertSource(t, ca, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				calls++
+				if calls <= len(tt.errs) {
+					return nil, tt.errs[calls-1]
+				}
+				return certFn(ctx, org, db, branch)
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			testOpts.CertRetries = tt.retries
+			testOpts.CertRetryBackoff = time.Millisecond
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr {
+				c.Assert(err, qt.Not(qt.IsNil))
+			} else {
+				c.Assert(err, qt.IsNil)
+				conn.Close()
+			}
+			c.Assert(calls, qt.Equals, tt.wantCalls)
+		})
+	}
+}
+
+func TestClient_CertRetries_Context(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			calls++
+			return nil, &CertSourceError{Kind: CertErrorUnavailable, Err: errors.New("503 Service Unavailable")}
+		},
+	}
+	testOpts.CertRetryBackoff = time.Hour
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// the retries are given up on with the connection
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = client.Dial(ctx, "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, ".*503 Service Unavailable")
+	c.Assert(calls, qt.Equals, 1)
+}
@@ -0,0 +1,205 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// EventVersion is the version of the Event format. It's incremented whenever
+// a field is removed or its meaning changes.
+const EventVersion = 1
+
+// defaultEventBufferSize is the default size of the Events channel buffer.
+const defaultEventBufferSize = 256
+
+// defaultRecentEvents is the default number of recent events kept for the
+// admin API.
+const defaultRecentEvents = 1000
+
+// EventType is the type of an Event.
+type EventType string
+
+const (
+	// EventConnect is emitted once the tunnel for a local connection is
+	// established.
+	EventConnect EventType = "connect"
+
+	// EventSetupFailed is emitted when the tunnel for a local connection
+	// couldn't be established, or the connection was refused.
+	EventSetupFailed EventType = "setup_failed"
+
+	// EventDisconnect is emitted when a tunneled connection is closed.
+	EventDisconnect EventType = "disconnect"
+
+	// EventCertRefresh is emitted when new certificates are retrieved from
+	// the CertSource.
+	EventCertRefresh EventType = "cert_refresh"
+
+	// EventShutdown is emitted when the client starts to shut down. No
+	// events for new connections are emitted after it.
+	EventShutdown EventType = "shutdown"
+
+	// EventListenerFailed is emitted when the local listener fails while
+	// the client runs, before it's re-created.
+	EventListenerFailed EventType = "listener_failed"
+)
+
+// Event describes something that happened in the Client. Events are JSON
+// serializable, fields that don't apply to a type are omitted.
+type Event struct {
+	Version int       `json:"version"`
+	Type    EventType `json:"type"`
+	Time    time.Time `json:"time"`
+
+	// ConnID is the ID of the connection the event is about, as logged
+	// with the conn_id field.
+	ConnID uint64 `json:"conn_id,omitempty"`
+
+	Instance string `json:"instance,omitempty"`
+
+	// ClientAddr is the address of the local client.
+	ClientAddr string `json:"client_addr,omitempty"`
+
+	// RemoteAddr is the address of the remote server.
+	RemoteAddr string `json:"remote_addr,omitempty"`
+
+	// Phase is the failed setup phase, for EventSetupFailed.
+	Phase SetupPhase `json:"phase,omitempty"`
+
+	// CertError is the kind of the error of the CertSource, for
+	// EventSetupFailed in the PhaseCert phase.
+	CertError CertErrorKind `json:"cert_error,omitempty"`
+
+	// BytesIn is the number of bytes sent from the local client to the
+	// remote, for EventDisconnect.
+	BytesIn int64 `json:"bytes_in,omitempty"`
+
+	// BytesOut is the number of bytes sent from the remote to the local
+	// client, for EventDisconnect.
+	BytesOut int64 `json:"bytes_out,omitempty"`
+
+	// Reason is the reason the proxy closed the connection, for
+	// EventDisconnect. It's empty if one of the peers closed it.
+	Reason CloseReason `json:"reason,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// ServerVersion and ConnectionID are the version of the MySQL server and
+	// the id of the connection on it, as announced in its greeting, for
+	// EventDisconnect. They're only set if ParseServerGreetings is set.
+	ServerVersion string `json:"server_version,omitempty"`
+	ConnectionID  uint32 `json:"connection_id,omitempty"`
+
+	// Labels are the labels of the client, merged with the labels of the
+	// event's instance. The map is shared by the events of the instance and
+	// must not be modified.
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Events returns the channel the client's events are delivered to. Events are
+// only recorded once Events was called. The channel is buffered, if the
+// consumer doesn't keep up and the buffer is full, new events are dropped and
+// counted in Stats.EventsDropped, so the proxied connections are never
+// blocked. The channel is never closed.
+func (c *Client) Events() <-chan Event {
+	atomic.StoreInt32(&c.eventsSubscribed, 1)
+	return c.events
+}
+
+// emit records the event in the recent events and delivers it to the events
+// channel without blocking.
+func (c *Client) emit(e Event) {
+	subscribed := atomic.LoadInt32(&c.eventsSubscribed) == 1
+	if !subscribed && c.recentEvents == nil {
+		return
+	}
+
+	e.Version = EventVersion
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	e.Labels = c.labelsFor(e.Instance)
+
+	if c.recentEvents != nil {
+		c.recentEvents.add(e)
+	}
+	if !subscribed {
+		return
+	}
+
+	select {
+	case c.events <- e:
+	default:
+		atomic.AddUint64(&c.stats.eventsDropped, 1)
+	}
+}
+
+// eventRing keeps the most recent events in a fixed size buffer. It's safe
+// for concurrent use.
+type eventRing struct {
+	mu     sync.Mutex // protects the fields below
+	events []Event
+	next   int  // index the next event is stored at
+	full   bool // whether the buffer wrapped around
+}
+
+func newEventRing(size int) *eventRing {
+	return &eventRing{events: make([]Event, size)}
+}
+
+// add stores the event, replacing the oldest one if the buffer is full.
+func (r *eventRing) add(e Event) {
+	r.mu.Lock()
+	r.events[r.next] = e
+	r.next++
+	if r.next == len(r.events) {
+		r.next = 0
+		r.full = true
+	}
+	r.mu.Unlock()
+}
+
+// recent returns the stored events that happened after since, newest first.
+func (r *eventRing) recent(since time.Time) []Event {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := r.next
+	if r.full {
+		n = len(r.events)
+	}
+
+	events := make([]Event, 0, n)
+	for i := 0; i < n; i++ {
+		e := r.events[(r.next-1-i+len(r.events))%len(r.events)]
+		if e.Time.After(since) {
+			events = append(events, e)
+		}
+	}
+	return events
+}
+
+// WriteEvents writes the events received from the given channel to w as
+// newline delimited JSON, until the context is cancelled, the channel is
+// closed or writing fails.
+func WriteEvents(ctx context.Context, w io.Writer, events <-chan Event) error {
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case e, ok := <-events:
+			if !ok {
+				return nil
+			}
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+}
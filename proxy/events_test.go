@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_Events(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+
+	local, remote := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	}()
+
+	_, err = remote.Write([]byte("hello"))
+	c.Assert(err, qt.IsNil)
+
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(remote, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "hello")
+
+	remote.Close()
+	c.Assert(<-done, qt.IsNil)
+
+	var got []Event
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+
+	c.Assert(got, qt.HasLen, 3)
+	c.Assert(got[0].Type, qt.Equals, EventCertRefresh)
+	c.Assert(got[1].Type, qt.Equals, EventConnect)
+	c.Assert(got[1].RemoteAddr, qt.Equals, addr.String())
+	c.Assert(got[2].Type, qt.Equals, EventDisconnect)
+	c.Assert(got[2].BytesIn, qt.Equals, int64(5))
+	c.Assert(got[2].BytesOut, qt.Equals, int64(5))
+
+	for _, e := range got {
+		c.Assert(e.Version, qt.Equals, EventVersion)
+		c.Assert(e.Instance, qt.Equals, "myorg/mydb/mybranch")
+		c.Assert(e.Time.IsZero(), qt.IsFalse)
+	}
+}
+
+func TestClient_Events_SetupFailed(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return nil, ErrUnauthorized
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+
+	err = client.handleConn(context.Background(), local, 1, "myorg/mydb/mybranch", ProtocolClassic, 0)
+	c.Assert(err, qt.Not(qt.IsNil))
+
+	c.Assert(events, qt.HasLen, 1)
+	e := <-events
+	c.Assert(e.Type, qt.Equals, EventSetupFailed)
+	c.Assert(e.Phase, qt.Equals, PhaseCert)
+	c.Assert(e.Error, qt.Equals, err.Error())
+}
+
+func TestClient_Events_Dropped(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.EventBufferSize = 1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// events are not recorded without a subscriber
+	client.emit(Event{Type: EventShutdown})
+	c.Assert(client.Stats().EventsDropped, qt.Equals, uint64(0))
+
+	events := client.Events()
+	for i := 0; i < 3; i++ {
+		client.emit(Event{Type: EventShutdown})
+	}
+
+	c.Assert(events, qt.HasLen, 1)
+	c.Assert(client.Stats().EventsDropped, qt.Equals, uint64(2))
+}
+
+func TestWriteEvents(t *testing.T) {
+	c := qt.New(t)
+
+	events := make(chan Event, 2)
+	events <- Event{Version: EventVersion, Type: EventConnect, Instance: "myorg/mydb/mybranch"}
+	events <- Event{Version: EventVersion, Type: EventDisconnect, BytesIn: 10, BytesOut: 20}
+	close(events)
+
+	var buf bytes.Buffer
+	err := WriteEvents(context.Background(), &buf, events)
+	c.Assert(err, qt.IsNil)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	c.Assert(lines, qt.HasLen, 2)
+
+	var e Event
+	c.Assert(json.Unmarshal([]byte(lines[1]), &e), qt.IsNil)
+	c.Assert(e.Type, qt.Equals, EventDisconnect)
+	c.Assert(e.BytesIn, qt.Equals, int64(10))
+	c.Assert(e.BytesOut, qt.Equals, int64(20))
+	c.Assert(lines[0], qt.Contains, `"type":"connect"`)
+	c.Assert(lines[0], qt.Not(qt.Contains), `"bytes_in"`)
+}
+
+func TestEventRing(t *testing.T) {
+	c := qt.New(t)
+
+	start := time.Now()
+	at := func(i int) time.Time { return start.Add(time.Duration(i) * time.Second) }
+
+	r := newEventRing(3)
+	c.Assert(r.recent(time.Time{}), qt.HasLen, 0)
+
+	r.add(Event{Type: EventConnect, Time: at(1)})
+	r.add(Event{Type: EventDisconnect, Time: at(2)})
+	events := r.recent(time.Time{})
+	c.Assert(events, qt.HasLen, 2)
+	c.Assert(events[0].Type, qt.Equals, EventDisconnect)
+	c.Assert(events[1].Type, qt.Equals, EventConnect)
+
+	// the oldest events are replaced once the buffer is full
+	for i := 3; i <= 5; i++ {
+		r.add(Event{Type: EventConnect, Time: at(i), Instance: fmt.Sprint(i)})
+	}
+	events = r.recent(time.Time{})
+	c.Assert(events, qt.HasLen, 3)
+	for i, e := range events {
+		c.Assert(e.Instance, qt.Equals, fmt.Sprint(5-i))
+	}
+
+	events = r.recent(at(3))
+	c.Assert(events, qt.HasLen, 2)
+	c.Assert(events[1].Instance, qt.Equals, "4")
+}
+
+func TestEventRing_Allocs(t *testing.T) {
+	c := qt.New(t)
+
+	r := newEventRing(16)
+	e := Event{Type: EventConnect, Time: time.Now(), Instance: "myorg/mydb/mybranch"}
+	allocs := testing.AllocsPerRun(100, func() {
+		r.add(e)
+	})
+	c.Assert(allocs, qt.Equals, float64(0))
+}
+
+func TestClient_emit_Allocs(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.RecentEvents = 16
+	testOpts.Labels = map[string]string{"env": "prod"}
+	testOpts.InstanceLabels = map[string]map[string]string{
+		"myorg/mydb/mybranch": {"tier": "1"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	for _, instance := range []string{"myorg/mydb/mybranch", "myorg/mydb/other"} {
+		e := Event{Type: EventConnect, Instance: instance}
+		allocs := testing.AllocsPerRun(100, func() {
+			client.emit(e)
+		})
+		c.Assert(allocs, qt.Equals, float64(0), qt.Commentf("instance %s", instance))
+	}
+
+	client.emit(Event{Type: EventConnect, Instance: "myorg/mydb/mybranch"})
+	client.emit(Event{Type: EventConnect, Instance: "myorg/mydb/other"})
+	events := client.recentEvents.recent(time.Time{})
+	c.Assert(events[0].Labels, qt.DeepEquals, map[string]string{"env": "prod"})
+	c.Assert(events[1].Labels, qt.DeepEquals, map[string]string{"env": "prod", "tier": "1"})
+}
+
+func TestClient_RecentEvents(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.RecentEvents = 2
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// recorded without subscribing to Events
+	client.emit(Event{Type: EventConnect})
+	client.emit(Event{Type: EventDisconnect})
+	client.emit(Event{Type: EventShutdown})
+
+	events := client.recentEvents.recent(time.Time{})
+	c.Assert(events, qt.HasLen, 2)
+	c.Assert(events[0].Type, qt.Equals, EventShutdown)
+	c.Assert(events[0].Version, qt.Equals, EventVersion)
+	c.Assert(events[1].Type, qt.Equals, EventDisconnect)
+	c.Assert(client.Stats().EventsDropped, qt.Equals, uint64(0))
+
+	testOpts.RecentEvents = -1
+	client, err = NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.recentEvents, qt.IsNil)
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// TestExecHelperProcess isn't a real test, it's the command run by the
+// ExecCertSource tests.
+func TestExecHelperProcess(t *testing.T) {
+	if os.Getenv("SQL_PROXY_TEST_HELPER") != "1" {
+		return
+	}
+
+	switch os.Getenv("SQL_PROXY_TEST_MODE") {
+	case "output":
+		fmt.Fprint(os.Stdout, os.Getenv("SQL_PROXY_TEST_OUTPUT"))
+	case "env":
+		fmt.Fprintf(os.Stdout, `{"access_host": %q}`, os.Getenv("SQL_PROXY_ORG")+"/"+os.Getenv("SQL_PROXY_DATABASE")+"/"+os.Getenv("SQL_PROXY_BRANCH"))
+		os.Exit(0)
+	case "fail":
+		fmt.Fprint(os.Stderr, strings.Repeat("token expired\n", 1000))
+		os.Exit(1)
+	case "unauthorized":
+		fmt.Fprint(os.Stderr, "access denied")
+		os.Exit(execExitUnauthorized)
+	case "unavailable":
+		fmt.Fprint(os.Stderr, "vault sealed")
+		os.Exit(execExitUnavailable)
+	case "sleep":
+		time.Sleep(time.Minute)
+	case "flood":
+		chunk := []byte(strings.Repeat("x", 1024))
+		for {
+			if _, err := os.Stdout.Write(chunk); err != nil {
+				os.Exit(1)
+			}
+		}
+	}
+	os.Exit(0)
+}
+
+// helperCertSource returns an ExecCertSource running TestExecHelperProcess
+// in the given mode.
+func helperCertSource(t *testing.T, mode, output string, opts ExecOptions) *ExecCertSource {
+	t.Helper()
+
+	opts.Command = os.Args[0]
+	opts.Args = []string{"-test.run=^TestExecHelperProcess$"}
+	opts.Env = append(opts.Env,
+		"SQL_PROXY_TEST_HELPER=1",
+		"SQL_PROXY_TEST_MODE="+mode,
+		"SQL_PROXY_TEST_OUTPUT="+output,
+	)
+	s, err := NewExecCertSource(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// testCertPEM returns the PEM encoded client certificate, private key and CA
+// certificate.
+func testCertPEM(t *testing.T, ca *testCA) (certPEM, keyPEM, caPEM string) {
+	t.Helper()
+
+	cert := ca.clientCert(t, "myorg/mydb/main")
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}))
+	keyPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}))
+	caPEM = string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}))
+	return certPEM, keyPEM, caPEM
+}
+
+func TestExecCertSource_JSON(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+
+	out, err := json.Marshal(execOutput{
+		ClientCert: certPEM,
+		ClientKey:  keyPEM,
+		CACerts:    caPEM,
+		AccessHost: "mydb.example.com",
+		ProxyPort:  3307,
+		MySQLPort:  3306,
+	})
+	c.Assert(err, qt.IsNil)
+
+	s := helperCertSource(t, "output", string(out), ExecOptions{})
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Certificate, qt.HasLen, 1)
+	c.Assert(cert.CACerts, qt.HasLen, 1)
+	c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+	c.Assert(cert.AccessHost, qt.Equals, "mydb.example.com")
+	c.Assert(cert.Ports, qt.Equals, RemotePorts{Proxy: 3307, MySQL: 3306})
+}
+
+func TestExecCertSource_PEM(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+
+	s := helperCertSource(t, "output", certPEM+keyPEM+caPEM, ExecOptions{})
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Certificate, qt.HasLen, 1)
+	c.Assert(cert.CACerts, qt.HasLen, 1)
+	c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+}
+
+func TestExecCertSource_Env(t *testing.T) {
+	c := qt.New(t)
+
+	s := helperCertSource(t, "env", "", ExecOptions{})
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+
+	// the output has no certificate, but the instance was passed
+	c.Assert(err, qt.ErrorMatches, "cert command .*: malformed output: invalid client certificate: .*")
+}
+
+func TestExecCertSource_Errors(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		output   string
+		opts     ExecOptions
+		wantErr  string
+		exitCode int
+		kind     CertErrorKind
+	}{
+		{
+			name:     "non-zero exit",
+			mode:     "fail",
+			wantErr:  `cert command .*: exit status 1 \(stderr: "token expired.*"\)`,
+			exitCode: 1,
+		},
+		{
+			name:     "unauthorized",
+			mode:     "unauthorized",
+			wantErr:  `cert command .*: exit status 77 \(stderr: "access denied"\)`,
+			exitCode: execExitUnauthorized,
+			kind:     CertErrorUnauthorized,
+		},
+		{
+			name:     "unavailable",
+			mode:     "unavailable",
+			wantErr:  `cert command .*: exit status 75 \(stderr: "vault sealed"\)`,
+			exitCode: execExitUnavailable,
+			kind:     CertErrorUnavailable,
+		},
+		{
+			name:     "no output",
+			mode:     "output",
+			wantErr:  "cert command .*: malformed output: no output",
+			exitCode: 0,
+		},
+		{
+			name:     "malformed JSON",
+			mode:     "output",
+			output:   `{"client_cert": `,
+			wantErr:  "cert command .*: malformed output: unexpected end of JSON input",
+			exitCode: 0,
+		},
+		{
+			name:     "unexpected PEM block",
+			mode:     "output",
+			output:   string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: []byte("key")})),
+			wantErr:  `cert command .*: malformed output: unexpected PEM block "PUBLIC KEY"`,
+			exitCode: 0,
+		},
+		{
+			name:     "timeout",
+			mode:     "sleep",
+			opts:     ExecOptions{Timeout: 100 * time.Millisecond},
+			wantErr:  "cert command .*: timed out after 100ms",
+			exitCode: -1,
+			kind:     CertErrorUnavailable,
+		},
+		{
+			name:     "output too large",
+			mode:     "flood",
+			opts:     ExecOptions{MaxOutputSize: 4096},
+			wantErr:  "cert command .*: output exceeds 4096 bytes",
+			exitCode: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			s := helperCertSource(t, tt.mode, tt.output, tt.opts)
+			_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+
+			var execErr *ExecError
+			c.Assert(errors.As(err, &execErr), qt.IsTrue)
+			c.Assert(execErr.ExitCode, qt.Equals, tt.exitCode)
+			c.Assert(len(execErr.Stderr) <= maxExecStderrSize, qt.IsTrue)
+			if tt.kind == "" {
+				tt.kind = CertErrorUnknown
+			}
+			c.Assert(certErrorKind(err), qt.Equals, tt.kind)
+		})
+	}
+}
+
+func TestExecCertSource_Cancel(t *testing.T) {
+	c := qt.New(t)
+
+	s := helperCertSource(t, "sleep", "", ExecOptions{})
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	_, err := s.Cert(ctx, "myorg", "mydb", "main")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	c.Assert(time.Since(start) < 10*time.Second, qt.IsTrue)
+}
+
+func TestNewExecCertSource(t *testing.T) {
+	c := qt.New(t)
+
+	_, err := NewExecCertSource(ExecOptions{})
+	c.Assert(err, qt.ErrorMatches, "Command must be set")
+
+	_, err = NewExecCertSource(ExecOptions{Command: "certs", Timeout: -1})
+	c.Assert(err, qt.ErrorMatches, "Timeout can't be negative")
+
+	_, err = NewExecCertSource(ExecOptions{Command: "certs", MaxOutputSize: -1})
+	c.Assert(err, qt.ErrorMatches, "MaxOutputSize can't be negative")
+}
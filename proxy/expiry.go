@@ -0,0 +1,194 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// defaultCertExpiryWarning is how long before they expire the
+	// certificates are warned about by default.
+	defaultCertExpiryWarning = 72 * time.Hour
+
+	// certExpiryCheckInterval is how often the certificates of the
+	// instances are checked again, for the long running proxies.
+	certExpiryCheckInterval = time.Hour
+)
+
+// CertExpiry tells when one of the certificates of an instance expires.
+type CertExpiry struct {
+	Instance string `json:"instance"`
+	// Cert is the kind of the certificate: "client", "intermediate" or
+	// "ca".
+	Cert    string `json:"cert"`
+	Serial  string `json:"serial"`
+	Subject string `json:"subject"`
+
+	NotAfter time.Time `json:"not_after"`
+	// ExpiresIn is the number of seconds left before the certificate
+	// expires, negative once it did.
+	ExpiresIn int64 `json:"expires_in_seconds"`
+}
+
+// expiringCert is a certificate of an instance whose expiry is tracked.
+type expiringCert struct {
+	kind     string
+	serial   string
+	subject  string
+	notAfter time.Time
+}
+
+// certExpiry tracks the expiry of the certificates of the instances, as of
+// the last time they were retrieved from the cert source, and warns about
+// the ones expiring within the threshold. It's safe for concurrent use.
+type certExpiry struct {
+	log *zap.Logger
+	// threshold is how long before they expire the certificates are warned
+	// about, zero if they aren't.
+	threshold time.Duration
+	// now returns the current time, it's replaced by the tests.
+	now func() time.Time
+
+	mu    sync.Mutex
+	certs map[string][]expiringCert
+}
+
+func newCertExpiry(log *zap.Logger, threshold time.Duration) *certExpiry {
+	return &certExpiry{
+		log:       log,
+		threshold: threshold,
+		now:       time.Now,
+		certs:     make(map[string][]expiringCert),
+	}
+}
+
+// record replaces the tracked certificates of the instance with the ones
+// of the given cert, and checks them.
+func (e *certExpiry) record(instance string, cert *Cert) {
+	var certs []expiringCert
+	add := func(kind string, c *x509.Certificate) {
+		certs = append(certs, expiringCert{
+			kind:     kind,
+			serial:   c.SerialNumber.String(),
+			subject:  c.Subject.String(),
+			notAfter: c.NotAfter,
+		})
+	}
+	if !cert.ServerAuthOnly {
+		leaf := cert.ClientCert.Leaf
+		if leaf == nil {
+			leaf, _ = x509.ParseCertificate(cert.ClientCert.Certificate[0])
+		}
+		if leaf != nil {
+			add("client", leaf)
+			// the cert source may tell the certificates expire earlier
+			if !cert.Expiry.IsZero() {
+				certs[len(certs)-1].notAfter = cert.Expiry
+			}
+		}
+	}
+	for _, c := range cert.Intermediates {
+		add("intermediate", c)
+	}
+	for _, c := range cert.CACerts {
+		add("ca", c)
+	}
+
+	e.mu.Lock()
+	e.certs[instance] = certs
+	e.mu.Unlock()
+
+	e.checkInstance(instance, certs, e.now())
+}
+
+// forget stops tracking the certificates of the instance.
+func (e *certExpiry) forget(instance string) {
+	e.mu.Lock()
+	delete(e.certs, instance)
+	e.mu.Unlock()
+}
+
+// check warns about the tracked certificates expiring within the threshold.
+func (e *certExpiry) check() {
+	e.mu.Lock()
+	certs := make(map[string][]expiringCert, len(e.certs))
+	for instance, c := range e.certs {
+		certs[instance] = c
+	}
+	e.mu.Unlock()
+
+	now := e.now()
+	for instance, c := range certs {
+		e.checkInstance(instance, c, now)
+	}
+}
+
+func (e *certExpiry) checkInstance(instance string, certs []expiringCert, now time.Time) {
+	if e.threshold == 0 {
+		return
+	}
+	for _, c := range certs {
+		left := c.notAfter.Sub(now)
+		if left > e.threshold {
+			continue
+		}
+
+		msg := "certificate expires soon, connections will fail once it did"
+		if left <= 0 {
+			msg = "certificate expired, connections will fail until it's renewed"
+		}
+		e.log.Warn(msg,
+			zap.String("instance", instance),
+			zap.String("cert", c.kind),
+			zap.String("serial", c.serial),
+			zap.String("subject", c.subject),
+			zap.Time("not_after", c.notAfter),
+			zap.Duration("expires_in", left.Round(time.Second)))
+	}
+}
+
+// run checks the certificates every certExpiryCheckInterval until stop is
+// closed.
+func (e *certExpiry) run(stop <-chan struct{}) {
+	ticker := time.NewTicker(certExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.check()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// stats returns the expiry of the tracked certificates, sorted by instance.
+func (e *certExpiry) stats() []CertExpiry {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if len(e.certs) == 0 {
+		return nil
+	}
+	now := e.now()
+	var stats []CertExpiry
+	for instance, certs := range e.certs {
+		for _, c := range certs {
+			stats = append(stats, CertExpiry{
+				Instance:  instance,
+				Cert:      c.kind,
+				Serial:    c.serial,
+				Subject:   c.subject,
+				NotAfter:  c.notAfter,
+				ExpiresIn: int64(c.notAfter.Sub(now) / time.Second),
+			})
+		}
+	}
+	sort.SliceStable(stats, func(i, j int) bool { return stats[i].Instance < stats[j].Instance })
+	return stats
+}
@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClient_CertExpiry(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	clientCert := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1234),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotAfter:     time.Now().Add(48 * time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	core, logs := observer.New(zap.WarnLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return &Cert{
+				ClientCert: clientCert,
+				CACerts:    []*x509.Certificate{ca.cert},
+				AccessHost: "localhost",
+				Ports:      RemotePorts{Proxy: 3306},
+			}, nil
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	// the client certificate and the test CA expire within the default 72
+	// hours
+	warnings := logs.FilterMessage("certificate expires soon, connections will fail once it did").All()
+	c.Assert(warnings, qt.HasLen, 2)
+	fields := warnings[0].ContextMap()
+	c.Assert(fields["instance"], qt.Equals, "myorg/mydb/mybranch")
+	c.Assert(fields["cert"], qt.Equals, "client")
+	c.Assert(fields["serial"], qt.Equals, "1234")
+
+	stats := client.Stats().Certificates
+	c.Assert(stats, qt.HasLen, 2)
+	c.Assert(stats[0].Cert, qt.Equals, "client")
+	c.Assert(stats[0].Serial, qt.Equals, "1234")
+	c.Assert(stats[0].ExpiresIn > 47*3600 && stats[0].ExpiresIn <= 48*3600, qt.IsTrue)
+	c.Assert(stats[1].Cert, qt.Equals, "ca")
+
+	var gauges int
+	for _, m := range client.metrics() {
+		if m.name == "cert_expires_in_seconds" {
+			gauges++
+			c.Assert(m.kind, qt.Equals, metricGauge)
+		}
+	}
+	c.Assert(gauges, qt.Equals, 2)
+
+	// the long running proxies are warned again, until the certificate
+	// expired
+	client.certExpiry.now = func() time.Time { return time.Now().Add(49 * time.Hour) }
+	client.certExpiry.check()
+	c.Assert(logs.FilterMessage("certificate expired, connections will fail until it's renewed").Len(), qt.Equals, 2)
+	c.Assert(client.Stats().Certificates[0].ExpiresIn < 0, qt.IsTrue)
+	for _, m := range client.metrics() {
+		if m.name == "cert_expires_in_seconds" && m.tags[1] == "cert:client" {
+			c.Assert(m.value, qt.Equals, uint64(0))
+		}
+	}
+
+	// the certificates of the invalidated instances aren't tracked anymore
+	client.InvalidateInstance("myorg/mydb/mybranch")
+	c.Assert(client.Stats().Certificates, qt.IsNil)
+}
+
+func TestClient_CertExpiry_Disabled(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	core, logs := observer.New(zap.WarnLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.CertExpiryWarning = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	// the test certificates expire within the hour
+	c.Assert(logs.Len(), qt.Equals, 0)
+	c.Assert(client.Stats().Certificates, qt.HasLen, 2)
+}
+
+func TestClient_CertExpiry_CertField(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the cert source knows better than the certificate, i.e: the access
+	// is revoked before the certificate expires
+	expiry := time.Now().Add(time.Hour).Truncate(time.Second)
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return &Cert{
+				ClientCert: ca.clientCert(t, "client"),
+				CACerts:    []*x509.Certificate{ca.cert},
+				AccessHost: "localhost",
+				Ports:      RemotePorts{Proxy: 3306},
+				Expiry:     expiry,
+			}, nil
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, _, err = client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	stats := client.Stats().Certificates
+	c.Assert(stats, qt.HasLen, 2)
+	c.Assert(stats[0].Cert, qt.Equals, "client")
+	c.Assert(stats[0].NotAfter.Equal(expiry), qt.IsTrue)
+}
@@ -0,0 +1,235 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultFilePollInterval is how often FileCertSource checks its files for
+// changes.
+const defaultFilePollInterval = 5 * time.Second
+
+// ReloadingCertSource is implemented by the CertSources whose certificates
+// change over time, like FileCertSource. The certificates of the instances
+// the client cached are retrieved again once they did, so the new
+// connections use the new ones. The established connections are left
+// alone.
+type ReloadingCertSource interface {
+	CertSource
+
+	// Reloaded returns a channel that is closed the next time the
+	// certificates change.
+	Reloaded() <-chan struct{}
+}
+
+// FileCertSource serves the certificates of PEM files for every instance,
+// and reloads them when the files change, so rotated certificates are used
+// without restarting the proxy. The files are checked every 5 seconds, the
+// certificates that were loaded last are kept if they can't be loaded
+// anymore, i.e: while they're being rewritten, and the problem is logged.
+//
+// The certificates hold no remote address, Options.RemoteAddr must be set,
+// and Options.ServerName to verify the name of the remote server.
+type FileCertSource struct {
+	certPath, keyPath, caPath string
+
+	mu sync.Mutex // protects the fields below
+	// cert holds the certificates that were loaded last.
+	cert *Cert
+	// stamps identify the versions of the files cert was loaded from, or
+	// that failed to load last.
+	stamps []fileStamp
+	// reloaded is closed once cert is replaced.
+	reloaded chan struct{}
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+var _ ReloadingCertSource = (*FileCertSource)(nil)
+
+// NewFileCertSource returns a FileCertSource serving the client certificate
+// and private key of the given PEM files, and the CA certificates of
+// caCertPath to verify the remote servers against. The client certificate
+// file may hold intermediates after the client's certificate. Without
+// caCertPath the system roots are used. Close stops watching the files.
+func NewFileCertSource(clientCertPath, clientKeyPath, caCertPath string) (*FileCertSource, error) {
+	return newFileCertSource(clientCertPath, clientKeyPath, caCertPath, defaultFilePollInterval)
+}
+
+func newFileCertSource(clientCertPath, clientKeyPath, caCertPath string, interval time.Duration) (*FileCertSource, error) {
+	if clientCertPath == "" || clientKeyPath == "" {
+		return nil, errors.New("the client certificate and key files must be set")
+	}
+
+	s := &FileCertSource{
+		certPath: clientCertPath,
+		keyPath:  clientKeyPath,
+		caPath:   caCertPath,
+		reloaded: make(chan struct{}),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	stamps, err := s.statFiles()
+	if err != nil {
+		return nil, err
+	}
+	cert, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	s.cert, s.stamps = cert, stamps
+
+	go s.watch(interval)
+	return s, nil
+}
+
+// Cert returns the certificates that were loaded last, whatever the
+// instance.
+func (s *FileCertSource) Cert(ctx context.Context, org, db, branch string) (*Cert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cert := *s.cert
+	return &cert, nil
+}
+
+// Reloaded returns a channel that is closed the next time the certificates
+// are reloaded.
+func (s *FileCertSource) Reloaded() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloaded
+}
+
+// Close stops watching the files, the certificates that were loaded last
+// are still served.
+func (s *FileCertSource) Close() error {
+	s.stopOnce.Do(func() { close(s.stop) })
+	<-s.done
+	return nil
+}
+
+// fileStamp identifies a version of a file.
+type fileStamp struct {
+	modTime time.Time
+	size    int64
+}
+
+// paths returns the paths of the files of the certificates.
+func (s *FileCertSource) paths() []string {
+	paths := []string{s.certPath, s.keyPath}
+	if s.caPath != "" {
+		paths = append(paths, s.caPath)
+	}
+	return paths
+}
+
+func (s *FileCertSource) statFiles() ([]fileStamp, error) {
+	paths := s.paths()
+	stamps := make([]fileStamp, 0, len(paths))
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		stamps = append(stamps, fileStamp{modTime: info.ModTime(), size: info.Size()})
+	}
+	return stamps, nil
+}
+
+// load loads and validates the certificates of the files.
+func (s *FileCertSource) load() (*Cert, error) {
+	clientCertPEM, err := os.ReadFile(s.certPath)
+	if err != nil {
+		return nil, err
+	}
+	clientKeyPEM, err := os.ReadFile(s.keyPath)
+	if err != nil {
+		return nil, err
+	}
+	var caPEM []byte
+	if s.caPath != "" {
+		if caPEM, err = os.ReadFile(s.caPath); err != nil {
+			return nil, err
+		}
+		if len(caPEM) == 0 {
+			return nil, fmt.Errorf("invalid CA certificates: %s is empty", s.caPath)
+		}
+	}
+	return parseCertPEM(clientCertPEM, clientKeyPEM, caPEM)
+}
+
+// watch reloads the certificates every interval if the files changed, until
+// Close is called.
+func (s *FileCertSource) watch(interval time.Duration) {
+	defer close(s.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			s.reload()
+		case <-s.stop:
+			return
+		}
+	}
+}
+
+// reload reloads the certificates if the files changed since they were last
+// loaded, or failed to.
+func (s *FileCertSource) reload() {
+	// the logger of the client is the global one by default
+	log := zap.L().With(zap.Strings("paths", s.paths()))
+
+	stamps, err := s.statFiles()
+	if err != nil {
+		log.Error("couldn't check the certificate files for changes, keeping the previous certificates", zap.Error(err))
+		return
+	}
+
+	s.mu.Lock()
+	changed := !equalStamps(stamps, s.stamps)
+	s.mu.Unlock()
+	if !changed {
+		return
+	}
+
+	cert, err := s.load()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// the files are only reloaded once they change again
+	s.stamps = stamps
+	if err != nil {
+		log.Error("couldn't reload the certificate files, keeping the previous certificates", zap.Error(err))
+		return
+	}
+	s.cert = cert
+	close(s.reloaded)
+	s.reloaded = make(chan struct{})
+
+	log.Info("reloaded the certificate files",
+		zap.String("serial", cert.ClientCert.Leaf.SerialNumber.String()),
+		zap.Time("not_after", cert.ClientCert.Leaf.NotAfter))
+}
+
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].modTime.Equal(b[i].modTime) || a[i].size != b[i].size {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,240 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// writeCertFiles writes a client certificate issued by ca, its key and the
+// CA certificate to the files of the given directory, and returns the
+// serial number of the certificate. The modification time of the files is
+// set to mtime, so the changes are noticed whatever the resolution of the
+// file system.
+func writeCertFiles(t *testing.T, ca *testCA, dir string, mtime time.Time) *big.Int {
+	t.Helper()
+
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+	for name, data := range map[string]string{
+		"client.crt": certPEM,
+		"client.key": keyPEM,
+		"ca.crt":     caPEM,
+	} {
+		writeFile(t, filepath.Join(dir, name), data, mtime)
+	}
+
+	cert, err := tls.X509KeyPair([]byte(certPEM), []byte(keyPEM))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber
+}
+
+func writeFile(t *testing.T, path, data string, mtime time.Time) {
+	t.Helper()
+
+	if err := os.WriteFile(path, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestNewFileCertSource(t *testing.T) {
+	ca := newTestCA(t)
+	dir := t.TempDir()
+	writeCertFiles(t, ca, dir, time.Now())
+	writeFile(t, filepath.Join(dir, "garbage"), "garbage", time.Now())
+	otherKeyPEM := func() string {
+		_, keyPEM, _ := testCertPEM(t, ca)
+		return keyPEM
+	}()
+	writeFile(t, filepath.Join(dir, "other.key"), otherKeyPEM, time.Now())
+
+	tests := []struct {
+		name     string
+		certPath string
+		keyPath  string
+		caPath   string
+		wantErr  string
+	}{
+		{
+			name:     "valid",
+			certPath: "client.crt",
+			keyPath:  "client.key",
+			caPath:   "ca.crt",
+		},
+		{
+			name:     "system roots",
+			certPath: "client.crt",
+			keyPath:  "client.key",
+		},
+		{
+			name:     "no key",
+			certPath: "client.crt",
+			wantErr:  "the client certificate and key files must be set",
+		},
+		{
+			name:     "missing file",
+			certPath: "client.crt",
+			keyPath:  "missing.key",
+			wantErr:  ".*no such file or directory",
+		},
+		{
+			name:     "key mismatch",
+			certPath: "client.crt",
+			keyPath:  "other.key",
+			wantErr:  "invalid client certificate: tls: private key does not match public key",
+		},
+		{
+			name:     "invalid CA",
+			certPath: "client.crt",
+			keyPath:  "client.key",
+			caPath:   "garbage",
+			wantErr:  "invalid CA certificates: no certificates found",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			path := func(name string) string {
+				if name == "" {
+					return ""
+				}
+				return filepath.Join(dir, name)
+			}
+			s, err := NewFileCertSource(path(tt.certPath), path(tt.keyPath), path(tt.caPath))
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			defer s.Close()
+
+			cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.IsNil)
+			c.Assert(validateCert(cert), qt.IsNil)
+			c.Assert(cert.ClientCert.Leaf, qt.Not(qt.IsNil))
+			if tt.caPath != "" {
+				c.Assert(cert.CACerts, qt.HasLen, 1)
+				c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+			} else {
+				c.Assert(cert.CACerts, qt.HasLen, 0)
+			}
+		})
+	}
+}
+
+func TestFileCertSource_Reload(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the backend tells the serial number of the client certificate
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    certPool([]*x509.Certificate{ca.cert}),
+	}, func(conn net.Conn) {
+		serial := conn.(*tls.Conn).ConnectionState().PeerCertificates[0].SerialNumber
+		conn.Write([]byte(serial.String() + "\n")) // nolint: errcheck
+	})
+
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Minute)
+	serial := writeCertFiles(t, ca, dir, mtime)
+
+	s, err := newFileCertSource(
+		filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "client.key"),
+		filepath.Join(dir, "ca.crt"),
+		10*time.Millisecond)
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = s
+	testOpts.RemoteAddr = addr.String()
+	testOpts.ServerName = "localhost"
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	readSerial := func() string {
+		conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+		c.Assert(err, qt.IsNil)
+		defer conn.Close()
+
+		line, err := bufio.NewReader(conn).ReadString('\n')
+		c.Assert(err, qt.IsNil)
+		return strings.TrimSpace(line)
+	}
+	c.Assert(readSerial(), qt.Equals, serial.String())
+
+	// the certificates are rotated
+	reloaded := s.Reloaded()
+	serial = writeCertFiles(t, ca, dir, mtime.Add(time.Second))
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		c.Fatal("the certificates weren't reloaded")
+	}
+	c.Assert(readSerial(), qt.Equals, serial.String())
+}
+
+func TestFileCertSource_ReloadError(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	core, logs := observer.New(zap.ErrorLevel)
+	defer zap.ReplaceGlobals(zap.New(core))()
+
+	dir := t.TempDir()
+	mtime := time.Now().Add(-time.Minute)
+	serial := writeCertFiles(t, ca, dir, mtime)
+
+	s, err := newFileCertSource(
+		filepath.Join(dir, "client.crt"),
+		filepath.Join(dir, "client.key"),
+		filepath.Join(dir, "ca.crt"),
+		time.Hour)
+	c.Assert(err, qt.IsNil)
+	defer s.Close()
+
+	// the certificate is being rewritten
+	reloaded := s.Reloaded()
+	writeFile(t, filepath.Join(dir, "client.crt"), "garbage", mtime.Add(time.Second))
+	s.reload()
+	// it's only logged once
+	s.reload()
+
+	select {
+	case <-reloaded:
+		c.Fatal("the certificates were reloaded")
+	default:
+	}
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(cert.ClientCert.Leaf.SerialNumber.Cmp(serial), qt.Equals, 0)
+
+	entries := logs.All()
+	c.Assert(entries, qt.HasLen, 1)
+	c.Assert(entries[0].Message, qt.Equals, "couldn't reload the certificate files, keeping the previous certificates")
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"strings"
+	"testing"
+)
+
+func FuzzInstanceName(f *testing.F) {
+	for _, tt := range parseInstanceTests {
+		f.Add(tt.instance)
+	}
+
+	f.Fuzz(func(t *testing.T, instance string) {
+		org, db, branch, err := ParseInstance(instance)
+		if err != nil {
+			return
+		}
+
+		for _, part := range []string{org, db, branch} {
+			if part == "" || strings.Contains(part, "/") {
+				t.Fatalf("invalid component %q parsed from %q", part, instance)
+			}
+		}
+
+		if got := org + "/" + db + "/" + branch; got != instance {
+			t.Fatalf("round trip mismatch: parsed %q from %q", got, instance)
+		}
+	})
+}
+
+func FuzzMySQLPacketFrames(f *testing.F) {
+	f.Add([]byte{1, 0, 0, 0, 0x01}, uint32(16), uint8(1))
+	f.Add([]byte{0xff, 0xff, 0xff, 0}, uint32(1<<20), uint8(3))
+	f.Add([]byte{5, 0}, uint32(4), uint8(1))
+	f.Add([]byte{2, 0, 0, 0, 1, 2, 3, 0, 0, 1, 9, 9, 9}, uint32(2), uint8(5))
+
+	f.Fuzz(func(t *testing.T, data []byte, max uint32, chunk uint8) {
+		if chunk == 0 {
+			chunk = 1
+		}
+
+		whole := &packetFramer{max: uint64(max)}
+		wantSeq, wantErr := whole.scan(data)
+
+		split := &packetFramer{max: uint64(max)}
+		var (
+			seq byte
+			err error
+		)
+		for i := 0; i < len(data) && err == nil; i += int(chunk) {
+			end := i + int(chunk)
+			if end > len(data) {
+				end = len(data)
+			}
+			seq, err = split.scan(data[i:end])
+		}
+
+		if (err == nil) != (wantErr == nil) {
+			t.Fatalf("framing depends on chunking: got %v, want %v", err, wantErr)
+		}
+		if err == nil {
+			return
+		}
+		if seq != wantSeq || err.Error() != wantErr.Error() {
+			t.Fatalf("got %v (seq %d), want %v (seq %d)", err, seq, wantErr, wantSeq)
+		}
+		if tooLarge := err.(*PacketTooLargeError); tooLarge.Size <= tooLarge.Max {
+			t.Fatalf("packet of %d bytes rejected with a maximum of %d", tooLarge.Size, tooLarge.Max)
+		}
+	})
+}
@@ -0,0 +1,443 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	// maxSummaryNames caps the number of SANs in a CertificateSummary.
+	maxSummaryNames = 8
+
+	// maxSummaryNameLen caps the length of the names in a
+	// CertificateSummary.
+	maxSummaryNameLen = 256
+
+	// maxSummaryChain caps the number of certificates in the chain of a
+	// HandshakeError.
+	maxSummaryChain = 8
+)
+
+// CertificateSummary describes a certificate presented by the remote server.
+// It never contains the raw certificate, and its size is capped, so it's safe
+// to log.
+type CertificateSummary struct {
+	Subject      string
+	Issuer       string
+	SerialNumber string
+
+	// DNSNames and IPAddresses are the SANs of the certificate. At most 8
+	// of each are included, OmittedNames is the number of the ones that
+	// were left out.
+	DNSNames     []string
+	IPAddresses  []string
+	OmittedNames int
+
+	NotBefore time.Time
+	NotAfter  time.Time
+
+	// SPKISHA256 is the hex encoded SHA-256 hash of the certificate's
+	// public key info, which can be used for pinning.
+	SPKISHA256 string
+}
+
+// summarizeCertificate returns the summary of the given certificate.
+func summarizeCertificate(cert *x509.Certificate) *CertificateSummary {
+	spki := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	s := &CertificateSummary{
+		Subject:      truncate(cert.Subject.String()),
+		Issuer:       truncate(cert.Issuer.String()),
+		SerialNumber: truncate(cert.SerialNumber.String()),
+		NotBefore:    cert.NotBefore,
+		NotAfter:     cert.NotAfter,
+		SPKISHA256:   hex.EncodeToString(spki[:]),
+	}
+
+	for i, name := range cert.DNSNames {
+		if i == maxSummaryNames {
+			s.OmittedNames += len(cert.DNSNames) - i
+			break
+		}
+		s.DNSNames = append(s.DNSNames, truncate(name))
+	}
+
+	for i, ip := range cert.IPAddresses {
+		if i == maxSummaryNames {
+			s.OmittedNames += len(cert.IPAddresses) - i
+			break
+		}
+		s.IPAddresses = append(s.IPAddresses, ip.String())
+	}
+
+	return s
+}
+
+func (s *CertificateSummary) String() string {
+	sans := append(append([]string{}, s.DNSNames...), s.IPAddresses...)
+	if s.OmittedNames > 0 {
+		sans = append(sans, fmt.Sprintf("and %d more", s.OmittedNames))
+	}
+
+	return fmt.Sprintf("subject=%q, SANs=[%s], issuer=%q, serial=%s, not before=%s, not after=%s, SPKI SHA-256=%s",
+		s.Subject,
+		strings.Join(sans, ", "),
+		s.Issuer,
+		s.SerialNumber,
+		s.NotBefore.UTC().Format(time.RFC3339),
+		s.NotAfter.UTC().Format(time.RFC3339),
+		s.SPKISHA256,
+	)
+}
+
+func truncate(s string) string {
+	if len(s) <= maxSummaryNameLen {
+		return s
+	}
+	return s[:maxSummaryNameLen] + "..."
+}
+
+// HandshakeFailure classifies the failures of the TLS handshake with the
+// remote server.
+type HandshakeFailure string
+
+const (
+	// HandshakeFailureUnknown is a failure none of the others describes, i.e:
+	// the remote address doesn't speak TLS or the connection was reset.
+	HandshakeFailureUnknown HandshakeFailure = "unknown"
+
+	// HandshakeFailureUnknownAuthority is a remote server certificate that
+	// isn't signed by the CA certificates of the instance.
+	HandshakeFailureUnknownAuthority HandshakeFailure = "unknown_authority"
+
+	// HandshakeFailureExpiredCertificate is a remote server certificate
+	// used outside of its validity period, or one of its issuers.
+	HandshakeFailureExpiredCertificate HandshakeFailure = "expired_certificate"
+
+	// HandshakeFailureNameMismatch is a remote server certificate that isn't
+	// valid for the server name.
+	HandshakeFailureNameMismatch HandshakeFailure = "name_mismatch"
+
+	// HandshakeFailureProtocolVersion is a remote server that supports none
+	// of the TLS versions the client offered.
+	HandshakeFailureProtocolVersion HandshakeFailure = "protocol_version"
+
+	// HandshakeFailurePeerRejected is a remote server certificate that the
+	// custom verification, the pins, the CRLs or the SPIFFE ID rejected.
+	HandshakeFailurePeerRejected HandshakeFailure = "peer_rejected"
+
+	// HandshakeFailureClientCertRejected is a remote server that rejected
+	// the client certificate with an alert.
+	HandshakeFailureClientCertRejected HandshakeFailure = "client_cert_rejected"
+)
+
+// certRelated reports whether the failure may be fixed by new certificates
+// from the CertSource, i.e: once they were rotated.
+func (f HandshakeFailure) certRelated() bool {
+	switch f {
+	case HandshakeFailureUnknownAuthority, HandshakeFailureExpiredCertificate,
+		HandshakeFailureNameMismatch, HandshakeFailureClientCertRejected:
+		return true
+	}
+	return false
+}
+
+// description returns the message of the failure in the errors, if the
+// error itself doesn't tell.
+func (f HandshakeFailure) description() string {
+	switch f {
+	case HandshakeFailureUnknownAuthority:
+		return "remote server certificate isn't signed by a trusted CA"
+	case HandshakeFailureExpiredCertificate:
+		return "remote server certificate is expired or not valid yet"
+	case HandshakeFailureNameMismatch:
+		return "remote server certificate isn't valid for the server name"
+	case HandshakeFailureProtocolVersion:
+		return "remote server supports none of the offered TLS versions"
+	case HandshakeFailureClientCertRejected:
+		return "remote server rejected the client certificate"
+	}
+	return ""
+}
+
+// HandshakeError is returned when the TLS handshake with the remote server
+// failed. If the failure was caused by the certificate the server presented,
+// Peer describes it.
+type HandshakeError struct {
+	// RemoteAddr is the address of the remote server.
+	RemoteAddr string
+
+	// ServerName is the name the certificate of the remote server was
+	// verified against.
+	ServerName string
+
+	// Peer is the summary of the leaf certificate the remote server
+	// presented, if it was rejected.
+	Peer *CertificateSummary
+
+	// Chain is the summary of the certificates the remote server presented,
+	// leaf first, if it got to present them. At most 8 are included.
+	Chain []*CertificateSummary
+
+	// Failure classifies the failure.
+	Failure HandshakeFailure
+
+	// Alert is the TLS alert the remote server sent, i.e: "bad
+	// certificate", if any.
+	Alert string
+
+	// MinVersion and MaxVersion are the TLS versions the client offered,
+	// Version the one the remote server selected, 0 if it didn't get to.
+	MinVersion uint16
+	MaxVersion uint16
+	Version    uint16
+
+	Err error
+
+	// certsInvalidated is set if the cached certificates of the instance
+	// were dropped because of the failure.
+	certsInvalidated bool
+}
+
+func (h *HandshakeError) Error() string {
+	err := h.Err.Error()
+	if desc := h.Failure.description(); desc != "" {
+		if h.Failure == HandshakeFailureProtocolVersion {
+			desc += fmt.Sprintf(" (%s to %s)", tlsVersionName(h.MinVersion), tlsVersionName(h.MaxVersion))
+		}
+		err = desc + ": " + err
+	}
+
+	if h.Peer == nil {
+		return fmt.Sprintf("couldn't initiate TLS handshake to remote addr %s (server name %q): %s",
+			h.RemoteAddr, h.ServerName, err)
+	}
+	return fmt.Sprintf("couldn't initiate TLS handshake to remote addr %s (server name %q, presented certificate: %s): %s",
+		h.RemoteAddr, h.ServerName, h.Peer, err)
+}
+
+func (h *HandshakeError) Unwrap() error { return h.Err }
+
+// remoteAlertPrefix prefixes the errors of crypto/tls for the alerts sent by
+// the remote, which it doesn't export.
+const remoteAlertPrefix = "remote error: tls: "
+
+// classifyHandshakeError returns the class of the given handshake error, and
+// the alert the remote server sent, if any.
+func classifyHandshakeError(err error) (HandshakeFailure, string) {
+	var alert string
+	msg := err.Error()
+	if i := strings.Index(msg, remoteAlertPrefix); i >= 0 {
+		alert = msg[i+len(remoteAlertPrefix):]
+	}
+
+	var (
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certInvalidErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+	)
+	switch {
+	case errors.Is(err, errPeerRejected):
+		return HandshakeFailurePeerRejected, alert
+	case errors.As(err, &unknownAuthorityErr):
+		return HandshakeFailureUnknownAuthority, alert
+	case errors.As(err, &certInvalidErr) && certInvalidErr.Reason == x509.Expired:
+		return HandshakeFailureExpiredCertificate, alert
+	case errors.As(err, &hostnameErr):
+		return HandshakeFailureNameMismatch, alert
+	}
+
+	// the errors of crypto/tls aren't exported, neither are the alerts
+	switch alert {
+	case "protocol version not supported":
+		return HandshakeFailureProtocolVersion, alert
+	case "bad certificate", "unknown certificate authority", "expired certificate",
+		"certificate required", "unsupported certificate", "certificate revoked":
+		return HandshakeFailureClientCertRejected, alert
+	}
+	if strings.Contains(msg, "tls: server selected unsupported protocol version") ||
+		strings.Contains(msg, "tls: no supported versions satisfy MinVersion and MaxVersion") {
+		return HandshakeFailureProtocolVersion, alert
+	}
+	return HandshakeFailureUnknown, alert
+}
+
+// offeredVersions returns the TLS versions offered with the given config,
+// with the defaults of crypto/tls for the clients.
+func offeredVersions(cfg *tls.Config) (min, max uint16) {
+	min, max = cfg.MinVersion, cfg.MaxVersion
+	if min == 0 {
+		min = tls.VersionTLS12
+	}
+	if max == 0 {
+		max = tls.VersionTLS13
+	}
+	return min, max
+}
+
+// handshakeRecorder records the certificates the remote server presents
+// during the TLS handshake of a single connection, so its failure can be
+// diagnosed.
+type handshakeRecorder struct {
+	chain []*x509.Certificate
+}
+
+// wrap wraps the verification of the given config of a single connection
+// to record the certificates of the remote server. crypto/tls doesn't call
+// VerifyPeerCertificate once its own verification failed, so the recorder
+// takes it over, with the same checks, and hands the verified chains to
+// VerifyPeerCertificate and VerifyConnection as crypto/tls would.
+func (r *handshakeRecorder) wrap(cfg *tls.Config) {
+	verifyPeer := cfg.VerifyPeerCertificate
+	if cfg.InsecureSkipVerify {
+		cfg.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			r.record(rawCerts)
+			if verifyPeer == nil {
+				return nil
+			}
+			return verifyPeer(rawCerts, verifiedChains)
+		}
+		return
+	}
+
+	var verified [][]*x509.Certificate
+	roots, serverName, now := cfg.RootCAs, cfg.ServerName, cfg.Time
+	if now == nil {
+		now = time.Now
+	}
+	cfg.InsecureSkipVerify = true // nolint: gosec
+	cfg.VerifyPeerCertificate = func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+		certs, err := r.record(rawCerts)
+		if err != nil {
+			return err
+		}
+		if len(certs) == 0 {
+			return errors.New("remote server presented no certificate")
+		}
+
+		opts := x509.VerifyOptions{
+			Roots:         roots,
+			CurrentTime:   now(),
+			DNSName:       serverName,
+			Intermediates: x509.NewCertPool(),
+		}
+		for _, cert := range certs[1:] {
+			opts.Intermediates.AddCert(cert)
+		}
+		if verified, err = certs[0].Verify(opts); err != nil {
+			return err
+		}
+		if verifyPeer == nil {
+			return nil
+		}
+		return verifyPeer(rawCerts, verified)
+	}
+
+	verifyConn := cfg.VerifyConnection
+	cfg.VerifyConnection = func(state tls.ConnectionState) error {
+		if verified != nil {
+			state.VerifiedChains = verified
+		}
+		if verifyConn == nil {
+			return nil
+		}
+		return verifyConn(state)
+	}
+}
+
+// record parses and records the given certificates of the remote server.
+func (r *handshakeRecorder) record(rawCerts [][]byte) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0, len(rawCerts))
+	for _, raw := range rawCerts {
+		cert, err := x509.ParseCertificate(raw)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the certificate of the remote server: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	r.chain = certs
+	return certs, nil
+}
+
+// summaries returns the summaries of the recorded certificates, capped.
+func (r *handshakeRecorder) summaries() []*CertificateSummary {
+	var chain []*CertificateSummary
+	for i, cert := range r.chain {
+		if i == maxSummaryChain {
+			break
+		}
+		chain = append(chain, summarizeCertificate(cert))
+	}
+	return chain
+}
+
+// peerRejectedError is returned during the handshake when the custom peer
+// verification rejected the certificate of the remote server.
+type peerRejectedError struct {
+	cert *x509.Certificate
+	err  error
+}
+
+func (p *peerRejectedError) Error() string {
+	return fmt.Sprintf("%s: %s", errPeerRejected, p.err)
+}
+
+func (p *peerRejectedError) Is(target error) bool { return target == errPeerRejected }
+
+func (p *peerRejectedError) Unwrap() error { return p.err }
+
+// rejectedCertificate returns the certificate the given handshake error was
+// caused by, if any.
+func rejectedCertificate(err error) *x509.Certificate {
+	var (
+		peerRejectedErr     *peerRejectedError
+		unknownAuthorityErr x509.UnknownAuthorityError
+		certInvalidErr      x509.CertificateInvalidError
+		hostnameErr         x509.HostnameError
+	)
+
+	switch {
+	case errors.As(err, &peerRejectedErr):
+		return peerRejectedErr.cert
+	case errors.As(err, &unknownAuthorityErr):
+		return unknownAuthorityErr.Cert
+	case errors.As(err, &certInvalidErr):
+		return certInvalidErr.Cert
+	case errors.As(err, &hostnameErr):
+		return hostnameErr.Certificate
+	}
+	return nil
+}
+
+// logHandshakeError logs the diagnostics of the given failed handshake with
+// the remote server of the instance.
+func (c *Client) logHandshakeError(instance string, h *HandshakeError) {
+	chain := make([]string, 0, len(h.Chain))
+	for _, cert := range h.Chain {
+		chain = append(chain, cert.String())
+	}
+
+	fields := []zap.Field{
+		zap.String("instance", instance),
+		zap.String("remote_addr", h.RemoteAddr),
+		zap.String("server_name", h.ServerName),
+		zap.String("failure", string(h.Failure)),
+		zap.String("offered_tls_versions", tlsVersionName(h.MinVersion)+" to "+tlsVersionName(h.MaxVersion)),
+		zap.Strings("peer_chain", chain),
+		zap.Error(h.Err),
+	}
+	if h.Version != 0 {
+		fields = append(fields, zap.String("tls_version", tlsVersionName(h.Version)))
+	}
+	if h.Alert != "" {
+		fields = append(fields, zap.String("alert", h.Alert))
+	}
+	c.log.Error("TLS handshake with remote server failed", fields...)
+}
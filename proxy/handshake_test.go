@@ -0,0 +1,318 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClient_HandshakeError(t *testing.T) {
+	trustedCA := newNamedTestCA(t, "Trusted CA")
+	otherCA := newNamedTestCA(t, "Other CA")
+
+	tests := []struct {
+		name        string
+		serverCert  tls.Certificate
+		verify      func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error
+		wantSubject string
+		wantIssuer  string
+		wantErr     string
+	}{
+		{
+			name:        "unknown authority",
+			serverCert:  otherCA.serverCert(t, 1),
+			wantSubject: "CN=localhost",
+			wantIssuer:  "CN=Other CA",
+			wantErr:     ".*certificate signed by unknown authority.*",
+		},
+		{
+			name: "hostname mismatch",
+			serverCert: trustedCA.issue(t, &x509.Certificate{
+				SerialNumber: big.NewInt(2),
+				Subject:      pkix.Name{CommonName: "other.example.com"},
+				DNSNames:     []string{"other.example.com"},
+				ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			}),
+			wantSubject: "CN=other.example.com",
+			wantIssuer:  "CN=Trusted CA",
+			wantErr:     ".*certificate is valid for other.example.com, not localhost",
+		},
+		{
+			name:       "custom verification",
+			serverCert: trustedCA.serverCert(t, 3),
+			verify: func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+				return errors.New("not today")
+			},
+			wantSubject: "CN=localhost",
+			wantIssuer:  "CN=Trusted CA",
+			wantErr:     ".*peer certificate rejected: not today",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{tt.serverCert},
+			}, echoHandler)
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = backendCertSource(t, trustedCA, addr)
+			testOpts.VerifyPeerCertificate = tt.verify
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+
+			var handshakeErr *HandshakeError
+			c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+			c.Assert(handshakeErr.ServerName, qt.Equals, "localhost")
+			c.Assert(handshakeErr.RemoteAddr, qt.Equals, "localhost:"+strconv.Itoa(addr.(*net.TCPAddr).Port))
+
+			peer := handshakeErr.Peer
+			c.Assert(peer, qt.Not(qt.IsNil))
+			c.Assert(peer.Subject, qt.Equals, tt.wantSubject)
+			c.Assert(peer.Issuer, qt.Equals, tt.wantIssuer)
+			c.Assert(peer.SerialNumber, qt.Equals, tt.serverCert.Leaf.SerialNumber.String())
+
+			spki := sha256.Sum256(tt.serverCert.Leaf.RawSubjectPublicKeyInfo)
+			c.Assert(peer.SPKISHA256, qt.Equals, hex.EncodeToString(spki[:]))
+
+			c.Assert(err.Error(), qt.Contains, fmt.Sprintf("presented certificate: subject=%q", tt.wantSubject))
+			c.Assert(err.Error(), qt.Contains, "SPKI SHA-256="+peer.SPKISHA256)
+		})
+	}
+}
+
+func TestClient_HandshakeError_Diagnostics(t *testing.T) {
+	trustedCA := newNamedTestCA(t, "Trusted CA")
+	otherCA := newNamedTestCA(t, "Other CA")
+
+	// the server presents its intermediate, so the chain has two
+	// certificates
+	intermediate := otherCA.intermediateCA(t, "Other Intermediate")
+	unknownCert := intermediate.serverCert(t, 1)
+	unknownCert.Certificate = append(unknownCert.Certificate, intermediate.cert.Raw)
+
+	expiredCert := trustedCA.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	mismatchCert := trustedCA.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(3),
+		Subject:      pkix.Name{CommonName: "other.example.com"},
+		DNSNames:     []string{"other.example.com"},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+
+	tests := []struct {
+		name        string
+		serverCfg   *tls.Config
+		minVersion  uint16
+		wantFailure HandshakeFailure
+		wantErr     string
+		wantChain   []string
+		wantAlert   string
+		wantVersion uint16
+	}{
+		{
+			name:        "unknown authority",
+			serverCfg:   &tls.Config{Certificates: []tls.Certificate{unknownCert}},
+			wantFailure: HandshakeFailureUnknownAuthority,
+			wantErr:     ".*: remote server certificate isn't signed by a trusted CA: x509: certificate signed by unknown authority.*",
+			wantChain:   []string{"CN=localhost", "CN=Other Intermediate"},
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name:        "expired certificate",
+			serverCfg:   &tls.Config{Certificates: []tls.Certificate{expiredCert}},
+			wantFailure: HandshakeFailureExpiredCertificate,
+			wantErr:     ".*: remote server certificate is expired or not valid yet: x509: certificate has expired or is not yet valid.*",
+			wantChain:   []string{"CN=localhost"},
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name:        "name mismatch",
+			serverCfg:   &tls.Config{Certificates: []tls.Certificate{mismatchCert}},
+			wantFailure: HandshakeFailureNameMismatch,
+			wantErr:     ".*: remote server certificate isn't valid for the server name: x509: certificate is valid for other.example.com, not localhost",
+			wantChain:   []string{"CN=other.example.com"},
+			wantVersion: tls.VersionTLS13,
+		},
+		{
+			name: "protocol version",
+			serverCfg: &tls.Config{
+				Certificates: []tls.Certificate{trustedCA.serverCert(t, 4)},
+				MaxVersion:   tls.VersionTLS12,
+			},
+			minVersion:  tls.VersionTLS13,
+			wantFailure: HandshakeFailureProtocolVersion,
+			wantErr:     `.*: remote server supports none of the offered TLS versions \(TLS 1.3 to TLS 1.3\): remote error: tls: protocol version not supported`,
+			wantAlert:   "protocol version not supported",
+		},
+		{
+			name: "client certificate rejected",
+			serverCfg: &tls.Config{
+				Certificates: []tls.Certificate{trustedCA.serverCert(t, 5)},
+				// TLS 1.3 clients learn about it after the handshake
+				MaxVersion: tls.VersionTLS12,
+				ClientAuth: tls.RequireAnyClientCert,
+				VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					return errors.New("not today")
+				},
+			},
+			wantFailure: HandshakeFailureClientCertRejected,
+			wantErr:     ".*: remote server rejected the client certificate: remote error: tls: bad certificate",
+			wantChain:   []string{"CN=localhost"},
+			wantAlert:   "bad certificate",
+			wantVersion: tls.VersionTLS12,
+		},
+	}
+
+	// with VerifySAN the chain is verified by the recorder in place of
+	// crypto/tls, by the client itself otherwise
+	for _, mode := range []NameVerification{VerifyEither, VerifySAN} {
+		for _, tt := range tests {
+			t.Run(string(mode)+"/"+tt.name, func(t *testing.T) {
+				c := qt.New(t)
+
+				addr := startTLSBackend(t, tt.serverCfg, echoHandler)
+
+				core, logs := observer.New(zap.ErrorLevel)
+				testOpts := testOptions(t)
+				testOpts.Logger = zap.New(core)
+				testOpts.CertSource = backendCertSource(t, trustedCA, addr)
+				testOpts.MinTLSVersion = tt.minVersion
+				testOpts.NameVerification = mode
+				client, err := NewClient(testOpts)
+				c.Assert(err, qt.IsNil)
+
+				_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+
+				var handshakeErr *HandshakeError
+				c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+				c.Assert(handshakeErr.Failure, qt.Equals, tt.wantFailure)
+				c.Assert(handshakeErr.Alert, qt.Equals, tt.wantAlert)
+				c.Assert(handshakeErr.Version, qt.Equals, tt.wantVersion)
+
+				var subjects []string
+				for _, cert := range handshakeErr.Chain {
+					subjects = append(subjects, cert.Subject)
+				}
+				c.Assert(subjects, qt.DeepEquals, tt.wantChain)
+
+				entries := logs.FilterMessage("TLS handshake with remote server failed").All()
+				c.Assert(entries, qt.Not(qt.HasLen), 0)
+				fields := entries[0].ContextMap()
+				c.Assert(fields["instance"], qt.Equals, "myorg/mydb/mybranch")
+				c.Assert(fields["remote_addr"], qt.Equals, handshakeErr.RemoteAddr)
+				c.Assert(fields["failure"], qt.Equals, string(tt.wantFailure))
+				c.Assert(fields["offered_tls_versions"], qt.Matches, "TLS 1\\.[23] to TLS 1\\.3")
+				c.Assert(fields["peer_chain"], qt.HasLen, len(tt.wantChain))
+				if tt.wantAlert != "" {
+					c.Assert(fields["alert"], qt.Equals, tt.wantAlert)
+				}
+			})
+		}
+	}
+}
+
+func TestClient_HandshakeRecorder_VerifiedChains(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 1)},
+	}, echoHandler)
+
+	// crypto/tls doesn't verify the chain itself anymore with the SAN
+	// verification, VerifyConnection still gets the verified chains
+	verifiedChains := make(chan int, 1)
+	testOpts := testOptions(t)
+	testOpts.NameVerification = VerifySAN
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.TLSConfigHook = func(instance string, cfg *tls.Config) *tls.Config {
+		cfg.VerifyConnection = func(state tls.ConnectionState) error {
+			verifiedChains <- len(state.VerifiedChains)
+			return nil
+		}
+		return cfg
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	c.Assert(<-verifiedChains, qt.Equals, 1)
+}
+
+func TestClient_HandshakeError_NoCertificate(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the remote doesn't speak TLS at all
+	addr, err := net.ResolveTCPAddr("tcp", startPlaintextEchoBackend(t))
+	c.Assert(err, qt.IsNil)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+
+	var handshakeErr *HandshakeError
+	c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+	c.Assert(handshakeErr.Peer, qt.IsNil)
+	c.Assert(err.Error(), qt.Not(qt.Contains), "presented certificate")
+}
+
+func TestSummarizeCertificate_Capped(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	var names []string
+	for i := 0; i < 20; i++ {
+		names = append(names, fmt.Sprintf("host%d.example.com", i))
+	}
+	cert := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: strings.Repeat("a", 500)},
+		DNSNames:     names,
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	})
+
+	s := summarizeCertificate(cert.Leaf)
+	c.Assert(s.DNSNames, qt.DeepEquals, names[:maxSummaryNames])
+	c.Assert(s.IPAddresses, qt.DeepEquals, []string{"127.0.0.1"})
+	c.Assert(s.OmittedNames, qt.Equals, 12)
+	c.Assert(s.Subject, qt.HasLen, maxSummaryNameLen+3)
+	c.Assert(s.String(), qt.Contains, "host7.example.com, 127.0.0.1, and 12 more]")
+
+	// the raw certificate is never included
+	c.Assert(len(s.String()) < 2*maxSummaryNameLen+1024, qt.IsTrue)
+}
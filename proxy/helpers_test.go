@@ -0,0 +1,382 @@
+package proxy
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testCA is a certificate authority to issue certificates in tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t testing.TB) *testCA {
+	return newNamedTestCA(t, "Test CA")
+}
+
+// newNamedTestCA creates a certificate authority with the given common
+// name.
+func newNamedTestCA(t testing.TB, commonName string) *testCA {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: commonName},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &testCA{cert: cert, key: key}
+}
+
+// issue signs a certificate for the given template with a newly generated
+// key.
+func (ca *testCA) issue(t testing.TB, tmpl *x509.Certificate) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ca.issueForKey(t, tmpl, key)
+}
+
+// issueForKey signs a certificate for the given template and key.
+func (ca *testCA) issueForKey(t testing.TB, tmpl *x509.Certificate, key crypto.Signer) tls.Certificate {
+	t.Helper()
+
+	if tmpl.NotBefore.IsZero() {
+		tmpl.NotBefore = time.Now().Add(-time.Hour)
+	}
+	if tmpl.NotAfter.IsZero() {
+		tmpl.NotAfter = time.Now().Add(time.Hour)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, key.Public(), ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+		Leaf:        leaf,
+	}
+}
+
+// intermediateCA issues an intermediate certificate authority with the given
+// common name.
+func (ca *testCA) intermediateCA(t testing.TB, commonName string) *testCA {
+	cert := ca.issue(t, &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: commonName},
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	})
+	return &testCA{cert: cert.Leaf, key: cert.PrivateKey.(*ecdsa.PrivateKey)}
+}
+
+// serverCert issues a server certificate for "localhost" with the given
+// serial number.
+func (ca *testCA) serverCert(t testing.TB, serial int64) tls.Certificate {
+	return ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+}
+
+// clientCert issues a client certificate with the given common name.
+func (ca *testCA) clientCert(t testing.TB, commonName string) tls.Certificate {
+	return ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+}
+
+// startTLSBackend starts a TLS server on a random local port, which handles
+// every connection with the given handler after a successful handshake. The
+// server is stopped once the test finishes.
+func startTLSBackend(t testing.TB, cfg *tls.Config, handler func(conn net.Conn)) net.Addr {
+	t.Helper()
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+				if err := conn.(*tls.Conn).Handshake(); err != nil {
+					return
+				}
+				handler(conn)
+			}()
+		}
+	}()
+
+	return l.Addr()
+}
+
+// echoHandler writes back everything it reads from the connection.
+func echoHandler(conn net.Conn) {
+	buf := make([]byte, 4096)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return
+		}
+		if _, err := conn.Write(buf[:n]); err != nil {
+			return
+		}
+	}
+}
+
+// startClient runs the client until the test finishes, and returns the
+// address it listens on.
+func startClient(t testing.TB, client *Client) net.Addr {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		client.Run(ctx) // nolint: errcheck
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+
+	addr, err := client.LocalAddr()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return addr
+}
+
+// startPlaintextEchoBackend starts a TCP echo server on a random local port
+// and returns its address. The server is stopped once the test finishes.
+func startPlaintextEchoBackend(t *testing.T) string {
+	t.Helper()
+	return startPlaintextBackend(t, echoHandler)
+}
+
+// startPlaintextBackend starts a TCP server on a random local port serving
+// every connection with handler and returns its address. The server is
+// stopped once the test finishes.
+func startPlaintextBackend(t testing.TB, handler func(conn net.Conn)) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				handler(conn)
+			}()
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+// backendCertSource returns a cert source that points to the given backend
+// and trusts the given CA.
+func backendCertSource(t testing.TB, ca *testCA, addr net.Addr) *fakeCertSource {
+	_, portStr, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clientCert := ca.clientCert(t, "client")
+	return &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return &Cert{
+				ClientCert: clientCert,
+				CACerts:    []*x509.Certificate{ca.cert},
+				AccessHost: "localhost",
+				Ports: RemotePorts{
+					Proxy: port,
+				},
+			}, nil
+		},
+	}
+}
+
+// testGreeting returns the payload of the greeting sent by mysqlHandler, of
+// a server of version 8.0.0-test on connection id 1.
+func testGreeting() []byte {
+	greeting := []byte{10} // protocol version
+	greeting = append(greeting, "8.0.0-test\x00"...)
+	greeting = append(greeting, 1, 0, 0, 0)            // connection id
+	greeting = append(greeting, "abcdefgh"...)         // auth data part 1
+	greeting = append(greeting, 0)                     // filler
+	greeting = append(greeting, 0x00, 0x82)            // capabilities: protocol 41, secure connection
+	greeting = append(greeting, 33, 0x02, 0x00)        // charset, status
+	greeting = append(greeting, 0x08, 0x00)            // capabilities: plugin auth
+	greeting = append(greeting, 21)                    // auth data length
+	greeting = append(greeting, make([]byte, 10)...)   // reserved
+	greeting = append(greeting, "ijklmnopqrst\x00"...) // auth data part 2
+	greeting = append(greeting, "mysql_native_password\x00"...)
+	return greeting
+}
+
+// mysqlHandler speaks just enough of the MySQL protocol for a client to
+// connect and run commands: it accepts any credentials and replies to every
+// command with an OK packet, until the client quits.
+func mysqlHandler(conn net.Conn) {
+	if err := writeMySQLPacket(conn, 0, testGreeting()); err != nil {
+		return
+	}
+
+	ok := []byte{0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00}
+	for {
+		seq, payload, err := readMySQLPacket(conn)
+		if err != nil {
+			return
+		}
+
+		// COM_QUIT, the handshake response has a sequence number of 1
+		if seq == 0 && len(payload) > 0 && payload[0] == 0x01 {
+			return
+		}
+
+		if err := writeMySQLPacket(conn, seq+1, ok); err != nil {
+			return
+		}
+	}
+}
+
+func readMySQLPacket(r io.Reader) (byte, []byte, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	payload := make([]byte, int(header[0])|int(header[1])<<8|int(header[2])<<16)
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return 0, nil, err
+	}
+	return header[3], payload, nil
+}
+
+func writeMySQLPacket(w io.Writer, seq byte, payload []byte) error {
+	n := len(payload)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...))
+	return err
+}
+
+// pipeListener is an in-memory net.Listener, its connections are created
+// with dial.
+type pipeListener struct {
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newPipeListener() *pipeListener {
+	return &pipeListener{
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (l *pipeListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (l *pipeListener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return nil
+}
+
+func (l *pipeListener) Addr() net.Addr {
+	return pipeAddr{}
+}
+
+// dial returns the client side of a new connection accepted by the
+// listener.
+func (l *pipeListener) dial() (net.Conn, error) {
+	local, remote := net.Pipe()
+	select {
+	case l.conns <- remote:
+		return local, nil
+	case <-l.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+type pipeAddr struct{}
+
+func (pipeAddr) Network() string { return "pipe" }
+func (pipeAddr) String() string  { return "pipe" }
@@ -0,0 +1,125 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// errHookPanicked is wrapped by the errors of the hooks that panicked.
+var errHookPanicked = errors.New("panicked")
+
+// callHook calls the given hook of the connection with the given id. A panic
+// of the hook is logged and returned as an error, so a broken hook doesn't
+// take the proxy down.
+func (c *Client) callHook(name string, id uint64, hook func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("connection hook panicked",
+				zap.String("hook", name),
+				zap.Uint64("conn_id", id),
+				zap.Any("panic", r),
+				zap.Stack("stack"))
+			err = fmt.Errorf("%s %w: %v", name, errHookPanicked, r)
+		}
+	}()
+	hook()
+	return nil
+}
+
+// onConnect calls the OnConnect hook, if any, and returns the error
+// rejecting the connection.
+func (c *Client) onConnect(ctx context.Context, info ConnInfo) error {
+	if c.onConnectHook == nil {
+		return nil
+	}
+
+	var err error
+	if perr := c.callHook("OnConnect", info.ID, func() {
+		err = c.onConnectHook(ctx, info)
+	}); perr != nil {
+		err = perr
+	}
+	if err != nil {
+		return fmt.Errorf("connection rejected by OnConnect: %w", err)
+	}
+	return nil
+}
+
+// onHandshake calls the OnHandshake hook, if any, for TLS connections.
+func (c *Client) onHandshake(info ConnInfo, remote net.Conn) {
+	if c.onHandshakeHook == nil {
+		return
+	}
+	tlsConn, ok := remote.(*tls.Conn)
+	if !ok {
+		return
+	}
+
+	state := tlsConn.ConnectionState()
+	_ = c.callHook("OnHandshake", info.ID, func() {
+		c.onHandshakeHook(info, state)
+	})
+}
+
+// onClose calls the OnClose hook, if any.
+func (c *Client) onClose(info ConnInfo, bytesIn, bytesOut int64, err error) {
+	if c.onCloseHook == nil {
+		return
+	}
+	_ = c.callHook("OnClose", info.ID, func() {
+		c.onCloseHook(info, bytesIn, bytesOut, err)
+	})
+}
+
+// tlsConfigFor returns the TLS config of a connection to the given instance,
+// the given clone of the cached config as the TLSConfigHook, if any, left
+// it. A config the hook returned in place of the given one inherits the
+// client certificates, the root CAs, the server name and the verification
+// of the given one it doesn't set itself, so they're only dropped by
+// clearing them on the given config.
+func (c *Client) tlsConfigFor(instance string, cfg *tls.Config) (_ *tls.Config, err error) {
+	if c.tlsConfigHook == nil {
+		return cfg, nil
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			c.log.Error("TLS config hook panicked",
+				zap.String("instance", instance),
+				zap.Any("panic", r),
+				zap.Stack("stack"))
+			err = fmt.Errorf("TLSConfigHook %w: %v", errHookPanicked, r)
+		}
+	}()
+
+	hooked := c.tlsConfigHook(instance, cfg)
+	if hooked == nil || hooked == cfg {
+		return cfg, nil
+	}
+
+	if hooked.Certificates == nil && hooked.GetClientCertificate == nil {
+		hooked.Certificates = cfg.Certificates
+		hooked.GetClientCertificate = cfg.GetClientCertificate
+	}
+	if hooked.RootCAs == nil {
+		hooked.RootCAs = cfg.RootCAs
+	}
+	if hooked.ServerName == "" {
+		hooked.ServerName = cfg.ServerName
+	}
+	// the verification of the proxy may rely on crypto/tls not verifying
+	// the chain itself, or on it doing so.
+	if hooked.VerifyPeerCertificate == nil {
+		hooked.VerifyPeerCertificate = cfg.VerifyPeerCertificate
+		hooked.InsecureSkipVerify = cfg.InsecureSkipVerify
+	}
+	if hooked.VerifyConnection == nil {
+		hooked.VerifyConnection = cfg.VerifyConnection
+	}
+	return hooked, nil
+}
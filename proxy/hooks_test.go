@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// hookRecorder records the calls of the connection hooks.
+type hookRecorder struct {
+	mu    sync.Mutex
+	calls []string
+	infos []ConnInfo
+	state tls.ConnectionState
+
+	bytesIn, bytesOut int64
+	closeErr          error
+}
+
+func (r *hookRecorder) record(call string, info ConnInfo) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+	r.infos = append(r.infos, info)
+}
+
+func (r *hookRecorder) setHooks(opts *Options) {
+	opts.OnConnect = func(ctx context.Context, info ConnInfo) error {
+		r.record("connect", info)
+		return nil
+	}
+	opts.OnHandshake = func(info ConnInfo, state tls.ConnectionState) {
+		r.record("handshake", info)
+		r.mu.Lock()
+		r.state = state
+		r.mu.Unlock()
+	}
+	opts.OnClose = func(info ConnInfo, bytesIn, bytesOut int64, err error) {
+		r.record("close", info)
+		r.mu.Lock()
+		r.bytesIn, r.bytesOut, r.closeErr = bytesIn, bytesOut, err
+		r.mu.Unlock()
+	}
+}
+
+func (r *hookRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.calls...)
+}
+
+// dialerFunc is a Dialer calling the function.
+type dialerFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+func (f dialerFunc) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return f(ctx, network, addr)
+}
+
+func TestClient_Hooks(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	recorder := &hookRecorder{}
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	recorder.setHooks(&testOpts)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(recorder.recorded(), qt.DeepEquals, []string{"connect", "handshake"})
+	c.Assert(recorder.state.HandshakeComplete, qt.IsTrue)
+
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	_, err = io.ReadFull(conn, make([]byte, 4))
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	conn.Close()
+
+	c.Assert(recorder.recorded(), qt.DeepEquals, []string{"connect", "handshake", "close"})
+	c.Assert(recorder.bytesIn, qt.Equals, int64(4))
+	c.Assert(recorder.bytesOut, qt.Equals, int64(4))
+	c.Assert(recorder.closeErr, qt.IsNil)
+	for _, info := range recorder.infos {
+		c.Assert(info.ID, qt.Equals, uint64(1))
+		c.Assert(info.Instance, qt.Equals, "myorg/mydb/mybranch")
+	}
+	c.Assert(recorder.infos[0].RemoteAddr, qt.Equals, "")
+	c.Assert(recorder.infos[1].RemoteAddr, qt.Equals, addr.String())
+
+	// the connections closed by the proxy tell why
+	conn, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	client.InvalidateInstance("myorg/mydb/mybranch")
+	conn.Close()
+
+	var closeErr *CloseError
+	c.Assert(errors.As(recorder.closeErr, &closeErr), qt.IsTrue)
+	c.Assert(closeErr.Reason, qt.Equals, CloseReasonInvalidated)
+}
+
+func TestClient_OnConnect_Reject(t *testing.T) {
+	c := qt.New(t)
+
+	var dials int
+	recorder := &hookRecorder{}
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		dials++
+		return nil, fmt.Errorf("unexpected dial to %s", addr)
+	})
+	recorder.setHooks(&testOpts)
+	testOpts.OnConnect = func(ctx context.Context, info ConnInfo) error {
+		recorder.record("connect", info)
+		return errors.New("not during maintenance")
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	addr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+
+	c.Assert(recorder.recorded(), qt.DeepEquals, []string{"connect"})
+	c.Assert(recorder.infos[0].ID, qt.Equals, uint64(1))
+	c.Assert(recorder.infos[0].ClientAddr, qt.Equals, conn.LocalAddr().String())
+
+	_, err = client.Dial(context.Background(), "local/db/main")
+	c.Assert(err, qt.ErrorMatches, "connection rejected by OnConnect: not during maintenance")
+	c.Assert(dials, qt.Equals, 0)
+	c.Assert(client.Stats().Connections, qt.Equals, uint64(0))
+}
+
+func TestClient_Hooks_SetupFailure(t *testing.T) {
+	c := qt.New(t)
+
+	recorder := &hookRecorder{}
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			return nil, fmt.Errorf("%w: token was revoked", ErrUnauthorized)
+		},
+	}
+	recorder.setHooks(&testOpts)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(recorder.recorded(), qt.DeepEquals, []string{"connect", "close"})
+	c.Assert(errors.Is(recorder.closeErr, ErrUnauthorized), qt.IsTrue)
+}
+
+func TestClient_Hooks_Panic(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.OnConnect = func(ctx context.Context, info ConnInfo) error {
+		if info.ID == 1 {
+			panic("boom")
+		}
+		return nil
+	}
+	testOpts.OnHandshake = func(info ConnInfo, state tls.ConnectionState) { panic("boom") }
+	testOpts.OnClose = func(info ConnInfo, bytesIn, bytesOut int64, err error) { panic("boom") }
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// a panicking OnConnect rejects the connection
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, "connection rejected by OnConnect: OnConnect panicked: boom")
+
+	// the others don't get in the way
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.Close(), qt.IsNil)
+}
+
+func TestClient_TLSConfigHook(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	var mu sync.Mutex
+	var instances []string
+	sessions := tls.NewLRUClientSessionCache(1)
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.TLSConfigHook = func(instance string, cfg *tls.Config) *tls.Config {
+		mu.Lock()
+		instances = append(instances, instance)
+		mu.Unlock()
+		cfg.ClientSessionCache = sessions
+		return nil
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	for i := 0; i < 2; i++ {
+		conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+		c.Assert(err, qt.IsNil)
+		c.Assert(conn.Close(), qt.IsNil)
+	}
+
+	// the hook runs for every connection, on a copy of the cached config
+	mu.Lock()
+	c.Assert(instances, qt.DeepEquals, []string{"myorg/mydb/mybranch", "myorg/mydb/mybranch"})
+	mu.Unlock()
+	entry, err := client.configCache.Get("myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(entry.cfg.ClientSessionCache, qt.Not(qt.Equals), sessions)
+}
+
+func TestClient_TLSConfigHook_Replaced(t *testing.T) {
+	ca := newTestCA(t)
+
+	tests := []struct {
+		name     string
+		serverCA *testCA
+		hook     func(cfg *tls.Config) *tls.Config
+		wantErr  string
+	}{
+		{
+			name:     "inherits the certificates",
+			serverCA: ca,
+			hook: func(cfg *tls.Config) *tls.Config {
+				return &tls.Config{CurvePreferences: []tls.CurveID{tls.CurveP256}}
+			},
+		},
+		{
+			name:     "inherits the verification",
+			serverCA: newNamedTestCA(t, "Other CA"),
+			hook: func(cfg *tls.Config) *tls.Config {
+				return &tls.Config{InsecureSkipVerify: true} // nolint: gosec
+			},
+			wantErr: ".*certificate signed by unknown authority.*",
+		},
+		{
+			name:     "client certificates cleared",
+			serverCA: ca,
+			hook: func(cfg *tls.Config) *tls.Config {
+				cfg.Certificates = nil
+				cfg.GetClientCertificate = nil
+				return cfg
+			},
+			wantErr: ".*remote error: tls: handshake failure",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			// the backend verifies the client certificates
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{tt.serverCA.serverCert(t, 42)},
+				ClientAuth:   tls.RequireAndVerifyClientCert,
+				ClientCAs:    certPool([]*x509.Certificate{ca.cert}),
+				MaxVersion:   tls.VersionTLS12,
+			}, echoHandler)
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.SetupRetries = -1
+			testOpts.TLSConfigHook = func(instance string, cfg *tls.Config) *tls.Config {
+				return tt.hook(cfg)
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			defer conn.Close()
+
+			_, err = conn.Write([]byte("ping"))
+			c.Assert(err, qt.IsNil)
+			_, err = io.ReadFull(conn, make([]byte, 4))
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestClient_TLSConfigHook_Panic(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	var calls int32
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.TLSConfigHook = func(instance string, cfg *tls.Config) *tls.Config {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			panic("boom")
+		}
+		return cfg
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// the connection fails without being retried
+	_, err = client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.ErrorMatches, ".*TLSConfigHook panicked: boom")
+	c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(1))
+
+	// the next ones aren't affected
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	c.Assert(conn.Close(), qt.IsNil)
+}
@@ -0,0 +1,277 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// Protocol is the protocol spoken by the connections of a local listener.
+type Protocol string
+
+const (
+	// ProtocolClassic is the classic MySQL protocol.
+	ProtocolClassic Protocol = "classic"
+
+	// ProtocolX is the MySQL X Protocol of the X DevAPI. Its tunnels are
+	// relayed as they are, the features parsing the MySQL packets, i.e:
+	// MaxPacketSize, are disabled for them.
+	ProtocolX Protocol = "x"
+)
+
+// InstanceConfig configures one of the instances of a Client proxying
+// several of them, each on its own local address.
+type InstanceConfig struct {
+	// Instance is the remote DB instance the connections accepted on
+	// LocalAddr are proxied to, in the form of
+	// "organization/database/branch".
+	Instance string
+
+	// LocalAddr is the address to listen for the connections to Instance,
+	// a TCP address or a unix socket in the form of "unix:///path".
+	LocalAddr string
+
+	// RemoteAddr overrides the remote address returned by the CertSource
+	// for Instance. By default Options.RemoteAddr is used, if set.
+	RemoteAddr string
+
+	// MaxConnections is the maximum number of connections to Instance,
+	// on top of the Options.MaxConnections limit of all instances
+	// together. 0 means no limit.
+	MaxConnections uint64
+
+	// XLocalAddr, if set, is the address to listen for the X Protocol
+	// connections to Instance, in the same forms as LocalAddr. They're
+	// proxied to XRemoteAddr and share the certificates and the
+	// MaxConnections of Instance.
+	XLocalAddr string
+
+	// XRemoteAddr is the address of the X Protocol port of Instance, i.e:
+	// "host:33060". It must be set with XLocalAddr, the CertSource only
+	// returns the address of the classic protocol.
+	XRemoteAddr string
+}
+
+// localListener is a local address the client accepts connections on, for
+// a single instance.
+type localListener struct {
+	addr     string
+	instance string
+	protocol Protocol
+
+	// given is the listener of Options.Listener, if set.
+	given net.Listener
+
+	mu sync.Mutex // protects l
+	l  net.Listener
+
+	// listening is 1 while the listener accepts connections, it's 0 while
+	// it's being re-created. Must be accessed atomically.
+	listening int32
+}
+
+// set sets the listener connections are accepted on.
+func (ll *localListener) set(l net.Listener) {
+	ll.mu.Lock()
+	ll.l = l
+	ll.mu.Unlock()
+	atomic.StoreInt32(&ll.listening, 1)
+}
+
+// current returns the listener connections are accepted on, nil if it
+// isn't set yet.
+func (ll *localListener) current() net.Listener {
+	ll.mu.Lock()
+	defer ll.mu.Unlock()
+	return ll.l
+}
+
+// ready reports whether the listener accepts connections.
+func (ll *localListener) ready() bool {
+	return ll.current() != nil && atomic.LoadInt32(&ll.listening) == 1
+}
+
+// setInstances validates opts.Instances and sets up a listener for each of
+// them.
+func (c *Client) setInstances(opts Options) error {
+	switch {
+	case opts.Instance != "":
+		return errors.New("Instances and Instance can't be set together")
+	case opts.LocalAddr != "":
+		return errors.New("Instances and LocalAddr can't be set together")
+	case opts.XLocalAddr != "" || opts.XRemoteAddr != "":
+		return errors.New("Instances and XLocalAddr can't be set together")
+	case opts.Listener != nil:
+		return errors.New("Instances and Listener can't be set together")
+	case len(opts.RemoteAddrs) > 0:
+		return errors.New("Instances and RemoteAddrs can't be set together")
+	}
+
+	localAddrs := make(map[string]bool)
+	for i, inst := range opts.Instances {
+		if _, _, _, err := ParseInstance(inst.Instance); err != nil {
+			return fmt.Errorf("invalid Instances[%d]: %w", i, err)
+		}
+		if c.instanceListener(inst.Instance) != nil {
+			return fmt.Errorf("invalid Instances[%d]: duplicate instance %q", i, inst.Instance)
+		}
+
+		if inst.LocalAddr == "" {
+			return fmt.Errorf("invalid Instances[%d]: LocalAddr must be set", i)
+		}
+		localAddr, err := normalizeLocalAddr(inst.LocalAddr)
+		if err != nil {
+			return fmt.Errorf("invalid Instances[%d].LocalAddr: %w", i, err)
+		}
+		// port 0 picks a different port for every listener
+		if localAddrs[localAddr] && !strings.HasSuffix(localAddr, ":0") {
+			return fmt.Errorf("invalid Instances[%d]: duplicate LocalAddr %q", i, inst.LocalAddr)
+		}
+		localAddrs[localAddr] = true
+
+		if inst.RemoteAddr != "" {
+			remoteAddr, err := normalizeRemoteAddr(inst.RemoteAddr)
+			if err != nil {
+				return fmt.Errorf("invalid Instances[%d].RemoteAddr: %w", i, err)
+			}
+			if c.instanceRemoteAddrs == nil {
+				c.instanceRemoteAddrs = make(map[string]string)
+			}
+			c.instanceRemoteAddrs[inst.Instance] = remoteAddr
+		} else if opts.InsecureRemotePlaintext && c.remoteAddr == "" {
+			return fmt.Errorf("invalid Instances[%d]: InsecureRemotePlaintext requires RemoteAddr to be set", i)
+		}
+
+		if inst.MaxConnections > 0 {
+			if c.instanceLimits == nil {
+				c.instanceLimits = make(map[string]*connSemaphore)
+			}
+			c.instanceLimits[inst.Instance] = newConnSemaphore(inst.MaxConnections)
+		}
+
+		c.listeners = append(c.listeners, &localListener{
+			addr:     localAddr,
+			instance: inst.Instance,
+			protocol: ProtocolClassic,
+		})
+
+		if inst.XLocalAddr == "" && inst.XRemoteAddr == "" {
+			continue
+		}
+		ll, err := c.addXListener(inst.Instance, inst.XLocalAddr, inst.XRemoteAddr)
+		if err != nil {
+			return fmt.Errorf("invalid Instances[%d]: %w", i, err)
+		}
+		if localAddrs[ll.addr] && !strings.HasSuffix(ll.addr, ":0") {
+			return fmt.Errorf("invalid Instances[%d]: duplicate XLocalAddr %q", i, inst.XLocalAddr)
+		}
+		localAddrs[ll.addr] = true
+	}
+	return nil
+}
+
+// addXListener sets up the listener of the X Protocol connections to the
+// given instance, proxied to the given remote address.
+func (c *Client) addXListener(instance, localAddr, remoteAddr string) (*localListener, error) {
+	switch {
+	case localAddr == "":
+		return nil, errors.New("XRemoteAddr requires XLocalAddr to be set")
+	case remoteAddr == "":
+		return nil, errors.New("XLocalAddr requires XRemoteAddr to be set")
+	}
+
+	addr, err := normalizeLocalAddr(localAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid XLocalAddr: %w", err)
+	}
+	remoteAddr, err = normalizeRemoteAddr(remoteAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid XRemoteAddr: %w", err)
+	}
+
+	if c.instanceXRemoteAddrs == nil {
+		c.instanceXRemoteAddrs = make(map[string]string)
+	}
+	c.instanceXRemoteAddrs[instance] = remoteAddr
+
+	ll := &localListener{
+		addr:     addr,
+		instance: instance,
+		protocol: ProtocolX,
+	}
+	c.listeners = append(c.listeners, ll)
+	return ll, nil
+}
+
+// normalizeLocalAddr normalizes the given TCP local address, unix sockets
+// are returned as they are.
+func normalizeLocalAddr(addr string) (string, error) {
+	if strings.HasPrefix(addr, "unix://") {
+		return addr, nil
+	}
+	return normalizeAddr(addr)
+}
+
+// instanceListener returns the classic protocol listener of the given
+// instance, nil if there's none.
+func (c *Client) instanceListener(instance string) *localListener {
+	for _, ll := range c.listeners {
+		if ll.instance == instance && ll.protocol == ProtocolClassic {
+			return ll
+		}
+	}
+	return nil
+}
+
+// remoteAddrOf returns the remote address set for the given instance, which
+// overrides the one returned by the CertSource, if any.
+func (c *Client) remoteAddrOf(instance string) string {
+	if addr, ok := c.instanceRemoteAddrs[instance]; ok {
+		return addr
+	}
+	return c.remoteAddr
+}
+
+// remoteAddrFor returns the remote address set for the connections of the
+// given protocol to the given instance, see remoteAddrOf.
+func (c *Client) remoteAddrFor(instance string, protocol Protocol) string {
+	if protocol == ProtocolX {
+		return c.instanceXRemoteAddrs[instance]
+	}
+	return c.remoteAddrOf(instance)
+}
+
+// LocalAddrs returns the addresses of the classic protocol local listeners,
+// keyed by the instance their connections are proxied to. Like LocalAddr, it
+// blocks until Run bound them.
+func (c *Client) LocalAddrs() (map[string]net.Addr, error) {
+	return c.localAddrs(ProtocolClassic)
+}
+
+// XLocalAddrs returns the addresses of the X Protocol local listeners, keyed
+// by the instance their connections are proxied to, like LocalAddrs.
+func (c *Client) XLocalAddrs() (map[string]net.Addr, error) {
+	return c.localAddrs(ProtocolX)
+}
+
+// localAddrs returns the addresses of the local listeners of the given
+// protocol, keyed by their instance.
+func (c *Client) localAddrs(protocol Protocol) (map[string]net.Addr, error) {
+	<-c.done
+
+	addrs := make(map[string]net.Addr, len(c.listeners))
+	for _, ll := range c.listeners {
+		if ll.protocol != protocol {
+			continue
+		}
+		l := ll.current()
+		if l == nil {
+			return nil, errors.New("listener is not set")
+		}
+		addrs[ll.instance] = l.Addr()
+	}
+	return addrs, nil
+}
@@ -0,0 +1,354 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// startNamedBackend starts a plaintext backend that writes its name to every
+// new connection before echoing it.
+func startNamedBackend(t *testing.T, name string) string {
+	return startPlaintextBackend(t, func(conn net.Conn) {
+		if _, err := conn.Write([]byte(name)); err != nil {
+			return
+		}
+		echoHandler(conn)
+	})
+}
+
+// readBackendName reads the name written by a backend of startNamedBackend.
+func readBackendName(c *qt.C, conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	buf := make([]byte, 1)
+	_, err := io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	conn.SetReadDeadline(time.Time{}) // nolint: errcheck
+	return string(buf)
+}
+
+func testInstancesOptions(t *testing.T) Options {
+	opts := testOptions(t)
+	opts.InsecureRemotePlaintext = true
+	opts.Instances = []InstanceConfig{
+		{
+			Instance:   "myorg/a/main",
+			LocalAddr:  "127.0.0.1:0",
+			RemoteAddr: startNamedBackend(t, "a"),
+		},
+		{
+			Instance:   "myorg/b/main",
+			LocalAddr:  "127.0.0.1:0",
+			RemoteAddr: startNamedBackend(t, "b"),
+		},
+	}
+	return opts
+}
+
+func TestClient_Instances(t *testing.T) {
+	c := qt.New(t)
+
+	client, err := NewClient(testInstancesOptions(t))
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	addrs, err := client.LocalAddrs()
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.HasLen, 2)
+	c.Assert(addrs["myorg/a/main"].String(), qt.Not(qt.Equals), addrs["myorg/b/main"].String())
+
+	for instance, name := range map[string]string{"myorg/a/main": "a", "myorg/b/main": "b"} {
+		conn, err := net.Dial("tcp", addrs[instance].String())
+		c.Assert(err, qt.IsNil)
+		c.Assert(readBackendName(c, conn), qt.Equals, name)
+
+		conns := client.connSnapshots(time.Now())
+		c.Assert(conns, qt.HasLen, 1)
+		c.Assert(conns[0].instance, qt.Equals, instance)
+		conn.Close()
+
+		for len(client.connSnapshots(time.Now())) > 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+}
+
+func TestClient_Instances_MaxConnections(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testInstancesOptions(t)
+	opts.Instances[0].MaxConnections = 1
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	addrs, err := client.LocalAddrs()
+	c.Assert(err, qt.IsNil)
+
+	first, err := net.Dial("tcp", addrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer first.Close()
+	c.Assert(readBackendName(c, first), qt.Equals, "a")
+
+	// the limit of the instance is reached
+	second, err := net.Dial("tcp", addrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = second.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+
+	// but not the one of the other instance
+	other, err := net.Dial("tcp", addrs["myorg/b/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer other.Close()
+	c.Assert(readBackendName(c, other), qt.Equals, "b")
+
+	// closing the first connection frees its slot
+	first.Close()
+	for len(client.connSnapshots(time.Now())) > 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	third, err := net.Dial("tcp", addrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer third.Close()
+	c.Assert(readBackendName(c, third), qt.Equals, "a")
+}
+
+func TestClient_Instances_AddressInUse(t *testing.T) {
+	c := qt.New(t)
+
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	defer taken.Close()
+
+	opts := testInstancesOptions(t)
+	opts.Instances[1].LocalAddr = taken.Addr().String()
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(context.Background())
+	}()
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, "error net.Listen: .*"+taken.Addr().String()+".*")
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't fail although an address is in use")
+	}
+
+	// the listener of the other instance isn't left open
+	_, err = client.LocalAddrs()
+	c.Assert(err, qt.ErrorMatches, "listener is not set")
+	l := client.listeners[0].current()
+	c.Assert(l, qt.Not(qt.IsNil))
+	_, err = net.Dial("tcp", l.Addr().String())
+	c.Assert(err, qt.Not(qt.IsNil))
+}
+
+func TestNewClient_Instances(t *testing.T) {
+	tests := []struct {
+		name    string
+		modify  func(opts *Options)
+		wantErr string
+	}{
+		{
+			name:    "with Instance",
+			modify:  func(opts *Options) { opts.Instance = "myorg/c/main" },
+			wantErr: "Instances and Instance can't be set together",
+		},
+		{
+			name:    "with LocalAddr",
+			modify:  func(opts *Options) { opts.LocalAddr = "127.0.0.1:0" },
+			wantErr: "Instances and LocalAddr can't be set together",
+		},
+		{
+			name:    "with XLocalAddr",
+			modify:  func(opts *Options) { opts.XLocalAddr = "127.0.0.1:0" },
+			wantErr: "Instances and XLocalAddr can't be set together",
+		},
+		{
+			name:    "invalid instance",
+			modify:  func(opts *Options) { opts.Instances[1].Instance = "myorg/b" },
+			wantErr: `invalid Instances\[1\]: instance format is malformed.*`,
+		},
+		{
+			name:    "duplicate instance",
+			modify:  func(opts *Options) { opts.Instances[1].Instance = "myorg/a/main" },
+			wantErr: `invalid Instances\[1\]: duplicate instance "myorg/a/main"`,
+		},
+		{
+			name:    "missing LocalAddr",
+			modify:  func(opts *Options) { opts.Instances[0].LocalAddr = "" },
+			wantErr: `invalid Instances\[0\]: LocalAddr must be set`,
+		},
+		{
+			name: "duplicate LocalAddr",
+			modify: func(opts *Options) {
+				opts.Instances[0].LocalAddr = "127.0.0.1:3306"
+				opts.Instances[1].LocalAddr = "127.0.0.1:3306"
+			},
+			wantErr: `invalid Instances\[1\]: duplicate LocalAddr "127.0.0.1:3306"`,
+		},
+		{
+			name:    "XLocalAddr without XRemoteAddr",
+			modify:  func(opts *Options) { opts.Instances[1].XLocalAddr = "127.0.0.1:0" },
+			wantErr: `invalid Instances\[1\]: XLocalAddr requires XRemoteAddr to be set`,
+		},
+		{
+			name:    "XRemoteAddr without XLocalAddr",
+			modify:  func(opts *Options) { opts.Instances[1].XRemoteAddr = "127.0.0.1:33060" },
+			wantErr: `invalid Instances\[1\]: XRemoteAddr requires XLocalAddr to be set`,
+		},
+		{
+			name: "duplicate XLocalAddr",
+			modify: func(opts *Options) {
+				opts.Instances[0].LocalAddr = "127.0.0.1:3306"
+				opts.Instances[1].XLocalAddr = "127.0.0.1:3306"
+				opts.Instances[1].XRemoteAddr = "127.0.0.1:33060"
+			},
+			wantErr: `invalid Instances\[1\]: duplicate XLocalAddr "127.0.0.1:3306"`,
+		},
+		{
+			name:    "missing RemoteAddr",
+			modify:  func(opts *Options) { opts.Instances[1].RemoteAddr = "" },
+			wantErr: `invalid Instances\[1\]: InsecureRemotePlaintext requires RemoteAddr to be set`,
+		},
+		{
+			name: "global RemoteAddr",
+			modify: func(opts *Options) {
+				opts.RemoteAddr = "127.0.0.1:3306"
+				opts.Instances[1].RemoteAddr = ""
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			opts := testInstancesOptions(t)
+			tt.modify(&opts)
+			_, err := NewClient(opts)
+			if tt.wantErr == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
+
+func TestClient_Instances_XProtocol(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testInstancesOptions(t)
+	opts.Instances[0].XLocalAddr = "127.0.0.1:0"
+	opts.Instances[0].XRemoteAddr = startNamedBackend(t, "x")
+	// the X Protocol messages aren't framed as MySQL packets
+	opts.MaxPacketSize = 4
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	addrs, err := client.LocalAddrs()
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.HasLen, 2)
+	xAddrs, err := client.XLocalAddrs()
+	c.Assert(err, qt.IsNil)
+	c.Assert(xAddrs, qt.HasLen, 1)
+
+	conn, err := net.Dial("tcp", xAddrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	c.Assert(readBackendName(c, conn), qt.Equals, "x")
+
+	msg := []byte{9, 0, 0, 0, 1, 'm', 'y', 's', 'q', 'l', 'x', '!', '!'}
+	_, err = conn.Write(msg)
+	c.Assert(err, qt.IsNil)
+	got := make([]byte, len(msg))
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, got)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, msg)
+
+	classic, err := net.Dial("tcp", addrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer classic.Close()
+	c.Assert(readBackendName(c, classic), qt.Equals, "a")
+
+	c.Assert(client.Stats().ProtocolConnections, qt.DeepEquals, map[string]uint64{
+		"classic": 1,
+		"x":       1,
+	})
+}
+
+func TestClient_Instances_XProtocolTooManyConnections(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testInstancesOptions(t)
+	opts.Instances[0].MaxConnections = 1
+	opts.Instances[0].XLocalAddr = "127.0.0.1:0"
+	opts.Instances[0].XRemoteAddr = startNamedBackend(t, "x")
+	opts.ProtocolAwareErrors = true
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	addrs, err := client.LocalAddrs()
+	c.Assert(err, qt.IsNil)
+	xAddrs, err := client.XLocalAddrs()
+	c.Assert(err, qt.IsNil)
+
+	first, err := net.Dial("tcp", addrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer first.Close()
+	c.Assert(readBackendName(c, first), qt.Equals, "a")
+
+	// the X Protocol connections count towards the limit of the instance,
+	// and get an X Protocol error
+	conn, err := net.Dial("tcp", xAddrs["myorg/a/main"].String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	got, err := io.ReadAll(conn)
+	c.Assert(err, qt.IsNil)
+
+	var want bytes.Buffer
+	err = writeXError(&want, erConCountError, "08004", "Too many connections")
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, want.Bytes())
+}
+
+func TestClient_XLocalAddr(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testOptions(t)
+	opts.InsecureRemotePlaintext = true
+	opts.RemoteAddr = startNamedBackend(t, "a")
+	opts.XLocalAddr = "127.0.0.1:0"
+	opts.XRemoteAddr = startNamedBackend(t, "x")
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	addr, err := client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+	xAddrs, err := client.XLocalAddrs()
+	c.Assert(err, qt.IsNil)
+	c.Assert(xAddrs, qt.HasLen, 1)
+
+	for addr, name := range map[string]string{addr.String(): "a", xAddrs[opts.Instance].String(): "x"} {
+		conn, err := net.Dial("tcp", addr)
+		c.Assert(err, qt.IsNil)
+		c.Assert(readBackendName(c, conn), qt.Equals, name)
+		conn.Close()
+	}
+}
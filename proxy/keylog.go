@@ -0,0 +1,19 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+)
+
+// keyLogWriter serializes the writes of the TLS secrets of concurrent
+// handshakes to KeyLogWriter, so its lines are never interleaved.
+type keyLogWriter struct {
+	mu sync.Mutex // protects w
+	w  io.Writer
+}
+
+func (k *keyLogWriter) Write(p []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	return k.w.Write(p)
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"strings"
+	"sync"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClient_KeyLogWriter(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	// a bytes.Buffer isn't safe for concurrent writes
+	var keyLog bytes.Buffer
+	core, logs := observer.New(zap.WarnLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.TLSSessionCacheSize = -1
+	testOpts.KeyLogWriter = &keyLog
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	const conns = 10
+	var wg sync.WaitGroup
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if err == nil {
+				conn.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	// every handshake logged its secrets, one per line
+	clientRandoms := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(keyLog.String()), "\n") {
+		fields := strings.Fields(line)
+		c.Assert(fields, qt.HasLen, 3, qt.Commentf(line))
+		if fields[0] == "CLIENT_TRAFFIC_SECRET_0" {
+			clientRandoms[fields[1]] = true
+		}
+	}
+	c.Assert(clientRandoms, qt.HasLen, conns)
+
+	c.Assert(logs.FilterMessageSnippet("anyone with them can decrypt the traffic").Len(), qt.Equals, 1)
+	c.Assert(logs.FilterMessage("writing the TLS secrets of the instance to KeyLogWriter").Len() > 0, qt.IsTrue)
+}
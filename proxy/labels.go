@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// labelKeyRegexp matches valid label keys. It's the same charset Prometheus
+// allows for label names.
+var labelKeyRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// validateLabels validates the keys of the given labels.
+func validateLabels(labels map[string]string) error {
+	for k := range labels {
+		if !labelKeyRegexp.MatchString(k) {
+			return fmt.Errorf("label key %q is invalid, it must match %s", k, labelKeyRegexp)
+		}
+		if strings.HasPrefix(k, "__") {
+			return fmt.Errorf("label key %q is invalid, keys starting with \"__\" are reserved", k)
+		}
+	}
+	return nil
+}
+
+// mergeLabels returns a new map with the labels of base, overridden by the
+// labels of override. It returns nil if both are empty.
+func mergeLabels(base, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+
+	merged := make(map[string]string, len(base)+len(override))
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range override {
+		merged[k] = v
+	}
+	return merged
+}
+
+// labelsFor returns the labels of the given instance, which are the client's
+// labels merged with the instance's overrides. They're computed once by
+// NewClient and shared, so they must not be modified.
+func (c *Client) labelsFor(instance string) map[string]string {
+	if labels, ok := c.mergedLabels[instance]; ok {
+		return labels
+	}
+	return c.labels
+}
+
+// sortedLabels returns the labels as "key:value" pairs, sorted by key.
+func sortedLabels(labels map[string]string) []string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+":"+v)
+	}
+	sort.Strings(pairs)
+	return pairs
+}
@@ -0,0 +1,199 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNewClient_Labels_Invalid(t *testing.T) {
+	tests := []struct {
+		name           string
+		labels         map[string]string
+		instanceLabels map[string]map[string]string
+		wantErr        string
+	}{
+		{
+			name:    "dash",
+			labels:  map[string]string{"my-team": "db"},
+			wantErr: `invalid Labels: label key "my-team" is invalid, .*`,
+		},
+		{
+			name:    "leading digit",
+			labels:  map[string]string{"1team": "db"},
+			wantErr: `invalid Labels: label key "1team" is invalid, .*`,
+		},
+		{
+			name:    "reserved",
+			labels:  map[string]string{"__name__": "db"},
+			wantErr: `invalid Labels: label key "__name__" is invalid, keys starting with "__" are reserved`,
+		},
+		{
+			name:           "instance label",
+			instanceLabels: map[string]map[string]string{"myorg/mydb/main": {"team.name": "db"}},
+			wantErr:        `invalid InstanceLabels for instance "myorg/mydb/main": label key "team.name" is invalid, .*`,
+		},
+		{
+			name:           "instance name",
+			instanceLabels: map[string]map[string]string{"mydb": {"team": "db"}},
+			wantErr:        `invalid InstanceLabels: instance format is malformed, .*`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			testOpts := testOptions(t)
+			testOpts.Labels = tt.labels
+			testOpts.InstanceLabels = tt.instanceLabels
+			_, err := NewClient(testOpts)
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
+
+func TestClient_Labels_Events(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.Labels = map[string]string{"env": "prod", "team": "platform"}
+	testOpts.InstanceLabels = map[string]map[string]string{
+		"myorg/mydb/mybranch": {"team": "payments", "tier": "1"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+
+	client.emit(Event{Type: EventShutdown})
+
+	var got []Event
+	for len(events) > 0 {
+		got = append(got, <-events)
+	}
+	c.Assert(got, qt.HasLen, 4)
+
+	for _, e := range got[:3] {
+		c.Assert(e.Labels, qt.DeepEquals, map[string]string{
+			"env":  "prod",
+			"team": "payments",
+			"tier": "1",
+		})
+	}
+
+	c.Assert(got[3].Type, qt.Equals, EventShutdown)
+	c.Assert(got[3].Labels, qt.DeepEquals, map[string]string{
+		"env":  "prod",
+		"team": "platform",
+	})
+
+	// the client's labels must not be modified by the overrides
+	c.Assert(client.labels, qt.DeepEquals, map[string]string{"env": "prod", "team": "platform"})
+}
+
+func TestClient_Labels_StatsD(t *testing.T) {
+	c := qt.New(t)
+
+	statsdAddr, lines := startStatsDServer(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.Labels = map[string]string{"env": "prod", "team": "platform"}
+	testOpts.StatsD = StatsDOptions{
+		Addr:     statsdAddr,
+		Interval: 20 * time.Millisecond,
+		Tags:     map[string]string{"team": "statsd"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	startClient(t, client)
+
+	c.Assert(waitForLine(c, lines, "sql_proxy.connections_total:"), qt.Equals,
+		"sql_proxy.connections_total:0|c|#env:prod,team:statsd")
+}
+
+func TestClient_Labels_Admin(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.Labels = map[string]string{"env": "prod"}
+	testOpts.InstanceLabels = map[string]map[string]string{
+		"myorg/mydb/mybranch": {"tier": "1"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	rec := httptest.NewRecorder()
+	client.AdminHandler(AdminOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/stats", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Content-Type"), qt.Equals, "application/json")
+
+	var resp struct {
+		Stats          Stats                        `json:"stats"`
+		Labels         map[string]string            `json:"labels"`
+		InstanceLabels map[string]map[string]string `json:"instance_labels"`
+	}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), qt.IsNil)
+	c.Assert(resp.Labels, qt.DeepEquals, map[string]string{"env": "prod"})
+	c.Assert(resp.InstanceLabels, qt.DeepEquals, map[string]map[string]string{
+		"myorg/mydb/mybranch": {"tier": "1"},
+	})
+}
+
+func TestClient_Labels_AdminEvents(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.Labels = map[string]string{"env": "prod"}
+	testOpts.InstanceLabels = map[string]map[string]string{
+		"myorg/mydb/mybranch": {"tier": "1"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// the recent events are labelled as well, even without a subscriber
+	client.emit(Event{Type: EventConnect, Instance: "myorg/mydb/mybranch"})
+	client.emit(Event{Type: EventShutdown})
+
+	rec := httptest.NewRecorder()
+	client.AdminHandler(AdminOptions{}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/events", nil))
+	c.Assert(rec.Code, qt.Equals, http.StatusOK)
+
+	var resp struct {
+		Events []Event `json:"events"`
+	}
+	c.Assert(json.Unmarshal(rec.Body.Bytes(), &resp), qt.IsNil)
+	c.Assert(resp.Events, qt.HasLen, 2)
+	c.Assert(resp.Events[0].Type, qt.Equals, EventShutdown)
+	c.Assert(resp.Events[0].Labels, qt.DeepEquals, map[string]string{"env": "prod"})
+	c.Assert(resp.Events[1].Type, qt.Equals, EventConnect)
+	c.Assert(resp.Events[1].Labels, qt.DeepEquals, map[string]string{"env": "prod", "tier": "1"})
+}
+
+func TestMergeLabels(t *testing.T) {
+	c := qt.New(t)
+
+	c.Assert(mergeLabels(nil, nil), qt.IsNil)
+
+	base := map[string]string{"a": "1", "b": "2"}
+	merged := mergeLabels(base, map[string]string{"b": "3", "c": "4"})
+	c.Assert(merged, qt.DeepEquals, map[string]string{"a": "1", "b": "3", "c": "4"})
+	c.Assert(base, qt.DeepEquals, map[string]string{"a": "1", "b": "2"})
+}
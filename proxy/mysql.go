@@ -0,0 +1,17 @@
+package proxy
+
+import "github.com/go-sql-driver/mysql"
+
+// RegisterMySQLDialer registers the client as a dialer with the given network
+// name for the github.com/go-sql-driver/mysql driver. The address of a DSN
+// using the network is the instance to connect to, i.e:
+//
+//	user:password@name(organization/dbname/branch)/dbname
+//
+// The driver's connections are tunneled by the client directly, without
+// going through the local listener, so the client doesn't need to be
+// running. They count towards MaxConnections and are waited for by Shutdown
+// like the connections accepted on the local address.
+func RegisterMySQLDialer(name string, client *Client) {
+	mysql.RegisterDialContext(name, client.Dial)
+}
@@ -0,0 +1,349 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// mysqlMaxPayloadLen is the largest payload a single MySQL packet can carry.
+// Larger payloads are split into packets of exactly this size, followed by a
+// shorter (possibly empty) one.
+const mysqlMaxPayloadLen = 1<<24 - 1
+
+const (
+	// erConCountError is the error code MySQL replies with instead of the
+	// greeting when it has too many connections.
+	erConCountError = 1040
+
+	// erNetPacketTooLarge is the error code MySQL replies with when a packet
+	// exceeds max_allowed_packet.
+	erNetPacketTooLarge = 1153
+
+	// erUserLimitReached is the error code MySQL replies with when a user
+	// exceeds one of its resource limits.
+	erUserLimitReached = 1226
+)
+
+// The capability flags of the handshake response of a client that change how
+// the rest of the stream is framed.
+const (
+	clientCompress         = 0x00000020
+	clientProtocol41       = 0x00000200
+	clientSSL              = 0x00000800
+	clientZstdCompression  = 0x04000000
+	clientUnframedSessions = clientCompress | clientSSL | clientZstdCompression
+)
+
+// PacketTooLargeError is returned when a local client sends a MySQL packet
+// bigger than Options.MaxPacketSize.
+type PacketTooLargeError struct {
+	// Size is the size of the payload received so far, including the
+	// declared length of the packet that crossed the limit.
+	Size uint64
+	// Max is the configured maximum packet size.
+	Max uint64
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("mysql packet of at least %d bytes exceeds the maximum packet size of %d bytes", e.Size, e.Max)
+}
+
+// packetFramer follows the MySQL packet boundaries of a stream without
+// buffering it: only the 4 byte headers are looked at, payloads are passed
+// through as they are.
+//
+// If the stream is a client's, its first packet is the handshake response.
+// Once it negotiates TLS or compression, the rest of the stream isn't made of
+// plain packets anymore, and the framer stops following it.
+type packetFramer struct {
+	max uint64 // zero means unlimited
+
+	header    [4]byte
+	headerLen int    // bytes of header read so far
+	remaining uint32 // payload bytes left in the current packet
+	total     uint64 // payload size of the current logical packet
+	continued bool   // the current packet is followed by a continuation
+
+	// handshake is set until the capability flags of the handshake response
+	// are read, caps holds the ones read so far.
+	handshake bool
+	caps      [4]byte
+	capsLen   int
+	// unframed is set once the client negotiated TLS or compression.
+	unframed bool
+}
+
+// scan advances the framer over data. It returns a *PacketTooLargeError and
+// the sequence id of the offending packet if a logical packet, continuations
+// included, exceeds the maximum size.
+func (f *packetFramer) scan(data []byte) (byte, error) {
+	for len(data) > 0 && !f.unframed {
+		if f.remaining > 0 {
+			n := uint32(len(data))
+			if n > f.remaining {
+				n = f.remaining
+			}
+			if f.handshake {
+				f.capsLen += copy(f.caps[f.capsLen:], data[:n])
+			}
+			f.remaining -= n
+			data = data[n:]
+			if f.handshake && (f.capsLen == len(f.caps) || f.remaining == 0) {
+				f.endHandshake()
+			}
+			continue
+		}
+
+		n := copy(f.header[f.headerLen:], data)
+		f.headerLen += n
+		data = data[n:]
+		if f.headerLen < len(f.header) {
+			break
+		}
+		f.headerLen = 0
+
+		length := uint32(f.header[0]) | uint32(f.header[1])<<8 | uint32(f.header[2])<<16
+		if !f.continued {
+			f.total = 0
+		}
+		f.total += uint64(length)
+		if f.max > 0 && f.total > f.max {
+			return f.header[3], &PacketTooLargeError{Size: f.total, Max: f.max}
+		}
+		f.continued = length == mysqlMaxPayloadLen
+		f.remaining = length
+		if f.handshake && length == 0 {
+			f.endHandshake()
+		}
+	}
+	return 0, nil
+}
+
+// endHandshake stops following the stream if the capability flags of the
+// handshake response negotiate TLS or compression. Before protocol 4.1, the
+// flags were only 2 bytes.
+func (f *packetFramer) endHandshake() {
+	f.handshake = false
+	if f.capsLen < 2 {
+		return
+	}
+	caps := uint32(binary.LittleEndian.Uint16(f.caps[:]))
+	if caps&clientProtocol41 != 0 && f.capsLen == len(f.caps) {
+		caps = binary.LittleEndian.Uint32(f.caps[:])
+	}
+	f.unframed = caps&clientUnframedSessions != 0
+}
+
+// atBoundary reports whether the stream is between two logical packets.
+func (f *packetFramer) atBoundary() bool {
+	return f.headerLen == 0 && f.remaining == 0 && !f.continued
+}
+
+// packetLimitConn enforces a maximum packet size on what is read from a
+// local client connection. Once a packet crosses the limit, an ERR packet is
+// sent back to the client and every read fails, which tears the tunnel down.
+// Once the client negotiated TLS or compression, its packets can't be
+// followed anymore and the limit isn't enforced.
+type packetLimitConn struct {
+	net.Conn
+
+	framer packetFramer
+	err    error
+	// unframed is set atomically with framer.unframed, it's read by the
+	// writers too.
+	unframed uint32
+
+	// writeMu serializes the writes to the client, written follows the
+	// packets relayed from the server so ERR packets go between them.
+	writeMu sync.Mutex
+	written packetFramer
+}
+
+func newPacketLimitConn(conn net.Conn, max uint64) *packetLimitConn {
+	return &packetLimitConn{Conn: conn, framer: packetFramer{max: max, handshake: true}}
+}
+
+func (c *packetLimitConn) Read(b []byte) (int, error) {
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	n, err := c.Conn.Read(b)
+	if n > 0 {
+		seq, ferr := c.framer.scan(b[:n])
+		if c.framer.unframed {
+			atomic.StoreUint32(&c.unframed, 1)
+		}
+		if ferr != nil {
+			c.err = ferr
+			c.writeError(seq+1, erNetPacketTooLarge, "08S01",
+				"Got a packet bigger than the proxy's maximum packet size")
+			return 0, ferr
+		}
+	}
+	return n, err
+}
+
+func (c *packetLimitConn) Write(b []byte) (int, error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	n, err := c.Conn.Write(b)
+	if atomic.LoadUint32(&c.unframed) == 0 {
+		c.written.scan(b[:n]) // nolint: errcheck, there's no limit
+	}
+	return n, err
+}
+
+// writeError writes an ERR packet with the given sequence id to the client,
+// best effort. It's dropped if the client couldn't make sense of it: once it
+// negotiated TLS or compression, or while a packet from the server is being
+// relayed to it.
+func (c *packetLimitConn) writeError(seq byte, code uint16, state, msg string) {
+	if atomic.LoadUint32(&c.unframed) != 0 || !c.writeMu.TryLock() {
+		return
+	}
+	defer c.writeMu.Unlock()
+
+	if c.written.atBoundary() {
+		// the client may not be reading anymore
+		_ = writeMySQLError(c.Conn, seq, code, state, msg)
+	}
+}
+
+// lastSeq returns the sequence id of the last packet header read from the
+// client.
+func (c *packetLimitConn) lastSeq() byte {
+	return c.framer.header[3]
+}
+
+func (c *packetLimitConn) CloseWrite() error { return closeWrite(c.Conn) }
+
+// writeMySQLError writes an ERR packet with the given sequence id to w.
+func writeMySQLError(w io.Writer, seq byte, code uint16, state, msg string) error {
+	payload := make([]byte, 0, 9+len(msg))
+	payload = append(payload, 0xff, byte(code), byte(code>>8), '#')
+	payload = append(payload, state...)
+	payload = append(payload, msg...)
+
+	n := len(payload)
+	_, err := w.Write(append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...))
+	return err
+}
+
+// maxGreetingSize bounds the payload of a server greeting that is parsed,
+// real greetings are around a hundred bytes.
+const maxGreetingSize = 1024
+
+// greetingTimeout bounds waiting for the greeting of a MySQL server, see
+// Options.ParseServerGreetings.
+const greetingTimeout = 10 * time.Second
+
+// serverGreeting holds the fields of the initial handshake packet of a MySQL
+// server that are useful to correlate a tunnel with the server side.
+type serverGreeting struct {
+	version      string
+	connectionID uint32
+	capabilities uint32
+}
+
+// parseServerGreeting parses the payload of a protocol version 10 initial
+// handshake packet.
+func parseServerGreeting(payload []byte) (*serverGreeting, error) {
+	if len(payload) == 0 {
+		return nil, errors.New("empty greeting")
+	}
+	switch payload[0] {
+	case 10:
+	case 0xff:
+		return nil, errors.New("server replied with an error instead of a greeting")
+	default:
+		return nil, fmt.Errorf("unsupported protocol version %d", payload[0])
+	}
+
+	rest := payload[1:]
+	end := bytes.IndexByte(rest, 0)
+	if end < 0 {
+		return nil, errors.New("unterminated server version")
+	}
+	g := &serverGreeting{version: string(rest[:end])}
+	rest = rest[end+1:]
+
+	// connection id, 8 bytes of auth data, a filler and the lower 2 bytes of
+	// the capability flags
+	if len(rest) < 15 {
+		return nil, errors.New("truncated greeting")
+	}
+	g.connectionID = binary.LittleEndian.Uint32(rest)
+	g.capabilities = uint32(binary.LittleEndian.Uint16(rest[13:]))
+	rest = rest[15:]
+
+	// character set and status flags, followed by the upper 2 bytes, which
+	// are optional
+	if len(rest) >= 5 {
+		g.capabilities |= uint32(binary.LittleEndian.Uint16(rest[3:])) << 16
+	}
+	return g, nil
+}
+
+// readServerGreeting reads the greeting of the MySQL server from conn, for
+// up to greetingTimeout. It returns the bytes read along with it, even if it
+// fails: they must be relayed to the client, see greetingConn.
+func readServerGreeting(ctx context.Context, conn net.Conn) (_ *serverGreeting, raw []byte, err error) {
+	deadline := time.Now().Add(greetingTimeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	if err := conn.SetReadDeadline(deadline); err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		if derr := conn.SetReadDeadline(time.Time{}); derr != nil && err == nil {
+			err = derr
+		}
+	}()
+
+	raw = make([]byte, 4, 4+maxGreetingSize)
+	n, err := io.ReadFull(conn, raw)
+	if err != nil {
+		return nil, raw[:n], err
+	}
+	size := int(raw[0]) | int(raw[1])<<8 | int(raw[2])<<16
+	if size > maxGreetingSize {
+		return nil, raw, fmt.Errorf("greeting of %d bytes exceeds %d bytes", size, maxGreetingSize)
+	}
+
+	raw = raw[:4+size]
+	n, err = io.ReadFull(conn, raw[4:])
+	if err != nil {
+		return nil, raw[:4+n], err
+	}
+	g, err := parseServerGreeting(raw[4:])
+	return g, raw, err
+}
+
+// greetingConn relays the bytes read by readServerGreeting before the rest of
+// the remote connection.
+type greetingConn struct {
+	net.Conn
+	greeting []byte
+}
+
+func (c *greetingConn) Read(b []byte) (int, error) {
+	if len(c.greeting) > 0 {
+		n := copy(b, c.greeting)
+		c.greeting = c.greeting[n:]
+		return n, nil
+	}
+	return c.Conn.Read(b)
+}
+
+func (c *greetingConn) CloseWrite() error { return closeWrite(c.Conn) }
@@ -0,0 +1,586 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+)
+
+// mysqlPacket returns a packet header for a payload of n bytes followed by
+// the payload, or just the header if the payload is omitted.
+func mysqlPacket(seq byte, n int, payload ...byte) []byte {
+	return append([]byte{byte(n), byte(n >> 8), byte(n >> 16), seq}, payload...)
+}
+
+func TestPacketFramer(t *testing.T) {
+	tests := []struct {
+		name      string
+		max       uint64
+		handshake bool
+		data      [][]byte
+		wantErr   string
+		wantSeq   byte
+	}{
+		{
+			name: "packets within the limit",
+			max:  4,
+			data: [][]byte{mysqlPacket(0, 4, 1, 2, 3, 4), mysqlPacket(1, 0), mysqlPacket(2, 1, 9)},
+		},
+		{
+			name:    "packet over the limit",
+			max:     4,
+			data:    [][]byte{mysqlPacket(0, 1, 1), mysqlPacket(3, 5)},
+			wantErr: "mysql packet of at least 5 bytes exceeds the maximum packet size of 4 bytes",
+			wantSeq: 3,
+		},
+		{
+			name:    "largest declared length",
+			max:     1 << 20,
+			data:    [][]byte{{0xff, 0xff, 0xff, 7}},
+			wantErr: "mysql packet of at least 16777215 bytes exceeds the maximum packet size of 1048576 bytes",
+			wantSeq: 7,
+		},
+		{
+			name: "truncated header",
+			max:  4,
+			data: [][]byte{{5, 0}},
+		},
+		{
+			name: "truncated payload",
+			max:  4,
+			data: [][]byte{mysqlPacket(0, 4, 1, 2)},
+		},
+		{
+			name: "continuation within the limit",
+			max:  mysqlMaxPayloadLen + 10,
+			data: [][]byte{
+				mysqlPacket(0, mysqlMaxPayloadLen), make([]byte, mysqlMaxPayloadLen),
+				mysqlPacket(1, 10), make([]byte, 10),
+				mysqlPacket(2, 10), make([]byte, 10),
+			},
+		},
+		{
+			name: "continuation with an empty last packet",
+			max:  mysqlMaxPayloadLen,
+			data: [][]byte{
+				mysqlPacket(0, mysqlMaxPayloadLen), make([]byte, mysqlMaxPayloadLen),
+				mysqlPacket(1, 0),
+				mysqlPacket(2, 1, 1),
+			},
+		},
+		{
+			name: "continuation over the limit",
+			max:  mysqlMaxPayloadLen + 10,
+			data: [][]byte{
+				mysqlPacket(0, mysqlMaxPayloadLen), make([]byte, mysqlMaxPayloadLen),
+				mysqlPacket(1, mysqlMaxPayloadLen),
+			},
+			wantErr: "mysql packet of at least 33554430 bytes exceeds the maximum packet size of 16777225 bytes",
+			wantSeq: 1,
+		},
+		{
+			name:      "handshake response keeps framing",
+			max:       8,
+			handshake: true,
+			data:      [][]byte{mysqlPacket(1, 6, 0x00, 0x02, 0x00, 0x00, 0, 0), mysqlPacket(0, 9)},
+			wantErr:   "mysql packet of at least 9 bytes exceeds the maximum packet size of 8 bytes",
+			wantSeq:   0,
+		},
+		{
+			name:      "ssl request stops framing",
+			max:       8,
+			handshake: true,
+			// the TLS handshake follows
+			data: [][]byte{mysqlPacket(1, 4, 0x00, 0x0a, 0x00, 0x00), {0x16, 0x03, 0x01, 0xff, 0xff}},
+		},
+		{
+			name:      "compression stops framing",
+			max:       8,
+			handshake: true,
+			// compressed packets have 7 byte headers
+			data: [][]byte{mysqlPacket(1, 6, 0x20, 0x02, 0x00, 0x00, 0, 0), {9, 0, 0, 0, 0, 0, 0}, make([]byte, 9)},
+		},
+		{
+			name:      "zstd compression stops framing",
+			max:       8,
+			handshake: true,
+			data:      [][]byte{mysqlPacket(1, 4, 0x00, 0x02, 0x00, 0x04), {9, 0, 0, 0, 0, 0, 0}, make([]byte, 9)},
+		},
+		{
+			name:      "pre 4.1 compression stops framing",
+			max:       8,
+			handshake: true,
+			data:      [][]byte{mysqlPacket(1, 2, 0x20, 0x00), {9, 0, 0, 0, 0, 0, 0}, make([]byte, 9)},
+		},
+		{
+			name:      "pre 4.1 flags ignore the next bytes",
+			max:       8,
+			handshake: true,
+			data:      [][]byte{mysqlPacket(1, 4, 0x00, 0x00, 0x00, 0x04), mysqlPacket(2, 9)},
+			wantErr:   "mysql packet of at least 9 bytes exceeds the maximum packet size of 8 bytes",
+			wantSeq:   2,
+		},
+		{
+			name:      "empty handshake response",
+			max:       8,
+			handshake: true,
+			data:      [][]byte{mysqlPacket(1, 0), mysqlPacket(2, 2, 0x20, 0x08), mysqlPacket(3, 9)},
+			wantErr:   "mysql packet of at least 9 bytes exceeds the maximum packet size of 8 bytes",
+			wantSeq:   3,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			// feed the stream in one go and one byte at a time, framing
+			// must not depend on how it's split
+			stream := bytes.Join(tt.data, nil)
+			for _, chunk := range []int{len(stream), 1} {
+				f := &packetFramer{max: tt.max, handshake: tt.handshake}
+				var (
+					seq byte
+					err error
+				)
+				for i := 0; i < len(stream) && err == nil; i += chunk {
+					end := i + chunk
+					if end > len(stream) {
+						end = len(stream)
+					}
+					seq, err = f.scan(stream[i:end])
+				}
+
+				if tt.wantErr == "" {
+					c.Assert(err, qt.IsNil)
+					continue
+				}
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				var tooLarge *PacketTooLargeError
+				c.Assert(errors.As(err, &tooLarge), qt.IsTrue)
+				c.Assert(tooLarge.Max, qt.Equals, tt.max)
+				c.Assert(seq, qt.Equals, tt.wantSeq)
+			}
+		})
+	}
+}
+
+func TestPacketLimitConn(t *testing.T) {
+	c := qt.New(t)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	conn := newPacketLimitConn(server, 8)
+
+	go func() {
+		client.Write(mysqlPacket(0, 2, 1, 2)) // nolint: errcheck
+		client.Write(mysqlPacket(1, 1024, 1)) // nolint: errcheck
+	}()
+
+	buf := make([]byte, 6)
+	_, err := io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(buf, qt.DeepEquals, mysqlPacket(0, 2, 1, 2))
+
+	errc := make(chan error, 1)
+	go func() {
+		_, err := conn.Read(buf)
+		errc <- err
+	}()
+
+	seq, payload, err := readMySQLPacket(client)
+	c.Assert(err, qt.IsNil)
+	c.Assert(seq, qt.Equals, byte(2))
+	c.Assert(payload[0], qt.Equals, byte(0xff))
+	c.Assert(payload[1:3], qt.DeepEquals, []byte{0x81, 0x04}) // 1153
+	c.Assert(string(payload[3:9]), qt.Equals, "#08S01")
+
+	err = <-errc
+	c.Assert(err, qt.ErrorMatches, "mysql packet of at least 1024 bytes exceeds the maximum packet size of 8 bytes")
+
+	// the connection stays unusable
+	_, err = conn.Read(buf)
+	c.Assert(err, qt.ErrorMatches, "mysql packet .*")
+}
+
+// bufferConn is a net.Conn reading from r and writing to w.
+type bufferConn struct {
+	net.Conn
+	r io.Reader
+	w io.Writer
+}
+
+func (c *bufferConn) Read(b []byte) (int, error)  { return c.r.Read(b) }
+func (c *bufferConn) Write(b []byte) (int, error) { return c.w.Write(b) }
+
+func TestPacketLimitConn_WriteError(t *testing.T) {
+	c := qt.New(t)
+
+	var out bytes.Buffer
+	conn := newPacketLimitConn(&bufferConn{r: bytes.NewReader(nil), w: &out}, 8)
+
+	// nothing is written while a packet from the server is being relayed
+	_, err := conn.Write(mysqlPacket(1, 4, 1, 2))
+	c.Assert(err, qt.IsNil)
+	conn.writeError(2, erUserLimitReached, "42000", "quota")
+	c.Assert(out.Bytes(), qt.DeepEquals, mysqlPacket(1, 4, 1, 2))
+
+	// but in between the packets
+	_, err = conn.Write([]byte{3, 4})
+	c.Assert(err, qt.IsNil)
+	out.Reset()
+	conn.writeError(2, erUserLimitReached, "42000", "quota")
+	seq, payload, err := readMySQLPacket(&out)
+	c.Assert(err, qt.IsNil)
+	c.Assert(seq, qt.Equals, byte(2))
+	c.Assert(payload[:3], qt.DeepEquals, []byte{0xff, erUserLimitReached & 0xff, erUserLimitReached >> 8})
+
+	// nor while another write is pending
+	conn.writeMu.Lock()
+	conn.writeError(2, erUserLimitReached, "42000", "quota")
+	conn.writeMu.Unlock()
+	c.Assert(out.Len(), qt.Equals, 0)
+}
+
+func TestPacketLimitConn_SSLRequest(t *testing.T) {
+	c := qt.New(t)
+
+	// an SSLRequest followed by a TLS record bigger than the limit
+	in := bytes.NewReader(append(mysqlPacket(1, 4, 0x00, 0x0a, 0x00, 0x00), 0x16, 0x03, 0x01, 0xff, 0xff))
+	var out bytes.Buffer
+	conn := newPacketLimitConn(&bufferConn{r: in, w: &out}, 8)
+
+	got, err := io.ReadAll(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.HasLen, 13)
+
+	// the client expects TLS records, not an ERR packet
+	conn.writeError(2, erUserLimitReached, "42000", "quota")
+	c.Assert(out.Len(), qt.Equals, 0)
+}
+
+func TestClient_MaxPacketSize(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.MaxPacketSize = 16
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	err = writeMySQLPacket(conn, 0, []byte("SELECT 1"))
+	c.Assert(err, qt.IsNil)
+	_, payload, err := readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(payload), qt.Equals, "SELECT 1")
+
+	err = writeMySQLPacket(conn, 0, bytes.Repeat([]byte("x"), 17))
+	c.Assert(err, qt.IsNil)
+	seq, payload, err := readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(seq, qt.Equals, byte(1))
+	c.Assert(payload[0], qt.Equals, byte(0xff))
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+}
+
+func TestClient_MaxPacketSize_Compressed(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.MaxPacketSize = 16
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// a handshake response with CLIENT_PROTOCOL_41 and CLIENT_COMPRESS
+	err = writeMySQLPacket(conn, 1, []byte{0x20, 0x02, 0x00, 0x00})
+	c.Assert(err, qt.IsNil)
+	_, _, err = readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+
+	// a compressed packet, its 7 byte header isn't mistaken for a packet
+	// over the limit
+	compressed := append([]byte{32, 0, 0, 0, 0, 0, 0}, bytes.Repeat([]byte("x"), 32)...)
+	_, err = conn.Write(compressed)
+	c.Assert(err, qt.IsNil)
+	got := make([]byte, len(compressed))
+	_, err = io.ReadFull(conn, got)
+	c.Assert(err, qt.IsNil)
+	c.Assert(got, qt.DeepEquals, compressed)
+}
+
+func TestClient_MaxBytesPerConnection_MySQL(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.MaxPacketSize = 1024
+	testOpts.MaxBytesPerConnection = 40
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// 12 bytes each way
+	err = writeMySQLPacket(conn, 0, []byte("SELECT 1"))
+	c.Assert(err, qt.IsNil)
+	_, _, err = readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+
+	// the next command crosses the quota
+	err = writeMySQLPacket(conn, 0, bytes.Repeat([]byte("x"), 16))
+	c.Assert(err, qt.IsNil)
+	seq, payload, err := readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(seq, qt.Equals, byte(1))
+	c.Assert(payload[:3], qt.DeepEquals, []byte{0xff, erUserLimitReached & 0xff, erUserLimitReached >> 8})
+
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(client.Stats().QuotaExceeded, qt.Equals, uint64(1))
+}
+
+func TestParseServerGreeting(t *testing.T) {
+	c := qt.New(t)
+
+	g, err := parseServerGreeting(testGreeting())
+	c.Assert(err, qt.IsNil)
+	c.Assert(*g, qt.Equals, serverGreeting{version: "8.0.0-test", connectionID: 1, capabilities: 0x00088200})
+
+	// old servers don't send the upper capability flags
+	short := append([]byte{10}, "5.0.1\x00"...)
+	short = append(short, 0x2a, 0x01, 0, 0, 'a', 'b', 'c', 'd', 'e', 'f', 'g', 'h', 0, 0x2c, 0x82)
+	g, err = parseServerGreeting(short)
+	c.Assert(err, qt.IsNil)
+	c.Assert(*g, qt.Equals, serverGreeting{version: "5.0.1", connectionID: 298, capabilities: 0x822c})
+
+	tests := []struct {
+		payload []byte
+		err     string
+	}{
+		{nil, "empty greeting"},
+		{[]byte{0xff, 0x10, 0x04, '#'}, "server replied with an error instead of a greeting"},
+		{[]byte{9, '4', '.', '0'}, "unsupported protocol version 9"},
+		{[]byte{10, '8', '.', '0'}, "unterminated server version"},
+		{[]byte{10, '8', 0, 1, 0, 0, 0}, "truncated greeting"},
+	}
+	for _, tt := range tests {
+		_, err := parseServerGreeting(tt.payload)
+		c.Assert(err, qt.ErrorMatches, tt.err, qt.Commentf("payload %q", tt.payload))
+	}
+}
+
+func TestReadServerGreeting(t *testing.T) {
+	tests := []struct {
+		name    string
+		data    []byte
+		stall   bool
+		version string
+		err     string
+	}{
+		{
+			name:    "greeting",
+			data:    mysqlPacket(0, len(testGreeting()), testGreeting()...),
+			version: "8.0.0-test",
+		},
+		{
+			name: "error packet",
+			data: mysqlPacket(0, 9, 0xff, 0x10, 0x04, '#', '0', '8', '0', '0', '4'),
+			err:  "server replied with an error instead of a greeting",
+		},
+		{
+			name: "too large",
+			data: mysqlPacket(0, 2048),
+			err:  "greeting of 2048 bytes exceeds 1024 bytes",
+		},
+		{
+			name:  "no greeting",
+			data:  []byte("not"),
+			stall: true,
+			err:   ".*i/o timeout",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			local, remote := net.Pipe()
+			defer local.Close()
+			go func() {
+				// one byte at a time, the greeting spans several reads
+				for _, b := range tt.data {
+					if _, err := remote.Write([]byte{b}); err != nil {
+						return
+					}
+				}
+				if !tt.stall {
+					remote.Write([]byte("more data")) // nolint: errcheck
+					remote.Close()
+				}
+			}()
+			defer remote.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			g, raw, err := readServerGreeting(ctx, local)
+			c.Assert(raw, qt.DeepEquals, tt.data)
+			if tt.err != "" {
+				c.Assert(g, qt.IsNil)
+				c.Assert(err, qt.ErrorMatches, tt.err)
+			} else {
+				c.Assert(err, qt.IsNil)
+				c.Assert(g.version, qt.Equals, tt.version)
+			}
+			if tt.stall {
+				return
+			}
+
+			// the bytes read are relayed before the rest of the connection
+			got, err := io.ReadAll(&greetingConn{Conn: local, greeting: raw})
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.DeepEquals, append(tt.data, "more data"...))
+		})
+	}
+}
+
+func TestClient_ServerGreeting(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.RemoteAddr = startPlaintextBackend(t, mysqlHandler)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.ParseServerGreetings = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	_, payload, err := readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(payload, qt.DeepEquals, testGreeting())
+
+	conns := client.Connections()
+	c.Assert(conns, qt.HasLen, 1)
+	c.Assert(conns[0].ServerVersion, qt.Equals, "8.0.0-test")
+	c.Assert(conns[0].ConnectionID, qt.Equals, uint32(1))
+
+	var dump bytes.Buffer
+	c.Assert(client.DumpState(&dump), qt.IsNil)
+	c.Assert(dump.String(), qt.Matches, `(?s).*oldest connections:\n  local/db/main: client .*, server 8\.0\.0-test, connection id 1\n.*`)
+
+	// COM_QUIT
+	err = writeMySQLPacket(conn, 0, []byte{0x01})
+	c.Assert(err, qt.IsNil)
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	// the server's close is passed on as a half-close, the client closes
+	// its side once it sees it
+	conn.Close()
+
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventDisconnect {
+				continue
+			}
+			c.Assert(e.ServerVersion, qt.Equals, "8.0.0-test")
+			c.Assert(e.ConnectionID, qt.Equals, uint32(1))
+		case <-time.After(5 * time.Second):
+			c.Fatal("no disconnect event")
+		}
+		break
+	}
+
+	c.Assert(client.Stats().ServerVersions, qt.DeepEquals, map[string]uint64{"8.0.0-test": 1})
+	c.Assert(client.metrics(), qt.Any(qt.CmpEquals(cmp.AllowUnexported(metric{}))), metric{
+		name:  "mysql_server_connections_total",
+		kind:  metricCounter,
+		value: 1,
+		tags:  []string{"server_version:8.0.0-test"},
+	})
+}
+
+func TestClient_ServerGreeting_Hooks(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, mysqlHandler)
+
+	recorder := &hookRecorder{}
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.ParseServerGreetings = true
+	recorder.setHooks(&testOpts)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	// the greeting was read before the handshake hook, and is still relayed
+	_, payload, err := readMySQLPacket(conn)
+	c.Assert(err, qt.IsNil)
+	c.Assert(payload, qt.DeepEquals, testGreeting())
+	conn.Close()
+
+	c.Assert(recorder.recorded(), qt.DeepEquals, []string{"connect", "handshake", "close"})
+	c.Assert(recorder.infos[0].ServerVersion, qt.Equals, "")
+	for _, info := range recorder.infos[1:] {
+		c.Assert(info.ServerVersion, qt.Equals, "8.0.0-test")
+		c.Assert(info.ConnectionID, qt.Equals, uint32(1))
+	}
+}
+
+func TestClient_MaxPacketSize_Negative(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.MaxPacketSize = -1
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "MaxPacketSize must not be negative")
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"sync/atomic"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/go-sql-driver/mysql"
+)
+
+func TestRegisterMySQLDialer(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, mysqlHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+
+	RegisterMySQLDialer("proxytest", client)
+
+	db, err := sql.Open("mysql", "root:secret@proxytest(myorg/mydb/mybranch)/mydb")
+	c.Assert(err, qt.IsNil)
+
+	ctx := context.Background()
+	err = db.PingContext(ctx)
+	c.Assert(err, qt.IsNil)
+
+	_, err = db.ExecContext(ctx, "DELETE FROM users")
+	c.Assert(err, qt.IsNil)
+
+	// the idle connection of the pool is still tunneled
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(1))
+	c.Assert(client.conns, qt.HasLen, 1)
+
+	err = db.Close()
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(atomic.LoadUint64(&client.connectionsCounter), qt.Equals, uint64(0))
+	c.Assert(client.conns, qt.HasLen, 0)
+
+	var types []EventType
+	for len(events) > 0 {
+		e := <-events
+		types = append(types, e.Type)
+		if e.Type == EventDisconnect {
+			c.Assert(e.Instance, qt.Equals, "myorg/mydb/mybranch")
+			c.Assert(e.BytesIn > 0, qt.IsTrue)
+			c.Assert(e.BytesOut > 0, qt.IsTrue)
+		}
+	}
+	c.Assert(types, qt.DeepEquals, []EventType{EventCertRefresh, EventConnect, EventDisconnect})
+}
+
+func TestRegisterMySQLDialer_MaxConnections(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, mysqlHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.MaxConnections = 1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	RegisterMySQLDialer("proxytest-max", client)
+
+	db, err := sql.Open("mysql", "root:secret@proxytest-max(myorg/mydb/mybranch)/mydb")
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+
+	ctx := context.Background()
+	conn1, err := db.Conn(ctx)
+	c.Assert(err, qt.IsNil)
+	defer conn1.Close()
+
+	_, err = db.Conn(ctx)
+	c.Assert(err, qt.ErrorMatches, `.*too many open connections \(max 1\)`)
+}
+
+func TestClient_ProtocolAwareErrors(t *testing.T) {
+	tests := []struct {
+		name                string
+		protocolAwareErrors bool
+		instanceLimit       bool
+	}{
+		{name: "MaxConnections", protocolAwareErrors: true},
+		{name: "instance MaxConnections", protocolAwareErrors: true, instanceLimit: true},
+		{name: "disabled"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			testOpts := testOptions(t)
+			testOpts.InsecureRemotePlaintext = true
+			testOpts.ProtocolAwareErrors = tt.protocolAwareErrors
+			if tt.instanceLimit {
+				testOpts.Instances = []InstanceConfig{{
+					Instance:       "local/db/main",
+					LocalAddr:      "127.0.0.1:0",
+					RemoteAddr:     startPlaintextBackend(t, mysqlHandler),
+					MaxConnections: 1,
+				}}
+			} else {
+				testOpts.LocalAddr = "127.0.0.1:0"
+				testOpts.Instance = "local/db/main"
+				testOpts.RemoteAddr = startPlaintextBackend(t, mysqlHandler)
+				testOpts.MaxConnections = 1
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+			startClient(t, client)
+
+			db, err := sql.Open("mysql", "root:secret@tcp("+client.currentListener().Addr().String()+")/mydb")
+			c.Assert(err, qt.IsNil)
+			defer db.Close()
+
+			ctx := context.Background()
+			conn1, err := db.Conn(ctx)
+			c.Assert(err, qt.IsNil)
+			defer conn1.Close()
+
+			_, err = db.Conn(ctx)
+			c.Assert(err, qt.Not(qt.IsNil))
+			var mysqlErr *mysql.MySQLError
+			if !tt.protocolAwareErrors {
+				c.Assert(errors.As(err, &mysqlErr), qt.IsFalse)
+				return
+			}
+			c.Assert(errors.As(err, &mysqlErr), qt.IsTrue, qt.Commentf("%v", err))
+			c.Assert(mysqlErr.Number, qt.Equals, uint16(1040))
+			c.Assert(mysqlErr.Message, qt.Equals, "Too many connections")
+		})
+	}
+}
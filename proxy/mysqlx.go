@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	// xServerMessageError is the type of the Mysqlx.Error messages sent by
+	// the server.
+	xServerMessageError = 1
+
+	// xSeverityFatal is the severity of an error after which the server
+	// closes the connection.
+	xSeverityFatal = 1
+)
+
+// writeXError writes a fatal Mysqlx.Error message to w, the X Protocol
+// equivalent of the ERR packet of the classic protocol.
+func writeXError(w io.Writer, code uint32, state, msg string) error {
+	// the message is a protocol buffer, small enough to encode by hand:
+	// severity = 1, code = 2, msg = 3, sql_state = 4.
+	payload := make([]byte, 0, 16+len(msg)+len(state))
+	payload = append(payload, xServerMessageError)
+	payload = appendXVarint(payload, 1<<3, xSeverityFatal)
+	payload = appendXVarint(payload, 2<<3, uint64(code))
+	payload = appendXBytes(payload, 3<<3|2, msg)
+	payload = appendXBytes(payload, 4<<3|2, state)
+
+	header := make([]byte, 4)
+	binary.LittleEndian.PutUint32(header, uint32(len(payload)))
+	_, err := w.Write(append(header, payload...))
+	return err
+}
+
+// appendXVarint appends a varint field with the given tag to b.
+func appendXVarint(b []byte, tag byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	b = append(b, tag)
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// appendXBytes appends a length-delimited field with the given tag to b.
+func appendXBytes(b []byte, tag byte, s string) []byte {
+	b = appendXVarint(b, tag, uint64(len(s)))
+	return append(b, s...)
+}
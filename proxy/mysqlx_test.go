@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"bytes"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestWriteXError(t *testing.T) {
+	c := qt.New(t)
+
+	var buf bytes.Buffer
+	err := writeXError(&buf, erConCountError, "08004", "Too many connections")
+	c.Assert(err, qt.IsNil)
+
+	want := []byte{
+		35, 0, 0, 0, // length of the type and the payload
+		xServerMessageError,
+		0x08, 1, // severity: FATAL
+		0x10, 0x90, 0x08, // code: 1040
+		0x1a, 20, 'T', 'o', 'o', ' ', 'm', 'a', 'n', 'y', ' ',
+		'c', 'o', 'n', 'n', 'e', 'c', 't', 'i', 'o', 'n', 's', // msg
+		0x22, 5, '0', '8', '0', '0', '4', // sql_state
+	}
+	c.Assert(buf.Bytes(), qt.DeepEquals, want)
+}
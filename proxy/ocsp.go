@@ -0,0 +1,123 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ocsp"
+)
+
+// OCSPStaplePolicy tells whether the OCSP responses stapled by the remote
+// servers are verified, and what to do when a server staples none.
+type OCSPStaplePolicy string
+
+const (
+	// OCSPStapleAllow verifies the stapled responses and accepts the
+	// servers stapling none.
+	OCSPStapleAllow OCSPStaplePolicy = "allow"
+	// OCSPStapleWarn verifies the stapled responses and logs a warning for
+	// the servers stapling none.
+	OCSPStapleWarn OCSPStaplePolicy = "warn"
+	// OCSPStapleFail verifies the stapled responses and rejects the servers
+	// stapling none.
+	OCSPStapleFail OCSPStaplePolicy = "fail"
+)
+
+var (
+	// errNoOCSPStaple is returned when the remote server stapled no OCSP
+	// response and OCSPStapling is OCSPStapleFail.
+	errNoOCSPStaple = errors.New("no stapled OCSP response")
+	// errOCSPStatus is returned when the stapled OCSP response doesn't tell
+	// that the certificate of the remote server is good.
+	errOCSPStatus = errors.New("OCSP status is not good")
+)
+
+// ocspStatusNames are the names of the OCSP statuses, for the errors.
+var ocspStatusNames = map[int]string{
+	ocsp.Good:    "good",
+	ocsp.Revoked: "revoked",
+	ocsp.Unknown: "unknown",
+}
+
+// verifyOCSPStaple returns the function verifying the OCSP response stapled
+// by the remote server of the given instance, called by crypto/tls once the
+// certificate of the server was verified, resumed sessions included. The
+// response must be signed by the issuer of the certificate, or a responder
+// it delegated to, tell it's good and be within its validity window.
+// issuers are the certificates the issuer is looked for among, on top of
+// the ones the server presented.
+func (c *Client) verifyOCSPStaple(instance string, issuers []*x509.Certificate) func(tls.ConnectionState) error {
+	policy := c.ocspStapling
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return fmt.Errorf("%w: no peer certificates", errPeerRejected)
+		}
+		leaf := state.PeerCertificates[0]
+
+		if len(state.OCSPResponse) == 0 {
+			switch policy {
+			case OCSPStapleFail:
+				return &peerRejectedError{cert: leaf, err: errNoOCSPStaple}
+			case OCSPStapleWarn:
+				c.log.Warn("remote server stapled no OCSP response, its revocation isn't checked",
+					zap.String("instance", instance))
+			}
+			return nil
+		}
+
+		issuer := findIssuer(leaf, append(state.PeerCertificates[1:len(state.PeerCertificates):len(state.PeerCertificates)], issuers...))
+		if issuer == nil {
+			return &peerRejectedError{cert: leaf, err: errors.New("couldn't find the issuer to verify the stapled OCSP response against")}
+		}
+
+		resp, err := ocsp.ParseResponseForCert(state.OCSPResponse, leaf, issuer)
+		if err != nil {
+			return &peerRejectedError{cert: leaf, err: fmt.Errorf("invalid stapled OCSP response: %w", err)}
+		}
+		if err := checkOCSPResponse(resp, time.Now()); err != nil {
+			return &peerRejectedError{cert: leaf, err: err}
+		}
+
+		c.log.Debug("verified stapled OCSP response",
+			zap.String("instance", instance),
+			zap.Time("this_update", resp.ThisUpdate),
+			zap.Time("next_update", resp.NextUpdate))
+		return nil
+	}
+}
+
+// checkOCSPResponse checks that the given verified OCSP response tells the
+// certificate is good at the given time.
+func checkOCSPResponse(resp *ocsp.Response, now time.Time) error {
+	switch resp.Status {
+	case ocsp.Good:
+	case ocsp.Revoked:
+		return fmt.Errorf("%w: revoked on %s by the stapled OCSP response",
+			errCertRevoked, resp.RevokedAt.Format(time.RFC3339))
+	default:
+		return fmt.Errorf("%w: %s", errOCSPStatus, ocspStatusNames[resp.Status])
+	}
+
+	if now.Before(resp.ThisUpdate) {
+		return fmt.Errorf("stapled OCSP response isn't valid before %s", resp.ThisUpdate.Format(time.RFC3339))
+	}
+	if !resp.NextUpdate.IsZero() && now.After(resp.NextUpdate) {
+		return fmt.Errorf("stapled OCSP response expired at %s", resp.NextUpdate.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// findIssuer returns the certificate among the given ones that signed cert,
+// nil if there is none.
+func findIssuer(cert *x509.Certificate, candidates []*x509.Certificate) *x509.Certificate {
+	for _, candidate := range candidates {
+		if cert.CheckSignatureFrom(candidate) == nil {
+			return candidate
+		}
+	}
+	return nil
+}
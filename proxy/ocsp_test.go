@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+	"golang.org/x/crypto/ocsp"
+)
+
+// ocspStaple returns an OCSP response of the CA for the leaf of the given
+// certificate, with the given status, valid until nextUpdate.
+func (ca *testCA) ocspStaple(t testing.TB, cert tls.Certificate, status int, nextUpdate time.Time) []byte {
+	t.Helper()
+
+	resp, err := ocsp.CreateResponse(ca.cert, ca.cert, ocsp.Response{
+		Status:       status,
+		SerialNumber: cert.Leaf.SerialNumber,
+		ThisUpdate:   time.Now().Add(-time.Hour),
+		NextUpdate:   nextUpdate,
+		RevokedAt:    time.Now().Add(-time.Hour),
+	}, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+func TestClient_OCSPStapling(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.serverCert(t, 42)
+	nextUpdate := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		policy   OCSPStaplePolicy
+		staple   []byte
+		wantErr  error
+		wantWarn bool
+	}{
+		{
+			name:   "good",
+			policy: OCSPStapleFail,
+			staple: ca.ocspStaple(t, serverCert, ocsp.Good, nextUpdate),
+		},
+		{
+			name:    "revoked",
+			policy:  OCSPStapleAllow,
+			staple:  ca.ocspStaple(t, serverCert, ocsp.Revoked, nextUpdate),
+			wantErr: errCertRevoked,
+		},
+		{
+			name:    "unknown",
+			policy:  OCSPStapleAllow,
+			staple:  ca.ocspStaple(t, serverCert, ocsp.Unknown, nextUpdate),
+			wantErr: errOCSPStatus,
+		},
+		{
+			name:    "expired",
+			policy:  OCSPStapleAllow,
+			staple:  ca.ocspStaple(t, serverCert, ocsp.Good, time.Now().Add(-time.Minute)),
+			wantErr: errPeerRejected,
+		},
+		{
+			name:    "signed by another CA",
+			policy:  OCSPStapleAllow,
+			staple:  newNamedTestCA(t, "Test CA").ocspStaple(t, serverCert, ocsp.Good, nextUpdate),
+			wantErr: errPeerRejected,
+		},
+		{
+			name:    "missing and required",
+			policy:  OCSPStapleFail,
+			wantErr: errNoOCSPStaple,
+		},
+		{
+			name:     "missing and warned about",
+			policy:   OCSPStapleWarn,
+			wantWarn: true,
+		},
+		{
+			name:   "missing and allowed",
+			policy: OCSPStapleAllow,
+		},
+		{
+			name:   "not verified",
+			staple: ca.ocspStaple(t, serverCert, ocsp.Revoked, nextUpdate),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			cert := serverCert
+			cert.OCSPStaple = tt.staple
+			addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{cert}}, echoHandler)
+
+			core, logs := observer.New(zap.WarnLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.SetupRetries = 0
+			testOpts.OCSPStapling = tt.policy
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr == nil {
+				c.Assert(err, qt.IsNil)
+				conn.Close()
+			} else {
+				c.Assert(errors.Is(err, tt.wantErr), qt.IsTrue, qt.Commentf("error: %v", err))
+				c.Assert(errors.Is(err, errPeerRejected), qt.IsTrue)
+			}
+
+			warnings := logs.FilterMessage("remote server stapled no OCSP response, its revocation isn't checked").Len()
+			c.Assert(warnings > 0, qt.Equals, tt.wantWarn)
+		})
+	}
+}
+
+func TestClient_OCSPStapling_Revoked(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	// the server never gets the data of a client whose tunnel is rejected
+	var received int64
+	cert := ca.serverCert(t, 42)
+	cert.OCSPStaple = ca.ocspStaple(t, cert, ocsp.Revoked, time.Now().Add(time.Hour))
+	addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{cert}}, func(conn net.Conn) {
+		n, _ := io.Copy(io.Discard, conn)
+		atomic.AddInt64(&received, n)
+	})
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "myorg/mydb/mybranch"
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.SetupRetries = 0
+	testOpts.OCSPStapling = OCSPStapleAllow
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	localAddr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	// the unread ping may reset the connection rather than close it
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Not(qt.IsNil))
+	c.Assert(errors.Is(err, os.ErrDeadlineExceeded), qt.IsFalse)
+	c.Assert(atomic.LoadInt64(&received), qt.Equals, int64(0))
+}
+
+func TestNewClient_OCSPStapling(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.OCSPStapling = "strict"
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `OCSPStapling must be "allow", "warn" or "fail", got "strict"`)
+}
@@ -0,0 +1,41 @@
+package proxy
+
+import (
+	"net"
+
+	"go.uber.org/zap"
+)
+
+// allowPeer reports whether the peer of the given unix socket connection is
+// allowed to connect, based on the configured allowed UIDs and GIDs. A peer
+// is allowed if either its UID or its GID is allowed. Rejections are logged
+// to the given logger of the connection.
+func (c *Client) allowPeer(log *zap.Logger, conn net.Conn) bool {
+	if len(c.allowedPeerUIDs) == 0 && len(c.allowedPeerGIDs) == 0 {
+		return true
+	}
+
+	uid, gid, err := peerCredentials(conn)
+	if err != nil {
+		log.Error("couldn't retrieve peer credentials, rejecting connection", zap.Error(err))
+		return false
+	}
+
+	for _, allowed := range c.allowedPeerUIDs {
+		if uid == allowed {
+			return true
+		}
+	}
+
+	for _, allowed := range c.allowedPeerGIDs {
+		if gid == allowed {
+			return true
+		}
+	}
+
+	log.Warn("rejected connection from unauthorized peer",
+		zap.Uint32("peer_uid", uid),
+		zap.Uint32("peer_gid", gid),
+	)
+	return false
+}
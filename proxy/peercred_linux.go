@@ -0,0 +1,39 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentialsSupported reports whether peer credentials of unix socket
+// connections can be retrieved on this platform.
+const peerCredentialsSupported = true
+
+// peerCredentials returns the UID and GID of the process on the other side of
+// the given unix socket connection, via SO_PEERCRED.
+func peerCredentials(conn net.Conn) (uid, gid uint32, err error) {
+	uc, ok := conn.(*net.UnixConn)
+	if !ok {
+		return 0, 0, fmt.Errorf("peer credentials are only available for unix socket connections, have: %T", conn)
+	}
+
+	raw, err := uc.SyscallConn()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var cred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	if credErr != nil {
+		return 0, 0, fmt.Errorf("couldn't get SO_PEERCRED: %w", credErr)
+	}
+
+	return cred.Uid, cred.Gid, nil
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_AllowedPeers(t *testing.T) {
+	uid, gid := uint32(os.Getuid()), uint32(os.Getgid())
+
+	tests := []struct {
+		name      string
+		uids      []uint32
+		gids      []uint32
+		wantAllow bool
+	}{
+		{name: "allowed uid", uids: []uint32{uid}, wantAllow: true},
+		{name: "allowed gid", gids: []uint32{gid}, wantAllow: true},
+		{name: "allowed uid in list", uids: []uint32{uid + 1, uid}, wantAllow: true},
+		{name: "denied uid", uids: []uint32{uid + 1}, wantAllow: false},
+		{name: "denied uid and gid", uids: []uint32{uid + 1}, gids: []uint32{gid + 1}, wantAllow: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			remoteAddr := startPlaintextEchoBackend(t)
+
+			testOpts := testOptions(t)
+			testOpts.LocalAddr = "unix://" + filepath.Join(t.TempDir(), "proxy.sock")
+			testOpts.RemoteAddr = remoteAddr
+			testOpts.Instance = "local/db/main"
+			testOpts.InsecureRemotePlaintext = true
+			testOpts.AllowedPeerUIDs = tt.uids
+			testOpts.AllowedPeerGIDs = tt.gids
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			localAddr := startClient(t, client)
+
+			conn, err := net.Dial("unix", localAddr.String())
+			c.Assert(err, qt.IsNil)
+			defer conn.Close()
+			conn.SetDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+
+			_, err = conn.Write([]byte("hello"))
+			c.Assert(err, qt.IsNil)
+
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(conn, buf)
+			if tt.wantAllow {
+				c.Assert(err, qt.IsNil)
+				c.Assert(string(buf), qt.Equals, "hello")
+				c.Assert(client.Stats().RejectedPeers, qt.Equals, uint64(0))
+			} else {
+				c.Assert(err, qt.Not(qt.IsNil))
+				c.Assert(client.Stats().RejectedPeers, qt.Equals, uint64(1))
+			}
+		})
+	}
+}
+
+func TestClient_AllowedPeers_RequiresUnixSocket(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.AllowedPeerUIDs = []uint32{0}
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "AllowedPeerUIDs and AllowedPeerGIDs require a unix socket LocalAddr")
+}
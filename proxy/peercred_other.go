@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+// peerCredentialsSupported reports whether peer credentials of unix socket
+// connections can be retrieved on this platform.
+const peerCredentialsSupported = false
+
+func peerCredentials(conn net.Conn) (uid, gid uint32, err error) {
+	return 0, 0, fmt.Errorf("peer credentials are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,113 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// CertificatePin holds the SHA-256 pins of a certificate, either of which
+// can be given in PinnedFingerprints.
+type CertificatePin struct {
+	// Subject is the subject of the certificate, to tell the pins apart.
+	Subject string
+	// Certificate is the hex encoded SHA-256 hash of the whole certificate,
+	// it changes every time the certificate is renewed.
+	Certificate string
+	// SPKI is the hex encoded SHA-256 hash of the public key of the
+	// certificate, which survives the renewals that keep the key.
+	SPKI string
+}
+
+// PinsFromPEM returns the pins of the certificates in the given PEM data,
+// i.e: to pin the certificate of a server from its file.
+func PinsFromPEM(data []byte) ([]CertificatePin, error) {
+	certs, err := parseCertsPEM(data)
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make([]CertificatePin, 0, len(certs))
+	for _, cert := range certs {
+		certHash := sha256.Sum256(cert.Raw)
+		spkiHash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+		pins = append(pins, CertificatePin{
+			Subject:     cert.Subject.String(),
+			Certificate: hex.EncodeToString(certHash[:]),
+			SPKI:        hex.EncodeToString(spkiHash[:]),
+		})
+	}
+	return pins, nil
+}
+
+// certPin is a parsed pin of PinnedFingerprints.
+type certPin struct {
+	hash [sha256.Size]byte
+	// pin is the pin as it was given, for the logs.
+	pin string
+}
+
+// parsePins parses the given SHA-256 pins, hex encoded, with or without
+// colons, or base64 encoded.
+func parsePins(pins []string) ([]certPin, error) {
+	parsed := make([]certPin, 0, len(pins))
+	for _, pin := range pins {
+		pin = strings.TrimSpace(pin)
+
+		var hash []byte
+		var err error
+		if s := strings.ReplaceAll(pin, ":", ""); len(s) == hex.EncodedLen(sha256.Size) {
+			hash, err = hex.DecodeString(s)
+		} else {
+			hash, err = base64.StdEncoding.DecodeString(pin)
+		}
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%q is not a hex or base64 encoded SHA-256 hash", pin)
+		}
+
+		p := certPin{pin: pin}
+		copy(p.hash[:], hash)
+		parsed = append(parsed, p)
+	}
+	return parsed, nil
+}
+
+// errNoPinMatched is returned when the certificate of the remote server
+// matches none of the PinnedFingerprints.
+var errNoPinMatched = errors.New("certificate matches none of the PinnedFingerprints")
+
+// verifyPins verifies that the leaf certificate of the remote server of the
+// given instance, or its public key, matches one of the pins, if any.
+func (c *Client) verifyPins(instance string, leaf *x509.Certificate) error {
+	if len(c.pins) == 0 {
+		return nil
+	}
+
+	certHash := sha256.Sum256(leaf.Raw)
+	spkiHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	for _, p := range c.pins {
+		var pinned string
+		switch p.hash {
+		case certHash:
+			pinned = "certificate"
+		case spkiHash:
+			pinned = "spki"
+		default:
+			continue
+		}
+
+		// the pin tells which ones are still in use during a rotation
+		c.log.Info("remote server certificate matched a pin",
+			zap.String("instance", instance),
+			zap.String("pin", p.pin),
+			zap.String("pinned", pinned))
+		return nil
+	}
+	return &peerRejectedError{cert: leaf, err: errNoPinMatched}
+}
@@ -0,0 +1,133 @@
+package proxy
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"strings"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestParsePins(t *testing.T) {
+	c := qt.New(t)
+	hash := sha256.Sum256([]byte("cert"))
+	hexPin := hex.EncodeToString(hash[:])
+
+	colons := make([]string, 0, len(hash))
+	for _, b := range hash {
+		colons = append(colons, hex.EncodeToString([]byte{b}))
+	}
+
+	for _, pin := range []string{
+		hexPin,
+		strings.ToUpper(hexPin),
+		strings.Join(colons, ":"),
+		base64.StdEncoding.EncodeToString(hash[:]),
+	} {
+		pins, err := parsePins([]string{pin})
+		c.Assert(err, qt.IsNil, qt.Commentf(pin))
+		c.Assert(pins[0].hash, qt.Equals, hash)
+	}
+
+	for _, pin := range []string{"", "abcd", hexPin[:62], base64.StdEncoding.EncodeToString(hash[:16])} {
+		_, err := parsePins([]string{pin})
+		c.Assert(err, qt.ErrorMatches, `".*" is not a hex or base64 encoded SHA-256 hash`)
+	}
+}
+
+func TestPinsFromPEM(t *testing.T) {
+	c := qt.New(t)
+	leaf := newTestCA(t).serverCert(t, 42).Leaf
+
+	pins, err := PinsFromPEM(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: leaf.Raw}))
+	c.Assert(err, qt.IsNil)
+	certHash := sha256.Sum256(leaf.Raw)
+	spkiHash := sha256.Sum256(leaf.RawSubjectPublicKeyInfo)
+	c.Assert(pins, qt.DeepEquals, []CertificatePin{{
+		Subject:     "CN=localhost",
+		Certificate: hex.EncodeToString(certHash[:]),
+		SPKI:        hex.EncodeToString(spkiHash[:]),
+	}})
+
+	_, err = PinsFromPEM([]byte("not a certificate"))
+	c.Assert(err, qt.ErrorMatches, "no certificates found")
+}
+
+func TestClient_PinnedFingerprints(t *testing.T) {
+	ca := newTestCA(t)
+	serverCert := ca.serverCert(t, 42)
+	addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, echoHandler)
+
+	certHash := sha256.Sum256(serverCert.Leaf.Raw)
+	spkiHash := sha256.Sum256(serverCert.Leaf.RawSubjectPublicKeyInfo)
+	otherHash := sha256.Sum256(ca.serverCert(t, 43).Leaf.Raw)
+	certPin := hex.EncodeToString(certHash[:])
+	spkiPin := base64.StdEncoding.EncodeToString(spkiHash[:])
+	otherPin := hex.EncodeToString(otherHash[:])
+
+	tests := []struct {
+		name           string
+		pins           []string
+		serverVerifier bool
+		wantPin        string
+		wantPinned     string
+		wantErr        bool
+	}{
+		{name: "certificate", pins: []string{certPin}, wantPin: certPin, wantPinned: "certificate"},
+		{name: "public key", pins: []string{spkiPin}, wantPin: spkiPin, wantPinned: "spki"},
+		{name: "rotation", pins: []string{otherPin, spkiPin}, wantPin: spkiPin, wantPinned: "spki"},
+		{name: "no match", pins: []string{otherPin}, wantErr: true},
+		{name: "no match with ServerVerifier", pins: []string{otherPin}, serverVerifier: true, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			core, logs := observer.New(zap.InfoLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.PinnedFingerprints = tt.pins
+			if tt.serverVerifier {
+				testOpts.ServerVerifier = func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+					return DefaultServerVerifier(cert, serverName, VerifyEither)
+				}
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr {
+				c.Assert(err, qt.ErrorMatches, ".*peer certificate rejected: certificate matches none of the PinnedFingerprints")
+				c.Assert(errors.Is(err, errPeerRejected), qt.IsTrue)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+
+			matched := logs.FilterMessage("remote server certificate matched a pin").All()
+			c.Assert(matched, qt.HasLen, 1)
+			c.Assert(matched[0].ContextMap()["pin"], qt.Equals, tt.wantPin)
+			c.Assert(matched[0].ContextMap()["pinned"], qt.Equals, tt.wantPinned)
+		})
+	}
+}
+
+func TestNewClient_PinnedFingerprints(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.PinnedFingerprints = []string{"sha256:abcd"}
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `invalid PinnedFingerprints: "sha256:abcd" is not a hex or base64 encoded SHA-256 hash`)
+}
@@ -0,0 +1,267 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// CloseReason describes why the proxy closed an established connection.
+type CloseReason string
+
+const (
+	// CloseReasonInvalidated means the certificates of the connection's
+	// instance were invalidated, i.e: because the access was revoked.
+	CloseReasonInvalidated CloseReason = "invalidated"
+
+	// CloseReasonQuotaExceeded means the connection transferred more bytes
+	// than its MaxBytesPerConnection quota.
+	CloseReasonQuotaExceeded CloseReason = "quota_exceeded"
+
+	// CloseReasonMaxLifetime means the connection was open for longer than
+	// MaxConnectionLifetime.
+	CloseReasonMaxLifetime CloseReason = "max_lifetime"
+
+	// CloseReasonShutdown means the connection was still active once the
+	// drain deadline of Shutdown passed.
+	CloseReasonShutdown CloseReason = "shutdown"
+
+	// CloseReasonStalled means the remote server didn't answer the data
+	// sent by the local client within StallTimeout.
+	CloseReasonStalled CloseReason = "stalled"
+)
+
+// ConnInfo describes an established connection, see Client.Connections.
+type ConnInfo struct {
+	// ID identifies the connection in the logs and the events.
+	ID uint64 `json:"id"`
+
+	// Instance is the instance the connection is tunneled to.
+	Instance string `json:"instance"`
+
+	// ClientAddr is the address of the local client, empty for the
+	// connections returned by Dial.
+	ClientAddr string `json:"client_addr,omitempty"`
+
+	// RemoteAddr is the address of the remote server.
+	RemoteAddr string `json:"remote_addr"`
+
+	// Started is when the tunnel was established.
+	Started time.Time `json:"started"`
+
+	// BytesIn and BytesOut are the bytes sent by the local client and by the
+	// remote server so far.
+	BytesIn  int64 `json:"bytes_in"`
+	BytesOut int64 `json:"bytes_out"`
+
+	// ServerVersion and ConnectionID are the version of the MySQL server and
+	// the id of the connection on it, as announced in its greeting. They're
+	// only set if ParseServerGreetings is set.
+	ServerVersion string `json:"server_version,omitempty"`
+	ConnectionID  uint32 `json:"connection_id,omitempty"`
+}
+
+// trackedConn is an established connection tracked by the Client, so it can
+// be closed by the proxy.
+type trackedConn struct {
+	id         uint64
+	instance   string
+	clientAddr string // empty unless the tunnel is for a local client
+	remote     net.Conn
+	started    time.Time
+
+	// greeting is the greeting of the MySQL server, nil unless it was
+	// parsed.
+	greeting *serverGreeting
+
+	// bytes returns the number of bytes sent by the local client and by the
+	// remote so far.
+	bytes func() (in, out int64)
+
+	mu     sync.Mutex
+	local  net.Conn // nil unless the tunnel is for a local client
+	reason CloseReason
+}
+
+// attach attaches the local client of the tunnel, so it's closed along with
+// the remote connection.
+func (t *trackedConn) attach(local net.Conn) {
+	t.mu.Lock()
+	t.local = local
+	closed := t.reason != ""
+	t.mu.Unlock()
+
+	if closed {
+		local.Close()
+	}
+}
+
+// close closes both sides of the connection. Only the first given reason is
+// recorded.
+func (t *trackedConn) close(reason CloseReason) {
+	t.mu.Lock()
+	if t.reason == "" {
+		t.reason = reason
+	}
+	local := t.local
+	t.mu.Unlock()
+
+	if local != nil {
+		local.Close()
+	}
+	t.remote.Close()
+}
+
+// closeReason returns the reason the proxy closed the connection, or an empty
+// reason if it wasn't closed by the proxy.
+func (t *trackedConn) closeReason() CloseReason {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.reason
+}
+
+// info returns the current state of the connection.
+func (t *trackedConn) info() ConnInfo {
+	info := ConnInfo{
+		ID:         t.id,
+		Instance:   t.instance,
+		ClientAddr: t.clientAddr,
+		RemoteAddr: t.remote.RemoteAddr().String(),
+		Started:    t.started,
+	}
+	if t.bytes != nil {
+		info.BytesIn, info.BytesOut = t.bytes()
+	}
+	if t.greeting != nil {
+		info.ServerVersion = t.greeting.version
+		info.ConnectionID = t.greeting.connectionID
+	}
+	return info
+}
+
+// Connections returns the established connections, the oldest first. The
+// connections keep being proxied while they're collected.
+func (c *Client) Connections() []ConnInfo {
+	c.connsMu.Lock()
+	tracked := make([]*trackedConn, 0, len(c.conns))
+	for t := range c.conns {
+		tracked = append(tracked, t)
+	}
+	c.connsMu.Unlock()
+
+	conns := make([]ConnInfo, 0, len(tracked))
+	for _, t := range tracked {
+		conns = append(conns, t.info())
+	}
+	sort.Slice(conns, func(i, j int) bool {
+		return conns[i].Started.Before(conns[j].Started)
+	})
+	return conns
+}
+
+// ActiveConnections returns the number of established connections. Unlike
+// the connections_active metric, the connections being set up aren't
+// counted.
+func (c *Client) ActiveConnections() int {
+	c.connsMu.Lock()
+	defer c.connsMu.Unlock()
+	return len(c.conns)
+}
+
+func (c *Client) track(t *trackedConn) {
+	c.connsMu.Lock()
+	c.conns[t] = struct{}{}
+	c.connsMu.Unlock()
+}
+
+func (c *Client) untrack(t *trackedConn) {
+	c.connsMu.Lock()
+	delete(c.conns, t)
+	c.connsMu.Unlock()
+}
+
+// InvalidateInstance drops the cached certificates of the given instance and
+// closes all of its established connections. New connections retrieve new
+// certificates from the CertSource. Use it when the access to an instance
+// was revoked.
+func (c *Client) InvalidateInstance(instance string) {
+	c.configCache.Remove(instance)
+	c.certExpiry.forget(instance)
+	c.csrKeys.forget(instance)
+
+	var conns []*trackedConn
+	c.connsMu.Lock()
+	for t := range c.conns {
+		if t.instance == instance {
+			conns = append(conns, t)
+		}
+	}
+	c.connsMu.Unlock()
+
+	c.log.Warn("invalidated instance, closing its connections",
+		zap.String("instance", instance),
+		zap.Int("connections", len(conns)),
+	)
+
+	for _, t := range conns {
+		t.close(CloseReasonInvalidated)
+	}
+}
+
+// InvalidateCerts drops the cached certificates of the given instance, so the
+// next connection to it retrieves new ones from the CertSource, i.e: once
+// they were rotated underneath it. Unlike InvalidateInstance, the established
+// connections are left alone, they keep their TLS session.
+func (c *Client) InvalidateCerts(instance string) {
+	c.configCache.Remove(instance)
+	c.forgetCerts(instance)
+
+	c.log.Info("invalidated the certificates of the instance",
+		zap.String("instance", instance))
+}
+
+// InvalidateAllCerts is like InvalidateCerts, for all the instances. It
+// returns the number of instances whose certificates were cached.
+func (c *Client) InvalidateAllCerts() int {
+	entries := c.configCache.entries()
+	for instance := range entries {
+		c.configCache.Remove(instance)
+		c.forgetCerts(instance)
+	}
+
+	c.log.Info("invalidated the certificates of all instances",
+		zap.Int("instances", len(entries)))
+	return len(entries)
+}
+
+// invalidateFailedCerts drops the cached certificates of the given instance
+// once a handshake with the given config failed on them, unless they were
+// replaced in the meantime. They're dropped at most once per
+// failedCertsInvalidationInterval, so a remote server that keeps failing the
+// handshakes, i.e: because its name doesn't match, doesn't have every
+// connection retrieve new certificates. It reports whether it dropped them.
+func (c *Client) invalidateFailedCerts(instance string, cfg *tls.Config, failure HandshakeFailure) bool {
+	if !c.configCache.removeFailed(instance, cfg, failedCertsInvalidationInterval) {
+		c.log.Debug("TLS handshake failed on a certificate, keeping the recently retrieved certificates of the instance",
+			zap.String("instance", instance),
+			zap.String("failure", string(failure)))
+		return false
+	}
+	c.forgetCerts(instance)
+
+	c.log.Warn("TLS handshake failed on a certificate, invalidated the certificates of the instance",
+		zap.String("instance", instance),
+		zap.String("failure", string(failure)))
+	return true
+}
+
+// forgetCerts forgets the expiry and the CSR key of the certificates of the
+// instance, once they're dropped from the cache.
+func (c *Client) forgetCerts(instance string) {
+	c.certExpiry.forget(instance)
+	c.csrKeys.forget(instance)
+}
@@ -0,0 +1,479 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// startTunnel establishes a tunnel through the client for the given instance
+// and returns the local side of the connection. The returned channel
+// receives the result of handleConn. The tunnel is closed and waited for
+// once the test is done.
+func startTunnel(c *qt.C, client *Client, instance string) (net.Conn, <-chan error) {
+	local, remote := net.Pipe()
+	done := make(chan error, 1)
+	closed := make(chan struct{})
+	go func() {
+		defer close(closed)
+		done <- client.handleConn(context.Background(), local, 1, instance, ProtocolClassic, 0)
+	}()
+	c.Cleanup(func() {
+		remote.Close()
+		<-closed
+	})
+
+	// make sure the tunnel is established
+	_, err := remote.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(remote, buf)
+	c.Assert(err, qt.IsNil)
+
+	return remote, done
+}
+
+func TestClient_InvalidateInstance(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	backendClosed := make(chan struct{}, 2)
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, func(conn net.Conn) {
+		echoHandler(conn)
+		backendClosed <- struct{}{}
+	})
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	events := client.Events()
+
+	instance := "myorg/mydb/mybranch"
+	conn1, done1 := startTunnel(c, client, instance)
+	defer conn1.Close()
+	conn2, done2 := startTunnel(c, client, instance)
+	defer conn2.Close()
+
+	client.InvalidateInstance(instance)
+
+	for _, conn := range []net.Conn{conn1, conn2} {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+		_, err := conn.Read(make([]byte, 1))
+		c.Assert(err, qt.Equals, io.EOF)
+	}
+
+	for i := 0; i < 2; i++ {
+		select {
+		case <-backendClosed:
+		case <-time.After(5 * time.Second):
+			c.Fatal("remote connection wasn't closed")
+		}
+	}
+
+	c.Assert(<-done1, qt.IsNil)
+	c.Assert(<-done2, qt.IsNil)
+
+	var disconnects int
+	for len(events) > 0 {
+		e := <-events
+		if e.Type == EventDisconnect {
+			disconnects++
+			c.Assert(e.Reason, qt.Equals, CloseReasonInvalidated)
+		}
+	}
+	c.Assert(disconnects, qt.Equals, 2)
+
+	// the cached certs must be dropped as well
+	_, err = client.configCache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+}
+
+func TestClient_InvalidateInstance_Unauthorized(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := backendCertSource(t, ca, addr)
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	conn, done := startTunnel(c, client, instance)
+	defer conn.Close()
+
+	// the access is revoked: the next cert retrieval fails and should close
+	// the existing connection.
+	client.configCache.Remove(instance)
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		return nil, ErrUnauthorized
+	}
+
+	local, remote := net.Pipe()
+	defer remote.Close()
+	err = client.handleConn(context.Background(), local, 1, instance, ProtocolClassic, 0)
+	c.Assert(err, qt.ErrorIs, ErrUnauthorized)
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+	_, err = conn.Read(make([]byte, 1))
+	c.Assert(err, qt.Equals, io.EOF)
+	c.Assert(<-done, qt.IsNil)
+}
+
+func TestClient_InvalidateInstance_OtherInstances(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, _ := startTunnel(c, client, "myorg/mydb/mybranch")
+	defer conn.Close()
+
+	client.InvalidateInstance("myorg/mydb/otherbranch")
+
+	// the connection of the other instance keeps working
+	_, err = conn.Write([]byte("pong"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "pong")
+}
+
+func TestClient_Connections(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(client.Connections(), qt.HasLen, 0)
+	c.Assert(client.ActiveConnections(), qt.Equals, 0)
+
+	instance := "myorg/mydb/mybranch"
+	conn1, done1 := startTunnel(c, client, instance)
+	defer conn1.Close()
+	dialed, err := client.Dial(context.Background(), instance)
+	c.Assert(err, qt.IsNil)
+	defer dialed.Close()
+
+	conns := client.Connections()
+	c.Assert(conns, qt.HasLen, 2)
+	c.Assert(client.ActiveConnections(), qt.Equals, 2)
+
+	// the oldest first
+	c.Assert(conns[0].Instance, qt.Equals, instance)
+	c.Assert(conns[0].ClientAddr, qt.Equals, "pipe")
+	c.Assert(conns[0].RemoteAddr, qt.Equals, addr.String())
+	c.Assert(conns[0].BytesIn, qt.Equals, int64(4))
+	c.Assert(conns[0].BytesOut, qt.Equals, int64(4))
+	c.Assert(conns[1].ClientAddr, qt.Equals, "")
+	c.Assert(conns[1].BytesIn, qt.Equals, int64(0))
+	c.Assert(conns[0].Started.After(conns[1].Started), qt.IsFalse)
+
+	conn1.Close()
+	<-done1
+	dialed.Close()
+	c.Assert(client.Connections(), qt.HasLen, 0)
+	c.Assert(client.ActiveConnections(), qt.Equals, 0)
+}
+
+func TestClient_Connections_Churn(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// snapshots are safe while connections come and go
+	stop := make(chan struct{})
+	snapshotsDone := make(chan struct{})
+	go func() {
+		defer close(snapshotsDone)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			for _, info := range client.Connections() {
+				if info.Instance != "myorg/mydb/mybranch" {
+					panic("unexpected instance " + info.Instance)
+				}
+			}
+			client.ActiveConnections()
+		}
+	}()
+
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			for j := 0; j < 10; j++ {
+				conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+				if err != nil {
+					errs <- err
+					return
+				}
+				conn.Close()
+			}
+			errs <- nil
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		c.Assert(<-errs, qt.IsNil)
+	}
+	close(stop)
+	<-snapshotsDone
+	c.Assert(client.ActiveConnections(), qt.Equals, 0)
+}
+
+func TestClient_InvalidateCerts(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := backendCertSource(t, ca, addr)
+	var certs int32
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		atomic.AddInt32(&certs, 1)
+		return certFn(ctx, org, db, branch)
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	conn1, done1 := startTunnel(c, client, instance)
+	defer conn1.Close()
+	c.Assert(atomic.LoadInt32(&certs), qt.Equals, int32(1))
+
+	client.InvalidateCerts(instance)
+	_, err = client.configCache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+
+	// the new connections retrieve new certs
+	conn2, done2 := startTunnel(c, client, instance)
+	defer conn2.Close()
+	c.Assert(atomic.LoadInt32(&certs), qt.Equals, int32(2))
+
+	// and the established ones are left alone
+	_, err = conn1.Write([]byte("pong"))
+	c.Assert(err, qt.IsNil)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(conn1, buf)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(buf), qt.Equals, "pong")
+
+	conn1.Close()
+	conn2.Close()
+	c.Assert(<-done1, qt.IsNil)
+	c.Assert(<-done2, qt.IsNil)
+}
+
+func TestClient_InvalidateAllCerts(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instances := []string{"myorg/mydb/mybranch", "myorg/otherdb/main"}
+	for _, instance := range instances {
+		conn, _ := startTunnel(c, client, instance)
+		defer conn.Close()
+	}
+
+	c.Assert(client.InvalidateAllCerts(), qt.Equals, 2)
+	for _, instance := range instances {
+		_, err = client.configCache.Get(instance)
+		c.Assert(err, qt.Equals, errConfigNotFound)
+	}
+	c.Assert(client.certExpiry.stats(), qt.HasLen, 0)
+
+	c.Assert(client.InvalidateAllCerts(), qt.Equals, 0)
+}
+
+func TestClient_InvalidateCerts_HandshakeFailure(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	// the first certs trust another CA than the one of the remote server,
+	// i.e: the CA was rotated, the next ones are up to date.
+	certSource := backendCertSource(t, ca, addr)
+	var certs int32
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		cert, err := certFn(ctx, org, db, branch)
+		if err == nil && atomic.AddInt32(&certs, 1) == 1 {
+			cert.CACerts = []*x509.Certificate{otherCA.cert}
+		}
+		return cert, err
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	local, remote := net.Pipe()
+	defer remote.Close()
+	err = client.handleConn(context.Background(), local, 1, instance, ProtocolClassic, 0)
+	var handshakeErr *HandshakeError
+	c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+	c.Assert(handshakeErr.Failure, qt.Equals, HandshakeFailureUnknownAuthority)
+
+	_, err = client.configCache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+
+	conn, done := startTunnel(c, client, instance)
+	c.Assert(atomic.LoadInt32(&certs), qt.Equals, int32(2))
+	conn.Close()
+	c.Assert(<-done, qt.IsNil)
+}
+
+func TestClient_invalidateFailedCerts_Replaced(t *testing.T) {
+	c := qt.New(t)
+	client, err := NewClient(testOptions(t))
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	failed := &tls.Config{}
+	client.configCache.Add(instance, &tls.Config{}, "localhost:3307")
+
+	// a handshake failing with older certs mustn't drop the new ones
+	client.invalidateFailedCerts(instance, failed, HandshakeFailureUnknownAuthority)
+	_, err = client.configCache.Get(instance)
+	c.Assert(err, qt.IsNil)
+}
+
+func TestClient_invalidateFailedCerts_RateLimited(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	otherCA := newTestCA(t)
+
+	// the remote server presents a certificate of a CA the certs never
+	// trust, i.e: it's impersonated, so every handshake fails.
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{otherCA.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := backendCertSource(t, ca, addr)
+	var certs int32
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		atomic.AddInt32(&certs, 1)
+		// give the concurrent dials time to miss the cache together
+		time.Sleep(10 * time.Millisecond)
+		return certFn(ctx, org, db, branch)
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	testOpts.SetupRetries = 2
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	dial := func() {
+		_, err := client.Dial(context.Background(), instance)
+		var handshakeErr *HandshakeError
+		c.Check(errors.As(err, &handshakeErr), qt.IsTrue)
+		c.Check(handshakeErr.Failure, qt.Equals, HandshakeFailureUnknownAuthority)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			dial()
+		}()
+	}
+	wg.Wait()
+	for i := 0; i < 20; i++ {
+		dial()
+	}
+
+	// the concurrent dials share the first retrieval, the first failure
+	// invalidates the certs once, and the later ones keep the new certs.
+	c.Assert(atomic.LoadInt32(&certs), qt.Equals, int32(2))
+}
+
+func TestTLSCache_removeFailed(t *testing.T) {
+	c := qt.New(t)
+	cache := newtlsCache()
+	now := time.Now()
+	cache.nowFn = func() time.Time { return now }
+
+	instance := "myorg/mydb/mybranch"
+	cfg := &tls.Config{}
+	cache.Add(instance, cfg, "localhost:3307")
+	c.Assert(cache.removeFailed(instance, cfg, time.Minute), qt.IsTrue)
+
+	// too soon after the previous removal
+	cfg = &tls.Config{}
+	cache.Add(instance, cfg, "localhost:3307")
+	now = now.Add(30 * time.Second)
+	c.Assert(cache.removeFailed(instance, cfg, time.Minute), qt.IsFalse)
+	_, err := cache.Get(instance)
+	c.Assert(err, qt.IsNil)
+
+	now = now.Add(30 * time.Second)
+	c.Assert(cache.removeFailed(instance, cfg, time.Minute), qt.IsTrue)
+	_, err = cache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+}
@@ -0,0 +1,347 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// startCertAPI starts an HTTPS server handling the requests with the given
+// handler, and returns a RemoteCertSource with the given options talking to
+// it.
+func startCertAPI(t *testing.T, opts RemoteOptions, handler http.HandlerFunc) *RemoteCertSource {
+	t.Helper()
+
+	srv := httptest.NewTLSServer(handler)
+	t.Cleanup(srv.Close)
+
+	opts.URL = srv.URL + "/v1"
+	if opts.HTTPClient == nil {
+		opts.TLSConfig = &tls.Config{RootCAs: certPool([]*x509.Certificate{srv.Certificate()})}
+	}
+	s, err := NewRemoteCertSource(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestRemoteCertSource(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+
+	s := startCertAPI(t, RemoteOptions{Token: "secret"}, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Method, qt.Equals, http.MethodPost)
+		c.Check(r.URL.Path, qt.Equals, "/v1/certificates")
+		c.Check(r.Header.Get("Authorization"), qt.Equals, "Bearer secret")
+		c.Check(r.Header.Get("Content-Type"), qt.Equals, "application/json")
+
+		var req remoteRequest
+		c.Check(json.NewDecoder(r.Body).Decode(&req), qt.IsNil)
+		c.Check(req, qt.Equals, remoteRequest{Organization: "myorg", Database: "mydb", Branch: "main"})
+
+		json.NewEncoder(w).Encode(remoteResponse{ // nolint: errcheck
+			ClientCert: certPEM,
+			ClientKey:  keyPEM,
+			CACerts:    caPEM,
+			AccessHost: "mydb.example.com",
+			ProxyPort:  3307,
+			MySQLPort:  3306,
+		})
+	})
+
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	c.Assert(validateCert(cert), qt.IsNil)
+	c.Assert(cert.CACerts, qt.HasLen, 1)
+	c.Assert(cert.CACerts[0].Equal(ca.cert), qt.IsTrue)
+	c.Assert(cert.AccessHost, qt.Equals, "mydb.example.com")
+	c.Assert(cert.Ports, qt.Equals, RemotePorts{Proxy: 3307, MySQL: 3306})
+}
+
+func TestRemoteCertSource_TokenFunc(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int64
+	tokenErr := &CertSourceError{Kind: CertErrorUnauthorized, Err: errors.New("token revoked")}
+	s := startCertAPI(t, RemoteOptions{
+		TokenFunc: func(ctx context.Context) (string, error) {
+			if atomic.AddInt64(&calls, 1) > 1 {
+				return "", tokenErr
+			}
+			return "token-1", nil
+		},
+	}, func(w http.ResponseWriter, r *http.Request) {
+		c.Check(r.Header.Get("Authorization"), qt.Equals, "Bearer token-1")
+		w.WriteHeader(http.StatusNotFound)
+	})
+
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(certErrorKind(err), qt.Equals, CertErrorNotFound)
+
+	// the errors of the token func are returned as they are
+	_, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.ErrorMatches, "couldn't get the cert API token: token revoked")
+	c.Assert(errors.Is(err, ErrUnauthorized), qt.IsTrue)
+}
+
+func TestRemoteCertSource_Errors(t *testing.T) {
+	ca := newTestCA(t)
+	certPEM, _, _ := testCertPEM(t, ca)
+
+	tests := []struct {
+		name           string
+		status         int
+		header         http.Header
+		body           string
+		wantErr        string
+		wantKind       CertErrorKind
+		wantStatus     int
+		wantRetryAfter time.Duration
+	}{
+		{
+			name:       "unauthorized",
+			status:     http.StatusUnauthorized,
+			body:       `{"error": "invalid token"}`,
+			wantErr:    `cert API .*: unexpected status "401 Unauthorized" \(body: "{\\"error\\": \\"invalid token\\"}"\)`,
+			wantKind:   CertErrorUnauthorized,
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "forbidden",
+			status:     http.StatusForbidden,
+			wantErr:    `cert API .*: unexpected status "403 Forbidden"`,
+			wantKind:   CertErrorUnauthorized,
+			wantStatus: http.StatusForbidden,
+		},
+		{
+			name:       "not found",
+			status:     http.StatusNotFound,
+			wantErr:    `cert API .*: unexpected status "404 Not Found"`,
+			wantKind:   CertErrorNotFound,
+			wantStatus: http.StatusNotFound,
+		},
+		{
+			name:           "rate limited",
+			status:         http.StatusTooManyRequests,
+			header:         http.Header{"Retry-After": {"7"}},
+			wantErr:        `cert API .*: unexpected status "429 Too Many Requests"`,
+			wantKind:       CertErrorRateLimited,
+			wantStatus:     http.StatusTooManyRequests,
+			wantRetryAfter: 7 * time.Second,
+		},
+		{
+			name:       "unavailable",
+			status:     http.StatusServiceUnavailable,
+			wantErr:    `cert API .*: unexpected status "503 Service Unavailable"`,
+			wantKind:   CertErrorUnavailable,
+			wantStatus: http.StatusServiceUnavailable,
+		},
+		{
+			name:       "bad request",
+			status:     http.StatusBadRequest,
+			wantErr:    `cert API .*: unexpected status "400 Bad Request"`,
+			wantKind:   CertErrorUnknown,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "malformed JSON",
+			status:     http.StatusOK,
+			body:       "certs",
+			wantErr:    `cert API .*: malformed response: invalid character .*`,
+			wantKind:   CertErrorUnknown,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "no key",
+			status:     http.StatusOK,
+			body:       `{"client_cert": ` + jsonString(t, certPEM) + `}`,
+			wantErr:    `cert API .*: malformed response: invalid client key: no private key found`,
+			wantKind:   CertErrorUnknown,
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "too large",
+			status:     http.StatusOK,
+			body:       `{"client_cert": "` + strings.Repeat("x", 2048) + `"}`,
+			wantErr:    `cert API .*: response exceeds 1024 bytes`,
+			wantKind:   CertErrorUnknown,
+			wantStatus: http.StatusOK,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			s := startCertAPI(t, RemoteOptions{MaxResponseSize: 1024}, func(w http.ResponseWriter, r *http.Request) {
+				for k, v := range tt.header {
+					w.Header()[k] = v
+				}
+				w.WriteHeader(tt.status)
+				w.Write([]byte(tt.body)) // nolint: errcheck
+			})
+
+			_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+			c.Assert(certErrorKind(err), qt.Equals, tt.wantKind)
+			c.Assert(retryAfter(err), qt.Equals, tt.wantRetryAfter)
+
+			var remoteErr *RemoteError
+			c.Assert(errors.As(err, &remoteErr), qt.IsTrue)
+			c.Assert(remoteErr.StatusCode, qt.Equals, tt.wantStatus)
+		})
+	}
+}
+
+func TestRemoteCertSource_Context(t *testing.T) {
+	c := qt.New(t)
+
+	stop := make(chan struct{})
+	s := startCertAPI(t, RemoteOptions{Timeout: 50 * time.Millisecond}, func(w http.ResponseWriter, r *http.Request) {
+		<-stop
+	})
+	// the server waits for the handlers once the test finishes
+	t.Cleanup(func() { close(stop) })
+
+	// the API timing out is a transient failure
+	_, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.ErrorMatches, "cert API .*: timed out after 50ms")
+	c.Assert(certErrorKind(err), qt.Equals, CertErrorUnavailable)
+
+	// the caller giving up isn't
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err = s.Cert(ctx, "myorg", "mydb", "main")
+	c.Assert(errors.Is(err, context.DeadlineExceeded), qt.IsTrue)
+	c.Assert(certErrorKind(err), qt.Equals, CertErrorUnknown)
+}
+
+func TestRemoteCertSource_UntrustedAPI(t *testing.T) {
+	c := qt.New(t)
+
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	// the certificate of the test server isn't trusted by the system roots
+	s, err := NewRemoteCertSource(RemoteOptions{URL: srv.URL})
+	c.Assert(err, qt.IsNil)
+
+	_, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.ErrorMatches, "cert API .*: .*certificate.*")
+	c.Assert(certErrorKind(err), qt.Equals, CertErrorUnavailable)
+
+	// the client of the test server trusts it
+	s, err = NewRemoteCertSource(RemoteOptions{URL: srv.URL, HTTPClient: srv.Client()})
+	c.Assert(err, qt.IsNil)
+	_, err = s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(certErrorKind(err), qt.Equals, CertErrorNotFound)
+}
+
+func TestNewRemoteCertSource(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    RemoteOptions
+		wantErr string
+	}{
+		{
+			name: "valid",
+			opts: RemoteOptions{URL: "https://certs.example.com/v1/", Token: "secret"},
+		},
+		{
+			name:    "no URL",
+			wantErr: `URL must be an HTTPS URL, have: ""`,
+		},
+		{
+			name:    "plain HTTP",
+			opts:    RemoteOptions{URL: "http://certs.example.com"},
+			wantErr: `URL must be an HTTPS URL, have: "http://certs.example.com"`,
+		},
+		{
+			name:    "invalid URL",
+			opts:    RemoteOptions{URL: "https://certs.example.com:port"},
+			wantErr: "invalid URL: .*",
+		},
+		{
+			name: "token and token func",
+			opts: RemoteOptions{
+				URL:       "https://certs.example.com",
+				Token:     "secret",
+				TokenFunc: func(ctx context.Context) (string, error) { return "secret", nil },
+			},
+			wantErr: "only one of Token and TokenFunc can be set",
+		},
+		{
+			name: "HTTP client and TLS config",
+			opts: RemoteOptions{
+				URL:        "https://certs.example.com",
+				HTTPClient: http.DefaultClient,
+				TLSConfig:  &tls.Config{},
+			},
+			wantErr: "TLSConfig can't be set along with HTTPClient",
+		},
+		{
+			name:    "negative timeout",
+			opts:    RemoteOptions{URL: "https://certs.example.com", Timeout: -1},
+			wantErr: "Timeout can't be negative",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			s, err := NewRemoteCertSource(tt.opts)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(s.certsURL, qt.Equals, "https://certs.example.com/v1/certificates")
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2023, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		value string
+		want  time.Duration
+	}{
+		{value: "", want: 0},
+		{value: "30", want: 30 * time.Second},
+		{value: "-1", want: 0},
+		{value: "Sat, 01 Apr 2023 12:01:00 GMT", want: time.Minute},
+		{value: "Sat, 01 Apr 2023 11:59:00 GMT", want: 0},
+		{value: "soon", want: 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			c := qt.New(t)
+			c.Assert(parseRetryAfter(tt.value, now), qt.Equals, tt.want)
+		})
+	}
+}
+
+func jsonString(t *testing.T, s string) string {
+	t.Helper()
+
+	data, err := json.Marshal(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
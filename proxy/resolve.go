@@ -0,0 +1,183 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// HostResolver resolves host names to IP addresses. *net.Resolver
+// implements it.
+type HostResolver interface {
+	LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error)
+}
+
+// hostEntry is the resolved addresses of a host.
+type hostEntry struct {
+	ips      []string
+	resolved time.Time
+
+	// next is the index of the address new connections try first, it moves
+	// past the addresses that failed.
+	next int
+}
+
+// hostCache resolves the host names of the remote addresses itself, so the
+// addresses are re-resolved every interval, whatever the upstream caches do,
+// and a dial failure moves on to the next address.
+type hostCache struct {
+	resolver HostResolver
+	interval time.Duration
+	log      *zap.Logger
+
+	mu    sync.Mutex // protects hosts
+	hosts map[string]*hostEntry
+
+	// nowFn returns the current time, it's a function so we can use it for
+	// tests.
+	nowFn func() time.Time
+}
+
+func newHostCache(resolver HostResolver, interval time.Duration, log *zap.Logger) *hostCache {
+	return &hostCache{
+		resolver: resolver,
+		interval: interval,
+		log:      log,
+		hosts:    make(map[string]*hostEntry),
+		nowFn:    time.Now,
+	}
+}
+
+// addrs returns the addresses to dial for the given host:port address, in
+// the order to try them. The host is resolved again if it was resolved more
+// than the interval ago. If resolving it fails, the addresses resolved
+// before are returned, if any. IP addresses are returned as they are.
+func (h *hostCache) addrs(ctx context.Context, addr string) ([]string, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if net.ParseIP(host) != nil {
+		return []string{addr}, nil
+	}
+
+	ips, err := h.ips(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := make([]string, len(ips))
+	for i, ip := range ips {
+		addrs[i] = net.JoinHostPort(ip, port)
+	}
+	return addrs, nil
+}
+
+// ips returns the addresses of the given host, starting with the one to try
+// first.
+func (h *hostCache) ips(ctx context.Context, host string) ([]string, error) {
+	now := h.nowFn()
+
+	h.mu.Lock()
+	e := h.hosts[host]
+	if e != nil && now.Sub(e.resolved) < h.interval {
+		ips := e.rotated()
+		h.mu.Unlock()
+		return ips, nil
+	}
+	h.mu.Unlock()
+
+	resolved, err := h.resolver.LookupIPAddr(ctx, host)
+	if err == nil && len(resolved) == 0 {
+		err = fmt.Errorf("no addresses found for %s", host)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	// someone else might have resolved it in the meantime
+	e = h.hosts[host]
+	if err != nil {
+		if e == nil {
+			return nil, err
+		}
+		h.log.Warn("couldn't resolve remote host, using the addresses resolved before",
+			zap.String("host", host),
+			zap.Strings("addrs", e.ips),
+			zap.Error(err))
+		return e.rotated(), nil
+	}
+
+	ips := make([]string, len(resolved))
+	for i, ip := range resolved {
+		ips[i] = ip.String()
+	}
+
+	if e == nil {
+		h.log.Info("resolved remote host", zap.String("host", host), zap.Strings("addrs", ips))
+		e = &hostEntry{}
+		h.hosts[host] = e
+	} else if !sameAddrs(e.ips, ips) {
+		h.log.Info("resolved addresses of remote host changed",
+			zap.String("host", host),
+			zap.Strings("old_addrs", e.ips),
+			zap.Strings("new_addrs", ips))
+		e.next = 0
+	}
+	e.ips = ips
+	e.resolved = now
+	if e.next >= len(ips) {
+		e.next = 0
+	}
+	return e.rotated(), nil
+}
+
+// failed moves new connections to the given host:port address past the
+// given resolved address, after dialing it failed.
+func (h *hostCache) failed(addr, resolved string) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return
+	}
+	ip, _, err := net.SplitHostPort(resolved)
+	if err != nil {
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	e := h.hosts[host]
+	if e == nil {
+		return
+	}
+	for i, candidate := range e.ips {
+		if candidate == ip && i == e.next {
+			e.next = (i + 1) % len(e.ips)
+		}
+	}
+}
+
+// rotated returns the addresses, starting with the one to try first.
+func (e *hostEntry) rotated() []string {
+	ips := make([]string, 0, len(e.ips))
+	ips = append(ips, e.ips[e.next:]...)
+	return append(ips, e.ips[:e.next]...)
+}
+
+// sameAddrs reports whether a and b hold the same addresses, in any order.
+func sameAddrs(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	a = append([]string(nil), a...)
+	b = append([]string(nil), b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return strings.Join(a, ",") == strings.Join(b, ",")
+}
@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// fakeHostResolver resolves the hosts to the addresses in ips.
+type fakeHostResolver struct {
+	mu      sync.Mutex
+	ips     map[string][]string
+	err     error
+	lookups int
+}
+
+func (r *fakeHostResolver) set(host string, ips ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.ips == nil {
+		r.ips = make(map[string][]string)
+	}
+	r.ips[host] = ips
+}
+
+func (r *fakeHostResolver) LookupIPAddr(ctx context.Context, host string) ([]net.IPAddr, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.lookups++
+	if r.err != nil {
+		return nil, r.err
+	}
+	var addrs []net.IPAddr
+	for _, ip := range r.ips[host] {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs, nil
+}
+
+func TestHostCache(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	core, logs := observer.New(zap.InfoLevel)
+	resolver := &fakeHostResolver{}
+	resolver.set("db.example.com", "10.0.0.1", "2001:db8::1")
+	hosts := newHostCache(resolver, time.Minute, zap.New(core))
+	now := time.Now()
+	hosts.nowFn = func() time.Time { return now }
+
+	addrs, err := hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"10.0.0.1:3307", "[2001:db8::1]:3307"})
+	c.Assert(logs.FilterMessage("resolved remote host").Len(), qt.Equals, 1)
+
+	// the resolved addresses are cached within the interval
+	resolver.set("db.example.com", "10.0.0.2")
+	now = now.Add(30 * time.Second)
+	addrs, err = hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"10.0.0.1:3307", "[2001:db8::1]:3307"})
+	c.Assert(resolver.lookups, qt.Equals, 1)
+
+	// and resolved again after it
+	now = now.Add(time.Minute)
+	addrs, err = hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"10.0.0.2:3307"})
+	changed := logs.FilterMessage("resolved addresses of remote host changed").All()
+	c.Assert(changed, qt.HasLen, 1)
+	c.Assert(changed[0].ContextMap()["new_addrs"], qt.DeepEquals, []interface{}{"10.0.0.2"})
+
+	// if resolving fails, the addresses resolved before are used
+	resolver.err = errors.New("no DNS")
+	now = now.Add(time.Minute)
+	addrs, err = hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"10.0.0.2:3307"})
+	c.Assert(logs.FilterMessage("couldn't resolve remote host, using the addresses resolved before").Len(), qt.Equals, 1)
+
+	// unless there are none
+	_, err = hosts.addrs(ctx, "other.example.com:3307")
+	c.Assert(err, qt.ErrorMatches, "no DNS")
+
+	// IP addresses aren't resolved
+	resolver.err = nil
+	lookups := resolver.lookups
+	addrs, err = hosts.addrs(ctx, "[::1]:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"[::1]:3307"})
+	c.Assert(resolver.lookups, qt.Equals, lookups)
+}
+
+func TestHostCache_Failed(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	resolver := &fakeHostResolver{}
+	resolver.set("db.example.com", "2001:db8::1", "10.0.0.1", "10.0.0.2")
+	hosts := newHostCache(resolver, time.Minute, zap.NewNop())
+
+	addrs, err := hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs[0], qt.Equals, "[2001:db8::1]:3307")
+
+	// new connections start with the address after the one that failed
+	hosts.failed("db.example.com:3307", "[2001:db8::1]:3307")
+	addrs, err = hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs, qt.DeepEquals, []string{"10.0.0.1:3307", "10.0.0.2:3307", "[2001:db8::1]:3307"})
+
+	// an address that isn't tried first anymore doesn't move them again
+	hosts.failed("db.example.com:3307", "[2001:db8::1]:3307")
+	addrs, err = hosts.addrs(ctx, "db.example.com:3307")
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs[0], qt.Equals, "10.0.0.1:3307")
+}
+
+func TestClient_ResolveInterval(t *testing.T) {
+	c := qt.New(t)
+
+	backend := startPlaintextEchoBackend(t)
+	_, port, err := net.SplitHostPort(backend)
+	c.Assert(err, qt.IsNil)
+
+	resolver := &fakeHostResolver{}
+	// the backend only listens on 127.0.0.1, 127.0.0.2 refuses the connections
+	resolver.set("db.example.com", "127.0.0.2", "127.0.0.1")
+
+	opts := testListenOptions(t)
+	opts.InsecureRemotePlaintext = true
+	opts.RemoteAddr = net.JoinHostPort("db.example.com", port)
+	opts.HostResolver = resolver
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.hosts.interval, qt.Equals, defaultResolveInterval)
+	startClient(t, client)
+
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", client.currentListener().Addr().String())
+		c.Assert(err, qt.IsNil)
+		_, err = conn.Write([]byte("ping"))
+		c.Assert(err, qt.IsNil)
+		buf := make([]byte, 4)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second)) // nolint: errcheck
+		_, err = conn.Read(buf)
+		c.Assert(err, qt.IsNil)
+		c.Assert(string(buf), qt.Equals, "ping")
+		conn.Close()
+	}
+
+	// the second connection started with the address that worked
+	addrs, err := client.hosts.addrs(context.Background(), opts.RemoteAddr)
+	c.Assert(err, qt.IsNil)
+	c.Assert(addrs[0], qt.Equals, net.JoinHostPort("127.0.0.1", port))
+	c.Assert(resolver.lookups, qt.Equals, 1)
+}
+
+func TestNewClient_ResolveInterval(t *testing.T) {
+	c := qt.New(t)
+
+	opts := testListenOptions(t)
+	opts.ResolveInterval = -time.Second
+	_, err := NewClient(opts)
+	c.Assert(err, qt.ErrorMatches, "ResolveInterval must not be negative")
+
+	opts.ResolveInterval = 0
+	client, err := NewClient(opts)
+	c.Assert(err, qt.IsNil)
+	c.Assert(client.hosts, qt.IsNil)
+}
@@ -0,0 +1,71 @@
+package proxy
+
+import (
+	"container/list"
+	"context"
+	"sync"
+)
+
+// connSemaphore caps the number of active connections. The connections
+// waiting for a slot get one in the order they started waiting.
+type connSemaphore struct {
+	max uint64
+
+	mu      sync.Mutex // protects active and waiters
+	active  uint64
+	waiters list.List // of chan struct{}, closed once the waiter got a slot
+}
+
+func newConnSemaphore(max uint64) *connSemaphore {
+	return &connSemaphore{max: max}
+}
+
+// acquire takes a slot. If there's none free and wait is set, it waits for
+// one until ctx is done. waited reports whether it had to wait, ok whether
+// it got a slot.
+func (s *connSemaphore) acquire(ctx context.Context, wait bool) (waited, ok bool) {
+	s.mu.Lock()
+	// the connections waiting already go first
+	if s.active < s.max && s.waiters.Len() == 0 {
+		s.active++
+		s.mu.Unlock()
+		return false, true
+	}
+	if !wait {
+		s.mu.Unlock()
+		return false, false
+	}
+	ready := make(chan struct{})
+	elem := s.waiters.PushBack(ready)
+	s.mu.Unlock()
+
+	select {
+	case <-ready:
+		return true, true
+	case <-ctx.Done():
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	select {
+	case <-ready:
+		// it got a slot in the meantime
+		return true, true
+	default:
+	}
+	s.waiters.Remove(elem)
+	return true, false
+}
+
+// release frees a slot, handing it to the connection waiting the longest,
+// if any.
+func (s *connSemaphore) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.active--
+	if front := s.waiters.Front(); front != nil {
+		s.active++
+		close(s.waiters.Remove(front).(chan struct{}))
+	}
+}
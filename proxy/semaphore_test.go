@@ -0,0 +1,76 @@
+package proxy
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestConnSemaphore(t *testing.T) {
+	c := qt.New(t)
+	ctx := context.Background()
+
+	s := newConnSemaphore(1)
+	waited, ok := s.acquire(ctx, false)
+	c.Assert(waited, qt.IsFalse)
+	c.Assert(ok, qt.IsTrue)
+
+	// no slot left
+	_, ok = s.acquire(ctx, false)
+	c.Assert(ok, qt.IsFalse)
+
+	// the waiters get the freed slots in order
+	order := make(chan int, 3)
+	for i := 0; i < 3; i++ {
+		i := i
+		go func() {
+			waited, ok := s.acquire(ctx, true)
+			c.Check(waited, qt.IsTrue)
+			c.Check(ok, qt.IsTrue)
+			order <- i
+		}()
+		for waiters(s) < i+1 {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	// a connection that doesn't wait doesn't jump the queue
+	s.release()
+	_, ok = s.acquire(ctx, false)
+	c.Assert(ok, qt.IsFalse)
+
+	c.Assert(<-order, qt.Equals, 0)
+	s.release()
+	c.Assert(<-order, qt.Equals, 1)
+	s.release()
+	c.Assert(<-order, qt.Equals, 2)
+}
+
+func TestConnSemaphore_WaitExpires(t *testing.T) {
+	c := qt.New(t)
+
+	s := newConnSemaphore(1)
+	_, ok := s.acquire(context.Background(), false)
+	c.Assert(ok, qt.IsTrue)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	waited, ok := s.acquire(ctx, true)
+	c.Assert(waited, qt.IsTrue)
+	c.Assert(ok, qt.IsFalse)
+	c.Assert(waiters(s), qt.Equals, 0)
+
+	// the expired waiter doesn't get the freed slot
+	s.release()
+	waited, ok = s.acquire(context.Background(), false)
+	c.Assert(waited, qt.IsFalse)
+	c.Assert(ok, qt.IsTrue)
+}
+
+func waiters(s *connSemaphore) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.waiters.Len()
+}
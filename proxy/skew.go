@@ -0,0 +1,86 @@
+package proxy
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultClockSkewTolerance is how long the setup waits by default for a
+// client certificate issued in the future to become valid.
+const defaultClockSkewTolerance = 5 * time.Second
+
+// waitClientCertValid waits for the client certificate of the given cert of
+// the instance to become valid, if it's not valid yet but will be within the
+// clock skew tolerance. The cert source issues certificates valid from the
+// time of its own clock, which the clock of this host may be behind, so the
+// remote server would reject them.
+func (c *Client) waitClientCertValid(ctx context.Context, instance string, cert *Cert) error {
+	if cert.ServerAuthOnly {
+		return nil
+	}
+	leaf := cert.ClientCert.Leaf
+	if leaf == nil {
+		var err error
+		if leaf, err = x509.ParseCertificate(cert.ClientCert.Certificate[0]); err != nil {
+			return err
+		}
+	}
+
+	skew := time.Until(leaf.NotBefore)
+	if skew <= 0 {
+		return nil
+	}
+	if skew > c.clockSkewTolerance {
+		c.log.Warn("client certificate isn't valid yet, the clock of this host is likely behind the one of the cert source, check NTP",
+			zap.String("instance", instance),
+			zap.Duration("skew", skew),
+			zap.Duration("tolerance", c.clockSkewTolerance))
+		return nil
+	}
+
+	c.log.Warn("client certificate isn't valid yet, waiting for it, the clock of this host is likely behind the one of the cert source, check NTP",
+		zap.String("instance", instance),
+		zap.Duration("skew", skew))
+	timer := time.NewTimer(skew)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// isValidityError reports whether the given setup error may be caused by a
+// certificate used outside of its validity period, i.e: because of the
+// clock skew between this host, the cert source and the remote server.
+func isValidityError(err error) bool {
+	var certInvalidErr x509.CertificateInvalidError
+	if errors.As(err, &certInvalidErr) {
+		return certInvalidErr.Reason == x509.Expired
+	}
+
+	var handshakeErr *HandshakeError
+	if !errors.As(err, &handshakeErr) {
+		return false
+	}
+	// the alerts of the remote server aren't exported by crypto/tls. Go
+	// servers send a bad certificate alert whatever the verification of the
+	// client certificate failed on, OpenSSL ones an expired certificate
+	// alert for the certificates outside of their validity period.
+	msg := handshakeErr.Err.Error()
+	return strings.Contains(msg, "remote error: tls: expired certificate") ||
+		strings.Contains(msg, "remote error: tls: bad certificate")
+}
+
+// certsInvalidated reports whether the given setup error dropped the cached
+// certificates of the instance, see invalidateFailedCerts.
+func certsInvalidated(err error) bool {
+	var handshakeErr *HandshakeError
+	return errors.As(err, &handshakeErr) && handshakeErr.certsInvalidated
+}
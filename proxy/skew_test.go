@@ -0,0 +1,178 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClient_ClockSkewTolerance(t *testing.T) {
+	// the validity period of the certificates is in seconds, the actual
+	// skew is between 0.5 and 1.5 seconds
+	const skew = 1500 * time.Millisecond
+
+	tests := []struct {
+		name      string
+		tolerance time.Duration
+		wantWait  bool
+	}{
+		{
+			name:     "within the default tolerance",
+			wantWait: true,
+		},
+		{
+			name:      "beyond the tolerance",
+			tolerance: 100 * time.Millisecond,
+		},
+		{
+			name:      "disabled",
+			tolerance: -1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+			}, echoHandler)
+
+			// the clock of the cert source is ahead of the one of the host
+			certSource := backendCertSource(t, ca, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				cert, err := certFn(ctx, org, db, branch)
+				if err != nil {
+					return nil, err
+				}
+				cert.ClientCert = ca.issue(t, &x509.Certificate{
+					SerialNumber: big.NewInt(1),
+					Subject:      pkix.Name{CommonName: "client"},
+					NotBefore:    time.Now().Add(skew),
+					ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+				})
+				return cert, nil
+			}
+
+			core, logs := observer.New(zap.WarnLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.CertSource = certSource
+			testOpts.ClockSkewTolerance = tt.tolerance
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			start := time.Now()
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+
+			waited := time.Since(start) >= 400*time.Millisecond
+			c.Assert(waited, qt.Equals, tt.wantWait)
+
+			entries := logs.FilterField(zap.String("instance", "myorg/mydb/mybranch")).All()
+			c.Assert(entries, qt.Not(qt.HasLen), 0)
+			c.Assert(entries[0].ContextMap()["skew"], qt.Not(qt.IsNil))
+		})
+	}
+}
+
+func TestClient_ValidityRefresh(t *testing.T) {
+	ca := newTestCA(t)
+
+	// the backend verifies the client certificates
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		// a TLS 1.3 server rejects the client certificate after the
+		// handshake completed on the side of the client
+		MaxVersion: tls.VersionTLS12,
+		ClientCAs:  certPool([]*x509.Certificate{ca.cert}),
+	}, echoHandler)
+
+	expired := ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now().Add(-2 * time.Hour),
+		NotAfter:     time.Now().Add(-time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+
+	tests := []struct {
+		name      string
+		expired   int64
+		dials     int
+		wantErr   bool
+		wantCalls int64
+	}{
+		{
+			name:      "expired certificate refreshed",
+			expired:   1,
+			wantCalls: 2,
+		},
+		{
+			// the certs are only refreshed once
+			name:      "refreshed certificate expired",
+			expired:   2,
+			wantErr:   true,
+			wantCalls: 2,
+		},
+		{
+			// the next connections keep the certs refreshed recently
+			name:      "refresh rate limited",
+			expired:   10,
+			dials:     5,
+			wantErr:   true,
+			wantCalls: 2,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			var calls int64
+			certSource := backendCertSource(t, ca, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				cert, err := certFn(ctx, org, db, branch)
+				if err == nil && atomic.AddInt64(&calls, 1) <= tt.expired {
+					cert.ClientCert = expired
+				}
+				return cert, err
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			testOpts.SetupRetries = 0
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			dials := tt.dials
+			if dials == 0 {
+				dials = 1
+			}
+			for i := 0; i < dials; i++ {
+				conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+				if tt.wantErr {
+					c.Assert(err, qt.ErrorMatches, ".*remote error: tls: .*")
+				} else {
+					c.Assert(err, qt.IsNil)
+					conn.Close()
+				}
+			}
+			c.Assert(atomic.LoadInt64(&calls), qt.Equals, tt.wantCalls)
+		})
+	}
+}
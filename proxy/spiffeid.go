@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+)
+
+// parseSPIFFEID validates the given SPIFFE ID, i.e:
+// "spiffe://example.org/db/main", and returns it in its canonical form.
+func parseSPIFFEID(id string) (string, error) {
+	u, err := url.Parse(id)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case u.Scheme != "spiffe":
+		return "", fmt.Errorf("%q doesn't have the spiffe scheme", id)
+	case u.Host == "":
+		return "", fmt.Errorf("%q has no trust domain", id)
+	case u.User != nil || u.Port() != "" || u.RawQuery != "" || u.Fragment != "":
+		return "", fmt.Errorf("%q can't have a user, a port, a query or a fragment", id)
+	}
+	return u.String(), nil
+}
+
+// verifySPIFFEID verifies that the given certificate is an X.509-SVID of the
+// given SPIFFE ID: it has a single URI SAN, the ID.
+func verifySPIFFEID(cert *x509.Certificate, id string) error {
+	switch len(cert.URIs) {
+	case 0:
+		return errors.New("x509: certificate has no SPIFFE ID")
+	case 1:
+	default:
+		return fmt.Errorf("x509: certificate has %d URI SANs, an X.509-SVID has a single one", len(cert.URIs))
+	}
+	if got := cert.URIs[0].String(); got != id {
+		return fmt.Errorf("x509: certificate SPIFFE ID is %q, not %q", got, id)
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"math/big"
+	"net/url"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestParseSPIFFEID(t *testing.T) {
+	tests := []struct {
+		id      string
+		want    string
+		wantErr string
+	}{
+		{id: "spiffe://example.org/db/main", want: "spiffe://example.org/db/main"},
+		{id: "spiffe://example.org", want: "spiffe://example.org"},
+		{id: "https://example.org/db", wantErr: `"https://example.org/db" doesn't have the spiffe scheme`},
+		{id: "spiffe:///db", wantErr: `"spiffe:///db" has no trust domain`},
+		{id: "spiffe://example.org:443/db", wantErr: `"spiffe://example.org:443/db" can't have a user, a port, a query or a fragment`},
+		{id: "spiffe://example.org/db?x=1", wantErr: `"spiffe://example.org/db\?x=1" can't have a user, a port, a query or a fragment`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			c := qt.New(t)
+			got, err := parseSPIFFEID(tt.id)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(got, qt.Equals, tt.want)
+		})
+	}
+}
+
+// svid issues an X.509-SVID server certificate for the given SPIFFE IDs.
+func (ca *testCA) svid(t testing.TB, ids ...string) tls.Certificate {
+	var uris []*url.URL
+	for _, id := range ids {
+		u, err := url.Parse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		uris = append(uris, u)
+	}
+	return ca.issue(t, &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		URIs:         uris,
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	})
+}
+
+func TestClient_ServerSPIFFEID(t *testing.T) {
+	ca := newTestCA(t)
+
+	tests := []struct {
+		name       string
+		serverCert func(t *testing.T) tls.Certificate
+		wantErr    string
+	}{
+		{
+			name:       "matching SVID",
+			serverCert: func(t *testing.T) tls.Certificate { return ca.svid(t, "spiffe://example.org/db/main") },
+		},
+		{
+			name:       "other SPIFFE ID",
+			serverCert: func(t *testing.T) tls.Certificate { return ca.svid(t, "spiffe://example.org/db/other") },
+			wantErr:    `.*peer certificate rejected: x509: certificate SPIFFE ID is "spiffe://example.org/db/other", not "spiffe://example.org/db/main"`,
+		},
+		{
+			name: "several URI SANs",
+			serverCert: func(t *testing.T) tls.Certificate {
+				return ca.svid(t, "spiffe://example.org/db/main", "spiffe://example.org/db/other")
+			},
+			wantErr: `.*peer certificate rejected: x509: certificate has 2 URI SANs, an X.509-SVID has a single one`,
+		},
+		{
+			// the name of the server doesn't count anymore
+			name:       "matching name",
+			serverCert: func(t *testing.T) tls.Certificate { return ca.serverCert(t, 42) },
+			wantErr:    `.*peer certificate rejected: x509: certificate has no SPIFFE ID`,
+		},
+		{
+			name: "other CA",
+			serverCert: func(t *testing.T) tls.Certificate {
+				return newNamedTestCA(t, "Other CA").svid(t, "spiffe://example.org/db/main")
+			},
+			wantErr: `.*certificate signed by unknown authority.*`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{tt.serverCert(t)},
+			}, echoHandler)
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.ServerSPIFFEID = "spiffe://example.org/db/main"
+			testOpts.SetupRetries = -1
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				c.Assert(isRetryable(err), qt.IsFalse)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			c.Assert(conn.Close(), qt.IsNil)
+		})
+	}
+}
+
+func TestNewClient_ServerSPIFFEID(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.ServerSPIFFEID = "https://example.org/db"
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `invalid ServerSPIFFEID: "https://example.org/db" doesn't have the spiffe scheme`)
+
+	testOpts = testOptions(t)
+	testOpts.ServerSPIFFEID = "spiffe://example.org/db"
+	testOpts.ServerVerifier = func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return nil
+	}
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "ServerSPIFFEID can't be combined with ServerVerifier")
+}
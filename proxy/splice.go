@@ -0,0 +1,75 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// spliceChunkSize is how much data is handed to the kernel at once when
+// splicing, so the byte counters of the tunnel keep up with the transfer.
+// The bytes of a chunk are counted once it's done, or the copy ends.
+const spliceChunkSize = 1 << 20
+
+// spliceConns returns the TCP connections under dst and src if the data
+// between them can be copied by the kernel, with splice(2) on Linux, rather
+// than through a buffer. That's the case for the plaintext tunnels whose data
+// isn't inspected, limited, captured or watched for stalls, which need the
+// bytes counted as they're copied. count adds the copied bytes to the
+// counters of the tunnel.
+func spliceConns(dst io.Writer, src io.Reader) (dstConn, srcConn *net.TCPConn, count func(n int64), ok bool) {
+	dstConn, dstTunnel, ok := spliceableConn(dst)
+	if !ok {
+		return nil, nil, nil, false
+	}
+	srcConn, srcTunnel, ok := spliceableConn(src)
+	if !ok {
+		return nil, nil, nil, false
+	}
+
+	count = func(n int64) {
+		if dstTunnel != nil {
+			dstTunnel.countIn(n)
+		}
+		if srcTunnel != nil {
+			srcTunnel.countOut(n)
+		}
+	}
+	return dstConn, srcConn, count, true
+}
+
+// spliceableConn returns the TCP connection of the given end of a copy, and
+// the tunnel it belongs to if it's the remote end.
+func spliceableConn(conn interface{}) (*net.TCPConn, *dialedConn, bool) {
+	switch conn := conn.(type) {
+	case *net.TCPConn:
+		return conn, nil, true
+	case *dialedConn:
+		tcpConn, ok := conn.Conn.(*net.TCPConn)
+		if !ok || conn.quota > 0 || conn.capture != nil || conn.stallTimeout > 0 {
+			return nil, nil, false
+		}
+		return tcpConn, conn, true
+	}
+	return nil, nil, false
+}
+
+// spliceCopy copies from src to dst until src is closed or an error occurs,
+// like myCopy. The kernel doesn't tell which end failed, the errors are
+// reported as read errors unless they're EPIPE, which only writes return.
+func spliceCopy(dst, src *net.TCPConn, count func(n int64)) (written int64, readErr bool, err error) {
+	for {
+		chunk := &io.LimitedReader{R: src, N: spliceChunkSize}
+		n, err := dst.ReadFrom(chunk)
+		written += n
+		count(n)
+		if err != nil {
+			return written, !errors.Is(err, syscall.EPIPE), err
+		}
+		if chunk.N > 0 {
+			// src was closed before the end of the chunk
+			return written, true, io.EOF
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+// tcpPair returns both ends of a TCP connection over the loopback address.
+func tcpPair(tb testing.TB) (client, server *net.TCPConn) {
+	tb.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := l.Accept()
+		accepted <- conn
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server, ok := (<-accepted).(*net.TCPConn)
+	if !ok {
+		tb.Fatal("couldn't accept the connection")
+	}
+	tb.Cleanup(func() {
+		conn.Close()
+		server.Close()
+	})
+	return conn.(*net.TCPConn), server
+}
+
+func TestSpliceConns(t *testing.T) {
+	c := qt.New(t)
+
+	local, remote := tcpPair(t)
+	pipe, _ := net.Pipe()
+
+	tests := []struct {
+		name string
+		dst  io.Writer
+		want bool
+	}{
+		{name: "TCP", dst: remote, want: true},
+		{name: "plaintext tunnel", dst: &dialedConn{Conn: remote}, want: true},
+		{name: "TLS tunnel", dst: &dialedConn{Conn: tls.Client(remote, &tls.Config{})}},
+		{name: "tunnel with quota", dst: &dialedConn{Conn: remote, quota: 1024}},
+		{name: "captured tunnel", dst: &dialedConn{Conn: remote, capture: &connCapture{}}},
+		{name: "watched tunnel", dst: &dialedConn{Conn: remote, stallTimeout: time.Minute}},
+		{name: "inspected tunnel", dst: &greetingConn{Conn: &dialedConn{Conn: remote}}},
+		{name: "pipe", dst: pipe},
+	}
+
+	for _, tt := range tests {
+		c.Run(tt.name, func(c *qt.C) {
+			_, _, _, ok := spliceConns(tt.dst, local)
+			c.Assert(ok, qt.Equals, tt.want)
+			_, _, _, ok = spliceConns(local, tt.dst.(io.Reader))
+			c.Assert(ok, qt.Equals, tt.want)
+		})
+	}
+}
+
+func TestClient_Splice(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "local/db/main"
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	events := client.Events()
+	addr := startClient(t, client)
+
+	conn, err := net.Dial("tcp", addr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	data := make([]byte, 4*spliceChunkSize+1)
+	_, err = rand.Read(data)
+	c.Assert(err, qt.IsNil)
+	go conn.Write(data) // nolint: errcheck
+
+	echoed := make([]byte, len(data))
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second)) // nolint: errcheck
+	_, err = io.ReadFull(conn, echoed)
+	c.Assert(err, qt.IsNil)
+	c.Assert(bytes.Equal(echoed, data), qt.IsTrue)
+
+	// the bytes of the chunk being spliced are counted once it's done, the
+	// counts are exact once the tunnel is closed
+	conn.Close()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e := <-events:
+			if e.Type != EventDisconnect {
+				continue
+			}
+			c.Assert(e.BytesIn, qt.Equals, int64(len(data)))
+			c.Assert(e.BytesOut, qt.Equals, int64(len(data)))
+		case <-timeout:
+			c.Fatal("the connection wasn't closed")
+		}
+		break
+	}
+}
+
+// BenchmarkMyCopy_TCPToTCP measures copying between two TCP connections
+// through a buffer and by the kernel.
+func BenchmarkMyCopy_TCPToTCP(b *testing.B) {
+	chunk := bytes.Repeat([]byte("x"), 1<<20)
+
+	run := func(b *testing.B, wrap func(dst *net.TCPConn) io.Writer) {
+		srcWriter, src := tcpPair(b)
+		dst, dstReader := tcpPair(b)
+
+		go func() {
+			for i := 0; i < b.N; i++ {
+				if _, err := srcWriter.Write(chunk); err != nil {
+					return
+				}
+			}
+			srcWriter.Close()
+		}()
+		go io.Copy(io.Discard, dstReader) // nolint: errcheck
+
+		b.SetBytes(int64(len(chunk)))
+		b.ResetTimer()
+		n, _, err := myCopy(wrap(dst), src, defaultCopyBufferSize)
+		if err != io.EOF {
+			b.Fatal(err)
+		}
+		if n != int64(b.N*len(chunk)) {
+			b.Fatalf("copied %d bytes, want %d", n, b.N*len(chunk))
+		}
+	}
+
+	b.Run("buffered", func(b *testing.B) {
+		// hiding the connection makes myCopy use its buffer
+		run(b, func(dst *net.TCPConn) io.Writer { return struct{ io.Writer }{dst} })
+	})
+	b.Run("spliced", func(b *testing.B) {
+		run(b, func(dst *net.TCPConn) io.Writer { return dst })
+	})
+}
@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// StaticCertSource serves the certificates of in-memory PEM blobs for every
+// instance, i.e: the ones retrieved from a secrets manager at startup. Update
+// replaces them at runtime.
+//
+// The certificates hold no remote address, Options.RemoteAddr must be set,
+// and Options.ServerName to verify the name of the remote server.
+type StaticCertSource struct {
+	mu sync.Mutex // protects the fields below
+	// cert holds the certificates of the blobs given last.
+	cert *Cert
+	// reloaded is closed once cert is replaced.
+	reloaded chan struct{}
+}
+
+var _ ReloadingCertSource = (*StaticCertSource)(nil)
+
+// NewStaticCertSource returns a StaticCertSource serving the given PEM
+// encoded client certificate, private key and CA certificates to verify the
+// remote servers against. The client certificate blob may hold
+// intermediates after the client's certificate, the CA one as many
+// certificates as needed. Without CA certificates the system roots are used.
+func NewStaticCertSource(clientCertPEM, clientKeyPEM, caPEM []byte) (*StaticCertSource, error) {
+	cert, err := parseCertPEM(clientCertPEM, clientKeyPEM, caPEM)
+	if err != nil {
+		return nil, err
+	}
+	return &StaticCertSource{
+		cert:     cert,
+		reloaded: make(chan struct{}),
+	}, nil
+}
+
+// Cert returns the certificates of the blobs given last, whatever the
+// instance.
+func (s *StaticCertSource) Cert(ctx context.Context, org, db, branch string) (*Cert, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cert := *s.cert
+	return &cert, nil
+}
+
+// Update replaces the certificates with the ones of the given PEM blobs,
+// validated like NewStaticCertSource does. The new connections use them,
+// the established ones are left alone. The previous certificates are kept
+// if the blobs are invalid.
+func (s *StaticCertSource) Update(clientCertPEM, clientKeyPEM, caPEM []byte) error {
+	cert, err := parseCertPEM(clientCertPEM, clientKeyPEM, caPEM)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cert = cert
+	close(s.reloaded)
+	s.reloaded = make(chan struct{})
+	return nil
+}
+
+// Reloaded returns a channel that is closed the next time Update replaces
+// the certificates.
+func (s *StaticCertSource) Reloaded() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.reloaded
+}
+
+// parseCertPEM parses and validates the given PEM encoded client
+// certificate, with its intermediates if any, its private key and the CA
+// certificates, which are optional. The private key must match the
+// certificate, and the CA certificates must be certificate authorities, the
+// self-signed ones with a valid signature. The errors name the blob that
+// failed to parse.
+func parseCertPEM(clientCertPEM, clientKeyPEM, caPEM []byte) (*Cert, error) {
+	if _, err := parseCertsPEM(clientCertPEM); err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	if err := checkKeyPEM(clientKeyPEM); err != nil {
+		return nil, fmt.Errorf("invalid client key: %w", err)
+	}
+	clientCert, err := tls.X509KeyPair(clientCertPEM, clientKeyPEM)
+	if err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	if clientCert.Leaf, err = x509.ParseCertificate(clientCert.Certificate[0]); err != nil {
+		return nil, fmt.Errorf("invalid client certificate: %w", err)
+	}
+
+	var caCerts []*x509.Certificate
+	if len(caPEM) > 0 {
+		if caCerts, err = parseCertsPEM(caPEM); err != nil {
+			return nil, fmt.Errorf("invalid CA certificates: %w", err)
+		}
+		for _, ca := range caCerts {
+			if !ca.BasicConstraintsValid || !ca.IsCA {
+				return nil, fmt.Errorf("invalid CA certificates: %q isn't a certificate authority", ca.Subject)
+			}
+			if string(ca.RawIssuer) != string(ca.RawSubject) {
+				continue
+			}
+			if err := ca.CheckSignatureFrom(ca); err != nil {
+				return nil, fmt.Errorf("invalid CA certificates: invalid signature of %q: %w", ca.Subject, err)
+			}
+		}
+	}
+
+	return &Cert{
+		ClientCert: clientCert,
+		CACerts:    caCerts,
+		Expiry:     clientCert.Leaf.NotAfter,
+	}, nil
+}
+
+// checkKeyPEM checks that the given data holds a single PEM encoded private
+// key, and nothing else.
+func checkKeyPEM(data []byte) error {
+	var keys int
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if !strings.HasSuffix(block.Type, "PRIVATE KEY") {
+			return fmt.Errorf("unexpected PEM block %q", block.Type)
+		}
+		keys++
+	}
+	switch {
+	case keys == 0:
+		return errors.New("no private key found")
+	case keys > 1:
+		return errors.New("more than one private key")
+	}
+	return nil
+}
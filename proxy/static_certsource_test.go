@@ -0,0 +1,150 @@
+package proxy
+
+import (
+	"context"
+	"encoding/pem"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestNewStaticCertSource(t *testing.T) {
+	ca := newTestCA(t)
+	otherCA := newNamedTestCA(t, "Other CA")
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+	_, otherKeyPEM, otherCAPEM := testCertPEM(t, otherCA)
+	notCAPEM := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.clientCert(t, "client").Certificate[0]}))
+
+	tests := []struct {
+		name    string
+		certPEM string
+		keyPEM  string
+		caPEM   string
+		wantCAs int
+		wantErr string
+	}{
+		{
+			name:    "valid",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+			caPEM:   caPEM,
+			wantCAs: 1,
+		},
+		{
+			name:    "CA bundle",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+			caPEM:   caPEM + otherCAPEM,
+			wantCAs: 2,
+		},
+		{
+			name:    "system roots",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+		},
+		{
+			name:    "invalid certificate",
+			certPEM: "garbage",
+			keyPEM:  keyPEM,
+			wantErr: "invalid client certificate: no certificates found",
+		},
+		{
+			name:    "key instead of the certificate",
+			certPEM: keyPEM,
+			keyPEM:  keyPEM,
+			wantErr: `invalid client certificate: unexpected PEM block "PRIVATE KEY"`,
+		},
+		{
+			name:    "invalid key",
+			certPEM: certPEM,
+			keyPEM:  "garbage",
+			wantErr: "invalid client key: no private key found",
+		},
+		{
+			name:    "two keys",
+			certPEM: certPEM,
+			keyPEM:  keyPEM + otherKeyPEM,
+			wantErr: "invalid client key: more than one private key",
+		},
+		{
+			name:    "key mismatch",
+			certPEM: certPEM,
+			keyPEM:  otherKeyPEM,
+			wantErr: "invalid client certificate: tls: private key does not match public key",
+		},
+		{
+			// the text around the PEM blocks is ignored, like by crypto/x509
+			name:    "CA with trailing text",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+			caPEM:   caPEM + "trailing text",
+			wantCAs: 1,
+		},
+		{
+			name:    "no CA",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+			caPEM:   "garbage",
+			wantErr: "invalid CA certificates: no certificates found",
+		},
+		{
+			name:    "not a CA",
+			certPEM: certPEM,
+			keyPEM:  keyPEM,
+			caPEM:   caPEM + notCAPEM,
+			wantErr: `invalid CA certificates: "CN=client" isn't a certificate authority`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			s, err := NewStaticCertSource([]byte(tt.certPEM), []byte(tt.keyPEM), []byte(tt.caPEM))
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+
+			cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+			c.Assert(err, qt.IsNil)
+			c.Assert(validateCert(cert), qt.IsNil)
+			c.Assert(cert.ClientCert.Leaf, qt.Not(qt.IsNil))
+			c.Assert(cert.CACerts, qt.HasLen, tt.wantCAs)
+		})
+	}
+}
+
+func TestStaticCertSource_Update(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	certPEM, keyPEM, caPEM := testCertPEM(t, ca)
+
+	s, err := NewStaticCertSource([]byte(certPEM), []byte(keyPEM), []byte(caPEM))
+	c.Assert(err, qt.IsNil)
+	reloaded := s.Reloaded()
+
+	// the invalid blobs are rejected, the certificates are kept
+	err = s.Update([]byte(certPEM), nil, []byte(caPEM))
+	c.Assert(err, qt.ErrorMatches, "invalid client key: no private key found")
+	select {
+	case <-reloaded:
+		c.Fatal("the certificates were replaced")
+	default:
+	}
+
+	newCertPEM, newKeyPEM, _ := testCertPEM(t, ca)
+	err = s.Update([]byte(newCertPEM), []byte(newKeyPEM), []byte(caPEM))
+	c.Assert(err, qt.IsNil)
+	select {
+	case <-reloaded:
+	default:
+		c.Fatal("the certificates weren't replaced")
+	}
+
+	cert, err := s.Cert(context.Background(), "myorg", "mydb", "main")
+	c.Assert(err, qt.IsNil)
+	block, _ := pem.Decode([]byte(newCertPEM))
+	c.Assert(cert.ClientCert.Certificate[0], qt.DeepEquals, block.Bytes)
+}
@@ -0,0 +1,414 @@
+package proxy
+
+import (
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Stats holds counters about the connections handled by a Client.
+type Stats struct {
+	// Connections is the number of tunnels that were established.
+	Connections uint64 `json:"connections"`
+
+	// SetupFailures is the number of tunnels that couldn't be established,
+	// or were refused.
+	SetupFailures uint64 `json:"setup_failures"`
+
+	// SetupFailuresByPhase is the number of SetupFailures by the failed
+	// SetupPhase. Refused connections and failures outside of the setup
+	// phases are counted as "other".
+	SetupFailuresByPhase map[string]uint64 `json:"setup_failures_by_phase,omitempty"`
+
+	// CertErrorsByKind is the number of setup failures of the PhaseCert
+	// phase by the CertErrorKind of the error of the CertSource.
+	CertErrorsByKind map[string]uint64 `json:"cert_errors_by_kind,omitempty"`
+
+	// SetupRetries is the number of times a failed connection setup was
+	// retried.
+	SetupRetries uint64 `json:"setup_retries"`
+
+	// EventsDropped is the number of events that were dropped because the
+	// consumer of the Events channel didn't keep up.
+	EventsDropped uint64 `json:"events_dropped"`
+
+	// RejectedPeers is the number of accepted connections that were closed
+	// because the connecting peer, or its network, wasn't allowed.
+	RejectedPeers uint64 `json:"rejected_peers"`
+
+	// ListenerRestarts is the number of times the local listener was
+	// re-created after it failed.
+	ListenerRestarts uint64 `json:"listener_restarts"`
+
+	// Queued is the number of accepted connections currently waiting to be
+	// handled.
+	Queued uint64 `json:"queued"`
+
+	// ProbeConnections is the number of local connections that were closed
+	// by the client before the tunnel was set up, without sending any data,
+	// such as the ones of TCP health checks.
+	ProbeConnections uint64 `json:"probe_connections"`
+
+	// ConnectionsWaited is the number of connections that got a slot of
+	// MaxConnections after waiting for one, see MaxConnectionsWait.
+	ConnectionsWaited uint64 `json:"connections_waited"`
+
+	// ConnectionsRejected is the number of connections that were refused
+	// because MaxConnections was reached, after waiting for a slot if
+	// MaxConnectionsWait is set. They count as SetupFailures as well.
+	ConnectionsRejected uint64 `json:"connections_rejected"`
+
+	// QuotaExceeded is the number of tunnels that were closed because they
+	// exceeded their MaxBytesPerConnection quota.
+	QuotaExceeded uint64 `json:"quota_exceeded"`
+
+	// BytesIn and BytesOut are the number of bytes sent by the local
+	// clients to the remote servers and back, including the ones of the
+	// active tunnels.
+	BytesIn  uint64 `json:"bytes_in"`
+	BytesOut uint64 `json:"bytes_out"`
+
+	// InstanceBytes is the number of bytes that went through the tunnels of
+	// each instance.
+	InstanceBytes map[string]ByteCounts `json:"instance_bytes,omitempty"`
+
+	// ServerVersions is the number of tunnels by the version of the MySQL
+	// server, as announced in its greeting. It's only recorded if
+	// ParseServerGreetings is set.
+	ServerVersions map[string]uint64 `json:"server_versions,omitempty"`
+
+	// ProtocolConnections is the number of tunnels by the protocol of their
+	// local listener, "classic" or "x".
+	ProtocolConnections map[string]uint64 `json:"protocol_connections,omitempty"`
+
+	// Endpoints holds the last probe results of the RemoteAddrs, if set.
+	Endpoints []EndpointStats `json:"endpoints,omitempty"`
+
+	// Certificates tells when the certificates of the instances expire, as
+	// of the last time they were retrieved from the cert source.
+	Certificates []CertExpiry `json:"certificates,omitempty"`
+}
+
+// clientStats holds the counters of a Client. All fields must be accessed
+// atomically.
+type clientStats struct {
+	connections      uint64
+	setupFailures    uint64
+	setupRetries     uint64
+	eventsDropped    uint64
+	rejectedPeers    uint64
+	listenerRestarts uint64
+	queued           uint64
+	quotaExceeded    uint64
+	probeConnections uint64
+
+	connectionsWaited   uint64
+	connectionsRejected uint64
+
+	// queueWait is the time between accepting a connection and starting to
+	// handle it.
+	queueWait *histogram
+
+	// serverVersions counts the tunnels by the version of the MySQL server.
+	serverVersions keyedCounter
+	// setupFailuresByPhase counts the setup failures by the failed phase.
+	setupFailuresByPhase keyedCounter
+	// certErrorsByKind counts the cert setup failures by kind.
+	certErrorsByKind keyedCounter
+	// protocolConnections counts the tunnels by protocol.
+	protocolConnections keyedCounter
+	// instanceBytes counts the bytes of the tunnels by instance.
+	instanceBytes byteCounters
+}
+
+// maxCounterKeys bounds the number of distinct keys of a keyedCounter, any
+// other key is counted as "other".
+const maxCounterKeys = 32
+
+// keyedCounter counts occurrences by key. It's safe for concurrent use.
+type keyedCounter struct {
+	mu     sync.Mutex
+	counts map[string]uint64
+}
+
+func (k *keyedCounter) add(key string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.counts == nil {
+		k.counts = make(map[string]uint64)
+	}
+	if _, ok := k.counts[key]; !ok && len(k.counts) >= maxCounterKeys {
+		key = "other"
+	}
+	k.counts[key]++
+}
+
+// snapshot returns a copy of the counts, nil if nothing was counted.
+func (k *keyedCounter) snapshot() map[string]uint64 {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if len(k.counts) == 0 {
+		return nil
+	}
+	counts := make(map[string]uint64, len(k.counts))
+	for key, n := range k.counts {
+		counts[key] = n
+	}
+	return counts
+}
+
+// ByteCounts holds the number of bytes that went through tunnels.
+type ByteCounts struct {
+	// In is the number of bytes sent by the local clients, Out the number
+	// of bytes sent back by the remote servers.
+	In  uint64 `json:"in"`
+	Out uint64 `json:"out"`
+}
+
+// byteCounters counts the bytes of the tunnels by instance. It's safe for
+// concurrent use, the counts it returns must be updated atomically.
+type byteCounters struct {
+	mu     sync.Mutex
+	counts map[string]*ByteCounts
+}
+
+// forInstance returns the counts of the given instance, the tunnels keep
+// them so they aren't looked up for every read and write.
+func (b *byteCounters) forInstance(instance string) *ByteCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.counts == nil {
+		b.counts = make(map[string]*ByteCounts)
+	}
+	if _, ok := b.counts[instance]; !ok && len(b.counts) >= maxCounterKeys {
+		instance = "other"
+	}
+	counts, ok := b.counts[instance]
+	if !ok {
+		counts = &ByteCounts{}
+		b.counts[instance] = counts
+	}
+	return counts
+}
+
+// snapshot returns a copy of the counts, nil if nothing was counted.
+func (b *byteCounters) snapshot() map[string]ByteCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if len(b.counts) == 0 {
+		return nil
+	}
+	snapshot := make(map[string]ByteCounts, len(b.counts))
+	for instance, counts := range b.counts {
+		snapshot[instance] = ByteCounts{
+			In:  atomic.LoadUint64(&counts.In),
+			Out: atomic.LoadUint64(&counts.Out),
+		}
+	}
+	return snapshot
+}
+
+func newClientStats() *clientStats {
+	return &clientStats{queueWait: newHistogram(queueWaitBuckets)}
+}
+
+// queueWaitBuckets are the upper bounds of the queue wait histogram.
+var queueWaitBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	5 * time.Second,
+}
+
+// histogram counts durations in fixed buckets. It's safe for concurrent use.
+type histogram struct {
+	// count and sum must be accessed atomically. sum is in nanoseconds.
+	count uint64
+	sum   uint64
+
+	bounds []time.Duration
+	// buckets holds the number of observations per bucket, the last one is
+	// for observations above every bound. Must be accessed atomically.
+	buckets []uint64
+}
+
+func newHistogram(bounds []time.Duration) *histogram {
+	return &histogram{
+		bounds:  bounds,
+		buckets: make([]uint64, len(bounds)+1),
+	}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.bounds) && d > h.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&h.buckets[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	atomic.AddUint64(&h.sum, uint64(d))
+}
+
+// metrics returns the histogram as counters in milliseconds: a cumulative
+// counter per bucket tagged with its upper bound, the number of
+// observations and their sum.
+func (h *histogram) metrics(name string) []metric {
+	metrics := make([]metric, 0, len(h.buckets)+2)
+	var cumulative uint64
+	for i := range h.buckets {
+		cumulative += atomic.LoadUint64(&h.buckets[i])
+		le := "+Inf"
+		if i < len(h.bounds) {
+			le = strconv.FormatInt(h.bounds[i].Milliseconds(), 10)
+		}
+		metrics = append(metrics, metric{
+			name:  name + "_bucket",
+			kind:  metricCounter,
+			value: cumulative,
+			tags:  []string{"le:" + le},
+		})
+	}
+	return append(metrics,
+		metric{name: name + "_count", kind: metricCounter, value: atomic.LoadUint64(&h.count)},
+		metric{name: name + "_sum", kind: metricCounter, value: atomic.LoadUint64(&h.sum) / uint64(time.Millisecond)},
+	)
+}
+
+// Stats returns a snapshot of the client's counters.
+func (c *Client) Stats() Stats {
+	s := Stats{
+		Connections:      atomic.LoadUint64(&c.stats.connections),
+		SetupFailures:    atomic.LoadUint64(&c.stats.setupFailures),
+		SetupRetries:     atomic.LoadUint64(&c.stats.setupRetries),
+		EventsDropped:    atomic.LoadUint64(&c.stats.eventsDropped),
+		RejectedPeers:    atomic.LoadUint64(&c.stats.rejectedPeers),
+		ListenerRestarts: atomic.LoadUint64(&c.stats.listenerRestarts),
+		Queued:           atomic.LoadUint64(&c.stats.queued),
+		QuotaExceeded:    atomic.LoadUint64(&c.stats.quotaExceeded),
+		ProbeConnections: atomic.LoadUint64(&c.stats.probeConnections),
+
+		ConnectionsWaited:   atomic.LoadUint64(&c.stats.connectionsWaited),
+		ConnectionsRejected: atomic.LoadUint64(&c.stats.connectionsRejected),
+	}
+	s.ServerVersions = c.stats.serverVersions.snapshot()
+	s.SetupFailuresByPhase = c.stats.setupFailuresByPhase.snapshot()
+	s.CertErrorsByKind = c.stats.certErrorsByKind.snapshot()
+	s.ProtocolConnections = c.stats.protocolConnections.snapshot()
+	s.InstanceBytes = c.stats.instanceBytes.snapshot()
+	for _, counts := range s.InstanceBytes {
+		s.BytesIn += counts.In
+		s.BytesOut += counts.Out
+	}
+	if c.endpoints != nil {
+		s.Endpoints = c.endpoints.stats()
+	}
+	s.Certificates = c.certExpiry.stats()
+	return s
+}
+
+// metricKind is the kind of a metric.
+type metricKind int
+
+const (
+	// metricCounter is a monotonically increasing value.
+	metricCounter metricKind = iota
+
+	// metricGauge is a value that can go up and down.
+	metricGauge
+)
+
+// metric is a single value of the client's metrics, independent of the
+// backend they're exported to.
+type metric struct {
+	name  string
+	kind  metricKind
+	value uint64
+	// tags are attached to the metric in addition to the client's labels.
+	tags []string
+}
+
+// metrics returns a snapshot of the client's metrics.
+func (c *Client) metrics() []metric {
+	s := c.Stats()
+	metrics := []metric{
+		{name: "connections_active", kind: metricGauge, value: atomic.LoadUint64(&c.connectionsCounter)},
+		{name: "connections_total", kind: metricCounter, value: s.Connections},
+		{name: "setup_failures_total", kind: metricCounter, value: s.SetupFailures},
+		{name: "setup_retries_total", kind: metricCounter, value: s.SetupRetries},
+		{name: "events_dropped_total", kind: metricCounter, value: s.EventsDropped},
+		{name: "rejected_peers_total", kind: metricCounter, value: s.RejectedPeers},
+		{name: "listener_restarts_total", kind: metricCounter, value: s.ListenerRestarts},
+		{name: "connections_queued", kind: metricGauge, value: s.Queued},
+		{name: "quota_exceeded_total", kind: metricCounter, value: s.QuotaExceeded},
+		{name: "probe_connections_total", kind: metricCounter, value: s.ProbeConnections},
+		{name: "connections_waited_total", kind: metricCounter, value: s.ConnectionsWaited},
+		{name: "connections_rejected_total", kind: metricCounter, value: s.ConnectionsRejected},
+	}
+
+	instances := make([]string, 0, len(s.InstanceBytes))
+	for instance := range s.InstanceBytes {
+		instances = append(instances, instance)
+	}
+	sort.Strings(instances)
+	for _, instance := range instances {
+		tags := []string{"instance:" + instance}
+		metrics = append(metrics,
+			metric{name: "bytes_in_total", kind: metricCounter, value: s.InstanceBytes[instance].In, tags: tags},
+			metric{name: "bytes_out_total", kind: metricCounter, value: s.InstanceBytes[instance].Out, tags: tags},
+		)
+	}
+
+	// the expired certificates are reported as expiring now, the gauges
+	// can't be negative
+	for _, cert := range s.Certificates {
+		var left uint64
+		if cert.ExpiresIn > 0 {
+			left = uint64(cert.ExpiresIn)
+		}
+		metrics = append(metrics, metric{
+			name:  "cert_expires_in_seconds",
+			kind:  metricGauge,
+			value: left,
+			tags:  []string{"instance:" + cert.Instance, "cert:" + cert.Cert, "serial:" + cert.Serial},
+		})
+	}
+
+	for _, kind := range sortedKeys(s.CertErrorsByKind) {
+		metrics = append(metrics, metric{
+			name:  "cert_errors_total",
+			kind:  metricCounter,
+			value: s.CertErrorsByKind[kind],
+			tags:  []string{"kind:" + kind},
+		})
+	}
+
+	for _, protocol := range sortedKeys(s.ProtocolConnections) {
+		metrics = append(metrics, metric{
+			name:  "protocol_connections_total",
+			kind:  metricCounter,
+			value: s.ProtocolConnections[protocol],
+			tags:  []string{"protocol:" + protocol},
+		})
+	}
+
+	for _, version := range sortedKeys(s.ServerVersions) {
+		metrics = append(metrics, metric{
+			name:  "mysql_server_connections_total",
+			kind:  metricCounter,
+			value: s.ServerVersions[version],
+			tags:  []string{"server_version:" + version},
+		})
+	}
+
+	return append(metrics, c.stats.queueWait.metrics("queue_wait_ms")...)
+}
@@ -0,0 +1,203 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"github.com/google/go-cmp/cmp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestHistogram(t *testing.T) {
+	c := qt.New(t)
+
+	h := newHistogram([]time.Duration{time.Millisecond, 10 * time.Millisecond})
+	h.observe(0)
+	h.observe(time.Millisecond)
+	h.observe(5 * time.Millisecond)
+	h.observe(time.Second)
+
+	c.Assert(h.metrics("wait_ms"), qt.CmpEquals(cmp.AllowUnexported(metric{})), []metric{
+		{name: "wait_ms_bucket", kind: metricCounter, value: 2, tags: []string{"le:1"}},
+		{name: "wait_ms_bucket", kind: metricCounter, value: 3, tags: []string{"le:10"}},
+		{name: "wait_ms_bucket", kind: metricCounter, value: 4, tags: []string{"le:+Inf"}},
+		{name: "wait_ms_count", kind: metricCounter, value: 4},
+		{name: "wait_ms_sum", kind: metricCounter, value: 1006},
+	})
+}
+
+func TestStatsDExporter_MetricTags(t *testing.T) {
+	c := qt.New(t)
+
+	addr, lines := startStatsDServer(t)
+	exporter, err := newStatsDExporter(StatsDOptions{Addr: addr, Tags: map[string]string{"env": "test"}}, nil, zap.NewNop())
+	c.Assert(err, qt.IsNil)
+	defer exporter.conn.Close()
+
+	h := newHistogram([]time.Duration{time.Millisecond})
+	h.observe(0)
+	exporter.flush(h.metrics("wait_ms"))
+	c.Assert(waitForLine(c, lines, "sql_proxy.wait_ms_bucket:1|c|#env:test,le:1"), qt.Not(qt.Equals), "")
+	c.Assert(waitForLine(c, lines, "sql_proxy.wait_ms_bucket:1|c|#env:test,le:+Inf"), qt.Not(qt.Equals), "")
+
+	// the deltas are kept per bucket
+	h.observe(time.Second)
+	exporter.flush(h.metrics("wait_ms"))
+	c.Assert(waitForLine(c, lines, "sql_proxy.wait_ms_bucket:0|c|#env:test,le:1"), qt.Not(qt.Equals), "")
+	c.Assert(waitForLine(c, lines, "sql_proxy.wait_ms_bucket:1|c|#env:test,le:+Inf"), qt.Not(qt.Equals), "")
+}
+
+func TestClient_QueueWait(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	// Run fetches the certs once on start, the connection gets stuck on
+	// the next fetch
+	var calls int32
+	release := make(chan struct{})
+	certSource := backendCertSource(t, ca, addr)
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		if atomic.AddInt32(&calls, 1) > 1 {
+			<-release
+		}
+		return certFn(ctx, org, db, branch)
+	}
+
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.Instance = "myorg/mydb/mybranch"
+	testOpts.CertSource = certSource
+	testOpts.Logger = zap.New(core)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	client.slowSetupThreshold = 0
+
+	localAddr := startClient(t, client)
+	conn, err := net.Dial("tcp", localAddr.String())
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	// wait for the connection to be picked up, it's stuck fetching certs
+	for client.stats.queueWait.metrics("")[len(queueWaitBuckets)+1].value == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.Assert(client.Stats().Queued, qt.Equals, uint64(0))
+	close(release)
+
+	_, err = conn.Write([]byte("ping"))
+	c.Assert(err, qt.IsNil)
+	_, err = conn.Read(make([]byte, 4))
+	c.Assert(err, qt.IsNil)
+
+	slow := logs.FilterMessage("slow connection setup").All()
+	c.Assert(slow, qt.HasLen, 1)
+	fields := slow[0].ContextMap()
+	c.Assert(fields["established"], qt.IsTrue)
+	c.Assert(fields["queued"], qt.Not(qt.IsNil))
+	c.Assert(fields["setup"], qt.Not(qt.IsNil))
+}
+
+func TestKeyedCounter(t *testing.T) {
+	c := qt.New(t)
+
+	var k keyedCounter
+	c.Assert(k.snapshot(), qt.IsNil)
+
+	for i := 0; i < maxCounterKeys; i++ {
+		k.add(strconv.Itoa(i))
+	}
+	k.add("0")
+	k.add("8.0.34")
+	k.add("8.0.35")
+
+	counts := k.snapshot()
+	c.Assert(counts, qt.HasLen, maxCounterKeys+1)
+	c.Assert(counts["0"], qt.Equals, uint64(2))
+	c.Assert(counts["other"], qt.Equals, uint64(2))
+}
+
+func TestByteCounters(t *testing.T) {
+	c := qt.New(t)
+
+	var b byteCounters
+	c.Assert(b.snapshot(), qt.IsNil)
+
+	for i := 0; i < maxCounterKeys; i++ {
+		atomic.AddUint64(&b.forInstance(strconv.Itoa(i)).In, 1)
+	}
+	c.Assert(b.forInstance("0"), qt.Equals, b.forInstance("0"))
+	atomic.AddUint64(&b.forInstance("org/db/a").Out, 2)
+	atomic.AddUint64(&b.forInstance("org/db/b").Out, 3)
+
+	counts := b.snapshot()
+	c.Assert(counts, qt.HasLen, maxCounterKeys+1)
+	c.Assert(counts["0"], qt.Equals, ByteCounts{In: 1})
+	c.Assert(counts["other"], qt.Equals, ByteCounts{Out: 5})
+}
+
+func TestClient_Stats_Bytes(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	core, logs := observer.New(zap.DebugLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ping := func(conn net.Conn, size int) {
+		_, err := conn.Write(make([]byte, size))
+		c.Assert(err, qt.IsNil)
+		_, err = io.ReadFull(conn, make([]byte, size))
+		c.Assert(err, qt.IsNil)
+	}
+
+	main, err := client.Dial(context.Background(), "myorg/mydb/main")
+	c.Assert(err, qt.IsNil)
+	defer main.Close()
+	dev, err := client.Dial(context.Background(), "myorg/mydb/dev")
+	c.Assert(err, qt.IsNil)
+	ping(main, 100)
+	ping(dev, 10)
+	dev.Close()
+
+	// the active tunnels count as well
+	ping(main, 100)
+	stats := client.Stats()
+	c.Assert(stats.InstanceBytes, qt.DeepEquals, map[string]ByteCounts{
+		"myorg/mydb/main": {In: 200, Out: 200},
+		"myorg/mydb/dev":  {In: 10, Out: 10},
+	})
+	c.Assert(stats.BytesIn, qt.Equals, uint64(210))
+	c.Assert(stats.BytesOut, qt.Equals, uint64(210))
+	c.Assert(client.metrics(), qt.Any(qt.CmpEquals(cmp.AllowUnexported(metric{}))), metric{
+		name:  "bytes_in_total",
+		kind:  metricCounter,
+		value: 200,
+		tags:  []string{"instance:myorg/mydb/main"},
+	})
+
+	closed := logs.FilterMessage("connection closed").All()
+	c.Assert(closed, qt.HasLen, 1)
+	c.Assert(closed[0].ContextMap()["bytes_in"], qt.Equals, int64(10))
+	c.Assert(closed[0].ContextMap()["bytes_out"], qt.Equals, int64(10))
+}
@@ -0,0 +1,146 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+const (
+	defaultStatsDInterval = 10 * time.Second
+	defaultStatsDPrefix   = "sql_proxy."
+
+	// statsdMaxPacketSize keeps the packets below the usual MTU, so they're
+	// not fragmented.
+	statsdMaxPacketSize = 1432
+)
+
+// StatsDOptions configures pushing the client's metrics to a StatsD server,
+// for environments where metrics can't be scraped.
+type StatsDOptions struct {
+	// Addr is the UDP address of the StatsD server, i.e: "127.0.0.1:8125".
+	// Pushing metrics is disabled if it's empty.
+	Addr string
+
+	// Interval is how often the metrics are pushed. By default it's 10
+	// seconds.
+	Interval time.Duration
+
+	// Prefix is prepended to the name of every metric. By default it's
+	// "sql_proxy.".
+	Prefix string
+
+	// Tags are attached to every metric, in the DogStatsD format.
+	Tags map[string]string
+}
+
+// statsdExporter pushes the metrics of a Client to a StatsD server. Metrics
+// are sent over UDP, so a server that is down never blocks the client and
+// metrics that can't be delivered are dropped.
+type statsdExporter struct {
+	conn     net.Conn
+	interval time.Duration
+	prefix   string
+	tags     string
+	log      *zap.Logger
+
+	// last holds the counter values of the last flush by name and tags, as
+	// StatsD counters are sent as deltas.
+	last map[string]uint64
+}
+
+func newStatsDExporter(opts StatsDOptions, labels map[string]string, log *zap.Logger) (*statsdExporter, error) {
+	conn, err := net.Dial("udp", opts.Addr)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to StatsD server: %w", err)
+	}
+
+	e := &statsdExporter{
+		conn:     conn,
+		interval: opts.Interval,
+		prefix:   opts.Prefix,
+		log:      log,
+		last:     make(map[string]uint64),
+	}
+
+	if e.interval <= 0 {
+		e.interval = defaultStatsDInterval
+	}
+	if e.prefix == "" {
+		e.prefix = defaultStatsDPrefix
+	}
+
+	// the client's labels are sent as tags as well, the exporter's own tags
+	// take precedence.
+	if tags := mergeLabels(labels, opts.Tags); len(tags) > 0 {
+		e.tags = "|#" + strings.Join(sortedLabels(tags), ",")
+	}
+
+	return e, nil
+}
+
+// run pushes the metrics returned by metrics every interval until stop is
+// closed, then pushes them a last time and closes the connection.
+func (e *statsdExporter) run(stop <-chan struct{}, metrics func() []metric) {
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+	defer e.conn.Close()
+
+	for {
+		select {
+		case <-ticker.C:
+			e.flush(metrics())
+		case <-stop:
+			e.flush(metrics())
+			return
+		}
+	}
+}
+
+// flush sends the given metrics. Errors are only logged, metrics that
+// couldn't be sent are dropped.
+func (e *statsdExporter) flush(metrics []metric) {
+	var packet []byte
+	for _, m := range metrics {
+		tags := e.tags
+		if len(m.tags) > 0 {
+			if tags == "" {
+				tags = "|#"
+			} else {
+				tags += ","
+			}
+			tags += strings.Join(m.tags, ",")
+		}
+
+		var line string
+		switch m.kind {
+		case metricCounter:
+			key := m.name + tags
+			delta := m.value - e.last[key]
+			e.last[key] = m.value
+			line = fmt.Sprintf("%s%s:%d|c%s\n", e.prefix, m.name, delta, tags)
+		case metricGauge:
+			line = fmt.Sprintf("%s%s:%d|g%s\n", e.prefix, m.name, m.value, tags)
+		}
+
+		if len(packet)+len(line) > statsdMaxPacketSize && len(packet) > 0 {
+			e.send(packet)
+			packet = packet[:0]
+		}
+		packet = append(packet, line...)
+	}
+
+	if len(packet) > 0 {
+		e.send(packet)
+	}
+}
+
+func (e *statsdExporter) send(packet []byte) {
+	e.conn.SetWriteDeadline(time.Now().Add(time.Second)) // nolint: errcheck
+	if _, err := e.conn.Write(packet); err != nil {
+		e.log.Warn("couldn't push metrics to StatsD server", zap.Error(err))
+	}
+}
@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+)
+
+// startStatsDServer listens for StatsD packets on a random local UDP port and
+// sends every received line to the returned channel.
+func startStatsDServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	lines := make(chan string, 1024)
+	go func() {
+		buf := make([]byte, 65536)
+		for {
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			for _, line := range strings.Split(strings.TrimSpace(string(buf[:n])), "\n") {
+				select {
+				case lines <- line:
+				default:
+				}
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String(), lines
+}
+
+// waitForLine waits until a line with the given prefix is received.
+func waitForLine(c *qt.C, lines <-chan string, prefix string) string {
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case line := <-lines:
+			if strings.HasPrefix(line, prefix) {
+				return line
+			}
+		case <-timeout:
+			c.Fatalf("no line with prefix %q received", prefix)
+		}
+	}
+}
+
+func TestClient_StatsD(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	backend := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	statsdAddr, lines := startStatsDServer(t)
+
+	testOpts := testListenOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, backend)
+	testOpts.StatsD = StatsDOptions{
+		Addr:     statsdAddr,
+		Interval: 20 * time.Millisecond,
+		Tags:     map[string]string{"env": "test", "app": "proxy"},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+	defer cancel()
+
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	c.Assert(err, qt.IsNil)
+
+	c.Assert(waitForLine(c, lines, "sql_proxy.connections_active:1|"), qt.Equals,
+		"sql_proxy.connections_active:1|g|#app:proxy,env:test")
+	c.Assert(waitForLine(c, lines, "sql_proxy.connections_total:1|"), qt.Equals,
+		"sql_proxy.connections_total:1|c|#app:proxy,env:test")
+
+	// counters are sent as deltas
+	c.Assert(waitForLine(c, lines, "sql_proxy.connections_total:"), qt.Equals,
+		"sql_proxy.connections_total:0|c|#app:proxy,env:test")
+
+	conn.Close()
+	cancel()
+	c.Assert(<-done, qt.IsNil)
+
+	// the last push happens during shutdown
+	waitForLine(c, lines, "sql_proxy.connections_active:0|")
+}
+
+func TestStatsDExporter_ServerDown(t *testing.T) {
+	c := qt.New(t)
+
+	// reserve a port nobody listens on
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	c.Assert(err, qt.IsNil)
+	addr := conn.LocalAddr().String()
+	conn.Close()
+
+	exporter, err := newStatsDExporter(StatsDOptions{Addr: addr}, nil, zap.NewNop())
+	c.Assert(err, qt.IsNil)
+
+	metrics := func() []metric {
+		return []metric{{name: "connections_total", kind: metricCounter, value: 1}}
+	}
+
+	start := time.Now()
+	for i := 0; i < 100; i++ {
+		exporter.flush(metrics())
+	}
+
+	stop := make(chan struct{})
+	close(stop)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		exporter.run(stop, metrics)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		c.Fatal("exporter didn't stop")
+	}
+	c.Assert(time.Since(start) < time.Second, qt.IsTrue)
+}
+
+func TestStatsDExporter_Packets(t *testing.T) {
+	c := qt.New(t)
+
+	addr, lines := startStatsDServer(t)
+	exporter, err := newStatsDExporter(StatsDOptions{Addr: addr, Prefix: "p."}, nil, zap.NewNop())
+	c.Assert(err, qt.IsNil)
+	defer exporter.conn.Close()
+
+	var metrics []metric
+	for i := 0; i < 100; i++ {
+		metrics = append(metrics, metric{name: strings.Repeat("m", 50), kind: metricGauge, value: uint64(i)})
+	}
+	exporter.flush(metrics)
+
+	for i := 0; i < 100; i++ {
+		select {
+		case line := <-lines:
+			c.Assert(strings.HasPrefix(line, "p."+strings.Repeat("m", 50)+":"), qt.IsTrue)
+		case <-time.After(5 * time.Second):
+			c.Fatalf("received only %d lines", i)
+		}
+	}
+}
+
+func TestNewClient_StatsDAddr(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.StatsD = StatsDOptions{Addr: "localhost"}
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `invalid StatsD.Addr: .*`)
+}
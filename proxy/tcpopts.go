@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// setKeepAliver is implemented by the TCP connections.
+type setKeepAliver interface {
+	SetKeepAlive(keepalive bool) error
+	SetKeepAlivePeriod(d time.Duration) error
+}
+
+// setKeepAlive configures the keep alives and the TCP user timeout of the
+// given connection.
+func (c *Client) setKeepAlive(conn setKeepAliver) error {
+	if c.disableKeepAlive {
+		if err := conn.SetKeepAlive(false); err != nil {
+			return fmt.Errorf("couldn't disable keep alives: %w", err)
+		}
+	} else {
+		if err := conn.SetKeepAlive(true); err != nil {
+			return fmt.Errorf("couldn't enable keep alives: %w", err)
+		}
+		if err := conn.SetKeepAlivePeriod(c.keepAlivePeriod); err != nil {
+			return fmt.Errorf("couldn't set the keep alive period to %v: %w", c.keepAlivePeriod, err)
+		}
+	}
+
+	if c.tcpUserTimeout > 0 {
+		if tc, ok := conn.(*net.TCPConn); ok {
+			return setTCPUserTimeout(tc, c.tcpUserTimeout)
+		}
+	}
+	return nil
+}
+
+// setNoDelayer is implemented by the TCP connections.
+type setNoDelayer interface {
+	SetNoDelay(noDelay bool) error
+}
+
+// setNoDelay disables Nagle's algorithm on the given connection, the local
+// or the remote one as desc tells, if NoDelay is set.
+func (c *Client) setNoDelay(log *zap.Logger, conn net.Conn, desc string) {
+	if !c.noDelay {
+		return
+	}
+	s, ok := conn.(setNoDelayer)
+	if !ok {
+		log.Debug("NoDelay not supported, leaving the connection as is",
+			zap.String("conn", desc), zap.String("network", conn.LocalAddr().Network()))
+		return
+	}
+	if err := s.SetNoDelay(true); err != nil {
+		log.Error("couldn't disable Nagle's algorithm", zap.String("conn", desc), zap.Error(err))
+	}
+}
+
+// dialRemote dials the given remote address, with the keep alives
+// configured if they were set explicitly and Nagle's algorithm disabled if
+// NoDelay is set. If the client resolves the remote
+// hosts itself, the resolved addresses are dialed by dialResolved.
+func (c *Client) dialRemote(ctx context.Context, addr string) (net.Conn, error) {
+	var conn net.Conn
+	var err error
+	if c.hosts != nil {
+		conn, err = c.dialResolved(ctx, addr)
+	} else {
+		conn, err = c.dialer.DialContext(ctx, c.remoteNetwork, addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if s, ok := conn.(setKeepAliver); ok && c.remoteKeepAlive {
+		if err := c.setKeepAlive(s); err != nil {
+			c.log.Error("couldn't configure the keep alives of the remote connection",
+				zap.String("remote_addr", addr), zap.Error(err))
+		}
+	}
+	c.setNoDelay(c.log.With(zap.String("remote_addr", addr)), conn, "remote")
+	return conn, nil
+}
@@ -0,0 +1,38 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+	"time"
+)
+
+// tcpUserTimeoutSupported reports whether the TCP user timeout can be set on
+// this platform.
+const tcpUserTimeoutSupported = true
+
+// sysTCPUserTimeout is TCP_USER_TIMEOUT, which the syscall package doesn't
+// define on every architecture.
+const sysTCPUserTimeout = 0x12
+
+// setTCPUserTimeout sets how long data sent on the given connection may
+// remain unacknowledged before the connection is closed, via
+// TCP_USER_TIMEOUT.
+func setTCPUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_TCP, sysTCPUserTimeout, int(d.Milliseconds()))
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return fmt.Errorf("couldn't set TCP_USER_TIMEOUT: %w", sockErr)
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package proxy
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+)
+
+func TestClient_setKeepAlive_TCPUserTimeout(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.TCPUserTimeout = 30 * time.Second
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := net.Dial("tcp", startPlaintextEchoBackend(t))
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+	c.Assert(client.setKeepAlive(conn.(*net.TCPConn)), qt.IsNil)
+
+	raw, err := conn.(*net.TCPConn).SyscallConn()
+	c.Assert(err, qt.IsNil)
+	var timeout int
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		timeout, sockErr = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_TCP, sysTCPUserTimeout)
+	})
+	c.Assert(err, qt.IsNil)
+	c.Assert(sockErr, qt.IsNil)
+	c.Assert(timeout, qt.Equals, 30000)
+}
@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+)
+
+// tcpUserTimeoutSupported reports whether the TCP user timeout can be set on
+// this platform.
+const tcpUserTimeoutSupported = false
+
+func setTCPUserTimeout(conn *net.TCPConn, d time.Duration) error {
+	return fmt.Errorf("TCP user timeout is not supported on %s", runtime.GOOS)
+}
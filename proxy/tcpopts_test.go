@@ -0,0 +1,271 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// keepAliveRecorder records the keep alive settings of a connection.
+type keepAliveRecorder struct {
+	net.Conn
+
+	keepAlive bool
+	period    time.Duration
+	calls     int
+}
+
+func (r *keepAliveRecorder) SetKeepAlive(keepalive bool) error {
+	r.keepAlive = keepalive
+	r.calls++
+	return nil
+}
+
+func (r *keepAliveRecorder) SetKeepAlivePeriod(d time.Duration) error {
+	r.period = d
+	return nil
+}
+
+func TestClient_setKeepAlive(t *testing.T) {
+	tests := []struct {
+		name          string
+		period        time.Duration
+		disable       bool
+		wantKeepAlive bool
+		wantPeriod    time.Duration
+	}{
+		{
+			name:          "default",
+			wantKeepAlive: true,
+			wantPeriod:    defaultKeepAlivePeriod,
+		},
+		{
+			name:          "period",
+			period:        15 * time.Second,
+			wantKeepAlive: true,
+			wantPeriod:    15 * time.Second,
+		},
+		{
+			name:    "disabled",
+			period:  15 * time.Second,
+			disable: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			testOpts := testOptions(t)
+			testOpts.KeepAlivePeriod = tt.period
+			testOpts.DisableKeepAlive = tt.disable
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			r := &keepAliveRecorder{}
+			c.Assert(client.setKeepAlive(r), qt.IsNil)
+			c.Assert(r.keepAlive, qt.Equals, tt.wantKeepAlive)
+			c.Assert(r.period, qt.Equals, tt.wantPeriod)
+		})
+	}
+}
+
+// keepAliveDialer returns the connections it dials wrapped in a
+// keepAliveRecorder.
+type keepAliveDialer struct {
+	conns []*keepAliveRecorder
+}
+
+func (d *keepAliveDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	var nd net.Dialer
+	conn, err := nd.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	r := &keepAliveRecorder{Conn: conn}
+	d.conns = append(d.conns, r)
+	return r, nil
+}
+
+func TestClient_dialRemote_KeepAlive(t *testing.T) {
+	c := qt.New(t)
+	addr := startPlaintextEchoBackend(t)
+
+	// the settings of the dialer are kept by default
+	dialer := &keepAliveDialer{}
+	testOpts := testOptions(t)
+	testOpts.Dialer = dialer
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.dialRemote(context.Background(), addr)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	c.Assert(dialer.conns[0].calls, qt.Equals, 0)
+
+	testOpts.KeepAlivePeriod = 10 * time.Second
+	client, err = NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err = client.dialRemote(context.Background(), addr)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	c.Assert(dialer.conns[1].keepAlive, qt.IsTrue)
+	c.Assert(dialer.conns[1].period, qt.Equals, 10*time.Second)
+}
+
+func TestNewClient_KeepAlive(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.KeepAlivePeriod = -time.Second
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "KeepAlivePeriod must not be negative")
+
+	testOpts = testOptions(t)
+	testOpts.TCPUserTimeout = -time.Second
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "TCPUserTimeout must not be negative")
+}
+
+// noDelayRecorder records the Nagle setting of a connection.
+type noDelayRecorder struct {
+	net.Conn
+
+	noDelay bool
+	calls   int
+}
+
+func (r *noDelayRecorder) SetNoDelay(noDelay bool) error {
+	r.noDelay = noDelay
+	r.calls++
+	return nil
+}
+
+func TestClient_setNoDelay(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	// the settings of the connections are kept by default
+	r := &noDelayRecorder{}
+	client.setNoDelay(client.log, r, "local")
+	c.Assert(r.calls, qt.Equals, 0)
+
+	testOpts.NoDelay = true
+	client, err = NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	client.setNoDelay(client.log, r, "local")
+	c.Assert(r.calls, qt.Equals, 1)
+	c.Assert(r.noDelay, qt.IsTrue)
+
+	// the other connections are left as is
+	core, logs := observer.New(zap.DebugLevel)
+	local, _ := net.Pipe()
+	defer local.Close()
+	client.setNoDelay(zap.New(core), local, "local")
+	c.Assert(logs.FilterMessage("NoDelay not supported, leaving the connection as is").Len(), qt.Equals, 1)
+}
+
+func TestClient_dialRemote_NoDelay(t *testing.T) {
+	c := qt.New(t)
+	addr := startPlaintextEchoBackend(t)
+
+	var dialed []*noDelayRecorder
+	testOpts := testOptions(t)
+	testOpts.NoDelay = true
+	testOpts.Dialer = dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+		var nd net.Dialer
+		conn, err := nd.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		r := &noDelayRecorder{Conn: conn}
+		dialed = append(dialed, r)
+		return r, nil
+	})
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.dialRemote(context.Background(), addr)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+	c.Assert(dialed, qt.HasLen, 1)
+	c.Assert(dialed[0].noDelay, qt.IsTrue)
+}
+
+// BenchmarkClient_NoDelay measures the round trips of small requests
+// written in two parts, like a packet header and its payload, through a
+// tunnel whose remote connection was dialed with Nagle's algorithm enabled.
+// The loopback acknowledges quickly, the gap widens with the round trip time
+// of the network.
+func BenchmarkClient_NoDelay(b *testing.B) {
+	const headerSize, payloadSize = 4, 60
+
+	run := func(b *testing.B, noDelay bool) {
+		addr := startPlaintextBackend(b, func(conn net.Conn) {
+			buf := make([]byte, headerSize+payloadSize)
+			for {
+				if _, err := io.ReadFull(conn, buf); err != nil {
+					return
+				}
+				if _, err := conn.Write(buf); err != nil {
+					return
+				}
+			}
+		})
+
+		client, err := NewClient(Options{
+			Logger:                  zap.NewNop(),
+			LocalAddr:               "127.0.0.1:0",
+			Instance:                "local/db/main",
+			RemoteAddr:              addr,
+			InsecureRemotePlaintext: true,
+			NoDelay:                 noDelay,
+			Dialer: dialerFunc(func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var nd net.Dialer
+				conn, err := nd.DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				return conn, conn.(*net.TCPConn).SetNoDelay(false)
+			}),
+		})
+		if err != nil {
+			b.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", startClient(b, client).String())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer conn.Close()
+
+		header := make([]byte, headerSize)
+		payload := make([]byte, payloadSize)
+		resp := make([]byte, headerSize+payloadSize)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(header); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := conn.Write(payload); err != nil {
+				b.Fatal(err)
+			}
+			if _, err := io.ReadFull(conn, resp); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+
+	b.Run("nagle", func(b *testing.B) { run(b, false) })
+	b.Run("nodelay", func(b *testing.B) { run(b, true) })
+}
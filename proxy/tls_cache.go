@@ -19,12 +19,32 @@ type cacheEntry struct {
 
 	// added holds the time the cfg was added to the cache
 	added time.Time
+
+	// certRemoteAddr tells whether remoteAddr was set by the cert source
+	// with Cert.RemoteAddr, or by the AddrResolver, which override the
+	// remote addresses of the client.
+	certRemoteAddr bool
+
+	// resolved tells whether remoteAddr was resolved by the AddrResolver.
+	resolved bool
+
+	// expiry is when the certificates of cfg expire, the entry is dropped
+	// then. Zero if the cert source didn't tell.
+	expiry time.Time
+
+	// reloaded is closed once the certificates of cfg were reloaded by
+	// the cert source, nil if they aren't.
+	reloaded <-chan struct{}
 }
 
 type tlsCache struct {
 	// configs holds the TLS config for each remote instance
 	configs   map[string]cacheEntry
-	configsMu sync.Mutex // protects configs
+	configsMu sync.Mutex // protects configs and failedRemovals
+
+	// failedRemovals holds when the config of each instance was last removed
+	// by removeFailed.
+	failedRemovals map[string]time.Time
 
 	// nowFn returns the current local time, used during insertion of cache
 	// entries. It's a function so we can use it for tests.
@@ -33,20 +53,36 @@ type tlsCache struct {
 
 func newtlsCache() *tlsCache {
 	return &tlsCache{
-		configs: make(map[string]cacheEntry),
-		nowFn:   time.Now,
+		configs:        make(map[string]cacheEntry),
+		failedRemovals: make(map[string]time.Time),
+		nowFn:          time.Now,
 	}
 }
 
 // Add adds the given config and remote address for the given instance name
 func (t *tlsCache) Add(instance string, cfg *tls.Config, remoteAddr string) {
+	t.put(instance, cacheEntry{cfg: cfg, remoteAddr: remoteAddr})
+}
+
+// put adds the given entry for the given instance name, until it expires or
+// its reloaded channel is closed.
+func (t *tlsCache) put(instance string, e cacheEntry) {
 	t.configsMu.Lock()
 	defer t.configsMu.Unlock()
 
-	t.configs[instance] = cacheEntry{
-		cfg:        cfg,
-		remoteAddr: remoteAddr,
-		added:      t.nowFn(),
+	e.added = t.nowFn()
+	t.configs[instance] = e
+}
+
+// setRemoteAddr replaces the remote address of the entry of the given
+// instance, if any, without extending its life.
+func (t *tlsCache) setRemoteAddr(instance, remoteAddr string) {
+	t.configsMu.Lock()
+	defer t.configsMu.Unlock()
+
+	if e, ok := t.configs[instance]; ok {
+		e.remoteAddr = remoteAddr
+		t.configs[instance] = e
 	}
 }
 
@@ -62,12 +98,118 @@ func (t *tlsCache) Get(instance string) (cacheEntry, error) {
 
 	now := time.Now()
 
-	// delete the config if it's expired. This will trigger the user to request
-	// another TLS config.
-	if e.added.Add(expireTTL).Before(now) {
+	// delete the config if it's expired, or its certificates did. This will
+	// trigger the user to request another TLS config.
+	if e.added.Add(expireTTL).Before(now) || (!e.expiry.IsZero() && !now.Before(e.expiry)) {
 		delete(t.configs, instance)
 		return cacheEntry{}, errConfigNotFound
 	}
 
+	// same if the cert source reloaded the certificates, so the new
+	// connections use the new ones.
+	if e.reloaded != nil {
+		select {
+		case <-e.reloaded:
+			delete(t.configs, instance)
+			return cacheEntry{}, errConfigNotFound
+		default:
+		}
+	}
+
 	return e, nil
 }
+
+// Remove removes the config of the given instance
+func (t *tlsCache) Remove(instance string) {
+	t.configsMu.Lock()
+	defer t.configsMu.Unlock()
+
+	delete(t.configs, instance)
+}
+
+// removeFailed removes the config of the given instance after a handshake
+// with it failed, if it's still the given one and no config of the instance
+// was removed by removeFailed in the last interval. It reports whether it
+// removed it.
+func (t *tlsCache) removeFailed(instance string, cfg *tls.Config, interval time.Duration) bool {
+	t.configsMu.Lock()
+	defer t.configsMu.Unlock()
+
+	e, ok := t.configs[instance]
+	if !ok || e.cfg != cfg {
+		return false
+	}
+
+	now := t.nowFn()
+	if last, ok := t.failedRemovals[instance]; ok && now.Sub(last) < interval {
+		return false
+	}
+
+	delete(t.configs, instance)
+	t.failedRemovals[instance] = now
+	return true
+}
+
+// entries returns a copy of the cached configs by instance, including the
+// expired ones that weren't removed yet.
+func (t *tlsCache) entries() map[string]cacheEntry {
+	t.configsMu.Lock()
+	defer t.configsMu.Unlock()
+
+	entries := make(map[string]cacheEntry, len(t.configs))
+	for instance, e := range t.configs {
+		entries[instance] = e
+	}
+	return entries
+}
+
+// certFetch is a retrieval of the certificates of an instance in progress.
+// The connections missing the certificates in the cache at the same time wait
+// for it rather than calling the CertSource themselves.
+type certFetch struct {
+	done chan struct{}
+
+	// entry and err are the result of the retrieval, set once done is
+	// closed.
+	entry cacheEntry
+	err   error
+
+	// abandoned is set if the retrieval failed because the context of the
+	// connection that started it was done, the waiting connections then
+	// retrieve the certificates themselves.
+	abandoned bool
+}
+
+// certFetches holds the retrievals of certificates in progress, by instance.
+type certFetches struct {
+	mu      sync.Mutex // protects fetches
+	fetches map[string]*certFetch
+}
+
+func newCertFetches() *certFetches {
+	return &certFetches{fetches: make(map[string]*certFetch)}
+}
+
+// join returns the retrieval in progress for the given instance, or starts
+// a new one, in which case started is set and the caller must finish it.
+func (f *certFetches) join(instance string) (fetch *certFetch, started bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if fetch, ok := f.fetches[instance]; ok {
+		return fetch, false
+	}
+	fetch = &certFetch{done: make(chan struct{})}
+	f.fetches[instance] = fetch
+	return fetch, true
+}
+
+// finish records the result of the given retrieval started by join and
+// releases the connections waiting for it.
+func (f *certFetches) finish(instance string, fetch *certFetch) {
+	f.mu.Lock()
+	delete(f.fetches, instance)
+	f.mu.Unlock()
+
+	close(fetch.done)
+}
@@ -1,12 +1,19 @@
 package proxy
 
 import (
+	"context"
 	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	qt "github.com/frankban/quicktest"
 	"github.com/google/go-cmp/cmp/cmpopts"
+	"go.uber.org/zap"
 )
 
 func TestTLSCache_Retrieve(t *testing.T) {
@@ -58,3 +65,270 @@ func TestTLSCache_Expired(t *testing.T) {
 	c.Assert(err, qt.Equals, errConfigNotFound)
 	c.Assert(cache.configs, qt.HasLen, 0)
 }
+
+func TestTLSCache_Reloaded(t *testing.T) {
+	c := qt.New(t)
+	cache := newtlsCache()
+
+	instance := "foo"
+	cfg := &tls.Config{ServerName: "server", MinVersion: tls.VersionTLS12}
+	reloaded := make(chan struct{})
+	cache.put(instance, cacheEntry{cfg: cfg, remoteAddr: "foo.example.com:3306", reloaded: reloaded})
+
+	_, err := cache.Get(instance)
+	c.Assert(err, qt.IsNil)
+
+	// the certificates were reloaded by the cert source
+	close(reloaded)
+	_, err = cache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+	c.Assert(cache.configs, qt.HasLen, 0)
+}
+
+func TestTLSCache_CertExpiry(t *testing.T) {
+	c := qt.New(t)
+	cache := newtlsCache()
+
+	instance := "foo"
+	cfg := &tls.Config{ServerName: "server", MinVersion: tls.VersionTLS12}
+	cache.put(instance, cacheEntry{cfg: cfg, remoteAddr: "foo.example.com:3306", expiry: time.Now().Add(time.Minute)})
+
+	_, err := cache.Get(instance)
+	c.Assert(err, qt.IsNil)
+
+	// the certificate expired before the TTL
+	cache.put(instance, cacheEntry{cfg: cfg, remoteAddr: "foo.example.com:3306", expiry: time.Now().Add(-time.Second)})
+	_, err = cache.Get(instance)
+	c.Assert(err, qt.Equals, errConfigNotFound)
+	c.Assert(cache.configs, qt.HasLen, 0)
+}
+
+func TestClient_clientCerts_CertExpiry(t *testing.T) {
+	ca := newTestCA(t)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3306}
+
+	tests := []struct {
+		name        string
+		expiry      time.Time
+		wantFetches int
+	}{
+		{name: "not provided", wantFetches: 1},
+		{name: "ahead", expiry: time.Now().Add(time.Hour), wantFetches: 1},
+		{name: "past", expiry: time.Now().Add(-time.Minute), wantFetches: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			var fetches int
+			certSource := backendCertSource(t, ca, addr)
+			certFn := certSource.CertFn
+			certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+				fetches++
+				cert, err := certFn(ctx, org, db, branch)
+				if err == nil {
+					cert.Expiry = tt.expiry
+				}
+				return cert, err
+			}
+
+			testOpts := testOptions(t)
+			testOpts.CertSource = certSource
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			for i := 0; i < 2; i++ {
+				_, _, err := client.clientCerts(context.Background(), "myorg/mydb/mybranch")
+				c.Assert(err, qt.IsNil)
+			}
+			c.Assert(fetches, qt.Equals, tt.wantFetches)
+		})
+	}
+}
+
+func BenchmarkClient_clientCerts(b *testing.B) {
+	ca := newTestCA(b)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3306}
+	instance := "myorg/mydb/mybranch"
+
+	client, err := NewClient(Options{
+		CertSource: backendCertSource(b, ca, addr),
+		Logger:     zap.NewNop(),
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.Run("cached", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, _, err := client.clientCerts(context.Background(), instance); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("rebuilt", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			client.configCache.Remove(instance)
+			if _, _, err := client.clientCerts(context.Background(), instance); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func TestClient_clientCerts_ConcurrentRotation(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, echoHandler)
+
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.NewNop()
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	stop := make(chan struct{})
+	rotated := make(chan struct{})
+	go func() {
+		defer close(rotated)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				client.configCache.Remove(instance)
+			}
+		}
+	}()
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 8)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				conn, err := client.Dial(context.Background(), instance)
+				if err != nil {
+					errs <- err
+					return
+				}
+
+				_, err = conn.Write([]byte("ping"))
+				if err == nil {
+					_, err = io.ReadFull(conn, make([]byte, 4))
+				}
+				conn.Close()
+				if err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	<-rotated
+	close(errs)
+
+	for err := range errs {
+		c.Assert(err, qt.IsNil)
+	}
+}
+
+func TestClient_certEntry_SharedFetch(t *testing.T) {
+	c := qt.New(t)
+
+	var calls int32
+	release := make(chan struct{})
+	testOpts := testOptions(t)
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			atomic.AddInt32(&calls, 1)
+			<-release
+			return nil, &CertSourceError{Kind: CertErrorUnavailable, Err: errors.New("api is down")}
+		},
+	}
+	testOpts.CertRetries = -1
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 10)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := client.certEntry(context.Background(), "myorg/mydb/mybranch")
+			errs <- err
+		}()
+	}
+
+	// wait for the first retrieval to start, then for the others to join it
+	for atomic.LoadInt32(&calls) == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(1))
+	for err := range errs {
+		c.Assert(err, qt.ErrorMatches, ".*api is down")
+	}
+}
+
+func TestClient_certEntry_AbandonedFetch(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	var calls int32
+	started := make(chan struct{})
+	certSource := backendCertSource(t, ca, &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 3307})
+	certFn := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return certFn(ctx, org, db, branch)
+	}
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	instance := "myorg/mydb/mybranch"
+	ctx, cancel := context.WithCancel(context.Background())
+	firstErr := make(chan error, 1)
+	go func() {
+		_, err := client.certEntry(ctx, instance)
+		firstErr <- err
+	}()
+	<-started
+
+	secondErr := make(chan error, 1)
+	go func() {
+		_, err := client.certEntry(context.Background(), instance)
+		secondErr <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	// the connection that started the retrieval went away, the waiting one
+	// retrieves the certs itself
+	cancel()
+	c.Assert(<-firstErr, qt.ErrorIs, context.Canceled)
+	c.Assert(<-secondErr, qt.IsNil)
+	c.Assert(atomic.LoadInt32(&calls), qt.Equals, int32(2))
+}
@@ -0,0 +1,167 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// SecurityPolicy is a named preset of the TLS versions, cipher suites and
+// key exchange curves of the connections to the remote servers.
+type SecurityPolicy string
+
+const (
+	// SecurityPolicyDefault uses TLS 1.2 and later, with the cipher suites
+	// and curves of crypto/tls, like setting none of the TLS options.
+	SecurityPolicyDefault SecurityPolicy = "default"
+
+	// SecurityPolicyModern only uses TLS 1.3.
+	SecurityPolicyModern SecurityPolicy = "modern"
+
+	// SecurityPolicyFIPS only negotiates FIPS 140 approved algorithms: TLS
+	// 1.2 and later, with the ECDHE key exchange over the P-256 and P-384
+	// curves, and the AES-GCM cipher suites. crypto/tls doesn't let the
+	// suites of TLS 1.3 be configured, the connections negotiating
+	// TLS_CHACHA20_POLY1305_SHA256 are rejected after the fact. The keys of
+	// the certificates aren't restricted, they're up to the cert source.
+	SecurityPolicyFIPS SecurityPolicy = "fips"
+)
+
+// securityPolicy holds the TLS settings of a SecurityPolicy.
+type securityPolicy struct {
+	minVersion   uint16
+	maxVersion   uint16
+	cipherSuites []uint16
+	curves       []tls.CurveID
+	// allowedSuites are the cipher suites the connections may negotiate,
+	// any if empty, to restrict the ones of TLS 1.3.
+	allowedSuites []uint16
+}
+
+// securityPolicies are the settings of the security policies.
+var securityPolicies = map[SecurityPolicy]securityPolicy{
+	SecurityPolicyDefault: {
+		minVersion: tls.VersionTLS12,
+	},
+	SecurityPolicyModern: {
+		minVersion: tls.VersionTLS13,
+	},
+	SecurityPolicyFIPS: {
+		minVersion: tls.VersionTLS12,
+		cipherSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+		},
+		curves: []tls.CurveID{tls.CurveP256, tls.CurveP384},
+		allowedSuites: []uint16{
+			tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+			tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+			tls.TLS_AES_128_GCM_SHA256,
+			tls.TLS_AES_256_GCM_SHA384,
+		},
+	},
+}
+
+// errSecurityPolicy is wrapped by the errors of the connections that
+// negotiated settings the security policy doesn't allow.
+var errSecurityPolicy = errors.New("not allowed by the security policy")
+
+// lookupSecurityPolicy returns the settings of the given security policy.
+// It's an error to set the TLS versions or the cipher suites along with a
+// policy.
+func lookupSecurityPolicy(name SecurityPolicy, minVersion, maxVersion uint16, cipherSuites []uint16) (securityPolicy, error) {
+	policy, ok := securityPolicies[name]
+	if !ok {
+		names := make([]string, 0, len(securityPolicies))
+		for _, n := range []SecurityPolicy{SecurityPolicyDefault, SecurityPolicyModern, SecurityPolicyFIPS} {
+			names = append(names, string(n))
+		}
+		return securityPolicy{}, fmt.Errorf("unknown SecurityPolicy %q, must be one of: %s", name, strings.Join(names, ", "))
+	}
+	if minVersion != 0 || maxVersion != 0 || len(cipherSuites) > 0 {
+		return securityPolicy{}, errors.New("SecurityPolicy can't be set along with MinTLSVersion, MaxTLSVersion or CipherSuites")
+	}
+	return policy, nil
+}
+
+// verifyCipherSuite returns the function rejecting the connections that
+// negotiated another cipher suite than the given ones.
+func verifyCipherSuite(policy SecurityPolicy, allowed []uint16) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		for _, id := range allowed {
+			if state.CipherSuite == id {
+				return nil
+			}
+		}
+		return fmt.Errorf("cipher suite %s negotiated by the remote server is %w %q",
+			tls.CipherSuiteName(state.CipherSuite), errSecurityPolicy, policy)
+	}
+}
+
+// tlsVersionNames are the names of the TLS versions the remote connections
+// can be restricted to.
+var tlsVersionNames = map[uint16]string{
+	tls.VersionTLS12: "TLS 1.2",
+	tls.VersionTLS13: "TLS 1.3",
+}
+
+// tlsVersionName returns the name of the given TLS version.
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+// validateTLSVersions validates the MinTLSVersion, MaxTLSVersion and
+// CipherSuites options.
+func validateTLSVersions(minVersion, maxVersion uint16, cipherSuites []uint16) error {
+	if _, ok := tlsVersionNames[minVersion]; !ok && minVersion != 0 {
+		return fmt.Errorf("MinTLSVersion must be TLS 1.2 or TLS 1.3, got %s", tlsVersionName(minVersion))
+	}
+	if _, ok := tlsVersionNames[maxVersion]; !ok && maxVersion != 0 {
+		return fmt.Errorf("MaxTLSVersion must be TLS 1.2 or TLS 1.3, got %s", tlsVersionName(maxVersion))
+	}
+	if maxVersion != 0 && maxVersion < minVersion {
+		return fmt.Errorf("MaxTLSVersion %s is lower than MinTLSVersion %s", tlsVersionName(maxVersion), tlsVersionName(minVersion))
+	}
+
+	if len(cipherSuites) == 0 {
+		return nil
+	}
+	// crypto/tls doesn't let the TLS 1.3 suites be configured
+	if minVersion == tls.VersionTLS13 {
+		return errors.New("CipherSuites only apply to TLS 1.2, they can't be set with a MinTLSVersion of TLS 1.3")
+	}
+
+	supported := make(map[uint16]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		supported[suite.ID] = suite
+	}
+	for _, id := range cipherSuites {
+		suite, ok := supported[id]
+		if !ok {
+			return fmt.Errorf("cipher suite %s is insecure or unknown", tls.CipherSuiteName(id))
+		}
+		if !supportsTLS12(suite) {
+			return fmt.Errorf("cipher suite %s is a TLS 1.3 suite, which can't be configured", suite.Name)
+		}
+	}
+	return nil
+}
+
+// supportsTLS12 reports whether the given cipher suite can be used with TLS
+// 1.2.
+func supportsTLS12(suite *tls.CipherSuite) bool {
+	for _, v := range suite.SupportedVersions {
+		if v == tls.VersionTLS12 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,404 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestValidateTLSVersions(t *testing.T) {
+	tests := []struct {
+		name         string
+		minVersion   uint16
+		maxVersion   uint16
+		cipherSuites []uint16
+		wantErr      string
+	}{
+		{name: "defaults"},
+		{name: "TLS 1.3 only", minVersion: tls.VersionTLS13},
+		{name: "TLS 1.2 only", minVersion: tls.VersionTLS12, maxVersion: tls.VersionTLS12},
+		{
+			name:         "TLS 1.2 suites",
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			name:       "TLS 1.1",
+			minVersion: tls.VersionTLS11,
+			wantErr:    "MinTLSVersion must be TLS 1.2 or TLS 1.3, got 0x0302",
+		},
+		{
+			name:       "unknown max version",
+			maxVersion: 0x0305,
+			wantErr:    "MaxTLSVersion must be TLS 1.2 or TLS 1.3, got 0x0305",
+		},
+		{
+			name:       "max lower than min",
+			minVersion: tls.VersionTLS13,
+			maxVersion: tls.VersionTLS12,
+			wantErr:    "MaxTLSVersion TLS 1.2 is lower than MinTLSVersion TLS 1.3",
+		},
+		{
+			name:         "suites with TLS 1.3 only",
+			minVersion:   tls.VersionTLS13,
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			wantErr:      "CipherSuites only apply to TLS 1.2, they can't be set with a MinTLSVersion of TLS 1.3",
+		},
+		{
+			name:         "TLS 1.3 suite",
+			cipherSuites: []uint16{tls.TLS_AES_128_GCM_SHA256},
+			wantErr:      "cipher suite TLS_AES_128_GCM_SHA256 is a TLS 1.3 suite, which can't be configured",
+		},
+		{
+			name:         "insecure suite",
+			cipherSuites: []uint16{tls.TLS_RSA_WITH_RC4_128_SHA},
+			wantErr:      "cipher suite TLS_RSA_WITH_RC4_128_SHA is insecure or unknown",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			err := validateTLSVersions(tt.minVersion, tt.maxVersion, tt.cipherSuites)
+			if tt.wantErr == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
+
+func TestClient_TLSVersions(t *testing.T) {
+	ca := newTestCA(t)
+	// the server only speaks TLS 1.2, with a single cipher suite
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+		MaxVersion:   tls.VersionTLS12,
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+	}, echoHandler)
+
+	tests := []struct {
+		name         string
+		minVersion   uint16
+		cipherSuites []uint16
+		wantErr      string
+	}{
+		{
+			name: "defaults",
+		},
+		{
+			name:       "TLS 1.3 required",
+			minVersion: tls.VersionTLS13,
+			wantErr:    ".*protocol version not supported",
+		},
+		{
+			name:         "cipher suite of the server",
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+		},
+		{
+			name:         "other cipher suite",
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			wantErr:      ".*handshake failure",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			core, logs := observer.New(zap.DebugLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.MinTLSVersion = tt.minVersion
+			testOpts.CipherSuites = tt.cipherSuites
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+
+			negotiated := logs.FilterMessage("negotiated TLS with remote server").All()
+			c.Assert(negotiated, qt.HasLen, 1)
+			c.Assert(negotiated[0].ContextMap()["tls_version"], qt.Equals, "TLS 1.2")
+			c.Assert(negotiated[0].ContextMap()["cipher_suite"], qt.Equals, "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256")
+		})
+	}
+}
+
+// dialPing dials the instance through the client and sends a ping through
+// the tunnel, so the session tickets of TLS 1.3, sent after the handshake,
+// are received.
+func dialPing(tb testing.TB, client *Client) {
+	tb.Helper()
+
+	conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		tb.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// resumptionTestClient returns a client tunneling to an echo backend with
+// the given TLSSessionCacheSize, which records whether the sessions were
+// resumed.
+func resumptionTestClient(tb testing.TB, cacheSize int, resumed *[]bool) *Client {
+	ca := newTestCA(tb)
+	addr := startTLSBackend(tb, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(tb, 42)},
+	}, echoHandler)
+
+	client, err := NewClient(Options{
+		Logger:              zap.NewNop(),
+		CertSource:          backendCertSource(tb, ca, addr),
+		TLSSessionCacheSize: cacheSize,
+		OnHandshake: func(info ConnInfo, state tls.ConnectionState) {
+			if resumed != nil {
+				*resumed = append(*resumed, state.DidResume)
+			}
+		},
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return client
+}
+
+func TestClient_TLSSessionResumption(t *testing.T) {
+	c := qt.New(t)
+
+	var resumed []bool
+	client := resumptionTestClient(t, 0, &resumed)
+	dialPing(t, client)
+	dialPing(t, client)
+	c.Assert(resumed, qt.DeepEquals, []bool{false, true})
+
+	// the sessions are dropped along with the certs
+	client.InvalidateInstance("myorg/mydb/mybranch")
+	dialPing(t, client)
+	dialPing(t, client)
+	c.Assert(resumed, qt.DeepEquals, []bool{false, true, false, true})
+
+	resumed = nil
+	client = resumptionTestClient(t, -1, &resumed)
+	dialPing(t, client)
+	dialPing(t, client)
+	c.Assert(resumed, qt.DeepEquals, []bool{false, false})
+}
+
+// BenchmarkClient_Dial_Resumption measures setting up tunnels with full TLS
+// handshakes and with resumed sessions.
+func BenchmarkClient_Dial_Resumption(b *testing.B) {
+	run := func(b *testing.B, cacheSize int) {
+		client := resumptionTestClient(b, cacheSize, nil)
+		dialPing(b, client)
+
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			dialPing(b, client)
+		}
+	}
+
+	b.Run("full", func(b *testing.B) { run(b, -1) })
+	b.Run("resumed", func(b *testing.B) { run(b, 0) })
+}
+
+func TestLookupSecurityPolicy(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       SecurityPolicy
+		minVersion   uint16
+		maxVersion   uint16
+		cipherSuites []uint16
+		wantErr      string
+	}{
+		{name: "default", policy: SecurityPolicyDefault},
+		{name: "modern", policy: SecurityPolicyModern},
+		{name: "fips", policy: SecurityPolicyFIPS},
+		{
+			name:    "unknown",
+			policy:  "strict",
+			wantErr: `unknown SecurityPolicy "strict", must be one of: default, modern, fips`,
+		},
+		{
+			name:       "with MinTLSVersion",
+			policy:     SecurityPolicyModern,
+			minVersion: tls.VersionTLS13,
+			wantErr:    "SecurityPolicy can't be set along with MinTLSVersion, MaxTLSVersion or CipherSuites",
+		},
+		{
+			name:       "with MaxTLSVersion",
+			policy:     SecurityPolicyDefault,
+			maxVersion: tls.VersionTLS12,
+			wantErr:    "SecurityPolicy can't be set along with MinTLSVersion, MaxTLSVersion or CipherSuites",
+		},
+		{
+			name:         "with CipherSuites",
+			policy:       SecurityPolicyFIPS,
+			cipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256},
+			wantErr:      "SecurityPolicy can't be set along with MinTLSVersion, MaxTLSVersion or CipherSuites",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			_, err := lookupSecurityPolicy(tt.policy, tt.minVersion, tt.maxVersion, tt.cipherSuites)
+			if tt.wantErr == "" {
+				c.Assert(err, qt.IsNil)
+				return
+			}
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+
+			testOpts := testOptions(t)
+			testOpts.SecurityPolicy = tt.policy
+			testOpts.MinTLSVersion = tt.minVersion
+			testOpts.MaxTLSVersion = tt.maxVersion
+			testOpts.CipherSuites = tt.cipherSuites
+			_, err = NewClient(testOpts)
+			c.Assert(err, qt.ErrorMatches, tt.wantErr)
+		})
+	}
+}
+
+func TestClient_SecurityPolicy(t *testing.T) {
+	ca := newTestCA(t)
+
+	tests := []struct {
+		name        string
+		policy      SecurityPolicy
+		server      *tls.Config
+		wantVersion string
+		wantSuite   string
+		wantErr     string
+	}{
+		{
+			name:        "default",
+			policy:      SecurityPolicyDefault,
+			wantVersion: "TLS 1.3",
+		},
+		{
+			name:   "default with TLS 1.2 and CBC",
+			policy: SecurityPolicyDefault,
+			server: &tls.Config{
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+			},
+			wantVersion: "TLS 1.2",
+			wantSuite:   "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+		},
+		{
+			name:        "modern",
+			policy:      SecurityPolicyModern,
+			wantVersion: "TLS 1.3",
+		},
+		{
+			name:    "modern with TLS 1.2",
+			policy:  SecurityPolicyModern,
+			server:  &tls.Config{MaxVersion: tls.VersionTLS12},
+			wantErr: ".*protocol version not supported",
+		},
+		{
+			name:        "fips",
+			policy:      SecurityPolicyFIPS,
+			wantVersion: "TLS 1.3",
+		},
+		{
+			name:   "fips with TLS 1.2 and AES-GCM",
+			policy: SecurityPolicyFIPS,
+			server: &tls.Config{
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384},
+			},
+			wantVersion: "TLS 1.2",
+			wantSuite:   "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+		},
+		{
+			name:   "fips with TLS 1.2 and CBC",
+			policy: SecurityPolicyFIPS,
+			server: &tls.Config{
+				MaxVersion:   tls.VersionTLS12,
+				CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA},
+			},
+			wantErr: ".*handshake failure",
+		},
+		{
+			name:   "fips with X25519",
+			policy: SecurityPolicyFIPS,
+			server: &tls.Config{
+				CurvePreferences: []tls.CurveID{tls.X25519},
+			},
+			wantErr: ".*handshake failure",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			serverCfg := &tls.Config{}
+			if tt.server != nil {
+				serverCfg = tt.server.Clone()
+			}
+			serverCfg.Certificates = []tls.Certificate{ca.serverCert(t, 42)}
+			addr := startTLSBackend(t, serverCfg, echoHandler)
+
+			core, logs := observer.New(zap.DebugLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.SecurityPolicy = tt.policy
+			testOpts.SetupRetries = -1
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			active := logs.FilterMessage("using TLS security policy").All()
+			c.Assert(active, qt.HasLen, 1)
+			c.Assert(active[0].ContextMap()["policy"], qt.Equals, string(tt.policy))
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+
+			negotiated := logs.FilterMessage("negotiated TLS with remote server").All()
+			c.Assert(negotiated, qt.HasLen, 1)
+			c.Assert(negotiated[0].ContextMap()["tls_version"], qt.Equals, tt.wantVersion)
+			if tt.wantSuite != "" {
+				c.Assert(negotiated[0].ContextMap()["cipher_suite"], qt.Equals, tt.wantSuite)
+			}
+		})
+	}
+}
+
+func TestVerifyCipherSuite(t *testing.T) {
+	c := qt.New(t)
+
+	verify := verifyCipherSuite(SecurityPolicyFIPS, securityPolicies[SecurityPolicyFIPS].allowedSuites)
+	c.Assert(verify(tls.ConnectionState{CipherSuite: tls.TLS_AES_256_GCM_SHA384}), qt.IsNil)
+
+	// the suites of TLS 1.3 can't be configured, they're rejected after the
+	// fact
+	err := verify(tls.ConnectionState{CipherSuite: tls.TLS_CHACHA20_POLY1305_SHA256})
+	c.Assert(err, qt.ErrorMatches, `cipher suite TLS_CHACHA20_POLY1305_SHA256 negotiated by the remote server is not allowed by the security policy "fips"`)
+	c.Assert(isRetryable(&SetupError{Phase: PhaseHandshake, Err: err}), qt.IsFalse)
+}
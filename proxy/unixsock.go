@@ -0,0 +1,145 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// defaultSocketMode only lets the user running the proxy connect to a unix
+// socket LocalAddr.
+const defaultSocketMode os.FileMode = 0600
+
+// socketProbeTimeout is how long to wait for a pre-existing socket to
+// accept a connection before considering it stale.
+const socketProbeTimeout = time.Second
+
+// lookupGroup returns the GID of the given group name or numeric GID.
+func lookupGroup(group string) (int, error) {
+	if gid, err := strconv.Atoi(group); err == nil {
+		return gid, nil
+	}
+	g, err := user.LookupGroup(group)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(g.Gid)
+}
+
+// listenUnix listens on a unix socket at path, with the given file mode and
+// group, if gid isn't negative. The socket is created under a temporary name
+// and moved into place once its permissions are set, so it's never reachable
+// at path with the default ones. A socket left over at path is only
+// replaced if nothing is listening on it anymore. Missing parent directories
+// are created.
+func listenUnix(path string, mode os.FileMode, gid int) (net.Listener, error) {
+	// the directory must be searchable by the clients, the socket itself
+	// restricts who may connect
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("couldn't create the directory of unix socket %s: %w", path, err)
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return nil, err
+	}
+
+	tmp := filepath.Join(filepath.Dir(path), fmt.Sprintf(".%s.%d.tmp", filepath.Base(path), os.Getpid()))
+	if err := os.Remove(tmp); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	l, err := net.Listen("unix", tmp)
+	if err != nil {
+		return nil, err
+	}
+	// the socket file is removed by unixListener.Close, at its final path
+	l.(*net.UnixListener).SetUnlinkOnClose(false)
+
+	fail := func(err error) (net.Listener, error) {
+		l.Close()
+		os.Remove(tmp)
+		return nil, err
+	}
+
+	if err := os.Chmod(tmp, mode); err != nil {
+		return fail(fmt.Errorf("couldn't set the mode of unix socket %s: %w", path, err))
+	}
+	if gid >= 0 {
+		if err := os.Chown(tmp, -1, gid); err != nil {
+			return fail(fmt.Errorf("couldn't set the group of unix socket %s: %w", path, err))
+		}
+	}
+
+	info, err := os.Stat(tmp)
+	if err != nil {
+		return fail(err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fail(err)
+	}
+
+	return &unixListener{Listener: l, path: path, info: info}, nil
+}
+
+// removeStaleSocket removes the socket at path if nothing is listening on
+// it. It refuses to remove anything that isn't a socket.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("refusing to remove %s: not a unix socket", path)
+	}
+
+	conn, err := net.DialTimeout("unix", path, socketProbeTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("unix socket %s is in use by another process", path)
+	}
+
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove stale unix socket %s: %w", path, err)
+	}
+	return nil
+}
+
+// unixListener removes the socket file it was created with when closed.
+type unixListener struct {
+	net.Listener
+
+	path string
+	info os.FileInfo
+
+	closeOnce sync.Once
+}
+
+// Addr returns the final address of the socket, the listener itself is bound
+// to the temporary one.
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+func (l *unixListener) Close() error {
+	err := l.Listener.Close()
+	l.closeOnce.Do(func() {
+		// leave the path alone if it was replaced in the meantime
+		info, serr := os.Lstat(l.path)
+		if serr != nil || !os.SameFile(info, l.info) {
+			return
+		}
+		if rerr := os.Remove(l.path); rerr != nil && !errors.Is(rerr, os.ErrNotExist) && err == nil {
+			err = rerr
+		}
+	})
+	return err
+}
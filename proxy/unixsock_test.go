@@ -0,0 +1,207 @@
+//go:build !windows
+// +build !windows
+
+package proxy
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	qt "github.com/frankban/quicktest"
+	_ "github.com/go-sql-driver/mysql"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestListenUnix_Mode(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "proxy.sock")
+	l, err := listenUnix(path, 0660, os.Getgid())
+	c.Assert(err, qt.IsNil)
+
+	info, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode()&os.ModeSocket, qt.Not(qt.Equals), os.FileMode(0))
+	c.Assert(info.Mode().Perm(), qt.Equals, os.FileMode(0660))
+	c.Assert(l.Addr().String(), qt.Equals, path)
+
+	// the temporary socket was moved into place
+	entries, err := os.ReadDir(dir)
+	c.Assert(err, qt.IsNil)
+	c.Assert(entries, qt.HasLen, 1)
+
+	conn, err := net.Dial("unix", path)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+
+	c.Assert(l.Close(), qt.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestListenUnix_RefusesNonSocket(t *testing.T) {
+	c := qt.New(t)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	c.Assert(os.WriteFile(path, []byte("important"), 0600), qt.IsNil)
+
+	_, err := listenUnix(path, 0600, -1)
+	c.Assert(err, qt.ErrorMatches, "refusing to remove .*: not a unix socket")
+
+	data, err := os.ReadFile(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(string(data), qt.Equals, "important")
+}
+
+func TestListenUnix_InUse(t *testing.T) {
+	c := qt.New(t)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	l, err := net.Listen("unix", path)
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+
+	_, err = listenUnix(path, 0600, -1)
+	c.Assert(err, qt.ErrorMatches, "unix socket .* is in use by another process")
+
+	// the other process' socket is left alone
+	conn, err := net.Dial("unix", path)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+}
+
+func TestListenUnix_Stale(t *testing.T) {
+	c := qt.New(t)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	stale, err := net.Listen("unix", path)
+	c.Assert(err, qt.IsNil)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := listenUnix(path, 0600, -1)
+	c.Assert(err, qt.IsNil)
+	defer l.Close()
+
+	conn, err := net.Dial("unix", path)
+	c.Assert(err, qt.IsNil)
+	conn.Close()
+}
+
+func TestClient_UnixSocketRemovedOnShutdown(t *testing.T) {
+	c := qt.New(t)
+
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "unix://" + path
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(ctx)
+	}()
+
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+	info, err := os.Stat(path)
+	c.Assert(err, qt.IsNil)
+	c.Assert(info.Mode().Perm(), qt.Equals, defaultSocketMode)
+
+	cancel()
+	c.Assert(<-done, qt.IsNil)
+	_, err = os.Stat(path)
+	c.Assert(os.IsNotExist(err), qt.IsTrue)
+}
+
+func TestClient_UnixSocket_MySQL(t *testing.T) {
+	c := qt.New(t)
+
+	// the directory of the socket doesn't exist yet
+	path := filepath.Join(t.TempDir(), "run", "sql-proxy", "mydb.sock")
+	core, logs := observer.New(zap.InfoLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+	testOpts.LocalAddr = "unix://" + path
+	testOpts.RemoteAddr = startPlaintextBackend(t, mysqlHandler)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+	startClient(t, client)
+
+	db, err := sql.Open("mysql", "root:secret@unix("+path+")/mydb")
+	c.Assert(err, qt.IsNil)
+	defer db.Close()
+
+	c.Assert(db.PingContext(context.Background()), qt.IsNil)
+	c.Assert(client.Stats().Connections, qt.Equals, uint64(1))
+
+	// keep alives don't apply to unix sockets
+	c.Assert(logs.FilterMessageSnippet("KeepAlive").Len(), qt.Equals, 0)
+}
+
+func TestClient_Run_ListenerRestartGiveUp(t *testing.T) {
+	c := qt.New(t)
+
+	dir := t.TempDir()
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "unix://" + filepath.Join(dir, "proxy.sock")
+	testOpts.RemoteAddr = startPlaintextEchoBackend(t)
+	testOpts.Instance = "local/db/main"
+	testOpts.InsecureRemotePlaintext = true
+	testOpts.ListenerRestarts = 2
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- client.Run(context.Background())
+	}()
+	_, err = client.LocalAddr()
+	c.Assert(err, qt.IsNil)
+
+	// the socket can't be created anymore
+	client.currentListener().Close()
+	c.Assert(os.WriteFile(filepath.Join(dir, "proxy.sock"), nil, 0600), qt.IsNil)
+
+	select {
+	case err := <-done:
+		c.Assert(err, qt.ErrorMatches, "couldn't re-create local listener after 2 attempts: .*")
+	case <-time.After(5 * time.Second):
+		c.Fatal("Run didn't give up")
+	}
+	c.Assert(client.ready(), qt.IsFalse)
+	c.Assert(client.Stats().ListenerRestarts, qt.Equals, uint64(0))
+}
+
+func TestNewClient_LocalSocketMode(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.LocalAddr = "127.0.0.1:0"
+	testOpts.LocalSocketMode = 0660
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "LocalSocketMode and LocalSocketGroup require a unix socket LocalAddr")
+
+	testOpts.LocalAddr = "unix:///tmp/proxy.sock"
+	testOpts.LocalSocketMode = os.ModeSetuid | 0660
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "invalid LocalSocketMode .*: only permission bits may be set")
+
+	testOpts.LocalSocketMode = 0660
+	testOpts.LocalSocketGroup = "no-such-group-for-sure"
+	_, err = NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "invalid LocalSocketGroup: .*")
+}
@@ -0,0 +1,684 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"testing"
+
+	qt "github.com/frankban/quicktest"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestClient_VerifyPeerCertificate(t *testing.T) {
+	const blockedSerial = 42
+
+	tests := []struct {
+		name      string
+		serial    int64
+		wantErr   string
+		wantCalls int
+	}{
+		{
+			name:      "allowed serial",
+			serial:    43,
+			wantCalls: 1,
+		},
+		{
+			name:      "blocked serial",
+			serial:    blockedSerial,
+			wantErr:   ".*peer certificate rejected: serial 42 is blocked",
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+
+			addr := startTLSBackend(t, &tls.Config{
+				Certificates: []tls.Certificate{ca.serverCert(t, tt.serial)},
+			}, echoHandler)
+
+			var calls int
+			testOpts := testOptions(t)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			testOpts.SetupRetries = 2
+			testOpts.VerifyPeerCertificate = func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+				calls++
+				c.Assert(verifiedChains, qt.HasLen, 1)
+				c.Assert(verifiedChains[0][len(verifiedChains[0])-1].Equal(ca.cert), qt.IsTrue)
+
+				if leaf.SerialNumber.Int64() == blockedSerial {
+					return fmt.Errorf("serial %d is blocked", blockedSerial)
+				}
+				return nil
+			}
+
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.setupWithRetries(context.Background(), "myorg/mydb/mybranch", ProtocolClassic)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				c.Assert(errors.Is(err, errPeerRejected), qt.IsTrue)
+			} else {
+				c.Assert(err, qt.IsNil)
+				conn.Close()
+			}
+
+			// rejections are never retried
+			c.Assert(calls, qt.Equals, tt.wantCalls)
+		})
+	}
+}
+
+func TestClient_VerifyPeerCertificate_AfterBuiltinVerification(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	untrusted := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{untrusted.serverCert(t, 42)},
+	}, echoHandler)
+
+	var called bool
+	testOpts := testOptions(t)
+	testOpts.CertSource = backendCertSource(t, ca, addr)
+	testOpts.VerifyPeerCertificate = func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+		called = true
+		return nil
+	}
+
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.setup(context.Background(), "myorg/mydb/mybranch", ProtocolClassic)
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	c.Assert(errors.As(err, &unknownAuthorityErr), qt.IsTrue)
+
+	// the custom verification must not be able to accept a certificate the
+	// built-in verification rejected
+	c.Assert(called, qt.IsFalse)
+}
+
+func TestClient_ServerAuthOnly(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+
+	peerCerts := make(chan int, 1)
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{ca.serverCert(t, 42)},
+	}, func(conn net.Conn) {
+		peerCerts <- len(conn.(*tls.Conn).ConnectionState().PeerCertificates)
+	})
+
+	certSource := backendCertSource(t, ca, addr)
+	withClientCert := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		cert, err := withClientCert(ctx, org, db, branch)
+		if err != nil {
+			return nil, err
+		}
+		cert.ClientCert = tls.Certificate{}
+		cert.ServerAuthOnly = true
+		return cert, nil
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	conn, err := client.setup(context.Background(), "myorg/mydb/mybranch", ProtocolClassic)
+	c.Assert(err, qt.IsNil)
+	defer conn.Close()
+
+	c.Assert(<-peerCerts, qt.Equals, 0)
+}
+
+func TestClient_ServerAuthOnly_StillVerifiesServer(t *testing.T) {
+	c := qt.New(t)
+	ca := newTestCA(t)
+	untrusted := newTestCA(t)
+
+	addr := startTLSBackend(t, &tls.Config{
+		Certificates: []tls.Certificate{untrusted.serverCert(t, 42)},
+	}, echoHandler)
+
+	certSource := backendCertSource(t, ca, addr)
+	withClientCert := certSource.CertFn
+	certSource.CertFn = func(ctx context.Context, org, db, branch string) (*Cert, error) {
+		cert, err := withClientCert(ctx, org, db, branch)
+		if err != nil {
+			return nil, err
+		}
+		cert.ClientCert = tls.Certificate{}
+		cert.ServerAuthOnly = true
+		return cert, nil
+	}
+
+	testOpts := testOptions(t)
+	testOpts.CertSource = certSource
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	_, err = client.setup(context.Background(), "myorg/mydb/mybranch", ProtocolClassic)
+	var unknownAuthorityErr x509.UnknownAuthorityError
+	c.Assert(errors.As(err, &unknownAuthorityErr), qt.IsTrue)
+}
+
+func TestValidateCert(t *testing.T) {
+	ca := newTestCA(t)
+	clientCert := ca.clientCert(t, "client")
+
+	tests := []struct {
+		name    string
+		cert    *Cert
+		wantErr string
+	}{
+		{
+			name: "client certificate",
+			cert: &Cert{ClientCert: clientCert},
+		},
+		{
+			name: "server auth only",
+			cert: &Cert{ServerAuthOnly: true},
+		},
+		{
+			name:    "nil cert",
+			wantErr: "cert is nil",
+		},
+		{
+			name:    "empty client certificate",
+			cert:    &Cert{},
+			wantErr: "client certificate is empty",
+		},
+		{
+			name: "client certificate without key",
+			cert: &Cert{ClientCert: tls.Certificate{
+				Certificate: clientCert.Certificate,
+			}},
+			wantErr: "client certificate has no private key",
+		},
+		{
+			name: "server auth only with client certificate",
+			cert: &Cert{
+				ClientCert:     clientCert,
+				ServerAuthOnly: true,
+			},
+			wantErr: "client certificate is set, but the cert is marked as server auth only",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			err := validateCert(tt.cert)
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+		})
+	}
+}
+
+func TestClient_MultipleCACerts(t *testing.T) {
+	c := qt.New(t)
+	oldCA := newNamedTestCA(t, "Old CA")
+	newCA := newNamedTestCA(t, "New CA")
+	otherCA := newNamedTestCA(t, "Other CA")
+
+	core, logs := observer.New(zap.DebugLevel)
+	testOpts := testOptions(t)
+	testOpts.Logger = zap.New(core)
+
+	// the instances present certs of different CAs, but the cert source
+	// trusts both the old and the new one.
+	backends := map[string]net.Addr{
+		"myorg/mydb/old":   startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{oldCA.serverCert(t, 1)}}, echoHandler),
+		"myorg/mydb/new":   startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{newCA.serverCert(t, 2)}}, echoHandler),
+		"myorg/mydb/other": startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{otherCA.serverCert(t, 3)}}, echoHandler),
+	}
+	clientCert := oldCA.clientCert(t, "client")
+	testOpts.CertSource = &fakeCertSource{
+		CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+			addr := backends[org+"/"+db+"/"+branch].(*net.TCPAddr)
+			return &Cert{
+				ClientCert: clientCert,
+				CACerts:    []*x509.Certificate{oldCA.cert, newCA.cert},
+				AccessHost: "localhost",
+				Ports:      RemotePorts{Proxy: addr.Port},
+			}, nil
+		},
+	}
+	client, err := NewClient(testOpts)
+	c.Assert(err, qt.IsNil)
+
+	for _, instance := range []string{"myorg/mydb/old", "myorg/mydb/new"} {
+		conn, err := client.Dial(context.Background(), instance)
+		c.Assert(err, qt.IsNil)
+		conn.Close()
+	}
+
+	_, err = client.Dial(context.Background(), "myorg/mydb/other")
+	c.Assert(err, qt.ErrorMatches, ".*certificate signed by unknown authority.*")
+
+	verified := logs.FilterMessage("verified remote server certificate").All()
+	c.Assert(verified, qt.HasLen, 2)
+	c.Assert(verified[0].Level, qt.Equals, zap.DebugLevel)
+
+	roots := make(map[string]string)
+	for _, entry := range verified {
+		fields := entry.ContextMap()
+		roots[fields["instance"].(string)] = fields["root_ca"].(string)
+	}
+	c.Assert(roots, qt.DeepEquals, map[string]string{
+		"myorg/mydb/old": "CN=Old CA",
+		"myorg/mydb/new": "CN=New CA",
+	})
+}
+
+func TestClient_ServerName(t *testing.T) {
+	const autoGeneratedCN = "MySQL_Server_8.0.34_Auto_Generated_Server_Certificate"
+
+	tests := []struct {
+		name       string
+		autoCert   bool // the backend presents a MySQL auto-generated cert
+		otherCA    bool // the backend cert is issued by an untrusted CA
+		accessHost string
+		serverName string
+		// certServerName is the server name returned by the cert source
+		certServerName string
+		wantErr        string
+		wantWarn       bool
+	}{
+		{
+			name:       "hostname from the cert source",
+			accessHost: "localhost",
+		},
+		{
+			name:       "hostname",
+			accessHost: "db.example.com",
+			serverName: "localhost",
+		},
+		{
+			name:       "hostname mismatch",
+			accessHost: "localhost",
+			serverName: "db.example.com",
+			wantErr:    ".*certificate is valid for localhost, not db.example.com",
+		},
+		{
+			name:           "hostname from the cert",
+			accessHost:     "db.example.com",
+			serverName:     "db.example.com",
+			certServerName: "localhost",
+		},
+		{
+			name:           "hostname from the cert mismatch",
+			accessHost:     "localhost",
+			serverName:     "localhost",
+			certServerName: "db.example.com",
+			wantErr:        ".*certificate is valid for localhost, not db.example.com",
+		},
+		{
+			name:       "auto-generated common name",
+			autoCert:   true,
+			accessHost: "localhost",
+			serverName: autoGeneratedCN,
+		},
+		{
+			name:       "auto-generated without server name",
+			autoCert:   true,
+			accessHost: "localhost",
+			wantErr:    ".*certificate is not valid for any names.*",
+		},
+		{
+			name:       "common name mismatch",
+			autoCert:   true,
+			accessHost: "localhost",
+			serverName: "MySQL_Server_5.7.32_Auto_Generated_Server_Certificate",
+			wantErr:    ".*certificate is not valid for any names.*",
+		},
+		{
+			name:     "no name, chain only",
+			autoCert: true,
+			wantWarn: true,
+		},
+		{
+			name:     "no name, untrusted chain",
+			otherCA:  true,
+			wantErr:  ".*certificate signed by unknown authority.*",
+			wantWarn: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+			ca := newTestCA(t)
+
+			issuer := ca
+			if tt.otherCA {
+				issuer = newNamedTestCA(t, "Other CA")
+			}
+			serverCert := issuer.serverCert(t, 42)
+			if tt.autoCert {
+				serverCert = issuer.issue(t, &x509.Certificate{
+					SerialNumber: big.NewInt(42),
+					Subject:      pkix.Name{CommonName: autoGeneratedCN},
+				})
+			}
+			addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, echoHandler)
+
+			core, logs := observer.New(zap.WarnLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.RemoteAddr = addr.String()
+			testOpts.ServerName = tt.serverName
+			certSource := backendCertSource(t, ca, addr)
+			testOpts.CertSource = &fakeCertSource{
+				CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					cert, err := certSource.Cert(ctx, org, db, branch)
+					if err != nil {
+						return nil, err
+					}
+					cert.AccessHost = tt.accessHost
+					cert.ServerName = tt.certServerName
+					return cert, nil
+				},
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+			} else {
+				c.Assert(err, qt.IsNil)
+				conn.Close()
+			}
+
+			warnings := logs.FilterMessage("no server name to verify the remote server certificate against, only its chain is verified").Len()
+			c.Assert(warnings > 0, qt.Equals, tt.wantWarn)
+		})
+	}
+}
+
+func TestClient_IntermediateCA(t *testing.T) {
+	root := newNamedTestCA(t, "Root CA")
+	intermediate := root.intermediateCA(t, "Intermediate CA")
+	leaf := intermediate.serverCert(t, 42)
+
+	// a server presenting the intermediate along with its certificate
+	chain := leaf
+	chain.Certificate = append([][]byte{}, leaf.Certificate[0], intermediate.cert.Raw)
+
+	tests := []struct {
+		name          string
+		serverCert    tls.Certificate
+		intermediates []*x509.Certificate
+		serverName    string
+		wantErr       string
+	}{
+		{
+			name:       "chain presented by the server",
+			serverCert: chain,
+		},
+		{
+			name:       "missing intermediate",
+			serverCert: leaf,
+			wantErr:    ".*certificate signed by unknown authority.*",
+		},
+		{
+			name:          "intermediate of the cert source",
+			serverCert:    leaf,
+			intermediates: []*x509.Certificate{intermediate.cert},
+		},
+		{
+			name:          "intermediate of the cert source and wrong name",
+			serverCert:    leaf,
+			intermediates: []*x509.Certificate{intermediate.cert},
+			serverName:    "db.example.com",
+			wantErr:       ".*certificate is valid for localhost, not db.example.com.*",
+		},
+		{
+			// the intermediates aren't trusted as roots
+			name:          "intermediate of another root",
+			serverCert:    newNamedTestCA(t, "Other Root CA").intermediateCA(t, "Other Intermediate CA").serverCert(t, 43),
+			intermediates: []*x509.Certificate{intermediate.cert},
+			wantErr:       ".*certificate signed by unknown authority.*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{tt.serverCert}}, echoHandler)
+			core, logs := observer.New(zap.DebugLevel)
+			testOpts := testOptions(t)
+			testOpts.Logger = zap.New(core)
+			testOpts.ServerName = tt.serverName
+			testOpts.CertSource = &fakeCertSource{
+				CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					return &Cert{
+						ServerAuthOnly: true,
+						CACerts:        []*x509.Certificate{root.cert},
+						Intermediates:  tt.intermediates,
+						AccessHost:     "localhost",
+						Ports:          RemotePorts{Proxy: addr.(*net.TCPAddr).Port},
+					}, nil
+				},
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+
+			verified := logs.FilterMessage("verified remote server certificate").All()
+			c.Assert(verified, qt.HasLen, 1)
+			c.Assert(verified[0].Level, qt.Equals, zap.DebugLevel)
+			c.Assert(verified[0].ContextMap()["root_ca"], qt.Equals, "CN=Root CA")
+		})
+	}
+}
+
+func TestClient_NameVerification(t *testing.T) {
+	ca := newTestCA(t)
+	certs := map[string]tls.Certificate{
+		// the identities are in the SANs, the common name is irrelevant
+		"san": ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(1),
+			Subject:      pkix.Name{CommonName: "Some Server"},
+			DNSNames:     []string{"localhost"},
+			IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		}),
+		"cn": ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(2),
+			Subject:      pkix.Name{CommonName: "localhost"},
+		}),
+		// the common name doesn't count once there are SANs
+		"cn and other san": ca.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(3),
+			Subject:      pkix.Name{CommonName: "localhost"},
+			DNSNames:     []string{"db.example.com"},
+		}),
+	}
+
+	tests := []struct {
+		cert    string
+		name    string
+		mode    NameVerification
+		wantErr string
+	}{
+		{cert: "san", name: "localhost", mode: VerifyEither},
+		{cert: "san", name: "localhost", mode: VerifySAN},
+		{cert: "san", name: "localhost", mode: VerifyCN, wantErr: `.*certificate common name is "Some Server", not localhost`},
+		{cert: "san", name: "127.0.0.1", mode: VerifyEither},
+		{cert: "san", name: "127.0.0.1", mode: VerifySAN},
+		{cert: "san", name: "127.0.0.1", mode: VerifyCN, wantErr: `.*certificate common name is "Some Server", not 127.0.0.1`},
+		{cert: "cn", name: "localhost", mode: VerifyEither},
+		{cert: "cn", name: "localhost", mode: VerifySAN, wantErr: ".*certificate relies on legacy Common Name field.*"},
+		{cert: "cn", name: "localhost", mode: VerifyCN},
+		{cert: "cn and other san", name: "localhost", mode: VerifyEither, wantErr: ".*certificate is valid for db.example.com, not localhost"},
+		{cert: "cn and other san", name: "localhost", mode: VerifySAN, wantErr: ".*certificate is valid for db.example.com, not localhost"},
+		{cert: "cn and other san", name: "localhost", mode: VerifyCN},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/%s/%s", tt.cert, tt.name, tt.mode), func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{certs[tt.cert]}}, echoHandler)
+			testOpts := testOptions(t)
+			testOpts.NameVerification = tt.mode
+			testOpts.CertSource = &fakeCertSource{
+				CertFn: func(ctx context.Context, org, db, branch string) (*Cert, error) {
+					return &Cert{
+						ServerAuthOnly: true,
+						CACerts:        []*x509.Certificate{ca.cert},
+						AccessHost:     tt.name,
+						Ports:          RemotePorts{Proxy: addr.(*net.TCPAddr).Port},
+					}, nil
+				},
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+		})
+	}
+}
+
+func TestNewClient_NameVerification(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.NameVerification = "subject"
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, `NameVerification must be "either", "san" or "cn", got "subject"`)
+}
+
+func TestClient_ServerVerifier(t *testing.T) {
+	ca := newTestCA(t)
+	spiffeCert := func(t *testing.T, issuer *testCA, id string) tls.Certificate {
+		u, err := url.Parse(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return issuer.issue(t, &x509.Certificate{
+			SerialNumber: big.NewInt(42),
+			URIs:         []*url.URL{u},
+		})
+	}
+
+	// the server is identified by its SPIFFE ID rather than its name
+	const wantID = "spiffe://example.org/mysql"
+	serverVerifier := func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		verifyChain := DefaultServerVerifier(cert, "", VerifyEither)
+		return func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if err := verifyChain(rawCerts, verifiedChains); err != nil {
+				return err
+			}
+			leaf, err := x509.ParseCertificate(rawCerts[0])
+			if err != nil {
+				return err
+			}
+			for _, u := range leaf.URIs {
+				if u.String() == wantID {
+					return nil
+				}
+			}
+			return fmt.Errorf("no SPIFFE ID %s", wantID)
+		}
+	}
+
+	tests := []struct {
+		name       string
+		serverCert func(t *testing.T) tls.Certificate
+		wantErr    string
+	}{
+		{
+			name:       "SPIFFE ID",
+			serverCert: func(t *testing.T) tls.Certificate { return spiffeCert(t, ca, wantID) },
+		},
+		{
+			name:       "other SPIFFE ID",
+			serverCert: func(t *testing.T) tls.Certificate { return spiffeCert(t, ca, "spiffe://example.org/web") },
+			wantErr:    ".*peer certificate rejected: no SPIFFE ID spiffe://example.org/mysql",
+		},
+		{
+			name: "untrusted chain",
+			serverCert: func(t *testing.T) tls.Certificate {
+				return spiffeCert(t, newNamedTestCA(t, "Other CA"), wantID)
+			},
+			wantErr: ".*certificate signed by unknown authority.*",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := qt.New(t)
+
+			addr := startTLSBackend(t, &tls.Config{Certificates: []tls.Certificate{tt.serverCert(t)}}, echoHandler)
+			testOpts := testOptions(t)
+			testOpts.CertSource = backendCertSource(t, ca, addr)
+			var gotName string
+			testOpts.ServerVerifier = func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+				gotName = serverName
+				return serverVerifier(cert, serverName)
+			}
+			client, err := NewClient(testOpts)
+			c.Assert(err, qt.IsNil)
+
+			conn, err := client.Dial(context.Background(), "myorg/mydb/mybranch")
+			c.Assert(gotName, qt.Equals, "localhost")
+			if tt.wantErr != "" {
+				c.Assert(err, qt.ErrorMatches, tt.wantErr)
+				var handshakeErr *HandshakeError
+				c.Assert(errors.As(err, &handshakeErr), qt.IsTrue)
+				c.Assert(handshakeErr.Peer, qt.Not(qt.IsNil))
+				return
+			}
+			c.Assert(err, qt.IsNil)
+			conn.Close()
+		})
+	}
+}
+
+func TestNewClient_ServerVerifier(t *testing.T) {
+	c := qt.New(t)
+
+	testOpts := testOptions(t)
+	testOpts.ServerVerifier = func(cert *Cert, serverName string) func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		return DefaultServerVerifier(cert, serverName, VerifySAN)
+	}
+	testOpts.VerifyPeerCertificate = func(leaf *x509.Certificate, verifiedChains [][]*x509.Certificate) error {
+		return nil
+	}
+	_, err := NewClient(testOpts)
+	c.Assert(err, qt.ErrorMatches, "VerifyPeerCertificate can't be combined with ServerVerifier, wrap DefaultServerVerifier instead")
+}